@@ -0,0 +1,154 @@
+// qobs add <name> <source>, qobs rm <name>
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/qobs-build/qobs/internal/builder"
+	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagAddDir               string
+	flagAddGit               bool
+	flagAddAsPath            bool
+	flagRmDir                string
+	flagAddNoDefaultFeatures bool
+	flagAddFeatures          []string
+)
+
+// readManifest reads the TOML manifest of the package in dir
+func readManifest(dir string) (string, []byte) {
+	path := builder.ManifestPath(dir)
+	if filepath.Ext(path) != ".toml" {
+		msg.Fatal("%s isn't a TOML manifest, edit it by hand instead", filepath.Base(path))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+	return path, data
+}
+
+// checkDependencySource makes sure source is fetched the way the user asked for
+func checkDependencySource(dir, source string) string {
+	if flagAddGit && flagAddAsPath {
+		msg.Fatal("--git and --path can't be used together")
+	}
+
+	kind, location, err := builder.ClassifyDependency(source)
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+
+	switch {
+	case flagAddGit && kind == builder.SourceArchive:
+		// a URL without a .git suffix is treated as an archive unless asked otherwise
+		source = "git:" + source
+	case flagAddGit && kind != builder.SourceGit:
+		msg.Fatal("%q isn't a Git URL", source)
+	case flagAddAsPath && kind != builder.SourcePath:
+		msg.Fatal("%q isn't a path (source kind: %s)", source, kind)
+	}
+
+	if kind == builder.SourcePath {
+		path := location
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		if _, err := os.Stat(builder.ManifestPath(path)); err != nil {
+			msg.Fatal("%q doesn't contain a package: %v", source, err)
+		}
+	}
+	return source
+}
+
+var addCmd = &cobra.Command{
+	Use:   "add <name> <source>",
+	Short: "Add or update a dependency",
+	Long: `Add a dependency to the [dependencies] section of Qobs.toml, or update it if it already exists.
+The rest of the file is left as it is.
+
+The source is interpreted like in Qobs.toml: "gh:user/repo", "git:<url>" and URLs ending with .git are
+Git repositories, other URLs are archives and anything else is a path. --git and --path make sure the source
+is fetched that way.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		name, source := args[0], args[1]
+		path, manifest := readManifest(flagAddDir)
+		source = checkDependencySource(flagAddDir, source)
+
+		dep, exists, err := builder.ReadDependency(manifest, name)
+		if err != nil {
+			msg.Fatal("%v", err)
+		}
+		dep.Source = source
+		dep.PkgConfig = ""
+		// updating the source keeps the features chosen before, unless they're given again
+		if !exists || cmd.Flags().Changed("no-default-features") {
+			dep.DefaultFeatures = !flagAddNoDefaultFeatures
+		}
+		if !exists || cmd.Flags().Changed("features") {
+			dep.Features = flagAddFeatures
+		}
+
+		out, err := builder.SetDependency(manifest, name, dep)
+		if err != nil {
+			msg.Fatal("%v", err)
+		}
+		if err := os.WriteFile(path, out, 0o644); err != nil {
+			msg.Fatal("%v", err)
+		}
+
+		verb := "Added"
+		if exists {
+			verb = "Updated"
+		}
+		fmt.Printf("%s dependency %s (%s)\n", color.HiGreenString(verb), name, source)
+		if len(dep.Features) > 0 {
+			fmt.Printf("  features: %s\n", strings.Join(dep.Features, ", "))
+		}
+	},
+}
+
+var rmCmd = &cobra.Command{
+	Use:   "rm <name>",
+	Short: "Remove a dependency",
+	Long:  `Remove a dependency from the [dependencies] section of Qobs.toml. The rest of the file is left as it is.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+		path, manifest := readManifest(flagRmDir)
+
+		out, found, err := builder.RemoveDependency(manifest, name)
+		if err != nil {
+			msg.Fatal("%v", err)
+		}
+		if !found {
+			msg.Fatal("%s has no dependency called %q", filepath.Base(path), name)
+		}
+		if err := os.WriteFile(path, out, 0o644); err != nil {
+			msg.Fatal("%v", err)
+		}
+		fmt.Printf("%s dependency %s\n", color.HiGreenString("Removed"), name)
+	},
+}
+
+func init() {
+	// qobs add subcommand
+	rootCmd.AddCommand(addCmd)
+	addCmd.Flags().StringVarP(&flagAddDir, "manifest-dir", "C", ".", "Directory of the package to edit")
+	addCmd.Flags().StringSliceVarP(&flagAddFeatures, "features", "f", []string{}, "Comma separated list of features to enable in the dependency")
+	addCmd.Flags().BoolVar(&flagAddNoDefaultFeatures, "no-default-features", false, "Disable the default features of the dependency")
+	addCmd.Flags().BoolVar(&flagAddGit, "git", false, "Fetch the source as a Git repository")
+	addCmd.Flags().BoolVar(&flagAddAsPath, "path", false, "Require the source to be a path to a local package")
+
+	// qobs rm subcommand
+	rootCmd.AddCommand(rmCmd)
+	rmCmd.Flags().StringVarP(&flagRmDir, "manifest-dir", "C", ".", "Directory of the package to edit")
+}
@@ -0,0 +1,51 @@
+// qobs bench [path] [-- args...]
+package cmd
+
+import (
+	"strings"
+
+	"github.com/qobs-build/qobs/internal/builder"
+	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagBenchFilter  string
+	flagBenchProfile string
+)
+
+func doBench(cmd *cobra.Command, args []string) {
+	target, args := splitRunArgs(cmd, args)
+	b, err := builder.NewBuilderInDirectory(target, flagBuildDir, flagFeatures, !flagNoDefaultFeatures)
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+	b.SetContext(cmd.Context())
+	failed, err := b.RunBenches(selectedProfile(cmd), flagBenchFilter, args)
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+	if len(failed) > 0 {
+		msg.Fatal("%d benchmark(s) failed: %s", len(failed), strings.Join(failed, ", "))
+	}
+}
+
+var benchCmd = &cobra.Command{
+	Use:   "bench [target path] [-- benchmark args...]",
+	Short: "Build and run the package's benchmarks",
+	Long: `Build and run the benchmarks listed in the [[benches]] section of the package, one after another.
+If no target path is given, uses "."
+
+Benchmarks are built with the release profile unless another one is chosen with --profile,
+QOBS_PROFILE or .qobs/config.toml. Everything after "--" is passed to every benchmark, e.g.
+"qobs bench -- --iterations 1000".`,
+	Args: checkRunArgs,
+	Run:  doBench,
+}
+
+func init() {
+	// qobs bench subcommand
+	rootCmd.AddCommand(benchCmd)
+	addPackageFlagsWithProfile(benchCmd, &flagBenchProfile, "release")
+	benchCmd.Flags().StringVar(&flagBenchFilter, "filter", "", "Only run benchmarks whose name contains this substring")
+}
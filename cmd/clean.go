@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 
 	"github.com/fatih/color"
+	"github.com/qobs-build/qobs/internal/builder"
 	"github.com/qobs-build/qobs/internal/msg"
 	"github.com/spf13/cobra"
 )
@@ -52,35 +53,105 @@ func dirExists(path string) bool {
 	return err == nil && stat.IsDir()
 }
 
-func cleanDir(path string) {
-	buildDir := filepath.Join(path, "build")
-	if dirExists(filepath.Join(buildDir, "QobsFiles")) || dirExists(filepath.Join(buildDir, "_deps")) {
-		sz, _ := dirSize(buildDir)
-		if err := os.RemoveAll(buildDir); err != nil {
-			msg.Warn("failed to remove %q: %v", buildDir, err)
-		} else {
-			fmt.Printf("%s %s of build artifacts\n", color.HiGreenString("Removed"), humanSize(sz))
+// isBuildDir reports whether buildDir looks like a directory generated by Qobs
+func isBuildDir(buildDir string) bool {
+	if dirExists(filepath.Join(buildDir, "_deps")) {
+		return true
+	}
+	profileDirs, _ := filepath.Glob(filepath.Join(buildDir, "*", "QobsFiles"))
+	return len(profileDirs) > 0
+}
+
+// removeDir removes a directory and returns the amount of bytes freed
+func removeDir(path string) int64 {
+	sz, _ := dirSize(path)
+	if err := os.RemoveAll(path); err != nil {
+		msg.Warn("failed to remove %q: %v", path, err)
+		return 0
+	}
+	return sz
+}
+
+func cleanDir(path, profile string, allProfiles, deps bool) {
+	if profile != "" {
+		// the profile directory is removed, it must not be anything else
+		if err := builder.ValidateProfileName(profile); err != nil {
+			msg.Fatal("%v", err)
 		}
-	} else {
+	}
+	buildDir := builder.ResolveBuildDir(path, flagBuildDir)
+	if !isBuildDir(buildDir) {
 		msg.Info("couldn't find build directory; nothing to clean")
+		return
 	}
+
+	var removed []string
+	switch {
+	case profile != "":
+		profileDir := filepath.Join(buildDir, profile)
+		if !dirExists(profileDir) {
+			msg.Info("couldn't find build directory for profile %q; nothing to clean", profile)
+			return
+		}
+		removed = append(removed, profileDir)
+	case allProfiles:
+		entries, err := os.ReadDir(buildDir)
+		if err != nil {
+			msg.Fatal("%v", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && entry.Name() != "_deps" {
+				removed = append(removed, filepath.Join(buildDir, entry.Name()))
+			}
+		}
+	default:
+		// remove everything, including dependencies
+		removed = append(removed, buildDir)
+	}
+
+	// dependency sources are shared between profiles, so they're only removed when asked to
+	if deps && (profile != "" || allProfiles) {
+		removed = append(removed, filepath.Join(buildDir, "_deps"))
+	}
+
+	var sz int64
+	for _, dir := range removed {
+		sz += removeDir(dir)
+	}
+	fmt.Printf("%s %s of build artifacts\n", color.HiGreenString("Removed"), humanSize(sz))
 }
 
+var (
+	flagCleanProfile     string
+	flagCleanAllProfiles bool
+	flagCleanDeps        bool
+)
+
 var cleanCmd = &cobra.Command{
 	Use:   "clean [path]",
 	Short: "Remove artifacts previously generated by Qobs",
-	Long:  `Removes the build folder previously generated by Qobs. If no target path is given, uses "."`,
-	Args:  cobra.MaximumNArgs(1),
+	Long: `Removes the build folder previously generated by Qobs. If no target path is given, uses "."
+
+With --profile or --all-profiles only the build output of those profiles is removed, fetched dependencies
+are kept unless --deps is also given.`,
+	Args: cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		path := "."
 		if len(args) != 0 {
 			path = args[0]
 		}
-		cleanDir(path)
+		if flagCleanProfile != "" && flagCleanAllProfiles {
+			msg.Fatal("--profile and --all-profiles can't be used together")
+		}
+		cleanDir(path, flagCleanProfile, flagCleanAllProfiles, flagCleanDeps)
 	},
 }
 
 func init() {
 	// qobs clean subcommand
 	rootCmd.AddCommand(cleanCmd)
+	addBuildDirFlag(cleanCmd)
+	cleanCmd.Flags().StringVarP(&flagCleanProfile, "profile", "p", "", "Only remove the build output of the given profile")
+	cleanCmd.Flags().BoolVar(&flagCleanAllProfiles, "all-profiles", false, "Remove the build output of every profile, keeping fetched dependencies")
+	cleanCmd.Flags().BoolVar(&flagCleanDeps, "deps", false, "Also remove fetched dependencies")
 }
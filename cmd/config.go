@@ -0,0 +1,67 @@
+// qobs config [path]
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/qobs-build/qobs/internal/builder"
+	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/spf13/cobra"
+)
+
+var flagConfigExpanded bool
+
+func doConfig(cmd *cobra.Command, args []string) {
+	target := "."
+	if len(args) > 0 {
+		target = args[0]
+	}
+
+	features := make(map[string]bool)
+	for _, feature := range flagFeatures {
+		features[feature] = true
+	}
+
+	path, err := filepath.Abs(target)
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+	if !flagConfigExpanded {
+		manifest, err := os.ReadFile(builder.ManifestPath(path))
+		if err != nil {
+			msg.Fatal("%v", err)
+		}
+		fmt.Print(string(manifest))
+		return
+	}
+
+	env := builder.NewConfigEnvWithFeatures(path, features)
+	cfg, err := builder.ParseConfigFromFile(builder.ManifestPath(path), env, !flagNoDefaultFeatures)
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+
+	expanded, err := cfg.Expanded()
+	if err != nil {
+		msg.Fatal("failed to print config: %v", err)
+	}
+	fmt.Print(expanded)
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config [target path]",
+	Short: "Print the package config",
+	Long:  `Print the package config as written. With --expanded, prints it after evaluating all expressions and conditional sections. If no target path is given, uses "."`,
+	Args:  cobra.MaximumNArgs(1),
+	Run:   doConfig,
+}
+
+func init() {
+	// qobs config subcommand
+	rootCmd.AddCommand(configCmd)
+	configCmd.Flags().StringSliceVarP(&flagFeatures, "features", "f", []string{}, "Comma separated list of features to activate")
+	configCmd.Flags().BoolVar(&flagNoDefaultFeatures, "no-default-features", false, "Disable default features")
+	configCmd.Flags().BoolVar(&flagConfigExpanded, "expanded", false, "Print the config after evaluating expressions and conditional sections")
+}
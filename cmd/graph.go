@@ -0,0 +1,157 @@
+// qobs graph [path]
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/qobs-build/qobs/internal/builder"
+	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/spf13/cobra"
+)
+
+const (
+	graphFormatText = "text"
+	graphFormatDot  = "dot"
+)
+
+var (
+	flagGraphHash         bool
+	flagGraphOutput       string
+	flagGraphShowFeatures bool
+	flagGraphFormat       EnumValue = NewEnumValue(graphFormatText, map[string]string{
+		graphFormatText: "A line per package (default)",
+		graphFormatDot:  "Graphviz DOT, e.g. for `dot -Tsvg`",
+	})
+)
+
+// dotQuote quotes s as a DOT identifier, which can then contain any character
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// writeGraphText writes every package with its source and enabled features, a line each
+func writeGraphText(w io.Writer, packages []*builder.Package) {
+	for _, pkg := range packages {
+		source := pkg.Source
+		if pkg.IsRoot {
+			source = "(root)"
+		}
+		fmt.Fprintf(w, "%s %s", pkg.Name, source)
+		if features := pkg.Config.EnabledFeatures(); len(features) > 0 {
+			fmt.Fprintf(w, " [%s]", strings.Join(features, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// writeGraphDot writes the packages as a Graphviz digraph with an edge from every package to each
+// of its dependencies. Executables are boxes, libraries ellipses and root packages are filled
+func writeGraphDot(w io.Writer, packages []*builder.Package, showFeatures bool) {
+	fmt.Fprintln(w, "digraph qobs {")
+	fmt.Fprintln(w, "\tnode [fontname=\"sans-serif\"];")
+	resolved := make(map[string]bool, len(packages))
+	for _, pkg := range packages {
+		resolved[pkg.Name] = true
+	}
+	for _, pkg := range packages {
+		attrs := []string{"label=" + dotQuote(pkg.Name)}
+		if pkg.Config.Target.Lib || pkg.Config.Target.HeaderOnly {
+			attrs = append(attrs, "shape=ellipse")
+		} else {
+			attrs = append(attrs, "shape=box")
+		}
+		if pkg.IsRoot {
+			attrs = append(attrs, "style=\"filled,bold\"", "fillcolor=lightblue")
+		}
+		if pkg.Config.Target.Kind == builder.KindSharedLib {
+			attrs = append(attrs, "peripheries=2")
+		}
+		fmt.Fprintf(w, "\t%s [%s];\n", dotQuote(pkg.Name), strings.Join(attrs, ", "))
+	}
+	for _, pkg := range packages {
+		for _, dep := range slices.Sorted(maps.Keys(pkg.Config.Dependencies)) {
+			if !resolved[dep] {
+				continue
+			}
+			fmt.Fprintf(w, "\t%s -> %s", dotQuote(pkg.Name), dotQuote(dep))
+			if features := pkg.Config.DependencyFeatures(dep); showFeatures && len(features) > 0 {
+				fmt.Fprintf(w, " [label=%s]", dotQuote(strings.Join(features, ", ")))
+			}
+			fmt.Fprintln(w, ";")
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func doGraph(cmd *cobra.Command, args []string) {
+	target := "."
+	if len(args) > 0 {
+		target = args[0]
+	}
+	b, err := builder.NewBuilderInDirectory(target, flagBuildDir, flagFeatures, !flagNoDefaultFeatures)
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+	b.SetContext(cmd.Context())
+
+	if flagGraphHash {
+		hash, err := b.GraphHash(selectedProfile(cmd))
+		if err != nil {
+			msg.Fatal("%v", err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	packages, err := b.ResolveGraph()
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+
+	out := os.Stdout
+	if flagGraphOutput != "" && flagGraphOutput != "-" {
+		if out, err = os.Create(flagGraphOutput); err != nil {
+			msg.Fatal("%v", err)
+		}
+	}
+	w := bufio.NewWriter(out)
+	if flagGraphFormat.Value() == graphFormatDot {
+		writeGraphDot(w, packages, flagGraphShowFeatures)
+	} else {
+		writeGraphText(w, packages)
+	}
+	if err := w.Flush(); err != nil {
+		msg.Fatal("failed to write the graph: %v", err)
+	}
+	if out != os.Stdout {
+		if err := out.Close(); err != nil {
+			msg.Fatal("failed to write the graph: %v", err)
+		}
+	}
+}
+
+var graphCmd = &cobra.Command{
+	Use:   "graph [target path]",
+	Short: "Print the resolved dependency graph",
+	Long: `Print every package in the resolved dependency graph, or the graph in Graphviz DOT format with
+--format dot, e.g. qobs graph --format dot | dot -Tsvg -o deps.svg. If no target path is given, uses "."`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  doGraph,
+}
+
+func init() {
+	// qobs graph subcommand
+	rootCmd.AddCommand(graphCmd)
+	addPackageFlags(graphCmd)
+	graphCmd.Flags().BoolVar(&flagGraphHash, "hash", false, "Print a stable hash of the resolved graph, usable as a cache key")
+	graphCmd.Flags().Var(&flagGraphFormat, "format", "Output format, one of "+flagGraphFormat.HelpString())
+	graphCmd.RegisterFlagCompletionFunc("format", flagGraphFormat.CompletionFunc())
+	graphCmd.Flags().StringVarP(&flagGraphOutput, "output", "o", "", "Write the graph to this file instead of stdout")
+	graphCmd.Flags().BoolVarP(&flagGraphShowFeatures, "show-features", "e", false, "Label the edges of the DOT graph with the features requested from each dependency")
+}
@@ -2,7 +2,7 @@
 package cmd
 
 import (
-	"fmt"
+	"context"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,6 +12,13 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var (
+	flagIndexName        string
+	flagIndexDescription string
+	flagIndexLicense     string
+	flagIndexVersions    []string
+)
+
 // ensureLocalIndex loads qobs_index.json from cwd or fails
 func ensureLocalIndex() (*index.Index, string) {
 	cwd, err := os.Getwd()
@@ -30,13 +37,25 @@ func ensureLocalIndex() (*index.Index, string) {
 	return idx, cwd
 }
 
-func doIndexAdd(url, dir string) {
+func doIndexAdd(cmd *cobra.Command, url, dir string) {
 	idx, cwd := ensureLocalIndex()
 
 	if idx.HasDep(url) {
 		msg.Warn("overwriting existing dependency for %s", url)
 	}
-	idx.SetDep(url, dir)
+	entry := idx.SetDep(url, dir)
+	if cmd.Flags().Changed("name") {
+		entry.Name = flagIndexName
+	}
+	if cmd.Flags().Changed("description") {
+		entry.Description = flagIndexDescription
+	}
+	if cmd.Flags().Changed("license") {
+		entry.License = flagIndexLicense
+	}
+	if cmd.Flags().Changed("versions") {
+		entry.Versions = flagIndexVersions
+	}
 
 	if err := idx.Save(cwd); err != nil {
 		msg.Fatal("failed to save index: %v", err)
@@ -58,43 +77,20 @@ func doIndexRemove(url string) {
 	}
 }
 
-func doIndexUpdate() {
-	_, err := index.UpdateGlobalIndex()
+func doIndexUpdate(ctx context.Context) {
+	_, err := index.UpdateGlobalIndex(ctx)
 	if err != nil {
 		msg.Fatal("failed to update global index: %v", err)
 	}
 	msg.Info("updated global index successfully")
 }
 
-func doIndexSearch(term string) {
-	idx, err := index.GetIndexAnyhow()
-	if err != nil {
-		msg.Fatal("failed to load global index: %v", err)
-	}
-
-	term = strings.ToLower(term)
-	i := 0
-	for url, path := range idx.Deps {
-		if strings.Contains(strings.ToLower(url), term) ||
-			strings.Contains(strings.ToLower(path), term) {
-			fmt.Printf("%d. %s -> %s\n", i+1, url, path)
-			i++
-		}
-	}
-
-	if i == 0 {
-		msg.Warn("no matches found for %q", term)
-	} else {
-		msg.Info("found %d matches for %q", i, term)
-	}
-}
-
 var indexAddCmd = &cobra.Command{
 	Use:   "add <url> <dir>",
 	Short: "Add a dependency to the local index",
 	Args:  cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		doIndexAdd(args[0], args[1])
+		doIndexAdd(cmd, args[0], args[1])
 	},
 }
 
@@ -111,16 +107,16 @@ var indexUpdateCmd = &cobra.Command{
 	Use:   "update",
 	Short: "Update the global cached index",
 	Run: func(cmd *cobra.Command, args []string) {
-		doIndexUpdate()
+		doIndexUpdate(cmd.Context())
 	},
 }
 
 var indexSearchCmd = &cobra.Command{
-	Use:   "search <term>",
-	Short: "Search the global index for dependencies",
-	Args:  cobra.ExactArgs(1),
+	Use:   "search <query>",
+	Short: "Search the global index for dependencies, like qobs search",
+	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		doIndexSearch(args[0])
+		doSearch(cmd.Context(), strings.Join(args, " "))
 	},
 }
 
@@ -131,6 +127,11 @@ var indexCmd = &cobra.Command{
 
 func init() {
 	// qobs index subcommand
+	indexAddCmd.Flags().StringVar(&flagIndexName, "name", "", "Name of the package (default: the last element of the URL)")
+	indexAddCmd.Flags().StringVar(&flagIndexDescription, "description", "", "Short description of the package")
+	indexAddCmd.Flags().StringVar(&flagIndexLicense, "license", "", "License of the package, e.g. MIT")
+	indexAddCmd.Flags().StringSliceVar(&flagIndexVersions, "versions", []string{}, "Comma separated list of available versions (tags)")
+	indexSearchCmd.Flags().IntVarP(&flagSearchLimit, "limit", "n", 20, "Show at most this many results, 0 for all")
 	indexCmd.AddCommand(indexUpdateCmd)
 	indexCmd.AddCommand(indexAddCmd)
 	indexCmd.AddCommand(indexRemoveCmd)
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/fatih/color"
+	"github.com/qobs-build/qobs/internal/builder"
 	"github.com/qobs-build/qobs/internal/msg"
 	"github.com/spf13/cobra"
 )
@@ -122,6 +123,9 @@ var initCmd = &cobra.Command{
 	Short: "Create a new package in the current directory",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		if err := builder.ValidatePackageName(args[0]); err != nil {
+			msg.Fatal("%v", err)
+		}
 		initIn(".", args[0], library)
 	},
 }
@@ -131,6 +135,9 @@ var newCmd = &cobra.Command{
 	Short: "Create a new package in a new directory",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		if err := builder.ValidatePackageName(filepath.Base(args[0])); err != nil {
+			msg.Fatal("%v", err)
+		}
 		mkdir(args[0])
 		initIn(args[0], filepath.Base(args[0]), library)
 	},
@@ -0,0 +1,45 @@
+// qobs install [path]
+package cmd
+
+import (
+	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagInstallPrefix  string
+	flagInstallDestdir string
+)
+
+var installCmd = &cobra.Command{
+	Use:   "install [target path]",
+	Short: "Build the package and install it",
+	Long: `Build the package and install it below a prefix: executables to <prefix>/bin, libraries to <prefix>/lib
+and the headers of libraries to <prefix>/include. If no target path is given, uses "."
+
+Packages are built with the release profile unless --profile is given. --destdir is prepended to every
+destination, for staging an installation when packaging.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		target := "."
+		if len(args) > 0 {
+			target = args[0]
+		}
+		profile := selectedProfile(cmd)
+		if !cmd.Flags().Changed("profile") {
+			profile = "release"
+		}
+		if err := newBuilder(cmd.Context(), target).Install(profile, flagGenerator.Value(), flagInstallPrefix, flagInstallDestdir); err != nil {
+			msg.Fatal("%v", err)
+		}
+	},
+}
+
+func init() {
+	// qobs install subcommand
+	rootCmd.AddCommand(installCmd)
+	addBuildFlags(installCmd)
+	installCmd.Flags().Lookup("profile").DefValue = "release"
+	installCmd.Flags().StringVar(&flagInstallPrefix, "prefix", "/usr/local", "Directory to install to")
+	installCmd.Flags().StringVar(&flagInstallDestdir, "destdir", "", "Directory prepended to every destination, for staged installs")
+}
@@ -0,0 +1,52 @@
+// qobs metadata [path]
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/qobs-build/qobs/internal/builder"
+	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/spf13/cobra"
+)
+
+func doMetadata(cmd *cobra.Command, args []string) {
+	// stdout is only for the JSON, fetching dependencies and warnings go to stderr
+	msg.SetOutput(os.Stderr)
+	target := "."
+	if len(args) > 0 {
+		target = args[0]
+	}
+	b, err := builder.NewBuilderInDirectory(target, flagBuildDir, flagFeatures, !flagNoDefaultFeatures)
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+	b.SetContext(cmd.Context())
+
+	meta, err := b.Metadata()
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(meta); err != nil {
+		msg.Fatal("%v", err)
+	}
+}
+
+var metadataCmd = &cobra.Command{
+	Use:   "metadata [target path]",
+	Short: "Print the resolved project as JSON for tools",
+	Long: `Resolve the dependency graph without building and print it as JSON: every package with its source,
+path, enabled features, sources and include directories, and the layout of the build directory.
+All paths are absolute. The "version" field changes only when the format changes incompatibly.
+If no target path is given, uses "."`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  doMetadata,
+}
+
+func init() {
+	// qobs metadata subcommand
+	rootCmd.AddCommand(metadataCmd)
+	addPackageFlags(metadataCmd)
+}
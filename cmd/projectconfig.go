@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/spf13/cobra"
+)
+
+// ProjectConfigPath is where the defaults of command line flags are read from, relative to the
+// working directory or any directory above it
+var ProjectConfigPath = filepath.Join(".qobs", "config.toml")
+
+// flagDefault is a flag that can take its default from the environment or the project config
+type flagDefault struct {
+	key    string   // key in the project config
+	flag   string   // name of the command line flag
+	env    string   // environment variable
+	except []string // commands whose flag of that name means something else
+}
+
+// flagDefaults are the flags with defaults in the project config. The value of each of them comes
+// from, in order of precedence: the command line, the environment variable, the project config and
+// the built-in default
+var flagDefaults = []flagDefault{
+	// qobs clean --profile limits what's removed, a default would keep the other profiles
+	{"profile", "profile", "QOBS_PROFILE", []string{"clean"}},
+	{"generator", "gen", "QOBS_GENERATOR", nil},
+	{"jobs", "jobs", "QOBS_JOBS", nil},
+	{"offline", "frozen", "QOBS_OFFLINE", nil},
+	{"frozen", "frozen", "QOBS_FROZEN", nil}, // alias of offline
+	{"platforms", "platform", "QOBS_PLATFORMS", nil},
+	{"no-color", "no-color", "NO_COLOR", nil},
+}
+
+// findProjectConfig returns the path of the closest ProjectConfigPath in dir or a directory
+// above it, or "" if there isn't one
+func findProjectConfig(dir string) string {
+	for {
+		path := filepath.Join(dir, ProjectConfigPath)
+		if stat, err := os.Stat(path); err == nil && !stat.IsDir() {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readProjectConfig reads the project config at path, rejecting unknown keys
+func readProjectConfig(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg map[string]any
+	if err := toml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for key := range cfg {
+		if !slices.ContainsFunc(flagDefaults, func(def flagDefault) bool { return def.key == key }) {
+			return nil, fmt.Errorf("%s: unknown key %q", path, key)
+		}
+	}
+	return cfg, nil
+}
+
+// configValue returns a value of the project config as a flag value. Arrays become comma separated
+// lists, e.g. platforms = ["x64", "ARM64"] is --platform x64,ARM64
+func configValue(v any) string {
+	list, ok := v.([]any)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	values := make([]string, 0, len(list))
+	for _, elem := range list {
+		values = append(values, fmt.Sprint(elem))
+	}
+	return strings.Join(values, ",")
+}
+
+// applyFlagDefaults sets the flags of cmd that weren't given on the command line from the
+// environment or the project config found from the working directory, see flagDefaults
+func applyFlagDefaults(cmd *cobra.Command) error {
+	var cfg map[string]any
+	var cfgPath string
+	if cwd, err := os.Getwd(); err == nil {
+		if cfgPath = findProjectConfig(cwd); cfgPath != "" {
+			if cfg, err = readProjectConfig(cfgPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	// flags set from the environment, an alias in the config mustn't override them
+	fromEnv := map[string]bool{}
+	for _, def := range flagDefaults {
+		flag := cmd.Flags().Lookup(def.flag)
+		if flag == nil || flag.Changed || slices.Contains(def.except, cmd.Name()) {
+			continue
+		}
+		value, source := os.Getenv(def.env), def.env
+		if def.env == "NO_COLOR" && value != "" {
+			// any value disables color, see https://no-color.org
+			value = "true"
+		}
+		if value != "" {
+			fromEnv[def.flag] = true
+		} else {
+			v, ok := cfg[def.key]
+			if !ok || fromEnv[def.flag] {
+				continue
+			}
+			value, source = configValue(v), cfgPath
+		}
+		// the flag isn't marked as changed, the value is still a default
+		if err := flag.Value.Set(value); err != nil {
+			return fmt.Errorf("invalid %s %q from %s: %w", def.key, value, source, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// newFlagTestCommand returns a command called name with the flags that have project config
+// defaults, its --profile defaulting to defaultProfile
+func newFlagTestCommand(name, defaultProfile string) (*cobra.Command, *int, *string) {
+	cmd := &cobra.Command{Use: name}
+	jobs, profile := new(int), new(string)
+	cmd.Flags().IntVarP(jobs, "jobs", "j", 0, "")
+	cmd.Flags().StringVarP(profile, "profile", "p", defaultProfile, "")
+	return cmd, jobs, profile
+}
+
+func TestFlagDefaultsPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ".qobs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := "jobs = 4\nprofile = \"release\"\n"
+	if err := os.WriteFile(filepath.Join(dir, ProjectConfigPath), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(dir, "src")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(sub) // the config is found in a directory above
+
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want int
+	}{
+		{"config", "", nil, 4},
+		{"env over config", "6", nil, 6},
+		{"flag over env and config", "6", []string{"-j", "8"}, 8},
+		{"flag over config", "", []string{"--jobs=2"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("QOBS_JOBS", tt.env)
+			t.Setenv("QOBS_PROFILE", "")
+			cmd, jobs, profile := newFlagTestCommand("build", "debug")
+			if err := cmd.ParseFlags(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyFlagDefaults(cmd); err != nil {
+				t.Fatal(err)
+			}
+			if *jobs != tt.want {
+				t.Errorf("jobs = %d, want %d", *jobs, tt.want)
+			}
+			if *profile != "release" {
+				t.Errorf("profile = %q, want the one from the config", *profile)
+			}
+		})
+	}
+
+	t.Run("clean ignores the profile", func(t *testing.T) {
+		cmd, _, profile := newFlagTestCommand("clean", "debug")
+		if err := applyFlagDefaults(cmd); err != nil {
+			t.Fatal(err)
+		}
+		if *profile != "debug" {
+			t.Errorf("profile = %q, want the built-in default", *profile)
+		}
+	})
+}
+
+// bench defaults to release, which the environment and the project config still override
+func TestFlagDefaultsPrecedenceBench(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ".qobs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ProjectConfigPath), []byte("profile = \"debug\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want string
+	}{
+		{"config over default", "", nil, "debug"},
+		{"env over config", "minsize", nil, "minsize"},
+		{"flag over env and config", "minsize", []string{"-p", "release"}, "release"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("QOBS_PROFILE", tt.env)
+			cmd, _, profile := newFlagTestCommand("bench", "release")
+			if err := cmd.ParseFlags(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyFlagDefaults(cmd); err != nil {
+				t.Fatal(err)
+			}
+			if *profile != tt.want {
+				t.Errorf("profile = %q, want %q", *profile, tt.want)
+			}
+		})
+	}
+}
+
+func TestProjectConfigOffline(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		env    string
+		want   bool
+	}{
+		{"offline", "offline = true\n", "", true},
+		{"frozen alias", "frozen = true\n", "", true},
+		{"env over alias", "frozen = true\n", "false", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(dir, ".qobs"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, ProjectConfigPath), []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Chdir(dir)
+			t.Setenv("QOBS_OFFLINE", tt.env)
+			t.Setenv("QOBS_FROZEN", "")
+
+			cmd := &cobra.Command{Use: "build"}
+			var frozen bool
+			cmd.Flags().BoolVar(&frozen, "frozen", false, "")
+			if err := applyFlagDefaults(cmd); err != nil {
+				t.Fatal(err)
+			}
+			if frozen != tt.want {
+				t.Errorf("frozen = %v, want %v", frozen, tt.want)
+			}
+		})
+	}
+}
+
+func TestProjectConfigUnknownKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("colour = true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readProjectConfig(path); err == nil {
+		t.Error("unknown key accepted")
+	}
+}
+
+func TestProjectConfigPlatforms(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ".qobs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ProjectConfigPath), []byte("platforms = [\"x64\", \"ARM64\"]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+	t.Setenv("QOBS_PLATFORMS", "")
+
+	cmd := &cobra.Command{Use: "build"}
+	var platforms []string
+	cmd.Flags().StringSliceVar(&platforms, "platform", []string{}, "")
+	if err := applyFlagDefaults(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(platforms, []string{"x64", "ARM64"}) {
+		t.Errorf("platforms = %q, want the ones from the config", platforms)
+	}
+}
@@ -2,39 +2,133 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/fatih/color"
 	"github.com/qobs-build/qobs/internal/builder"
+	"github.com/qobs-build/qobs/internal/index"
 	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/qobs-build/qobs/internal/retry"
 	"github.com/spf13/cobra"
 )
 
 var (
 	flagProfile           string
+	flagRelease           bool
+	flagBuildDir          string
 	flagFeatures          []string
 	flagNoDefaultFeatures bool
-	flagGenerator         EnumValue = NewEnumValue("qobs", map[string]string{
+	flagPlatforms         []string
+	flagNoCache           bool
+	flagVerbose           bool
+	flagKeepGoing         bool
+	flagJobs              int
+	flagAllowEmpty        bool
+	flagNoColor           bool
+	flagRetries           int
+	flagFrozen            bool
+	flagTimeout           time.Duration
+	flagCompileCommands   string
+	flagDryRun            bool
+	flagWatch             bool
+	flagTimings           bool
+	flagTimingsJSON       string
+	flagEmitPlan          bool
+	flagMessageFormat     EnumValue = NewEnumValue(builder.MessageFormatHuman, map[string]string{
+		builder.MessageFormatHuman: "Progress line or a line per job (default)",
+		builder.MessageFormatJSON:  "A JSON object per line for every job and a summary",
+	})
+	flagEmit EnumValue = NewEnumValue(builder.EmitObjects, map[string]string{
+		builder.EmitObjects:      "Compile to object files and link (default)",
+		builder.EmitPreprocessed: "Only preprocess sources to .i/.ii files, don't link",
+		builder.EmitAsm:          "Only compile sources to assembly, don't link",
+	})
+	flagGenerator EnumValue = NewEnumValue("qobs", map[string]string{
 		"qobs":   "Use Qobs's builder (default)",
 		"ninja":  "Generates build.ninja files",
 		"vs2022": "Generates Visual Studio 2022 project files",
 	})
 )
 
+// newBuilder creates a builder for the package in target, configured with the build flags, that
+// fetches dependencies with ctx
+func newBuilder(ctx context.Context, target string) *builder.Builder {
+	b, err := tryNewBuilder(ctx, target)
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+	return b
+}
+
+// tryNewBuilder is newBuilder returning errors instead of exiting
+func tryNewBuilder(ctx context.Context, target string) (*builder.Builder, error) {
+	b, err := builder.NewBuilderInDirectory(target, flagBuildDir, flagFeatures, !flagNoDefaultFeatures)
+	if err != nil {
+		return nil, err
+	}
+	b.SetContext(ctx)
+	if err := b.SetPlatforms(flagPlatforms); err != nil {
+		return nil, err
+	}
+	b.SetCompileCache(!flagNoCache)
+	b.SetVerbose(flagVerbose)
+	b.SetKeepGoing(flagKeepGoing)
+	b.SetJobs(flagJobs)
+	b.SetAllowEmpty(flagAllowEmpty)
+	b.SetCompileCommandsPath(flagCompileCommands)
+	b.SetTimings(flagTimings, flagTimingsJSON)
+	b.SetEmitPlan(flagEmitPlan)
+	if err := b.SetEmit(flagEmit.Value()); err != nil {
+		return nil, err
+	}
+	if err := b.SetMessageFormat(flagMessageFormat.Value()); err != nil {
+		return nil, err
+	}
+	if flagMessageFormat.Value() == builder.MessageFormatJSON {
+		// stdout is only for the events
+		msg.SetOutput(os.Stderr)
+	}
+	return b, nil
+}
+
+// selectedProfile returns the profile chosen with --profile or --release
+func selectedProfile(cmd *cobra.Command) string {
+	profile, _ := cmd.Flags().GetString("profile")
+	if !flagRelease {
+		return profile
+	}
+	if cmd.Flags().Changed("profile") && profile != "release" {
+		msg.Fatal("--release conflicts with --profile %s", profile)
+	}
+	return "release"
+}
+
 func doBuild(cmd *cobra.Command, args []string) {
 	target := "."
 	if len(args) > 0 {
 		target = args[0]
 	}
-	b, err := builder.NewBuilderInDirectory(target, flagFeatures, !flagNoDefaultFeatures)
-	if err != nil {
-		msg.Fatal("%v", err)
+	if flagWatch {
+		watch(cmd.Context(), target, func(b *builder.Builder) error {
+			return b.Build(selectedProfile(cmd), flagGenerator.Value())
+		})
+		return
 	}
-	if err := b.Build(flagProfile, flagGenerator.Value()); err != nil {
+
+	b := newBuilder(cmd.Context(), target)
+	b.SetDryRun(flagDryRun)
+	if err := b.Build(selectedProfile(cmd), flagGenerator.Value()); err != nil {
 		msg.Fatal("%v", err)
 	}
 }
 
+// Version is the version of qobs, set at build time with
+// -ldflags "-X github.com/qobs-build/qobs/cmd.Version=..."
+var Version = "dev"
+
 var rootCmd = &cobra.Command{
 	Use:   "qobs [target path]",
 	Short: "Quite OK Build System",
@@ -52,19 +146,80 @@ var buildCmd = &cobra.Command{
 }
 
 func init() {
+	// color is already disabled with NO_COLOR or when stdout isn't a terminal
+	rootCmd.PersistentFlags().BoolVar(&flagNoColor, "no-color", false, "Don't color the output")
+	rootCmd.PersistentFlags().IntVar(&flagRetries, "retries", retry.Attempts, "How many times to try downloading and cloning dependencies on transient network errors")
+	rootCmd.PersistentFlags().DurationVar(&flagTimeout, "timeout", builder.HTTPTimeout, "How long a download of a dependency may take before giving up, 0 for no limit (default from "+builder.TimeoutEnv+")")
+	rootCmd.PersistentFlags().BoolVar(&flagFrozen, "frozen", false, "Fail instead of fetching dependencies or the index, for builds that must not touch the network")
+	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		if err := applyFlagDefaults(cmd); err != nil {
+			msg.Fatal("%v", err)
+		}
+		if flagNoColor {
+			color.NoColor = true
+		}
+		retry.Attempts = max(flagRetries, 1)
+		builder.Frozen, index.Frozen = flagFrozen, flagFrozen
+		builder.UserAgent = "qobs/" + Version
+		if rootCmd.PersistentFlags().Changed("timeout") {
+			builder.HTTPTimeout = max(flagTimeout, 0)
+		} else {
+			builder.HTTPTimeout = builder.DefaultHTTPTimeout()
+		}
+	}
+
 	addBuildFlags(rootCmd)
+	addDryRunFlag(rootCmd)
+	addWatchFlag(rootCmd)
 
 	// qobs build subcommand
 	rootCmd.AddCommand(buildCmd)
 	addBuildFlags(buildCmd)
+	addDryRunFlag(buildCmd)
+	addWatchFlag(buildCmd)
+}
+
+func addDryRunFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&flagDryRun, "dry-run", "n", false, "Print what would be compiled and linked and why, without running anything (qobs generator only)")
 }
 
 func addBuildFlags(cmd *cobra.Command) {
-	cmd.Flags().StringVarP(&flagProfile, "profile", "p", "debug", "Build with the given profile")
-	cmd.Flags().StringSliceVarP(&flagFeatures, "features", "f", []string{}, "Comma separated list of features to activate")
-	cmd.Flags().BoolVar(&flagNoDefaultFeatures, "no-default-features", false, "Disable default features")
+	addPackageFlags(cmd)
 	cmd.Flags().VarP(&flagGenerator, "gen", "g", "Generator to build with, one of "+flagGenerator.HelpString())
 	cmd.RegisterFlagCompletionFunc("gen", flagGenerator.CompletionFunc())
+	cmd.Flags().StringSliceVar(&flagPlatforms, "platform", []string{}, "Comma separated list of platforms to generate for vs2022 (x64, x86, ARM64, ARM), the first one is built")
+	cmd.Flags().BoolVar(&flagNoCache, "no-cache", false, "Don't use the compile cache shared between projects (enabled with "+builder.CompileCacheEnv+"=1)")
+	cmd.Flags().Var(&flagEmit, "emit", "What to compile sources to, one of "+flagEmit.HelpString()+" (qobs generator only)")
+	cmd.RegisterFlagCompletionFunc("emit", flagEmit.CompletionFunc())
+	cmd.Flags().BoolVarP(&flagVerbose, "verbose", "v", false, "Print every compile and link job instead of a progress line")
+	cmd.Flags().Var(&flagMessageFormat, "message-format", "How to report compile and link jobs, one of "+flagMessageFormat.HelpString()+" (qobs generator only)")
+	cmd.RegisterFlagCompletionFunc("message-format", flagMessageFormat.CompletionFunc())
+	cmd.Flags().StringVar(&flagCompileCommands, "compile-commands", "", "Also write compile_commands.json to this file or directory, relative to the target path unless absolute (e.g. \".\" for clangd)")
+	cmd.Flags().BoolVar(&flagTimings, "timings", false, "Print the build time and the slowest translation units after the build (qobs generator only)")
+	cmd.Flags().StringVar(&flagTimingsJSON, "timings-json", "", "Write the time every compile and link job took to this file as JSON (qobs generator only)")
+	cmd.Flags().BoolVar(&flagEmitPlan, "emit-plan", false, "Write every planned target, source, object, flag and dependency to qobs_plan.json in the build directory (qobs generator only)")
+	cmd.Flags().BoolVar(&flagAllowEmpty, "allow-empty", false, "Build packages whose target.sources match no files instead of failing")
+	cmd.Flags().IntVarP(&flagJobs, "jobs", "j", 0, "How many compile and link jobs to run at the same time, 0 for one per CPU (qobs and ninja generators)")
+	cmd.Flags().BoolVarP(&flagKeepGoing, "keep-going", "k", false, "Keep compiling after a source fails to compile and report all failures (qobs generator only)")
+}
+
+// addPackageFlags adds the flags that affect how a package and its dependency graph are resolved
+func addPackageFlags(cmd *cobra.Command) {
+	addPackageFlagsWithProfile(cmd, &flagProfile, "debug")
+}
+
+// addPackageFlagsWithProfile is addPackageFlags with --profile stored in profile and defaulting to
+// defaultProfile. The variable is the command's own, so its default isn't the one of other commands
+func addPackageFlagsWithProfile(cmd *cobra.Command, profile *string, defaultProfile string) {
+	cmd.Flags().StringVarP(profile, "profile", "p", defaultProfile, "Build with the given profile")
+	cmd.Flags().BoolVarP(&flagRelease, "release", "r", false, "Build with the release profile, same as --profile release")
+	addBuildDirFlag(cmd)
+	cmd.Flags().StringSliceVarP(&flagFeatures, "features", "f", []string{}, "Comma separated list of features to activate")
+	cmd.Flags().BoolVar(&flagNoDefaultFeatures, "no-default-features", false, "Disable default features")
+}
+
+func addBuildDirFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&flagBuildDir, "build-dir", "B", builder.DefaultBuildDir, "Build directory, relative to the target path unless absolute")
 }
 
 func Execute() {
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/qobs-build/qobs/internal/msg"
+)
+
+func TestNoColorFlag(t *testing.T) {
+	defer func(noColor bool) { color.NoColor = noColor }(color.NoColor)
+	var buf bytes.Buffer
+	msg.SetOutput(&buf)
+	defer msg.SetOutput(os.Stdout)
+	output := func() string {
+		buf.Reset()
+		msg.Warn("careful")
+		fmt.Fprintf(msg.Output(), "  %s %s\n", color.HiGreenString("Cloning"), "https://example.com/foo.git")
+		return buf.String()
+	}
+
+	color.NoColor = false
+	if out := output(); !strings.Contains(out, "\x1b[") {
+		t.Fatalf("output isn't colored to begin with: %q", out)
+	}
+
+	rootCmd.SetArgs([]string{"--no-color", "help"})
+	rootCmd.SetOut(io.Discard)
+	defer rootCmd.SetArgs(nil)
+	defer rootCmd.SetOut(nil)
+	defer func() { flagNoColor = false }()
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if out := output(); strings.Contains(out, "\x1b[") {
+		t.Errorf("output with --no-color has escape sequences: %q", out)
+	}
+}
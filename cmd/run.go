@@ -1,33 +1,68 @@
-// qobs run [path]
+// qobs run [path] [-- args...]
 package cmd
 
 import (
+	"fmt"
+
 	"github.com/qobs-build/qobs/internal/builder"
 	"github.com/qobs-build/qobs/internal/msg"
 	"github.com/spf13/cobra"
 )
 
-func doRun(cmd *cobra.Command, args []string) {
-	target := "."
-	if len(args) > 0 {
-		target = args[0]
-		args = args[1:] // other arguments will be passed to program
+// splitRunArgs splits the arguments of qobs run into the target path and the arguments after
+// "--", which are passed to the program
+func splitRunArgs(cmd *cobra.Command, args []string) (target string, programArgs []string) {
+	target = "."
+	ownArgs := args
+	if dash := cmd.Flags().ArgsLenAtDash(); dash >= 0 {
+		ownArgs, programArgs = args[:dash], args[dash:]
 	}
-	b, err := builder.NewBuilderInDirectory(target, flagFeatures, !flagNoDefaultFeatures)
+	if len(ownArgs) > 0 {
+		target = ownArgs[0]
+	}
+	return target, programArgs
+}
+
+func doRun(cmd *cobra.Command, args []string) {
+	target, args := splitRunArgs(cmd, args)
+	b, err := builder.NewBuilderInDirectory(target, flagBuildDir, flagFeatures, !flagNoDefaultFeatures)
 	if err != nil {
 		msg.Fatal("%v", err)
 	}
-	if err := b.BuildAndRun(args, flagProfile, flagGenerator.Value()); err != nil {
+	b.SetContext(cmd.Context())
+	if err := b.SetPlatforms(flagPlatforms); err != nil {
+		msg.Fatal("%v", err)
+	}
+	b.SetCompileCache(!flagNoCache)
+	b.SetVerbose(flagVerbose)
+	b.SetKeepGoing(flagKeepGoing)
+	b.SetAllowEmpty(flagAllowEmpty)
+	b.SetCompileCommandsPath(flagCompileCommands)
+	if err := b.BuildAndRun(args, selectedProfile(cmd), flagGenerator.Value()); err != nil {
 		msg.Fatal("%v", err)
 	}
 }
 
 var runCmd = &cobra.Command{
-	Use:   "run [target path]",
+	Use:   "run [target path] [-- program args...]",
 	Short: "Build and run the package",
-	Long:  `Build and run the package. If no target path is given, uses "."`,
-	Args:  cobra.ArbitraryArgs,
-	Run:   doRun,
+	Long: `Build and run the package. If no target path is given, uses "."
+
+Everything after "--" is passed to the program as it is, e.g. "qobs run -- --help".`,
+	Args: checkRunArgs,
+	Run:  doRun,
+}
+
+// checkRunArgs accepts at most a target path before "--", see splitRunArgs
+func checkRunArgs(cmd *cobra.Command, args []string) error {
+	ownArgs := args
+	if dash := cmd.Flags().ArgsLenAtDash(); dash >= 0 {
+		ownArgs = args[:dash]
+	}
+	if len(ownArgs) > 1 {
+		return fmt.Errorf("unexpected arguments %q, pass arguments to the program after \"--\"", ownArgs[1:])
+	}
+	return nil
 }
 
 func init() {
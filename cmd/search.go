@@ -0,0 +1,66 @@
+// qobs search <query>
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/qobs-build/qobs/internal/builder"
+	"github.com/qobs-build/qobs/internal/index"
+	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/spf13/cobra"
+)
+
+var flagSearchLimit int
+
+func doSearch(ctx context.Context, query string) {
+	idx, err := index.GetIndexAnyhow(ctx)
+	if err != nil {
+		msg.Fatal("failed to load global index: %v", err)
+	}
+
+	matches, total := idx.Search(query, flagSearchLimit)
+	for i, m := range matches {
+		entry := m.Entry
+		fmt.Printf("%d. %s", i+1, entry.Name)
+		if entry.License != "" {
+			fmt.Printf(" (%s)", entry.License)
+		}
+		if entry.Description != "" {
+			fmt.Printf(" - %s", entry.Description)
+		}
+		fmt.Printf("\n   %s = %q\n", entry.Name, builder.DependencySource(entry.URL))
+		if len(entry.Versions) > 0 {
+			fmt.Printf("   versions: %s\n", strings.Join(entry.Versions, ", "))
+		}
+	}
+
+	switch {
+	case total == 0:
+		msg.Warn("no matches found for %q", query)
+	case len(matches) < total:
+		msg.Info("showing the best %d of %d matches for %q (use --limit to see more)", len(matches), total, query)
+	default:
+		msg.Info("found %d matches for %q", total, query)
+	}
+}
+
+var searchCmd = &cobra.Command{
+	Use:   "search <query>",
+	Short: "Search the index for packages",
+	Long: `Search the names, descriptions and URLs of the packages in the index, best matches first.
+
+Every word of the query has to match. Names match fuzzily, when the letters of the word appear in
+order, so "jsnp" finds "json-parser"; descriptions and URLs have to contain the word. Each result shows the line to paste into [dependencies] to use the package.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		doSearch(cmd.Context(), strings.Join(args, " "))
+	},
+}
+
+func init() {
+	// qobs search subcommand
+	searchCmd.Flags().IntVarP(&flagSearchLimit, "limit", "n", 20, "Show at most this many results, 0 for all")
+	rootCmd.AddCommand(searchCmd)
+}
@@ -0,0 +1,47 @@
+// qobs test [path]
+package cmd
+
+import (
+	"strings"
+
+	"github.com/qobs-build/qobs/internal/builder"
+	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/spf13/cobra"
+)
+
+var flagTestFilter string
+
+func doTest(cmd *cobra.Command, args []string) {
+	target := "."
+	if len(args) > 0 {
+		target = args[0]
+	}
+	b, err := builder.NewBuilderInDirectory(target, flagBuildDir, flagFeatures, !flagNoDefaultFeatures)
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+	b.SetContext(cmd.Context())
+	failed, err := b.RunTests(selectedProfile(cmd), flagTestFilter)
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+	if len(failed) > 0 {
+		msg.Fatal("%d test(s) failed: %s", len(failed), strings.Join(failed, ", "))
+	}
+	msg.Info("all tests passed")
+}
+
+var testCmd = &cobra.Command{
+	Use:   "test [target path]",
+	Short: "Build and run the package's tests",
+	Long:  `Build and run the tests listed in the [[tests]] section of the package. If no target path is given, uses "."`,
+	Args:  cobra.MaximumNArgs(1),
+	Run:   doTest,
+}
+
+func init() {
+	// qobs test subcommand
+	rootCmd.AddCommand(testCmd)
+	addPackageFlags(testCmd)
+	testCmd.Flags().StringVar(&flagTestFilter, "filter", "", "Only run tests whose name contains this substring")
+}
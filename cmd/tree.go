@@ -0,0 +1,128 @@
+// qobs tree [path]
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/qobs-build/qobs/internal/builder"
+	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagTreeDuplicates   bool
+	flagTreeShowFeatures bool
+)
+
+// treePrinter prints the dependency tree of the resolved packages
+type treePrinter struct {
+	packages map[string]*builder.Package
+	parents  map[string][]string // package name -> names of the packages depending on it
+	printed  map[string]bool     // packages whose dependencies were already printed
+}
+
+func newTreePrinter(packages []*builder.Package) *treePrinter {
+	t := &treePrinter{
+		packages: make(map[string]*builder.Package, len(packages)),
+		parents:  make(map[string][]string),
+		printed:  make(map[string]bool),
+	}
+	for _, pkg := range packages {
+		t.packages[pkg.Name] = pkg
+	}
+	for _, pkg := range packages {
+		for _, dep := range slices.Sorted(maps.Keys(pkg.Config.Dependencies)) {
+			t.parents[dep] = append(t.parents[dep], pkg.Name)
+		}
+	}
+	return t
+}
+
+// describe returns the line printed for pkg
+func (t *treePrinter) describe(pkg *builder.Package) string {
+	var sb strings.Builder
+	sb.WriteString(pkg.Name)
+	if pkg.IsRoot {
+		sb.WriteString(" (root)")
+	} else {
+		sb.WriteString(" " + pkg.Source)
+	}
+	if flagTreeShowFeatures {
+		if features := pkg.Config.EnabledFeatures(); len(features) > 0 {
+			fmt.Fprintf(&sb, " [%s]", strings.Join(features, ", "))
+		}
+	}
+	if parents := t.parents[pkg.Name]; flagTreeDuplicates && len(parents) > 1 {
+		return color.HiYellowString("%s (required by %s)", sb.String(), strings.Join(parents, ", "))
+	}
+	return sb.String()
+}
+
+// print prints pkg and, the first time it's seen, its dependencies below it
+func (t *treePrinter) print(pkg *builder.Package, prefix, branch, indent string) {
+	line := t.describe(pkg)
+	deps := slices.Sorted(maps.Keys(pkg.Config.Dependencies))
+	if t.printed[pkg.Name] && len(deps) > 0 {
+		fmt.Printf("%s%s%s (*)\n", prefix, branch, line)
+		return
+	}
+	fmt.Printf("%s%s%s\n", prefix, branch, line)
+	t.printed[pkg.Name] = true
+
+	for i, depName := range deps {
+		dep, ok := t.packages[depName]
+		if !ok {
+			continue
+		}
+		if i == len(deps)-1 {
+			t.print(dep, prefix+indent, "└── ", "    ")
+		} else {
+			t.print(dep, prefix+indent, "├── ", "│   ")
+		}
+	}
+}
+
+func doTree(cmd *cobra.Command, args []string) {
+	target := "."
+	if len(args) > 0 {
+		target = args[0]
+	}
+	b, err := builder.NewBuilderInDirectory(target, flagBuildDir, flagFeatures, !flagNoDefaultFeatures)
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+	b.SetContext(cmd.Context())
+
+	packages, err := b.ResolveGraph()
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+
+	t := newTreePrinter(packages)
+	for _, pkg := range packages {
+		if pkg.IsRoot {
+			t.print(pkg, "", "", "")
+		}
+	}
+}
+
+var treeCmd = &cobra.Command{
+	Use:   "tree [target path]",
+	Short: "Print the dependency tree",
+	Long: `Resolve the dependency graph without building and print it as a tree, starting at the root package.
+Dependencies whose own dependencies were already printed are marked with (*). If no target path is given, uses "."`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  doTree,
+}
+
+func init() {
+	// qobs tree subcommand
+	rootCmd.AddCommand(treeCmd)
+	addPackageFlags(treeCmd)
+	treeCmd.Flags().BoolVarP(&flagTreeDuplicates, "duplicates", "d", false, "Highlight dependencies required by more than one package")
+	treeCmd.Flags().BoolVarP(&flagTreeShowFeatures, "show-features", "e", false, "Show the features enabled in every package")
+}
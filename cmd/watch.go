@@ -0,0 +1,56 @@
+// qobs build --watch [path]
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/qobs-build/qobs/internal/builder"
+	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/spf13/cobra"
+)
+
+// watch calls build with a builder for the package in target, and again whenever one of the
+// files the build used changes, until ctx is done or the user interrupts it. The builder is
+// created anew every time, so that changes to the manifest are picked up
+func watch(ctx context.Context, target string, build func(b *builder.Builder) error) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	first := true
+	builder.WatchLoop(ctx, func() []string {
+		if !first {
+			fmt.Fprintln(msg.Output(), color.HiCyanString("Rebuilding")+" after changes")
+		}
+		first = false
+
+		b, err := tryNewBuilder(ctx, target)
+		if err != nil {
+			msg.Error("%v", err)
+			return watchedManifest(target)
+		}
+		b.SetWatch(true)
+
+		start := time.Now()
+		if err := build(b); err != nil {
+			msg.Error("%v", err)
+			fmt.Fprintln(msg.Output(), "qobs: build failed, waiting for changes...")
+		} else {
+			fmt.Fprintf(msg.Output(), "qobs: built in %s, waiting for changes...\n", time.Since(start).Round(time.Millisecond))
+		}
+		return b.WatchedFiles()
+	})
+}
+
+// watchedManifest returns what to watch when the manifest in target can't even be parsed
+func watchedManifest(target string) []string {
+	return []string{builder.ManifestPath(target)}
+}
+
+func addWatchFlag(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&flagWatch, "watch", "w", false, "Rebuild whenever a source, header or manifest of the package changes, until interrupted")
+}
@@ -0,0 +1,102 @@
+// qobs why <name> [path]
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/qobs-build/qobs/internal/builder"
+	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/spf13/cobra"
+)
+
+// dependencyPaths returns every path from a root package to the package name, each a list of
+// package names starting at the root. The graph is acyclic, resolving it reports cycles
+func dependencyPaths(packages []*builder.Package, name string) [][]string {
+	byName := make(map[string]*builder.Package, len(packages))
+	for _, pkg := range packages {
+		byName[pkg.Name] = pkg
+	}
+
+	var paths [][]string
+	var walk func(pkg *builder.Package, path []string)
+	walk = func(pkg *builder.Package, path []string) {
+		path = append(path, pkg.Name)
+		if pkg.Name == name {
+			paths = append(paths, slices.Clone(path))
+			return
+		}
+		for _, depName := range slices.Sorted(maps.Keys(pkg.Config.Dependencies)) {
+			if dep, ok := byName[depName]; ok {
+				walk(dep, path)
+			}
+		}
+	}
+	for _, pkg := range packages {
+		if pkg.IsRoot {
+			walk(pkg, nil)
+		}
+	}
+	return paths
+}
+
+// describePath joins a dependency path with arrows, noting the features that enabled optional
+// dependencies along the way
+func describePath(packages map[string]*builder.Package, path []string) string {
+	var sb strings.Builder
+	sb.WriteString(path[0])
+	for i := 1; i < len(path); i++ {
+		sb.WriteString(" -> " + path[i])
+		if features := packages[path[i-1]].Config.FeaturesEnabling(path[i]); len(features) > 0 {
+			fmt.Fprintf(&sb, " (optional, enabled by feature %s of %s)", strings.Join(features, ", "), path[i-1])
+		}
+	}
+	return sb.String()
+}
+
+func doWhy(cmd *cobra.Command, args []string) {
+	name := args[0]
+	target := "."
+	if len(args) > 1 {
+		target = args[1]
+	}
+	b, err := builder.NewBuilderInDirectory(target, flagBuildDir, flagFeatures, !flagNoDefaultFeatures)
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+	b.SetContext(cmd.Context())
+
+	packages, err := b.ResolveGraph()
+	if err != nil {
+		msg.Fatal("%v", err)
+	}
+	paths := dependencyPaths(packages, name)
+	if len(paths) == 0 {
+		msg.Fatal("%q is not in the dependency graph", name)
+	}
+
+	byName := make(map[string]*builder.Package, len(packages))
+	for _, pkg := range packages {
+		byName[pkg.Name] = pkg
+	}
+	for _, path := range paths {
+		fmt.Println(describePath(byName, path))
+	}
+}
+
+var whyCmd = &cobra.Command{
+	Use:   "why <name> [target path]",
+	Short: "Explain why a dependency is in the dependency graph",
+	Long: `Resolve the dependency graph without building and print every path from the root package to the
+named dependency, along with the features that enabled optional dependencies. If no target path is given, uses "."`,
+	Args: cobra.RangeArgs(1, 2),
+	Run:  doWhy,
+}
+
+func init() {
+	// qobs why subcommand
+	rootCmd.AddCommand(whyCmd)
+	addPackageFlags(whyCmd)
+}
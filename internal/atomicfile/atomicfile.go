@@ -0,0 +1,47 @@
+// Package atomicfile writes files through a temporary file that replaces them once it's complete,
+// so that readers and interrupted writes never leave a truncated file behind
+package atomicfile
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Write writes the contents produced by write to path with the permissions perm. They go to a
+// temporary file in the same directory first, which is renamed over path only if write and
+// closing it succeeded, so that path keeps its old contents otherwise
+func Write(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	bufw := bufio.NewWriter(tmp)
+	if err := write(bufw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := bufw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// WriteFile is like os.WriteFile, but path keeps its old contents if writing fails, see Write
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return Write(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
@@ -0,0 +1,54 @@
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteReplaces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(path, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Errorf("contents = %q, want %q", data, "new")
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Mode().Perm() != 0644 {
+		t.Errorf("mode = %v, %v, want 0644", stat.Mode().Perm(), err)
+	}
+}
+
+func TestInterruptedWriteKeepsOldContents(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	interrupted := errors.New("interrupted")
+	err := Write(path, 0644, func(w io.Writer) error {
+		// more than bufio buffers, so that part of it reaches the file before the failure
+		if _, err := w.Write(make([]byte, 64<<10)); err != nil {
+			return err
+		}
+		return interrupted
+	})
+	if !errors.Is(err, interrupted) {
+		t.Fatalf("Write = %v, want the error of the write", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "old" {
+		t.Errorf("contents = %q, want the old ones", data)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary file left behind: %v", entries)
+	}
+}
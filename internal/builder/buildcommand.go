@@ -0,0 +1,214 @@
+package builder
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/qobs-build/qobs/internal/msg"
+)
+
+// BuildCommandPrefix starts the lines of build command output that add flags to the target of its
+// package: qobs:cflags=-DFOO -O3, qobs:ldflags=-lfoo and qobs:define=NAME or qobs:define=NAME=VALUE.
+// Other lines are printed as they are
+const BuildCommandPrefix = "qobs:"
+
+// lookCommand finds the program of a command set in the package in dir. Names with a path are
+// relative to the package, bare names are looked up in PATH
+func lookCommand(name, dir string) (string, error) {
+	if strings.ContainsRune(name, '/') || strings.ContainsRune(name, filepath.Separator) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+	}
+	return exec.LookPath(name)
+}
+
+// RunBuildCommand runs the build command of the package in its directory, before its sources are
+// collected, so that sources it generates are built. env is added to the environment of the command.
+// The flags it prints are returned, see BuildCommandPrefix
+func (p *Package) RunBuildCommand(env []string) (BuildScriptOutput, error) {
+	var output BuildScriptOutput
+	command := p.Config.Package.BuildCommand
+	if len(command) == 0 {
+		return output, nil
+	}
+
+	path, err := lookCommand(command[0], p.Path)
+	if err != nil {
+		return output, fmt.Errorf("build command of package %q not found: %w", p.Name, err)
+	}
+	cmd := exec.Command(path, command[1:]...)
+	cmd.Dir = p.Path
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return output, err
+	}
+	if err := cmd.Start(); err != nil {
+		return output, fmt.Errorf("failed to run the build command of package %q: %w", p.Name, err)
+	}
+
+	var parseErr error
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		directive, ok := strings.CutPrefix(line, BuildCommandPrefix)
+		if !ok {
+			fmt.Fprintln(msg.Output(), line)
+			continue
+		}
+		if err := output.addDirective(directive); err != nil && parseErr == nil {
+			parseErr = err
+		}
+	}
+	// read everything before waiting, even if the output can't be parsed
+	if err := cmd.Wait(); err != nil {
+		return output, fmt.Errorf("build command of package %q failed: %w", p.Name, err)
+	}
+	if err := scanner.Err(); err != nil {
+		return output, fmt.Errorf("failed to read the output of the build command of package %q: %w", p.Name, err)
+	}
+	if parseErr != nil {
+		return output, fmt.Errorf("build command of package %q: %w", p.Name, parseErr)
+	}
+	return output, nil
+}
+
+// buildCommandStamp records a run of a build command, see Builder.runBuildCommand
+type buildCommandStamp struct {
+	Key    string            `json:"key"`
+	Output BuildScriptOutput `json:"output"`
+}
+
+// runBuildCommand runs the build command of p, unless it ran before with the same command line,
+// environment and inputs and its outputs are still there. Then the flags it printed that time are
+// returned without running it, so that rebuilds (and qobs build --watch) don't run it for nothing
+func (b *Builder) runBuildCommand(p *Package, profile string) (BuildScriptOutput, error) {
+	if len(p.Config.Package.BuildCommand) == 0 {
+		return BuildScriptOutput{}, nil
+	}
+	env := b.buildCommandEnv(profile)
+	key, err := b.buildCommandKey(p, env)
+	if err != nil {
+		return BuildScriptOutput{}, fmt.Errorf("build command of package %q: %w", p.Name, err)
+	}
+
+	stampPath := filepath.Join(b.profileBuildDir(profile), "build-commands", p.Name+".json")
+	var stamp buildCommandStamp
+	if data, err := os.ReadFile(stampPath); err == nil && json.Unmarshal(data, &stamp) == nil && stamp.Key == key && b.buildCommandOutputsExist(p) {
+		return stamp.Output, nil
+	}
+
+	output, err := p.RunBuildCommand(env)
+	if err != nil {
+		return output, err
+	}
+	data, err := json.Marshal(buildCommandStamp{Key: key, Output: output})
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(stampPath), 0755); err == nil {
+			err = os.WriteFile(stampPath, data, 0644)
+		}
+	}
+	if err != nil {
+		msg.Warn("failed to record the run of the build command of package %q, it will run again: %v", p.Name, err)
+	}
+	return output, nil
+}
+
+// buildCommandInputs returns the files the build command of p reads: build-command-inputs, or the
+// files of the package named in the command
+func (b *Builder) buildCommandInputs(p *Package) ([]string, error) {
+	if inputs := p.Config.Package.BuildCommandInputs; len(inputs) > 0 {
+		return b.collectFiles(p, inputs, false)
+	}
+	var files []string
+	for _, arg := range p.Config.Package.BuildCommand {
+		path := arg
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(p.Path, path)
+		}
+		if stat, err := os.Stat(path); err == nil && stat.Mode().IsRegular() && isInsideDir(p.Path, path) {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// buildCommandKey identifies a run of the build command of p with env: it changes with the command
+// line, the environment and the contents of its inputs
+func (b *Builder) buildCommandKey(p *Package, env []string) (string, error) {
+	inputs, err := b.buildCommandInputs(p)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, arg := range p.Config.Package.BuildCommand {
+		fmt.Fprintf(h, "arg\n%s\n", arg)
+	}
+	for _, v := range env {
+		fmt.Fprintf(h, "env\n%s\n", v)
+	}
+	for _, input := range inputs {
+		data, err := os.ReadFile(input)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "input\n%s\n%x\n", input, sha256.Sum256(data))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// buildCommandOutputsExist checks that build-command-outputs match files, if it's set
+func (b *Builder) buildCommandOutputsExist(p *Package) bool {
+	if len(p.Config.Package.BuildCommandOutputs) == 0 {
+		return true
+	}
+	files, err := b.collectFiles(p, p.Config.Package.BuildCommandOutputs, false)
+	return err == nil && len(files) > 0
+}
+
+// addDirective adds a qobs: line of build command output without its prefix, e.g. "cflags=-O3"
+func (o *BuildScriptOutput) addDirective(directive string) error {
+	key, value, ok := strings.Cut(directive, "=")
+	if !ok {
+		return fmt.Errorf("expected %skey=value, got %q", BuildCommandPrefix, BuildCommandPrefix+directive)
+	}
+	switch key {
+	case "cflags":
+		o.Cflags = append(o.Cflags, strings.Fields(value)...)
+	case "ldflags":
+		o.Ldflags = append(o.Ldflags, strings.Fields(value)...)
+	case "define":
+		name, v, _ := strings.Cut(value, "=")
+		if name == "" {
+			return fmt.Errorf("%sdefine without a name", BuildCommandPrefix)
+		}
+		if o.Defines == nil {
+			o.Defines = make(map[string]string)
+		}
+		o.Defines[name] = v
+	default:
+		msg.Warn("ignoring unknown build command directive %q, expected cflags, ldflags or define", BuildCommandPrefix+key)
+	}
+	return nil
+}
+
+// add adds the flags and defines of other, whose defines win
+func (o *BuildScriptOutput) add(other BuildScriptOutput) {
+	o.Cflags = append(o.Cflags, other.Cflags...)
+	o.Ldflags = append(o.Ldflags, other.Ldflags...)
+	for name, v := range other.Defines {
+		if o.Defines == nil {
+			o.Defines = make(map[string]string)
+		}
+		o.Defines[name] = v
+	}
+}
@@ -0,0 +1,112 @@
+package builder
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/qobs-build/qobs/internal/msg"
+)
+
+func TestBuildCommandOutputGoesToMessages(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	dir := t.TempDir()
+	script := "echo generating sources\necho qobs:define=FOO=1\n"
+	if err := os.WriteFile(filepath.Join(dir, "gen.sh"), []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var messages bytes.Buffer
+	msg.SetOutput(&messages)
+	defer msg.SetOutput(os.Stdout)
+
+	pkg := &Package{Name: "gen", Path: dir, Config: &Config{}}
+	pkg.Config.Package.BuildCommand = []string{"sh", "gen.sh"}
+	output, err := pkg.RunBuildCommand(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := messages.String(); got != "generating sources\n" {
+		t.Errorf("messages = %q, want the lines that aren't directives", got)
+	}
+	if output.Defines["FOO"] != "1" {
+		t.Errorf("defines = %v, want FOO=1", output.Defines)
+	}
+}
+
+func TestBuildCommandRunsWhenInputsChange(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every run appends to runs.txt
+	write("gen.sh", "echo run >> runs.txt\necho 'int x;' > gen.c\necho qobs:define=GEN=1\n")
+	write("schema.txt", "v1")
+	runs := func() int {
+		data, _ := os.ReadFile(filepath.Join(dir, "runs.txt"))
+		return bytes.Count(data, []byte("run"))
+	}
+
+	b := &Builder{buildDir: filepath.Join(dir, "build")}
+	pkg := &Package{Name: "gen", Path: dir, Config: &Config{}}
+	pkg.Config.Package.BuildCommand = []string{"sh", "gen.sh"}
+	build := func() {
+		t.Helper()
+		output, err := b.runBuildCommand(pkg, "debug")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output.Defines["GEN"] != "1" {
+			t.Errorf("defines = %v, want the ones of the last run", output.Defines)
+		}
+	}
+
+	build()
+	build()
+	if n := runs(); n != 1 {
+		t.Fatalf("ran %d times without changes, want 1", n)
+	}
+	write("gen.sh", "echo run >> runs.txt\necho 'int y;' > gen.c\necho qobs:define=GEN=1\n")
+	build()
+	if n := runs(); n != 2 {
+		t.Fatalf("ran %d times after the script changed, want 2", n)
+	}
+
+	pkg.Config.Package.BuildCommandInputs = []string{"schema.txt"}
+	pkg.Config.Package.BuildCommandOutputs = []string{"gen.c"}
+	build() // the inputs are different
+	build()
+	if n := runs(); n != 3 {
+		t.Fatalf("ran %d times with inputs, want 3", n)
+	}
+	write("schema.txt", "v2")
+	build()
+	if n := runs(); n != 4 {
+		t.Fatalf("ran %d times after an input changed, want 4", n)
+	}
+	if err := os.Remove(filepath.Join(dir, "gen.c")); err != nil {
+		t.Fatal(err)
+	}
+	build()
+	if n := runs(); n != 5 {
+		t.Fatalf("ran %d times after an output was removed, want 5", n)
+	}
+
+	watched := b.watchedFiles(map[string]*Package{"gen": pkg})
+	if slices.Contains(watched, filepath.Join(dir, "gen.c")) {
+		t.Error("the output of the build command is watched")
+	}
+	if !slices.Contains(watched, filepath.Join(dir, "schema.txt")) {
+		t.Error("the input of the build command isn't watched")
+	}
+}
@@ -1,6 +1,9 @@
 package builder
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +13,9 @@ import (
 	"path/filepath"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bmatcuk/doublestar/v4"
 	"github.com/qobs-build/qobs/internal/builder/gen"
@@ -18,7 +23,8 @@ import (
 )
 
 var (
-	errCantRunLib = errors.New("can't run a library target (target.lib is true)")
+	errCantRunLib       = errors.New("can't run a library target (target.kind is not \"exe\")")
+	errCantRunWorkspace = errors.New("can't run a workspace, run one of its members instead")
 )
 
 const (
@@ -27,41 +33,209 @@ const (
 	GeneratorVS2022 = "vs2022"
 )
 
-// Package represents a single component (root package or dependency) in the build graph
+// Package represents a single component (root package, dependency, test or benchmark) in the build graph
 type Package struct {
 	Name   string
 	Path   string
 	Config *Config
+	Source string // dependency source string, empty for the root package and tests
 	IsRoot bool
+	IsTest bool // a test or benchmark of the root package
+
+	pkgConfig *pkgConfigFlags // set for system dependencies resolved with pkg-config
 }
 
-// outputName returns the desired artifact name for this package (e.g., `my_app.exe` or `libmy_lib.a`)
-func (p *Package) outputName() string {
+// outputName returns the desired artifact name for this package when built for targetOS (e.g.,
+// `my_app.exe` or `libmy_lib.a`)
+func (p *Package) outputName(targetOS string) string {
 	pkgName := p.Config.Package.Name
+	if p.Config.Target.Kind == KindSharedLib {
+		switch targetOS {
+		case "windows":
+			return pkgName + ".dll"
+		case "darwin":
+			return "lib" + pkgName + ".dylib"
+		}
+		// the file is named after its soname, the generator links libfoo.so to it
+		if version := p.Config.Package.Version; version != "" {
+			return "lib" + pkgName + ".so." + MajorVersion(version)
+		}
+		return "lib" + pkgName + ".so"
+	}
 	if p.Config.Target.Lib {
-		if runtime.GOOS == "windows" {
+		if targetOS == "windows" {
 			return pkgName + ".lib"
 		}
 		return "lib" + pkgName + ".a"
 	}
-	if runtime.GOOS == "windows" {
+	if targetOS == "windows" {
 		return pkgName + ".exe"
 	}
 	return pkgName
 }
 
+// targetKind returns the generator target kind for this package
+func (p *Package) targetKind() gen.TargetKind {
+	switch p.Config.Target.Kind {
+	case KindStaticLib:
+		return gen.StaticLib
+	case KindSharedLib:
+		return gen.SharedLib
+	}
+	return gen.Executable
+}
+
+// picPackages returns the names of the packages that must be compiled as position independent
+// code: shared libraries and all libraries linked into them
+func picPackages(packages map[string]*Package) map[string]bool {
+	pic := make(map[string]bool)
+	var mark func(name string)
+	mark = func(name string) {
+		pkg, ok := packages[name]
+		if !ok || pic[name] {
+			return
+		}
+		pic[name] = true
+		for depName := range pkg.Config.Dependencies {
+			mark(depName)
+		}
+	}
+	for name, pkg := range packages {
+		if pkg.Config.Target.Kind == KindSharedLib {
+			mark(name)
+		}
+	}
+	return pic
+}
+
+// linkOrder returns pkg and all packages it transitively depends on in reverse topological
+// order, so every package comes before all of its dependencies
+func linkOrder(packages map[string]*Package, pkg *Package) []*Package {
+	var order []*Package
+	visited := make(map[*Package]bool)
+	var visit func(p *Package)
+	visit = func(p *Package) {
+		if visited[p] {
+			return
+		}
+		visited[p] = true
+		for _, depName := range slices.Sorted(maps.Keys(p.Config.Dependencies)) {
+			if dep, ok := packages[depName]; ok {
+				visit(dep)
+			}
+		}
+		order = append(order, p) // post-order: after all dependencies
+	}
+	visit(pkg)
+	slices.Reverse(order)
+	return order
+}
+
+// prebuiltLibs returns the absolute paths of the prebuilt libraries of the package
+func (p *Package) prebuiltLibs() []string {
+	libs := make([]string, 0, len(p.Config.Target.PrebuiltLib))
+	for _, lib := range p.Config.Target.PrebuiltLib {
+		if !filepath.IsAbs(lib) {
+			lib = filepath.Join(p.Path, lib)
+		}
+		libs = append(libs, lib)
+	}
+	return libs
+}
+
+// prebuiltLinkFlags returns the flags linking with the prebuilt libraries of pkg. Shared
+// libraries are also found at runtime through an rpath to their directory
+func prebuiltLinkFlags(pkg *Package) []string {
+	var flags []string
+	for _, lib := range pkg.prebuiltLibs() {
+		flags = append(flags, lib)
+		if runtime.GOOS != "windows" && (strings.HasSuffix(lib, ".so") || strings.Contains(filepath.Base(lib), ".so.") || strings.HasSuffix(lib, ".dylib")) {
+			flags = append(flags, "-Wl,-rpath,"+filepath.Dir(lib))
+		}
+	}
+	return flags
+}
+
+// libDirs returns the absolute library search paths of the package
+func (p *Package) libDirs() []string {
+	dirs := make([]string, 0, len(p.Config.Target.LibDirs))
+	for _, dir := range p.Config.Target.LibDirs {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(p.Path, dir)
+		}
+		dirs = append(dirs, filepath.Clean(dir))
+	}
+	return dirs
+}
+
+// dedupeLinkFlags removes duplicate -l flags and -framework pairs, keeping the last occurrence so
+// that the library still comes after everything that needs it. Other flags are kept as they are
+func dedupeLinkFlags(ldflags []string) []string {
+	// split into units, so that a -framework flag and its name are kept together
+	var units [][]string
+	for i := 0; i < len(ldflags); i++ {
+		if ldflags[i] == "-framework" && i+1 < len(ldflags) {
+			units = append(units, ldflags[i:i+2])
+			i++
+		} else {
+			units = append(units, ldflags[i:i+1])
+		}
+	}
+
+	last := make(map[string]int)
+	for i, unit := range units {
+		if strings.HasPrefix(unit[0], "-l") || len(unit) == 2 {
+			last[strings.Join(unit, " ")] = i
+		}
+	}
+	deduped := make([]string, 0, len(ldflags))
+	for i, unit := range units {
+		if j, ok := last[strings.Join(unit, " ")]; ok && j != i {
+			continue
+		}
+		deduped = append(deduped, unit...)
+	}
+	return deduped
+}
+
 type Builder struct {
-	cfg     *Config
-	basedir string
-	env     ConfigEnv
+	cfg             *Config
+	basedir         string
+	buildDir        string
+	env             ConfigEnv
+	ctx             context.Context
+	defaultFeatures bool
+	members         []*Package // workspace members, if basedir is a workspace root
+	vsPlatforms     []string
+	compileCache    bool
+	verbose         bool
+	keepGoing       bool
+	jobs            int // concurrent jobs, 0 for the default of the generator
+	emit            gen.EmitMode
+	compileCommands string // extra path compile_commands.json is written to, if not empty
+	dryRun          bool
+	watch           bool     // record the files the build depends on
+	watched         []string // files recorded by the last build, see WatchedFiles
+	timings         bool     // print a summary of the slowest jobs
+	timingsJSON     string   // file the job timings are written to, if not empty
+	jsonEvents      bool     // report jobs as JSON, see SetMessageFormat
+	emitPlan        bool     // write the complete build plan to the build directory
+	allowEmpty      bool     // build targets whose sources match no files
 }
 
-func NewBuilderInDirectory(path string, features []string, defaultFeatures bool) (*Builder, error) {
+// DefaultBuildDir is the build directory used when none is given, relative to the package
+const DefaultBuildDir = "build"
+
+// NewBuilderInDirectory creates a builder for the package in path. buildDir may be absolute
+// or relative to path (or to the workspace root, see ResolveBuildDir); if it's empty, DefaultBuildDir
+// is used. If path is a workspace root, the builder builds all of its members
+func NewBuilderInDirectory(path, buildDir string, features []string, defaultFeatures bool) (*Builder, error) {
 	var err error
 	path, err = filepath.Abs(path)
 	if err != nil {
 		return nil, err
 	}
+	buildDir = ResolveBuildDir(path, buildDir)
 
 	featureMap := make(map[string]bool)
 	for _, feature := range features {
@@ -69,129 +243,608 @@ func NewBuilderInDirectory(path string, features []string, defaultFeatures bool)
 	}
 
 	env := NewConfigEnvWithFeatures(path, featureMap)
-	cfg, err := ParseConfigFromFile(filepath.Join(path, "Qobs.toml"), env, defaultFeatures)
+	cfg, err := ParseConfigFromFile(ManifestPath(path), env, defaultFeatures)
 	if err != nil {
 		return nil, err
 	}
-	return &Builder{cfg: cfg, basedir: path, env: env}, nil
+	b := &Builder{cfg: cfg, basedir: path, buildDir: buildDir, env: env, ctx: context.Background(), defaultFeatures: defaultFeatures}
+	if len(cfg.Workspace.Members) > 0 {
+		if err := b.loadWorkspace(); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
 }
 
-func (b *Builder) resolveBuildGraph(rootPath string, depsDir string) (map[string]*Package, error) {
-	packages := make(map[string]*Package)
-	depSpecs := make(map[string]Dependency)
+// ResolveBuildDir resolves buildDir against the package path (not the working directory).
+// Members of a workspace share the build directory of the workspace root
+func ResolveBuildDir(path, buildDir string) string {
+	if root := findWorkspaceRoot(path); root != "" {
+		path = root
+	}
+	if buildDir == "" {
+		buildDir = DefaultBuildDir
+	}
+	if filepath.IsAbs(buildDir) {
+		return filepath.Clean(buildDir)
+	}
+	return filepath.Join(path, buildDir)
+}
 
-	rootPackage := &Package{
-		Name:   b.cfg.Package.Name,
-		Path:   rootPath,
-		Config: b.cfg,
-		IsRoot: true,
+// SetPlatforms sets the platforms generated by the vs2022 generator
+func (b *Builder) SetPlatforms(platforms []string) error {
+	platforms = slices.Clone(platforms)
+	for i, platform := range platforms {
+		if strings.EqualFold(platform, "x86") {
+			platform = "Win32"
+		}
+		found := false
+		for known := range gen.VSPlatforms {
+			if strings.EqualFold(platform, known) {
+				platforms[i], found = known, true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown platform %q, known platforms: %s", platform, strings.Join(slices.Sorted(maps.Keys(gen.VSPlatforms)), ", "))
+		}
 	}
-	packages[rootPackage.Name] = rootPackage
+	b.vsPlatforms = platforms
+	return nil
+}
 
-	// pass 1: resolve dependencies
-	queue := make([]string, 0)
-	for name, dep := range b.cfg.Dependencies {
-		depSpecs[name] = dep
-		queue = append(queue, name)
+const (
+	EmitObjects      = "obj"
+	EmitPreprocessed = "preprocessed"
+	EmitAsm          = "asm"
+)
+
+// SetEmit sets what the qobs generator compiles sources to: object files that are linked (EmitObjects),
+// or preprocessed sources (EmitPreprocessed) or assembly (EmitAsm) next to where the objects would be
+func (b *Builder) SetEmit(emit string) error {
+	switch emit {
+	case EmitObjects, "":
+		b.emit = gen.EmitObjects
+	case EmitPreprocessed:
+		b.emit = gen.EmitPreprocessed
+	case EmitAsm:
+		b.emit = gen.EmitAsm
+	default:
+		return fmt.Errorf("unknown emit mode %q, expected %q, %q or %q", emit, EmitObjects, EmitPreprocessed, EmitAsm)
 	}
+	return nil
+}
 
-	for i := 0; i < len(queue); i++ {
-		depName := queue[i]
-		if _, exists := packages[depName]; exists {
-			continue
-		}
+// SetCompileCommandsPath makes the builder also write compile_commands.json to path, which is
+// resolved against the package directory unless it's absolute. If path is a directory, the file
+// is written into it
+func (b *Builder) SetCompileCommandsPath(path string) {
+	if path != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(b.basedir, path)
+	}
+	b.compileCommands = path
+}
 
-		depSpec, ok := depSpecs[depName]
-		if !ok {
-			return nil, fmt.Errorf("internal error: dependency %q has no section", depName)
-		}
+// SetContext sets the context dependencies and the index are fetched with, canceling it stops
+// a fetch and its retries
+func (b *Builder) SetContext(ctx context.Context) {
+	b.ctx = ctx
+}
 
-		depPath := filepath.Join(depsDir, depName)
+// SetDryRun makes the qobs generator print the compile and link jobs it would run and why,
+// instead of running them
+func (b *Builder) SetDryRun(dryRun bool) {
+	b.dryRun = dryRun
+}
 
-		// fetch dependency if it doesn't exist
-		stat, err := os.Stat(depPath)
-		if os.IsNotExist(err) || !stat.IsDir() {
-			if _, err := fetchDependency(depSpec.Source, b.basedir, &depPath); err != nil {
-				return nil, fmt.Errorf("failed to fetch dependency %q: %w", depName, err)
-			}
-		}
+// SetTimings makes the qobs generator time every job and print the slowest ones after the build
+// if show is set, or write all of them as JSON to jsonPath if it's not empty
+func (b *Builder) SetTimings(show bool, jsonPath string) {
+	b.timings, b.timingsJSON = show, jsonPath
+}
 
-		// parse config with no features
-		env := NewConfigEnv(depPath)
-		depConfig, err := ParseConfigFromFile(filepath.Join(depPath, "Qobs.toml"), env, false)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse initial config for dependency %q: %w", depName, err)
-		}
+// SetEmitPlan makes the qobs generator write the complete build plan, with every target, source,
+// object, flag and dependency, to gen.PlanFile in the build directory
+func (b *Builder) SetEmitPlan(emitPlan bool) {
+	b.emitPlan = emitPlan
+}
 
-		if depConfig.Package.Name != depName {
-			msg.Warn("dependency %q has a mismatched package name: %q", depName, depConfig.Package.Name)
-		}
+const (
+	MessageFormatHuman = "human"
+	MessageFormatJSON  = "json"
+)
 
-		packages[depName] = &Package{
-			Name:   depConfig.Package.Name,
-			Path:   depPath,
-			Config: depConfig,
-		}
+// SetMessageFormat sets how the qobs generator reports its jobs: a progress line or a line per
+// job (MessageFormatHuman), or a JSON object per line for every job that starts and finishes and
+// a summary (MessageFormatJSON)
+func (b *Builder) SetMessageFormat(format string) error {
+	switch format {
+	case MessageFormatHuman, "":
+		b.jsonEvents = false
+	case MessageFormatJSON:
+		b.jsonEvents = true
+	default:
+		return fmt.Errorf("unknown message format %q, expected %q or %q", format, MessageFormatHuman, MessageFormatJSON)
+	}
+	return nil
+}
+
+// SetVerbose makes the qobs generator print every compile and link job instead of a progress line
+func (b *Builder) SetVerbose(verbose bool) {
+	b.verbose = verbose
+}
+
+// SetAllowEmpty makes builds go on with targets whose sources match no files, which are an error
+// otherwise
+func (b *Builder) SetAllowEmpty(allowEmpty bool) {
+	b.allowEmpty = allowEmpty
+}
+
+// SetKeepGoing makes the qobs generator run all compile jobs even if some fail, reporting every
+// failure instead of stopping at the first one
+func (b *Builder) SetKeepGoing(keepGoing bool) {
+	b.keepGoing = keepGoing
+}
+
+// SetJobs sets how many compile and link jobs run at the same time with the qobs and ninja generators.
+// 0 leaves it to the generator, which runs as many as there are CPUs
+func (b *Builder) SetJobs(jobs int) {
+	b.jobs = jobs
+}
 
-		for name, dep := range depConfig.Dependencies {
-			if _, ok := depSpecs[name]; !ok {
+// CompileCacheEnv is the environment variable that opts into the compile cache shared between projects
+const CompileCacheEnv = "QOBS_CACHE"
+
+// SetCompileCache sets whether the qobs generator may use the compile cache shared between projects.
+// The cache is opt-in, it's only used if CompileCacheEnv is set to a value other than "" or "0"
+func (b *Builder) SetCompileCache(enabled bool) {
+	b.compileCache = enabled
+}
+
+// compileCacheDir returns the directory of the compile cache, or "" if it shouldn't be used
+func (b *Builder) compileCacheDir() string {
+	if v := os.Getenv(CompileCacheEnv); !b.compileCache || v == "" || v == "0" {
+		return ""
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		msg.Warn("not using the compile cache: %v", err)
+		return ""
+	}
+	return filepath.Join(cacheDir, "qobs", "objcache")
+}
+
+// ResponseFileEnv is the environment variable that sets the command line length above which the
+// qobs generator passes arguments to the compiler, linker and archiver in a response file
+const ResponseFileEnv = "QOBS_RSP_THRESHOLD"
+
+// responseFileThreshold returns the response file threshold set in ResponseFileEnv, or 0 for the default
+func responseFileThreshold() int {
+	v := os.Getenv(ResponseFileEnv)
+	if v == "" {
+		return 0
+	}
+	threshold, err := strconv.Atoi(v)
+	if err != nil || threshold < 0 {
+		msg.Warn("ignoring %s=%q: expected a non-negative number of characters", ResponseFileEnv, v)
+		return 0
+	}
+	return threshold
+}
+
+// CompilerLauncherEnv is the environment variable that sets the command compiler and linker
+// invocations are prefixed with, overriding target.compiler-launcher
+const CompilerLauncherEnv = "QOBS_COMPILER_LAUNCHER"
+
+// compilerLauncher returns the launcher command of the build split into its arguments, if any
+func (b *Builder) compilerLauncher() []string {
+	if launcher := os.Getenv(CompilerLauncherEnv); launcher != "" {
+		return strings.Fields(launcher)
+	}
+	return strings.Fields(b.cfg.Target.CompilerLauncher)
+}
+
+// archiver returns the archiver command of the build along with its flags: AR and ARFLAGS, or
+// target.ar and target.ar-flags, or the ar matching the cross compiler cc (e.g. aarch64-linux-gnu-ar
+// for aarch64-linux-gnu-gcc) with rcs
+func (b *Builder) archiver(cc []string) ([]string, error) {
+	ar := strings.Fields(os.Getenv("AR"))
+	if len(ar) == 0 {
+		ar = strings.Fields(b.cfg.Target.AR)
+	}
+	if len(ar) == 0 {
+		ar = crossArchiver(cc)
+	}
+	flags := strings.Fields(os.Getenv("ARFLAGS"))
+	if len(flags) == 0 {
+		flags = b.cfg.Target.ARFlags
+	}
+	if len(flags) == 0 {
+		flags = []string{"rcs"}
+	}
+
+	if _, err := exec.LookPath(ar[0]); err != nil {
+		return nil, fmt.Errorf("archiver %q not found, set AR or target.ar: %w", ar[0], err)
+	}
+	return append(ar, flags...), nil
+}
+
+// stripper returns the command that strips the symbols of linked executables and shared libraries,
+// the strip set in STRIP or the one matching the compiler cc, or nil if there's nothing to strip
+// or no strip is found, which is warned about
+func (b *Builder) stripper(cc []string) []string {
+	if DetectCompilerKind(cc) == CompilerMSVC {
+		return nil // debug info is only written to separate PDB files
+	}
+	strip := strings.Fields(os.Getenv("STRIP"))
+	if len(strip) == 0 {
+		strip = []string{crossStrip(cc)}
+	}
+	if _, err := exec.LookPath(strip[0]); err != nil {
+		msg.Warn("not stripping symbols, %q not found (set STRIP): %v", strip[0], err)
+		return nil
+	}
+	// only local and debug symbols, shared libraries still need their exported ones
+	if b.env.TargetOS == "darwin" {
+		return append(strip, "-x")
+	}
+	return append(strip, "--strip-unneeded")
+}
+
+// resolveBuildGraph resolves the dependencies of the root package (or workspace members) and of
+// the extra (test) packages
+func (b *Builder) resolveBuildGraph(depsDir string, extra []*Package) (map[string]*Package, error) {
+	packages := make(map[string]*Package)
+	depSpecs := make(map[string]Dependency)
+	requestedBy := make(map[string]string) // dependency name -> package whose spec is used
+	specKeys := make(map[string]string)    // dependency name -> where the spec that's used points to
+
+	roots := b.rootPackages()
+	isRoot := make(map[string]bool)
+	for _, root := range roots {
+		packages[root.Name] = root
+		isRoot[root.Name] = true
+	}
+	members := make(map[string]string) // directory -> name of the workspace member in it
+	for _, member := range b.members {
+		members[member.Path] = member.Name
+	}
+
+	// pass 1: resolve dependencies
+	queue := make([]string, 0)
+	addDepSpecs := func(requester *Package) error {
+		for _, name := range slices.Sorted(maps.Keys(requester.Config.Dependencies)) {
+			dep := requester.Config.Dependencies[name]
+			key := dep.sourceKey()
+			// the same directory can be reached through different relative paths, e.g. "../common"
+			// from one package and "../../common" from another
+			if kind, location, err := ClassifyDependency(dep.Source); err == nil && kind == SourcePath && !filepath.IsAbs(location) {
+				key = filepath.Join(requester.Path, location)
+			}
+			if prev, ok := depSpecs[name]; !ok {
 				depSpecs[name] = dep
+				requestedBy[name] = requester.Name
+				specKeys[name] = key
+			} else if specKeys[name] != key && !isRoot[name] {
+				// the root package's dependencies override the ones requested by other packages
+				if !isRoot[requestedBy[name]] {
+					return fmt.Errorf("conflicting sources for dependency %q:\n  %q requires %q\n  %q requires %q\nadd %q to the [dependencies] of %q to choose one",
+						name, requestedBy[name], prev.sourceKey(), requester.Name, dep.sourceKey(), name, roots[0].Name)
+				}
+				msg.Warn("%q requires dependency %q from %q, using %q from %q instead",
+					requester.Name, name, dep.sourceKey(), prev.sourceKey(), requestedBy[name])
+			}
+
+			// path dependencies on other workspace members resolve to the member
+			if kind, location, err := ClassifyDependency(dep.Source); err == nil && kind == SourcePath {
+				if !filepath.IsAbs(location) {
+					location = filepath.Join(requester.Path, location)
+				}
+				if member, ok := members[location]; ok && member != name {
+					return fmt.Errorf("%q depends on workspace member %q as %q, use the member's name instead", requester.Name, member, name)
+				}
 			}
 			queue = append(queue, name)
 		}
+		return nil
+	}
+
+	for _, root := range roots {
+		if err := addDepSpecs(root); err != nil {
+			return nil, err
+		}
+	}
+	for _, pkg := range extra {
+		if _, exists := packages[pkg.Name]; exists {
+			return nil, fmt.Errorf("%q is already the name of another package", pkg.Name)
+		}
+		packages[pkg.Name] = pkg
+		if err := addDepSpecs(pkg); err != nil {
+			return nil, err
+		}
 	}
 
-	// pass 2: resolve features
+	// features can enable more (optional or conditional) dependencies, which are resolved
+	// in another round of both passes
+	next := 0
+	// the features and whether default features are on, as each package was last parsed with.
+	// Dependencies are first parsed with neither
 	finalFeatures := make(map[string]map[string]bool)
-	finalFeatures[b.cfg.Package.Name] = b.env.Features
+	finalDefaults := make(map[string]bool)
+	for _, root := range roots {
+		finalFeatures[root.Name] = b.env.Features
+		finalDefaults[root.Name] = b.defaultFeatures
+	}
+	for {
+		for ; next < len(queue); next++ {
+			depName := queue[next]
+			if _, exists := packages[depName]; exists {
+				continue
+			}
 
-	changed := true
-	for changed {
-		changed = false
+			depSpec, ok := depSpecs[depName]
+			if !ok {
+				return nil, fmt.Errorf("internal error: dependency %q has no section", depName)
+			}
 
-		for pkgName, pkg := range packages {
-			if pkg.IsRoot {
+			// system dependencies don't have a config, they only provide flags
+			if depSpec.PkgConfig != "" {
+				flags, err := queryPkgConfig(depSpec.PkgConfig, depSpec.Static)
+				if err != nil {
+					return nil, fmt.Errorf("failed to resolve pkg-config dependency %q: %w", depName, err)
+				}
+				packages[depName] = &Package{
+					Name: depName,
+					Config: &Config{
+						Package: PackageSection{Name: depName},
+						Target:  TargetSection{HeaderOnly: true},
+					},
+					Source:    "pkg-config:" + depSpec.PkgConfig,
+					pkgConfig: flags,
+				}
 				continue
 			}
 
-			requestedFeatures := make(map[string]bool)
-			useDefaultFeatures := false
+			depPath := filepath.Join(depsDir, depName)
 
-			for _, parentPkg := range packages {
-				if dep, isDependency := parentPkg.Config.Dependencies[pkgName]; isDependency {
-					if dep.DefaultFeatures {
-						useDefaultFeatures = true
-					}
-					for _, f := range dep.Features {
-						requestedFeatures[f] = true
-					}
-					if parentPkg.Config.enabledDepFeatures != nil {
-						for _, f := range parentPkg.Config.enabledDepFeatures[pkgName] {
+			if kind, _, err := ClassifyDependency(depSpec.Source); err == nil && kind == SourcePath {
+				// path dependencies are built in place, relative to the package that requires them
+				requester := packages[requestedBy[depName]]
+				if _, err := fetchDependency(b.ctx, depSpec.Source, requester.Path, &depPath); err != nil {
+					return nil, fmt.Errorf("failed to resolve dependency %q: %w", depName, err)
+				}
+				if stat, err := os.Stat(depPath); err != nil || !stat.IsDir() {
+					return nil, fmt.Errorf("path dependency %q not found at %s", depName, depPath)
+				}
+			} else if stat, err := os.Stat(depPath); os.IsNotExist(err) || !stat.IsDir() {
+				// fetch dependency if it doesn't exist
+				if _, err := fetchDependency(b.ctx, depSpec.Source, b.basedir, &depPath); err != nil {
+					return nil, fmt.Errorf("failed to fetch dependency %q: %w", depName, err)
+				}
+			}
+
+			// parse config with no features
+			env := b.packageEnv(depPath, nil)
+			depConfig, err := ParseConfigFromFile(ManifestPath(depPath), env, false)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse initial config for dependency %q: %w", depName, err)
+			}
+
+			if depConfig.Package.Name != depName {
+				msg.Warn("dependency %q has a mismatched package name: %q", depName, depConfig.Package.Name)
+			}
+
+			packages[depName] = &Package{
+				Name:   depConfig.Package.Name,
+				Path:   depPath,
+				Config: depConfig,
+				Source: depSpec.Source,
+			}
+
+			// stop before fetching anything else if the new package closes a cycle
+			if cycle := dependencyCycle(packages, depName); cycle != nil {
+				return nil, fmt.Errorf("circular dependency: %s", strings.Join(cycle, " -> "))
+			}
+			if err := addDepSpecs(packages[depName]); err != nil {
+				return nil, err
+			}
+		}
+
+		// pass 2: resolve features
+		changed := true
+		for changed {
+			changed = false
+
+			for _, pkgName := range slices.Sorted(maps.Keys(packages)) {
+				pkg := packages[pkgName]
+				if pkg.IsTest || pkg.pkgConfig != nil || (pkg.IsRoot && len(b.members) == 0) {
+					continue
+				}
+
+				requestedFeatures := make(map[string]bool)
+				useDefaultFeatures := false
+				if pkg.IsRoot {
+					// workspace members are built with the requested features, plus the ones
+					// requested by the members that depend on them
+					maps.Copy(requestedFeatures, b.env.Features)
+					useDefaultFeatures = b.defaultFeatures
+				}
+
+				// like in cargo, features are additive: default features are on as soon as
+				// a single package depending on this one doesn't disable them
+				for _, parentPkg := range packages {
+					if dep, isDependency := parentPkg.Config.Dependencies[pkgName]; isDependency {
+						if dep.DefaultFeatures {
+							useDefaultFeatures = true
+						}
+						for _, f := range dep.Features {
 							requestedFeatures[f] = true
 						}
+						if parentPkg.Config.enabledDepFeatures != nil {
+							for _, f := range parentPkg.Config.enabledDepFeatures[pkgName] {
+								requestedFeatures[f] = true
+							}
+						}
 					}
 				}
-			}
 
-			if !maps.Equal(finalFeatures[pkgName], requestedFeatures) {
-				changed = true
-				finalFeatures[pkgName] = requestedFeatures
+				if !maps.Equal(finalFeatures[pkgName], requestedFeatures) || finalDefaults[pkgName] != useDefaultFeatures {
+					changed = true
+					finalFeatures[pkgName] = requestedFeatures
+					finalDefaults[pkgName] = useDefaultFeatures
 
-				env := NewConfigEnvWithFeatures(pkg.Path, requestedFeatures)
-				newConfig, err := ParseConfigFromFile(filepath.Join(pkg.Path, "Qobs.toml"), env, useDefaultFeatures)
-				if err != nil {
-					return nil, fmt.Errorf("failed to parse config for package %q: %w", pkgName, err)
+					env := b.packageEnv(pkg.Path, requestedFeatures)
+					newConfig, err := ParseConfigFromFile(ManifestPath(pkg.Path), env, useDefaultFeatures)
+					if err != nil {
+						return nil, fmt.Errorf("failed to parse config for package %q: %w", pkgName, err)
+					}
+					pkg.Config = newConfig
+					if cycle := dependencyCycle(packages, pkgName); cycle != nil {
+						return nil, fmt.Errorf("circular dependency: %s", strings.Join(cycle, " -> "))
+					}
+					if err := addDepSpecs(pkg); err != nil {
+						return nil, err
+					}
 				}
-				pkg.Config = newConfig
 			}
 		}
+
+		if next == len(queue) {
+			break
+		}
 	}
 
 	return packages, nil
 }
 
+// dependencyCycle returns the path of a dependency cycle through the package called name, e.g.
+// [a b a], or nil if there is none. Only dependencies that are already resolved are followed
+func dependencyCycle(packages map[string]*Package, name string) []string {
+	visited := make(map[string]bool)
+	var path []string
+	var visit func(pkgName string) bool
+	visit = func(pkgName string) bool {
+		pkg, ok := packages[pkgName]
+		if !ok {
+			return false
+		}
+		path = append(path, pkgName)
+		for _, dep := range slices.Sorted(maps.Keys(pkg.Config.Dependencies)) {
+			if dep == name {
+				path = append(path, dep)
+				return true
+			}
+			if !visited[dep] {
+				visited[dep] = true
+				if visit(dep) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if visit(name) {
+		return path
+	}
+	return nil
+}
+
+// packageEnv returns the environment that conditions in the manifest of the package in path are
+// evaluated in. It's the one of the root package, so that dependencies are configured for the same
+// target and with the same environment variables, only with their own directory and features
+func (b *Builder) packageEnv(path string, features map[string]bool) ConfigEnv {
+	env := b.env
+	env.basedir = path
+	env.PackageVersion = ""
+	env.Features = features
+	if env.Features == nil {
+		env.Features = make(map[string]bool)
+	}
+	return env
+}
+
+// splitExcludes separates the patterns starting with '!' from the others, without the '!'
+func splitExcludes(patterns []string) (include, exclude []string, err error) {
+	for _, pat := range patterns {
+		if rest, ok := strings.CutPrefix(pat, "!"); ok {
+			if !filepath.IsAbs(rest) && !doublestar.ValidatePattern(filepath.ToSlash(rest)) {
+				return nil, nil, fmt.Errorf("invalid exclude pattern %q", pat)
+			}
+			exclude = append(exclude, rest)
+		} else {
+			include = append(include, pat)
+		}
+	}
+	return include, exclude, nil
+}
+
+// fileFlags returns the flags that target.file-flags of pkg adds to the source at srcPath, from
+// every pattern matching it (relative to the package), in the order of the sorted patterns
+func fileFlags(pkg *Package, srcPath string) ([]string, error) {
+	if len(pkg.Config.Target.FileFlags) == 0 {
+		return nil, nil
+	}
+	pkgPath, _ := filepath.Abs(pkg.Path)
+	srcPath, _ = filepath.Abs(srcPath)
+	rel, err := filepath.Rel(pkgPath, srcPath)
+	if err != nil {
+		return nil, err
+	}
+	var flags []string
+	for _, pattern := range slices.Sorted(maps.Keys(pkg.Config.Target.FileFlags)) {
+		ok, err := doublestar.Match(filepath.ToSlash(pattern), filepath.ToSlash(rel))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in target.file-flags: %w", pattern, err)
+		}
+		if ok {
+			flags = append(flags, pkg.Config.Target.FileFlags[pattern]...)
+		}
+	}
+	return flags, nil
+}
+
+// isExcluded checks if the file at absPath matches one of the exclude patterns of a package in
+// pkgPath. Relative patterns only match files inside the package
+func isExcluded(exclude []string, pkgPath, absPath string) bool {
+	if len(exclude) == 0 {
+		return false
+	}
+	pkgPath, _ = filepath.Abs(pkgPath)
+	absPath, _ = filepath.Abs(absPath)
+	rel, err := filepath.Rel(pkgPath, absPath)
+	inside := err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	for _, pat := range exclude {
+		if filepath.IsAbs(pat) {
+			if ok, _ := doublestar.PathMatch(filepath.Clean(pat), absPath); ok {
+				return true
+			}
+		} else if inside {
+			if ok, _ := doublestar.Match(filepath.ToSlash(pat), filepath.ToSlash(rel)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// collectFiles returns the absolute paths of the files matched by patterns in the directory of
+// pkg, or the directories containing them if stripFilename is set. Patterns starting with '!'
+// exclude files matched by the others, wherever they are in the list
 func (b *Builder) collectFiles(pkg *Package, patterns []string, stripFilename bool) ([]string, error) {
+	patterns, exclude, err := splitExcludes(patterns)
+	if err != nil {
+		return nil, err
+	}
+
 	var files []string
+	seen := make(map[string]bool) // overlapping patterns match some files more than once
+	addFile := func(file string) {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
 	var stripmap map[string]struct{}
 	if stripFilename {
 		stripmap = map[string]struct{}{}
@@ -205,18 +858,24 @@ func (b *Builder) collectFiles(pkg *Package, patterns []string, stripFilename bo
 
 	for _, pat := range patterns {
 		if filepath.IsAbs(pat) {
-			files = append(files, filepath.Clean(pat))
+			if !isExcluded(exclude, pkg.Path, filepath.Clean(pat)) {
+				addFile(filepath.Clean(pat))
+			}
 			continue
 		}
 		matches, err := doublestar.Glob(fsys, pat, globparams...)
 		if err != nil {
 			return nil, err
 		}
+		slices.Sort(matches) // the order of glob matches isn't guaranteed, builds should be stable
 		for _, match := range matches {
 			absPath, err := filepath.Abs(filepath.Join(pkg.Path, match))
 			if err != nil {
 				return nil, fmt.Errorf("while globbing directory %s: %w", match, err)
 			}
+			if isExcluded(exclude, pkg.Path, absPath) {
+				continue
+			}
 			if stripFilename {
 				if stat, err := os.Stat(absPath); err == nil && !stat.IsDir() {
 					stripmap[filepath.Dir(filepath.Clean(absPath))] = struct{}{} // this is a file, we need directories
@@ -224,54 +883,171 @@ func (b *Builder) collectFiles(pkg *Package, patterns []string, stripFilename bo
 					stripmap[absPath] = struct{}{}
 				}
 			} else {
-				files = append(files, filepath.Clean(absPath))
+				addFile(filepath.Clean(absPath))
 			}
 		}
 	}
 
 	if stripFilename {
-		for dir := range stripmap {
-			files = append(files, dir)
+		for _, dir := range slices.Sorted(maps.Keys(stripmap)) {
+			addFile(dir)
 		}
 	}
 
 	return files, nil
 }
 
-func createGenerator(generator string) gen.Generator {
+// osSuffixes are the suffixes that make a source file specific to a target OS, e.g. poll.linux.c,
+// mapped to the target_os they stand for
+var osSuffixes = map[string]string{
+	"aix": "aix", "android": "android", "darwin": "darwin", "dragonfly": "dragonfly",
+	"freebsd": "freebsd", "illumos": "illumos", "ios": "ios", "linux": "linux", "netbsd": "netbsd",
+	"openbsd": "openbsd", "solaris": "solaris", "windows": "windows",
+	"macos": "darwin", "win32": "windows",
+}
+
+// sourceOS returns the target OS a source is specific to and the generic source it replaces on
+// that OS, e.g. "linux" and "dir/poll.c" for "dir/poll.linux.c", or "" if it's not specific to one
+func sourceOS(path string) (targetOS, generic string) {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	suffix := filepath.Ext(stem)
+	targetOS, ok := osSuffixes[strings.TrimPrefix(suffix, ".")]
+	if !ok {
+		return "", ""
+	}
+	return targetOS, strings.TrimSuffix(stem, suffix) + ext
+}
+
+// platformSources drops the sources specific to another OS than targetOS, see sourceOS, and the
+// generic sources that a source specific to targetOS in the same directory replaces
+func platformSources(sources []string, targetOS string) []string {
+	replaced := make(map[string]bool)
+	for _, src := range sources {
+		if srcOS, generic := sourceOS(src); srcOS == targetOS {
+			replaced[generic] = true
+		}
+	}
+	return slices.DeleteFunc(sources, func(src string) bool {
+		srcOS, _ := sourceOS(src)
+		return replaced[src] || (srcOS != "" && srcOS != targetOS)
+	})
+}
+
+// targetSources returns the absolute paths of the sources of pkg that are compiled for the target OS
+func (b *Builder) targetSources(pkg *Package) ([]string, error) {
+	sources, err := b.collectFiles(pkg, pkg.Config.Target.Sources, false)
+	if err != nil {
+		return nil, err
+	}
+	return platformSources(sources, b.env.TargetOS), nil
+}
+
+// includeDirs returns the include directories of pkg: the directories of its headers, followed
+// by its include-dirs resolved against the package directory
+func (b *Builder) includeDirs(pkg *Package) ([]string, error) {
+	dirs, err := b.collectFiles(pkg, pkg.Config.Target.Headers, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range pkg.Config.Target.IncludeDirs {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(pkg.Path, dir)
+		}
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// createGenerator creates the generator for building profile in its build directory
+func (b *Builder) createGenerator(generator, profile string) gen.Generator {
+	buildDir := b.profileBuildDir(profile)
 	switch generator {
 	case GeneratorNinja:
-		return &gen.NinjaGen{}
+		g := gen.NewNinjaGen()
+		g.SetJobs(b.jobs)
+		return g
 	case GeneratorQobs:
-		return gen.NewQobsBuilder()
+		g := gen.NewQobsBuilder()
+		g.SetJobs(b.jobs)
+		g.SetCacheDir(b.compileCacheDir())
+		g.SetVerbose(b.verbose)
+		g.SetKeepGoing(b.keepGoing)
+		g.SetEmit(b.emit)
+		g.SetDryRun(b.dryRun)
+		g.SetTimings(b.timings, b.timingsJSON)
+		g.SetJSONEvents(b.jsonEvents)
+		g.SetEmitPlan(b.emitPlan)
+		g.SetResponseFileThreshold(responseFileThreshold())
+		return g
 	case GeneratorVS2022:
-		return gen.NewVS2022Gen()
+		g := gen.NewVS2022Gen(buildDir, b.vsPlatforms)
+		g.SetSolutionName(b.cfg.Package.Name)
+		// profiles that don't emit debug info build the configuration that optimizes
+		if !b.cfg.Profile[profile].Debug {
+			g.SetConfiguration("Release")
+		}
+		return g
 	default:
 		panic("createGenerator: unreachable")
 	}
 }
 
 func (b *Builder) makeCflags(profile string) ([]string, error) {
+	if profile == "_deps" {
+		return nil, errors.New("profile name \"_deps\" is reserved")
+	}
 	if prof, ok := b.cfg.Profile[profile]; ok {
 		var cflags []string
 		optLevel := prof.OptLevel.String()
 		if optLevel != "" {
 			cflags = append(cflags, "-O"+optLevel)
 		}
-		return cflags, nil
+		if prof.Debug {
+			cflags = append(cflags, "-g")
+		}
+		if prof.LTO {
+			cflags = append(cflags, "-flto")
+		}
+		// sorted so that generated build files are stable between runs
+		for _, define := range slices.Sorted(maps.Keys(prof.Defines)) {
+			if v := prof.Defines[define]; v != "" {
+				cflags = append(cflags, "-D"+define+"="+v)
+			} else {
+				cflags = append(cflags, "-D"+define)
+			}
+		}
+		return append(cflags, prof.Cflags...), nil
 	}
 	return nil, fmt.Errorf("unknown profile %q, known profiles: %s", profile, strings.Join(b.cfg.Profiles(), ", "))
 }
 
-func isCxx(path string) bool {
-	ext := filepath.Ext(filepath.Base(path))
-	return ext == ".cpp" || ext == ".cc" || ext == ".c++" || ext == ".cxx"
+// makeLdflags returns the linker flags implied by a profile that makeCflags accepted
+func (b *Builder) makeLdflags(profile string) []string {
+	if b.cfg.Profile[profile].LTO {
+		return []string{"-flto"}
+	}
+	return nil
 }
 
+// getObjectPath returns the object file of a source, relative to the build directory. Sources
+// outside of the package are placed in a directory named after a hash of their directory, so
+// that sources with the same name from different directories don't share an object
 func getObjectPath(pkgName, pkgPath, srcPath string) (string, error) {
 	rel, err := filepath.Rel(pkgPath, srcPath)
-	if err != nil {
-		rel = filepath.Base(srcPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		abs, err := filepath.Abs(srcPath)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256([]byte(filepath.ToSlash(filepath.Dir(abs))))
+		rel = filepath.Join("_external", hex.EncodeToString(sum[:8]), filepath.Base(abs))
 	}
 	return filepath.ToSlash(filepath.Join("QobsFiles", pkgName+".dir", rel+".obj")), nil
 }
@@ -283,12 +1059,57 @@ type jsonCompileCommand struct {
 	Output    string   `json:"output"`
 }
 
+// profileBuildDir returns the directory that artifacts and build state of a profile are placed in
+func (b *Builder) profileBuildDir(profile string) string {
+	return filepath.Join(b.buildDir, profile)
+}
+
 // Build resolves the entire dependency graph and then invokes the generator (or builder)
 func (b *Builder) Build(profile, generator string) error {
-	buildDir := filepath.Join(b.basedir, "build")
-	depsDir := filepath.Join(buildDir, "_deps")
-	if err := os.MkdirAll(depsDir, 0755); err != nil {
-		return err
+	return b.build(profile, generator, nil)
+}
+
+// depsDir returns the directory dependencies are fetched to, shared between all profiles
+func (b *Builder) depsDir() string {
+	return filepath.Join(b.buildDir, "_deps")
+}
+
+// setPch precompiles header, relative to pkg, for target, the target of pkg, if the generator can
+func setPch(g gen.Generator, generator string, pkg *Package, target, header string) error {
+	if !filepath.IsAbs(header) {
+		header = filepath.Join(pkg.Path, header)
+	}
+	if _, err := os.Stat(header); err != nil {
+		return fmt.Errorf("precompiled header of %q not found: %w", pkg.Name, err)
+	}
+	pg, ok := g.(gen.PrecompiledHeaders)
+	if !ok {
+		msg.Warn("package %q: ignoring target.pch, the %s generator doesn't precompile headers", pkg.Name, generator)
+		return nil
+	}
+	pg.SetPch(target, header)
+	return nil
+}
+
+// build builds the root package along with the extra (test) packages
+func (b *Builder) build(profile, generator string, extra []*Package) error {
+	if b.emit != gen.EmitObjects && generator != GeneratorQobs {
+		return fmt.Errorf("emitting preprocessed sources or assembly is only supported by the %s generator", GeneratorQobs)
+	}
+	if b.dryRun && generator != GeneratorQobs {
+		return fmt.Errorf("dry-run unsupported by the %s generator", generator)
+	}
+	if b.dryRun && b.emit != gen.EmitObjects {
+		return errors.New("dry-run unsupported with --emit")
+	}
+	if (b.timings || b.timingsJSON != "") && generator != GeneratorQobs {
+		msg.Warn("ignoring --timings, the %s generator doesn't time its jobs", generator)
+	}
+	if b.emitPlan && generator != GeneratorQobs {
+		msg.Warn("ignoring --emit-plan, the %s generator writes its own build file", generator)
+	}
+	if b.jsonEvents && generator != GeneratorQobs {
+		msg.Warn("ignoring --message-format json, the %s generator reports its own progress", generator)
 	}
 
 	globalCflags, err := b.makeCflags(profile)
@@ -296,65 +1117,158 @@ func (b *Builder) Build(profile, generator string) error {
 		return err
 	}
 
+	// each profile gets its own build directory so that switching profiles stays incremental,
+	// dependency sources are shared between all profiles
+	buildDir := b.profileBuildDir(profile)
+	depsDir := b.depsDir()
+	if err := os.MkdirAll(depsDir, 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(buildDir, 0755); err != nil {
+		return err
+	}
+
 	// resolve buildgraph
-	packages, err := b.resolveBuildGraph(b.basedir, depsDir)
+	packages, err := b.resolveBuildGraph(depsDir, extra)
 	if err != nil {
 		return fmt.Errorf("failed to resolve dependency graph: %w", err)
 	}
+	if b.watch {
+		b.watched = b.watchedFiles(packages)
+	}
 
-	g := createGenerator(generator)
+	g := b.createGenerator(generator, profile)
 	var rootPkg *Package
 	var compileCommands []jsonCompileCommand
 
-	cc := findCompiler(false)
-	cxx := findCompiler(true)
+	env, cc, cxx := b.compilerEnv(generator, findCompiler(false), findCompiler(true))
+	cc, cxx = zigCrossCompiler(cc, b.env), zigCrossCompiler(cxx, b.env)
 	g.SetCompiler(cc, cxx)
+	g.SetEnv(env)
+	if launcher := b.compilerLauncher(); len(launcher) > 0 {
+		if generator == GeneratorVS2022 {
+			msg.Warn("ignoring compiler launcher %q, the vs2022 generator doesn't support launchers", strings.Join(launcher, " "))
+		}
+		g.SetLauncher(launcher)
+	}
+	if generator != GeneratorVS2022 && slices.ContainsFunc(slices.Collect(maps.Values(packages)), func(pkg *Package) bool {
+		return pkg.Config.Target.builds() && pkg.targetKind() == gen.StaticLib
+	}) {
+		archiver, err := b.archiver(cc)
+		if err != nil {
+			return err
+		}
+		g.SetArchiver(archiver)
+	}
+	if b.cfg.Profile[profile].Strip {
+		if qg, ok := g.(*gen.QobsBuilder); ok {
+			qg.SetStrip(b.stripper(cc))
+		} else {
+			msg.Warn("ignoring profile.%s.strip, the %s generator doesn't strip symbols", profile, generator)
+		}
+	}
+
+	pic := picPackages(packages)
+
+	// build commands and scripts run before any target is added: they may generate sources, and
+	// dependents link with the libraries that the ones of their dependencies add
+	scripts := make(map[string]BuildScriptOutput, len(packages))
+	for _, name := range slices.Sorted(maps.Keys(packages)) {
+		pkg := packages[name]
+		var commandOutput BuildScriptOutput
+		if b.dryRun && len(pkg.Config.Package.BuildCommand) > 0 {
+			msg.Info("would run the build command of package %q: %s", pkg.Name, strings.Join(pkg.Config.Package.BuildCommand, " "))
+		} else if commandOutput, err = b.runBuildCommand(pkg, profile); err != nil {
+			return err
+		}
+		script, err := pkg.Config.RunBuildScript(b.env)
+		if err != nil {
+			return err
+		}
+		script.add(commandOutput)
+		scripts[name] = script
+	}
 
-	// add targets
-	for _, pkg := range packages {
+	// add targets, sorted so that generated build files and compile_commands.json are stable
+	for _, name := range slices.Sorted(maps.Keys(packages)) {
+		pkg := packages[name]
 		if pkg.IsRoot {
 			rootPkg = pkg
 		}
 
+		targetCC := zigCrossCompiler(compilerCommand(pkg.Config.Target.CC), b.env)
+		targetCXX := zigCrossCompiler(compilerCommand(pkg.Config.Target.CXX), b.env)
+		pkgCC, pkgCXX := cc, cxx
+		if len(targetCC) > 0 {
+			pkgCC = targetCC
+		}
+		if len(targetCXX) > 0 {
+			pkgCXX = targetCXX
+		}
+		if generator == GeneratorVS2022 && (pkg.Config.Target.CC != "" || pkg.Config.Target.CXX != "") {
+			msg.Warn("package %q: ignoring target.cc and target.cxx, the vs2022 generator always uses MSVC", pkg.Name)
+		}
+		if len(pkg.Config.Target.Frameworks) > 0 && b.env.TargetOS != "darwin" {
+			msg.Warn("package %q: ignoring target.frameworks, frameworks are only linked on macOS", pkg.Name)
+		}
+
 		// collect files for the package
-		sources, err := b.collectFiles(pkg, pkg.Config.Target.Sources, false)
+		sources, err := b.targetSources(pkg)
 		if err != nil {
 			return fmt.Errorf("failed to collect sources for %s: %w", pkg.Name, err)
 		}
+		if len(sources) == 0 && pkg.Config.Target.builds() && !b.allowEmpty {
+			return fmt.Errorf("package %q has no sources: target.sources %q matches no files (use --allow-empty to build it anyway)", pkg.Name, pkg.Config.Target.Sources)
+		}
+		if generator != GeneratorVS2022 && pkg.Config.Target.builds() {
+			if err := checkCompilers(pkgCC, pkgCXX, sources); err != nil {
+				return fmt.Errorf("package %q: %w", pkg.Name, err)
+			}
+		}
 
 		// collect own headers
-		ownHeaders, err := b.collectFiles(pkg, pkg.Config.Target.Headers, true)
+		ownHeaders, err := b.includeDirs(pkg)
 		if err != nil {
 			return fmt.Errorf("failed to collect headers for %s: %w", pkg.Name, err)
 		}
 
 		// determine the outputs of its dependencies
-		var depOutputs []string
+		var depOutputs, wholeArchive []string
 		cflags := slices.Clone(globalCflags)
 
 		cflags = append(cflags, pkg.Config.Target.Cflags...)
+		if pic[pkg.Name] && b.env.TargetOS != "windows" {
+			cflags = append(cflags, "-fPIC")
+		}
 
 		// add own include paths to cflags
 		for _, includePath := range ownHeaders {
 			cflags = append(cflags, "-I"+includePath)
 		}
+		if headers := pkg.Config.Target.ForceInclude; len(headers) > 0 {
+			msvc := generator == GeneratorVS2022 || DetectCompilerKind(pkgCC) == CompilerMSVC
+			cflags = append(cflags, forceIncludeFlags(pkg.Path, headers, msvc)...)
+		}
 
-		for depName := range pkg.Config.Dependencies {
+		for _, depName := range slices.Sorted(maps.Keys(pkg.Config.Dependencies)) {
 			dep, ok := packages[depName]
 			if !ok {
 				return fmt.Errorf("internal error: resolved dependency %q not found in package map", depName)
 			}
 
-			depHeaders, err := b.collectFiles(dep, dep.Config.Target.Headers, true)
+			depHeaders, err := b.includeDirs(dep)
 			if err != nil {
 				return fmt.Errorf("failed to collect headers for dependency %q: %w", dep.Name, err)
 			}
 			for _, includePath := range depHeaders {
 				cflags = append(cflags, "-I"+includePath)
 			}
+			if dep.pkgConfig != nil {
+				cflags = append(cflags, dep.pkgConfig.cflags...)
+			}
 
-			// don't produce link artifacts for header-only deps
-			if dep.Config.Target.HeaderOnly {
+			// header-only and prebuilt deps have no link artifacts that are built
+			if !dep.Config.Target.builds() {
 				continue
 			}
 
@@ -362,55 +1276,76 @@ func (b *Builder) Build(profile, generator string) error {
 				return fmt.Errorf("package %q depends on %q, which is not a library (target.lib = false)", pkg.Name, dep.Name)
 			}
 
-			depOutputs = append(depOutputs, dep.outputName())
+			depOutputs = append(depOutputs, dep.outputName(b.env.TargetOS))
+			if pkg.Config.Dependencies[depName].WholeArchive {
+				wholeArchive = append(wholeArchive, dep.outputName(b.env.TargetOS))
+			}
 		}
 
-		// build ldflags
-		var ldflags []string
-
-		seen := make(map[string]bool)
-		var collectLinks func(string)
-		collectLinks = func(name string) {
-			if seen[name] {
-				return
-			}
-			seen[name] = true
-			dep, ok := packages[name]
-			if !ok {
-				return
+		// the build script and command can add flags and defines of their own
+		script := scripts[pkg.Name]
+
+		// build ldflags: the library search paths of every linked package, which dependents
+		// inherit like include dirs, then the libraries and frameworks. Packages are visited
+		// dependents first so that every library comes after the ones that use it, which is
+		// the order ld resolves archives in
+		ldflags := b.makeLdflags(profile)
+		for _, linked := range linkOrder(packages, pkg) {
+			for _, dir := range linked.libDirs() {
+				if !slices.Contains(ldflags, "-L"+dir) {
+					ldflags = append(ldflags, "-L"+dir)
+				}
 			}
-			for _, lib := range dep.Config.Target.Links {
+		}
+		for _, linked := range linkOrder(packages, pkg) {
+			for _, lib := range linked.Config.Target.LinksFor(b.env.TargetOS) {
 				ldflags = append(ldflags, "-l"+lib)
 			}
-			for child := range dep.Config.Dependencies {
-				collectLinks(child)
+			ldflags = append(ldflags, linked.Config.Target.FrameworkFlags(b.env.TargetOS)...)
+			if linked.pkgConfig != nil {
+				ldflags = append(ldflags, linked.pkgConfig.libs...)
+			}
+			if linked != pkg {
+				ldflags = append(ldflags, prebuiltLinkFlags(linked)...)
+				// like links, so that the libraries a static library needs reach what links it
+				ldflags = append(ldflags, scripts[linked.Name].Ldflags...)
 			}
 		}
-
-		for depName := range pkg.Config.Dependencies {
-			collectLinks(depName)
-		}
-
-		for define, v := range pkg.Config.Target.Defines {
+		ldflags = dedupeLinkFlags(append(ldflags, script.Ldflags...))
+
+		// sorted so that generated build files are stable between runs
+		defines := make(map[string]string)
+		maps.Copy(defines, pkg.Config.Target.Defines)
+		maps.Copy(defines, script.Defines)
+		// the flags are arguments as they are, each generator escapes them for what it runs them with
+		for _, define := range slices.Sorted(maps.Keys(defines)) {
+			v := defines[define]
 			if v != "" {
-				cflags = append(cflags, "-D"+define+"="+v) // TODO: escape this?
+				cflags = append(cflags, "-D"+define+"="+v)
 			} else {
 				cflags = append(cflags, "-D"+define)
 			}
 		}
+		cflags = append(cflags, script.Cflags...)
 
-		for _, lib := range pkg.Config.Target.Links {
-			ldflags = append(ldflags, "-l"+lib)
+		// the Visual Studio generator turns -std= into project settings itself
+		cKind, cxxKind := CompilerUnknown, CompilerUnknown
+		if generator != GeneratorVS2022 {
+			cKind, cxxKind = DetectCompilerKind(pkgCC), DetectCompilerKind(pkgCXX)
 		}
-
-		if err := pkg.Config.RunBuildScript(b.env); err != nil {
-			return err
+		cStdFlag, err := stdFlag(pkg.Config.Target.CStd, false, cKind)
+		if err != nil {
+			return fmt.Errorf("package %q: %w", pkg.Name, err)
+		}
+		cxxStdFlag, err := stdFlag(pkg.Config.Target.CxxStd, true, cxxKind)
+		if err != nil {
+			return fmt.Errorf("package %q: %w", pkg.Name, err)
 		}
 
 		targetSources := make([]gen.SourceFile, 0, len(sources))
 
 		for _, srcPath := range sources {
-			objPath, err := getObjectPath(pkg.outputName(), pkg.Path, srcPath)
+			objPath, err := getObjectPath(pkg.outputName(b.env.TargetOS), pkg.Path, srcPath)
 			if err != nil {
 				msg.Warn("could not determine object path for %q: %v", srcPath, err)
 				continue
@@ -418,20 +1353,41 @@ func (b *Builder) Build(profile, generator string) error {
 
 			absoluteObjPath := filepath.Join(buildDir, objPath)
 
-			isCxxSource := isCxx(srcPath)
+			lang := gen.SourceLanguage(srcPath)
+			isCxxSource := lang == gen.LangCxx
+			if lang == gen.LangAsm && (generator == GeneratorVS2022 || DetectCompilerKind(pkgCC) == CompilerMSVC) {
+				return fmt.Errorf("package %q: can't assemble %s with MSVC, which doesn't support GNU assembly", pkg.Name, srcPath)
+			}
+
+			msvc := generator == GeneratorVS2022 || DetectCompilerKind(pkgCXX) == CompilerMSVC
+			srcCflags := gen.LanguageFlags(srcPath, lang, msvc)
+			// language standards only apply to sources of that language
+			if lang == gen.LangCxx && cxxStdFlag != "" {
+				srcCflags = append(srcCflags, cxxStdFlag)
+			} else if lang == gen.LangC && cStdFlag != "" {
+				srcCflags = append(srcCflags, cStdFlag)
+			}
+			fileFlags, err := fileFlags(pkg, srcPath)
+			if err != nil {
+				return fmt.Errorf("package %q: %w", pkg.Name, err)
+			}
+			srcCflags = append(srcCflags, fileFlags...)
+
 			targetSources = append(targetSources, gen.SourceFile{
-				Src:   srcPath,
-				Obj:   objPath,
-				IsCxx: isCxxSource,
+				Src:    srcPath,
+				Obj:    objPath,
+				Lang:   lang,
+				Cflags: srcCflags,
 			})
 
-			compiler := cc
+			compiler := pkgCC
 			if isCxxSource {
-				compiler = cxx
+				compiler = pkgCXX
 			}
 
-			args := []string{compiler}
+			args := slices.Clone(compiler)
 			args = append(args, cflags...)
+			args = append(args, srcCflags...)
 			args = append(args, "-c", srcPath, "-o", absoluteObjPath)
 
 			compileCommands = append(compileCommands, jsonCompileCommand{
@@ -442,16 +1398,36 @@ func (b *Builder) Build(profile, generator string) error {
 			})
 		}
 
-		if !pkg.Config.Target.HeaderOnly {
+		if pkg.Config.Target.IsPrebuilt() {
+			for _, lib := range pkg.prebuiltLibs() {
+				if _, err := os.Stat(lib); err != nil {
+					return fmt.Errorf("prebuilt library of %q not found: %w", pkg.Name, err)
+				}
+			}
+		}
+		if pkg.Config.Target.builds() {
+			resource, err := b.addVersionResource(g, pkg, buildDir, pkgCC, env)
+			if err != nil {
+				return err
+			}
+			ldflags = append(ldflags, resource...)
 			g.AddTarget(
-				pkg.outputName(),
+				pkg.outputName(b.env.TargetOS),
 				pkg.Path,
 				targetSources,
 				depOutputs,
-				pkg.Config.Target.Lib,
+				wholeArchive,
+				pkg.targetKind(),
+				targetCC,
+				targetCXX,
 				cflags,
 				ldflags,
 			)
+			if header := pkg.Config.Target.Pch; header != "" {
+				if err := setPch(g, generator, pkg, pkg.outputName(b.env.TargetOS), header); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
@@ -459,12 +1435,20 @@ func (b *Builder) Build(profile, generator string) error {
 		return errors.New("internal error: root package not found after graph resolution")
 	}
 
-	out := g.Generate()
+	out, err := g.Generate()
+	if err != nil {
+		return err
+	}
 	if out != "" {
 		buildFile := filepath.Join(buildDir, g.BuildFile())
 		if err = os.WriteFile(buildFile, []byte(out), 0644); err != nil {
 			return err
 		}
+		if err := b.runPostGenerateHook(buildDir, buildFile); err != nil {
+			return err
+		}
+	} else if len(b.cfg.Package.PostGenerate) > 0 {
+		msg.Warn("ignoring package.post-generate: the %s generator doesn't produce a build file", generator)
 	}
 
 	if len(compileCommands) > 0 {
@@ -476,32 +1460,97 @@ func (b *Builder) Build(profile, generator string) error {
 		if err := os.WriteFile(ccPath, jsonData, 0644); err != nil {
 			return fmt.Errorf("failed to write compile_commands.json: %w", err)
 		}
+		if ccPath := b.compileCommands; ccPath != "" {
+			if stat, err := os.Stat(ccPath); err == nil && stat.IsDir() {
+				ccPath = filepath.Join(ccPath, "compile_commands.json")
+			}
+			if err := os.WriteFile(ccPath, jsonData, 0644); err != nil {
+				return fmt.Errorf("failed to write compile_commands.json: %w", err)
+			}
+		}
 	}
 
-	if err := g.Invoke(buildDir); err != nil {
-		return err
+	err = g.Invoke(buildDir)
+	if s, ok := g.(gen.Summarizer); ok && !b.jsonEvents {
+		if summary, ran := s.Summary(); ran {
+			printBuildSummary(summary, err == nil)
+		}
 	}
+	return err
+}
 
-	return nil
+// printBuildSummary prints how many jobs a build ran, after its last job
+func printBuildSummary(summary gen.BuildSummary, success bool) {
+	duration := summary.Duration.Round(time.Millisecond)
+	if duration > time.Second {
+		duration = duration.Round(10 * time.Millisecond)
+	}
+	counts := fmt.Sprintf("%d compiled, %d up-to-date, %d linked", summary.Compiled, summary.UpToDate, summary.Linked)
+	if success {
+		msg.Done("%s in %s", counts, duration)
+		return
+	}
+	msg.Error("build failed after %s: %d jobs succeeded before the failure (%s), %d failed",
+		duration, summary.Compiled+summary.Linked, counts, summary.Failed)
 }
 
 func (b *Builder) BuildAndRun(args []string, profile, generator string) error {
+	if b.cfg.Package.Name == "" && b.IsWorkspace() {
+		return errCantRunWorkspace
+	}
 	if b.cfg.Target.Lib {
 		return errCantRunLib
 	}
+	if b.emit != gen.EmitObjects {
+		return errors.New("can't run a package built without linking (--emit)")
+	}
 
 	if err := b.Build(profile, generator); err != nil {
 		return err
 	}
 
 	outputName := b.cfg.Package.Name
-	if runtime.GOOS == "windows" {
+	if b.env.TargetOS == "windows" {
 		outputName += ".exe"
 	}
 
-	cmd := exec.Command(filepath.Join(b.basedir, "build", outputName), args...)
+	cmd := exec.Command(filepath.Join(b.profileBuildDir(profile), outputName), args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
 	return cmd.Run()
 }
+
+// buildCommandEnv returns the environment variables build commands get in addition to the ones of qobs
+func (b *Builder) buildCommandEnv(profile string) []string {
+	return []string{
+		TargetOSEnv + "=" + b.env.TargetOS,
+		TargetArchEnv + "=" + b.env.TargetArch,
+		"QOBS_PROFILE=" + profile,
+	}
+}
+
+// runPostGenerateHook runs the root package's post-generate command in buildDir with the path of
+// the generated build file, letting it edit the file before the generator is invoked.
+// The edited file isn't validated again
+func (b *Builder) runPostGenerateHook(buildDir, buildFile string) error {
+	hook := b.cfg.Package.PostGenerate
+	if len(hook) == 0 {
+		return nil
+	}
+
+	path, err := lookCommand(hook[0], b.basedir)
+	if err != nil {
+		return fmt.Errorf("post-generate command %q not found: %w", hook[0], err)
+	}
+
+	args := append(slices.Clone(hook[1:]), buildFile)
+	cmd := exec.Command(path, args...)
+	cmd.Dir = buildDir
+	cmd.Stdout = msg.Output()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("post-generate command failed: %w", err)
+	}
+	return nil
+}
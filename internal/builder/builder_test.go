@@ -0,0 +1,977 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/qobs-build/qobs/internal/builder/gen"
+	"github.com/qobs-build/qobs/internal/msg"
+)
+
+func TestPlatformSources(t *testing.T) {
+	tests := []struct {
+		name     string
+		sources  []string
+		targetOS string
+		want     []string
+	}{
+		{
+			name:     "linux source replaces the generic one on linux",
+			sources:  []string{"src/main.c", "src/poll.c", "src/poll.linux.c"},
+			targetOS: "linux",
+			want:     []string{"src/main.c", "src/poll.linux.c"},
+		},
+		{
+			name:     "generic source stays on other OSes",
+			sources:  []string{"src/main.c", "src/poll.c", "src/poll.linux.c"},
+			targetOS: "darwin",
+			want:     []string{"src/main.c", "src/poll.c"},
+		},
+		{
+			name:     "win32 alias",
+			sources:  []string{"src/poll.c", "src/poll.win32.c", "src/poll.linux.c"},
+			targetOS: "windows",
+			want:     []string{"src/poll.win32.c"},
+		},
+		{
+			name:     "macos alias",
+			sources:  []string{"src/poll.c", "src/poll.macos.c"},
+			targetOS: "darwin",
+			want:     []string{"src/poll.macos.c"},
+		},
+		{
+			name:     "only replaces the source in the same directory",
+			sources:  []string{"a/poll.c", "b/poll.c", "b/poll.linux.c"},
+			targetOS: "linux",
+			want:     []string{"a/poll.c", "b/poll.linux.c"},
+		},
+		{
+			name:     "directory named after an OS",
+			sources:  []string{"dir.linux/foo.c", "dir.windows/foo.c"},
+			targetOS: "linux",
+			want:     []string{"dir.linux/foo.c", "dir.windows/foo.c"},
+		},
+		{
+			name:     "not an OS suffix",
+			sources:  []string{"src/foo.impl.c", "src/foo.c"},
+			targetOS: "linux",
+			want:     []string{"src/foo.impl.c", "src/foo.c"},
+		},
+	}
+	for _, tt := range tests {
+		if got := platformSources(slices.Clone(tt.sources), tt.targetOS); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: platformSources(%q, %s) = %q, want %q", tt.name, tt.sources, tt.targetOS, got, tt.want)
+		}
+	}
+}
+
+// writeFiles writes files, by path relative to dir, creating their directories
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// planTarget is the part of a target in gen.PlanFile the tests look at
+type planTarget struct {
+	Name    string   `json:"name"`
+	Output  string   `json:"output"`
+	Cflags  []string `json:"cflags"`
+	Ldflags []string `json:"ldflags"`
+	Sources []struct {
+		Src string `json:"src"`
+	} `json:"sources"`
+}
+
+// planBuild plans the build of the package in dir with the qobs generator without running it, and
+// returns the planned targets by name
+func planBuild(t *testing.T, dir string) map[string]planTarget {
+	t.Helper()
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetDryRun(true)
+	b.SetEmitPlan(true)
+	if err := b.Build("debug", GeneratorQobs); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(b.profileBuildDir("debug"), gen.PlanFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plan struct {
+		Targets []planTarget `json:"targets"`
+	}
+	if err := json.Unmarshal(data, &plan); err != nil {
+		t.Fatal(err)
+	}
+	targets := make(map[string]planTarget)
+	for _, target := range plan.Targets {
+		targets[target.Name] = target
+	}
+	return targets
+}
+
+func TestBuildScriptLdflagsReachDependents(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml":     "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\n\n[dependencies]\nfoo = \"./foo\"\n",
+		"main.c":        "int foo(void);\nint main(void) { return foo(); }\n",
+		"foo/Qobs.toml": "[package]\nname = \"foo\"\nbuild = '{\"ldflags\": [\"-lm\"], \"defines\": {\"HAVE_FOO\": 1}}'\n\n[target]\nkind = \"staticlib\"\nsources = [\"foo.c\"]\n",
+		"foo/foo.c":     "int foo(void) { return 0; }\n",
+	})
+	targets := planBuild(t, dir)
+	app, ok := targets["app"]
+	if !ok {
+		t.Fatalf("no app target in %v", targets)
+	}
+	if !slices.Contains(app.Ldflags, "-lm") {
+		t.Errorf("app ldflags = %q, want the -lm of the build script of foo", app.Ldflags)
+	}
+}
+
+func TestSetPlatforms(t *testing.T) {
+	b := &Builder{}
+	platforms := []string{"x86", "arm64", "X64"}
+	if err := b.SetPlatforms(platforms); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Win32", "ARM64", "x64"}; !slices.Equal(b.vsPlatforms, want) {
+		t.Errorf("platforms = %q, want %q", b.vsPlatforms, want)
+	}
+	if want := []string{"x86", "arm64", "X64"}; !slices.Equal(platforms, want) {
+		t.Errorf("the slice passed in was changed to %q", platforms)
+	}
+	if err := b.SetPlatforms([]string{"x64", "mips"}); err == nil {
+		t.Error("unknown platform accepted")
+	}
+}
+
+// resolvedPaths resolves the dependency graph of the package in dir and returns the directories
+// of the packages by name
+func resolvedPaths(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packages, err := b.ResolveGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make(map[string]string)
+	for _, pkg := range packages {
+		paths[pkg.Name] = pkg.Path
+	}
+	return paths
+}
+
+func TestRelativePathDependencies(t *testing.T) {
+	dir := t.TempDir()
+	// app/liba and app/libb both depend on app/common, which is "../common" from either
+	writeFiles(t, dir, map[string]string{
+		"app/Qobs.toml":        "[package]\nname = \"app\"\n\n[dependencies]\nliba = \"liba\"\nlibb = \"./libb\"\n",
+		"app/liba/Qobs.toml":   "[package]\nname = \"liba\"\n\n[target]\nlib = true\n\n[dependencies]\ncommon = \"../common\"\n",
+		"app/libb/Qobs.toml":   "[package]\nname = \"libb\"\n\n[target]\nlib = true\n\n[dependencies]\ncommon = \"../common\"\n",
+		"app/common/Qobs.toml": "[package]\nname = \"common\"\n\n[target]\nlib = true\n",
+	})
+	paths := resolvedPaths(t, filepath.Join(dir, "app"))
+	want := map[string]string{
+		"app":    filepath.Join(dir, "app"),
+		"liba":   filepath.Join(dir, "app", "liba"),
+		"libb":   filepath.Join(dir, "app", "libb"),
+		"common": filepath.Join(dir, "app", "common"),
+	}
+	if !maps.Equal(paths, want) {
+		t.Errorf("resolved %q, want %q", paths, want)
+	}
+}
+
+func TestPathDependencyEditsRebuild(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app/Qobs.toml":   "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\n\n[dependencies]\nmylib = \"../mylib\"\n",
+		"app/main.c":      "int answer(void);\nint main(void) { return answer(); }\n",
+		"mylib/Qobs.toml": "[package]\nname = \"mylib\"\n\n[target]\nlib = true\nsources = [\"answer.c\"]\n",
+		"mylib/answer.c":  "int answer(void) { return 1; }\n",
+	})
+	b, err := NewBuilderInDirectory(filepath.Join(dir, "app"), "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func() int {
+		t.Helper()
+		if err := b.Build("debug", GeneratorQobs); err != nil {
+			t.Fatal(err)
+		}
+		err := exec.Command(filepath.Join(b.profileBuildDir("debug"), "app")).Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return 0
+	}
+
+	if got := run(); got != 1 {
+		t.Fatalf("app exited with %d, want 1", got)
+	}
+	if _, err := os.Stat(filepath.Join(b.depsDir(), "mylib")); err == nil {
+		t.Error("path dependency was copied to the dependencies directory")
+	}
+	// the same size and modification time, only the content tells the edit apart
+	answer := filepath.Join(dir, "mylib", "answer.c")
+	stat, err := os.Stat(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{"mylib/answer.c": "int answer(void) { return 2; }\n"})
+	if err := os.Chtimes(answer, stat.ModTime(), stat.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if got := run(); got != 2 {
+		t.Errorf("app exited with %d after editing mylib, want 2", got)
+	}
+}
+
+func TestConditionalDependenciesOfDependencies(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app/Qobs.toml": "[package]\nname = \"app\"\n\n[dependencies]\nmid = \"../mid\"\n",
+		"mid/Qobs.toml": "[package]\nname = \"mid\"\n\n[target]\nlib = true\n\n" +
+			"[dependencies.'target_os == \"windows\"']\nwincompat = \"../wincompat\"\n\n" +
+			"[dependencies.'target_os == \"linux\"']\nunixcompat = { dep = \"../unixcompat\" }\n\n" +
+			// fails if it's ever fetched
+			"[dependencies.'target_os == \"darwin\"']\nunreachable = \"http://127.0.0.1:1/unreachable.git\"\n",
+		"wincompat/Qobs.toml":  "[package]\nname = \"wincompat\"\n\n[target]\nlib = true\n",
+		"unixcompat/Qobs.toml": "[package]\nname = \"unixcompat\"\n\n[target]\nlib = true\n",
+	})
+	for targetOS, want := range map[string]string{"linux": "unixcompat", "windows": "wincompat"} {
+		t.Run(targetOS, func(t *testing.T) {
+			t.Setenv(TargetOSEnv, targetOS)
+			paths := resolvedPaths(t, filepath.Join(dir, "app"))
+			if got := slices.Sorted(maps.Keys(paths)); !slices.Equal(got, []string{"app", "mid", want}) {
+				t.Errorf("resolved %q, want app, mid and %s", got, want)
+			}
+		})
+	}
+}
+
+func TestCircularDependencies(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name: "mutual",
+			files: map[string]string{
+				"app/Qobs.toml": "[package]\nname = \"app\"\n\n[dependencies]\na = \"../a\"\n",
+				"a/Qobs.toml":   "[package]\nname = \"a\"\n\n[target]\nlib = true\n\n[dependencies]\nb = \"../b\"\n",
+				// the cycle is reported before anything else is fetched
+				"b/Qobs.toml": "[package]\nname = \"b\"\n\n[target]\nlib = true\n\n[dependencies]\na = \"../a\"\nunreachable = \"http://127.0.0.1:1/unreachable.git\"\n",
+			},
+			want: "circular dependency: b -> a -> b",
+		},
+		{
+			name: "through the root",
+			files: map[string]string{
+				"app/Qobs.toml": "[package]\nname = \"app\"\n\n[dependencies]\na = \"../a\"\n",
+				"a/Qobs.toml":   "[package]\nname = \"a\"\n\n[target]\nlib = true\n\n[dependencies]\napp = \"../app\"\n",
+			},
+			want: "circular dependency: a -> app -> a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFiles(t, dir, tt.files)
+			b, err := NewBuilderInDirectory(filepath.Join(dir, "app"), "", nil, true)
+			if err == nil {
+				_, err = b.ResolveGraph()
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("resolving failed with %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultFeaturesOfDependencies(t *testing.T) {
+	const lib = "[package]\nname = \"lib\"\n\n[target]\nlib = true\n\n[features]\ndefault = [\"fast\"]\nfast = []\nextra = []\n"
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []string
+	}{
+		{
+			name: "enabled",
+			files: map[string]string{
+				"app/Qobs.toml": "[package]\nname = \"app\"\n\n[dependencies]\nlib = \"../lib\"\n",
+			},
+			want: []string{"fast"},
+		},
+		{
+			name: "disabled by the only parent",
+			files: map[string]string{
+				"app/Qobs.toml": "[package]\nname = \"app\"\n\n[dependencies]\nlib = { dep = \"../lib\", default-features = false }\n",
+			},
+			want: []string{},
+		},
+		{
+			name: "parents disagree",
+			files: map[string]string{
+				"app/Qobs.toml": "[package]\nname = \"app\"\n\n[dependencies]\nlib = { dep = \"../lib\", default-features = false }\nmid = \"../mid\"\n",
+				"mid/Qobs.toml": "[package]\nname = \"mid\"\n\n[target]\nlib = true\n\n[dependencies]\nlib = { dep = \"../lib\", features = [\"extra\"] }\n",
+			},
+			want: []string{"extra", "fast"},
+		},
+		{
+			name: "feature of the dependency enabled by a feature",
+			files: map[string]string{
+				"app/Qobs.toml": "[package]\nname = \"app\"\n\n[features]\ndefault = [\"more\"]\nmore = [\"lib/extra\"]\n\n" +
+					"[dependencies]\nlib = { dep = \"../lib\", default-features = false }\n",
+			},
+			want: []string{"extra"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.files["lib/Qobs.toml"] = lib
+			writeFiles(t, dir, tt.files)
+			b, err := NewBuilderInDirectory(filepath.Join(dir, "app"), "", nil, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packages, err := b.ResolveGraph()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pkg := range packages {
+				if pkg.Name == "lib" {
+					if got := pkg.Config.EnabledFeatures(); !slices.Equal(got, tt.want) {
+						t.Errorf("lib has features %q, want %q", got, tt.want)
+					}
+					return
+				}
+			}
+			t.Error("lib wasn't resolved")
+		})
+	}
+}
+
+func TestGlobPathDependencies(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app/Qobs.toml":         "[package]\nname = \"app\"\n\n[dependencies]\nvendored = { dep = \"../vendor/*\", features = [\"fast\"] }\npng = \"../forks/png\"\n",
+		"vendor/zlib/Qobs.toml": "[package]\nname = \"zlib\"\n\n[target]\nlib = true\n\n[features]\nfast = []\n",
+		"vendor/png/Qobs.toml":  "[package]\nname = \"png\"\n\n[target]\nlib = true\n",
+		"vendor/docs/README":    "not a package\n",
+		"forks/png/Qobs.toml":   "[package]\nname = \"png\"\n\n[target]\nlib = true\n\n[dependencies]\nzlib = \"../../vendor/zlib\"\n",
+	})
+	paths := resolvedPaths(t, filepath.Join(dir, "app"))
+	want := map[string]string{
+		"app":  filepath.Join(dir, "app"),
+		"zlib": filepath.Join(dir, "vendor", "zlib"),
+		// listed by name, so it takes precedence over the package the glob matched
+		"png": filepath.Join(dir, "forks", "png"),
+	}
+	if !maps.Equal(paths, want) {
+		t.Errorf("resolved %q, want %q", paths, want)
+	}
+
+	b, err := NewBuilderInDirectory(filepath.Join(dir, "app"), "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dep := b.cfg.Dependencies["zlib"]; !slices.Equal(dep.Features, []string{"fast"}) {
+		t.Errorf("expanded dependency has features %q, want the ones of the glob", dep.Features)
+	}
+
+	writeFiles(t, dir, map[string]string{"empty/Qobs.toml": "[package]\nname = \"empty\"\n\n[dependencies]\nnone = \"../vendor/*/sub/*\"\n"})
+	if _, err := NewBuilderInDirectory(filepath.Join(dir, "empty"), "", nil, true); err == nil {
+		t.Error("glob matching no packages was accepted")
+	}
+}
+
+func TestExcludePatterns(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml":                "[package]\nname = \"app\"\n",
+		"src/main.c":               "",
+		"src/win32.c":              "",
+		"extra/kept.c":             "",
+		"extra/dropped.c":          "",
+		"include/app/app.h":        "",
+		"include/app/detail/x.h":   "",
+		"include/app/detail/y.txt": "",
+	})
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := b.rootPackages()[0]
+
+	// absolute entries skip globbing but are still excluded
+	kept, dropped := filepath.Join(dir, "extra", "kept.c"), filepath.Join(dir, "extra", "dropped.c")
+	files, err := b.collectFiles(pkg, []string{"!src/win32.c", "src/**.c", kept, dropped, "!" + dropped}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(files)
+	want := []string{kept, filepath.Join(dir, "src", "main.c")}
+	if !slices.Equal(files, want) {
+		t.Errorf("sources = %q, want %q", files, want)
+	}
+
+	dirs, err := b.collectFiles(pkg, []string{"include/**/*.h", "!include/app/detail/**"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(dir, "include", "app")}; !slices.Equal(dirs, want) {
+		t.Errorf("header directories = %q, want %q", dirs, want)
+	}
+	pkg.Config.Target.Headers = []string{"include/**", "!**/detail/*.h"}
+	installed := t.TempDir()
+	if err := installHeaders(pkg, installed); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{"app/app.h": true, "app/detail/x.h": false, "app/detail/y.txt": true} {
+		if _, err := os.Stat(filepath.Join(installed, path)); (err == nil) != want {
+			t.Errorf("%s installed: %v, want %v", path, err == nil, want)
+		}
+	}
+
+	if _, err := b.collectFiles(pkg, []string{"src/*.c", "!src/[.c"}, false); err == nil {
+		t.Error("invalid exclude pattern was accepted")
+	}
+}
+
+func TestHeaderOnlyDependency(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml":                  "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\n\n[dependencies]\nmath = \"./math\"\n",
+		"main.c":                     "#include <math/square.h>\nint main(void) { return square(3) - 9; }\n",
+		"math/Qobs.toml":             "[package]\nname = \"math\"\n\n[target]\nheader-only = true\ninclude-dirs = [\"include\"]\n",
+		"math/include/math/square.h": "static inline int square(int x) { return x * x; }\n",
+	})
+	targets := planBuild(t, dir)
+	if len(targets) != 1 {
+		t.Errorf("planned %v, want only the executable", slices.Collect(maps.Keys(targets)))
+	}
+	if _, ok := targets["app"]; !ok {
+		t.Fatalf("no app target in %v", targets)
+	}
+
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Build("debug", GeneratorQobs); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command(filepath.Join(b.profileBuildDir("debug"), "app")).Run(); err != nil {
+		t.Errorf("app failed: %v", err)
+	}
+}
+
+func TestForceInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml":     "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\nforce-include = [\"config.h\"]\n\n[dependencies]\nfoo = \"./foo\"\n",
+		"config.h":      "#define ANSWER 42\n",
+		"main.c":        "int foo(void);\nint main(void) { return ANSWER - 42 + foo(); }\n",
+		"foo/Qobs.toml": "[package]\nname = \"foo\"\n\n[target]\nlib = true\nsources = [\"foo.c\"]\nforce-include = [\"foo.h\"]\n",
+		"foo/foo.h":     "#define ZERO 0\n",
+		"foo/foo.c":     "int foo(void) { return ZERO; }\n",
+	})
+	targets := planBuild(t, dir)
+	appFlags := strings.Join(targets["app"].Cflags, " ")
+	if want := "-include " + filepath.Join(dir, "config.h"); !strings.Contains(appFlags, want) {
+		t.Errorf("app is compiled with %q, want %q", appFlags, want)
+	}
+	// not inherited by dependents
+	if strings.Contains(appFlags, "foo.h") {
+		t.Errorf("the force-include of foo leaks into app: %q", appFlags)
+	}
+	if want := "-include " + filepath.Join(dir, "foo", "foo.h"); !strings.Contains(strings.Join(targets["libfoo.a"].Cflags, " "), want) {
+		t.Errorf("foo is compiled with %q, want %q", targets["libfoo.a"].Cflags, want)
+	}
+
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Build("debug", GeneratorQobs); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command(filepath.Join(b.profileBuildDir("debug"), "app")).Run(); err != nil {
+		t.Errorf("app failed: %v", err)
+	}
+}
+
+func TestOverlappingSourcePatterns(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml":   "[package]\nname = \"app\"\n\n[target]\nsources = [\"src/**/*.c\", \"src/main.c\", \"src/*.c\"]\n",
+		"src/main.c":  "int zeta(void);\nint alpha(void);\nint main(void) { return zeta() + alpha(); }\n",
+		"src/zeta.c":  "int zeta(void) { return 0; }\n",
+		"src/alpha.c": "int alpha(void) { return 0; }\n",
+	})
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "src")
+	files, err := b.collectFiles(b.rootPackages()[0], []string{"src/*.c", "src/main.c", filepath.Join(src, "zeta.c"), "src/**/*.c"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each file once, where it was first matched, and sorted within a pattern
+	want := []string{filepath.Join(src, "alpha.c"), filepath.Join(src, "main.c"), filepath.Join(src, "zeta.c")}
+	if !slices.Equal(files, want) {
+		t.Errorf("collected %q, want %q", files, want)
+	}
+
+	// compiling main.c twice would fail to link with duplicate symbols
+	var sources []string
+	for _, source := range planBuild(t, dir)["app"].Sources {
+		sources = append(sources, source.Src)
+	}
+	if !slices.Equal(sources, want) {
+		t.Errorf("planned sources %q, want %q", sources, want)
+	}
+}
+
+func TestLibDirs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml":     "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\n\n[dependencies]\nfoo = \"./foo\"\n",
+		"main.c":        "int foo(void);\nint main(void) { return foo(); }\n",
+		"foo/Qobs.toml": "[package]\nname = \"foo\"\n\n[target]\nlib = true\nsources = [\"foo.c\"]\nlib-dirs = [\"vendor/lib\"]\nlinks = [\"bar\"]\n",
+		"foo/foo.c":     "int bar(void);\nint foo(void) { return bar(); }\n",
+		"foo/bar.c":     "int bar(void) { return 0; }\n",
+	})
+	targets := planBuild(t, dir)
+	libDir := "-L" + filepath.Join(dir, "foo", "vendor", "lib")
+	ldflags := targets["app"].Ldflags
+	// inherited from foo, and before the library that's searched for in it
+	if l, lib := slices.Index(ldflags, libDir), slices.Index(ldflags, "-lbar"); l < 0 || lib < l {
+		t.Errorf("app is linked with %q, want %s before -lbar", ldflags, libDir)
+	}
+
+	// a library that's only found in the search path
+	vendor := filepath.Join(dir, "foo", "vendor", "lib")
+	if err := os.MkdirAll(vendor, 0755); err != nil {
+		t.Fatal(err)
+	}
+	obj := filepath.Join(vendor, "bar.o")
+	for _, args := range [][]string{{"gcc", "-c", filepath.Join(dir, "foo", "bar.c"), "-o", obj}, {"ar", "rcs", filepath.Join(vendor, "libbar.a"), obj}} {
+		if output, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			t.Skipf("%s failed: %v\n%s", args[0], err, output)
+		}
+	}
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Build("debug", GeneratorQobs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDedupeLinkFlags(t *testing.T) {
+	ldflags := []string{"-lm", "-framework", "Cocoa", "-L/lib", "-lz", "-framework", "Metal", "-lm", "-framework", "Cocoa", "-L/lib"}
+	want := []string{"-L/lib", "-lz", "-framework", "Metal", "-lm", "-framework", "Cocoa", "-L/lib"}
+	if got := dedupeLinkFlags(ldflags); !slices.Equal(got, want) {
+		t.Errorf("dedupeLinkFlags(%q) = %q, want %q", ldflags, got, want)
+	}
+}
+
+func TestFrameworks(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml":    "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\nframeworks = [\"Metal\"]\n\n[dependencies]\nui = \"./ui\"\n",
+		"main.c":       "int main(void) { return 0; }\n",
+		"ui/Qobs.toml": "[package]\nname = \"ui\"\n\n[target]\nlib = true\nsources = [\"ui.c\"]\nlinks = [\"objc\"]\nframeworks = [\"Cocoa\", \"Metal\"]\n",
+		"ui/ui.c":      "int ui(void) { return 0; }\n",
+	})
+
+	t.Run("darwin", func(t *testing.T) {
+		t.Setenv(TargetOSEnv, "darwin")
+		ldflags := strings.Join(planBuild(t, dir)["app"].Ldflags, " ")
+		// inherited from ui, after its libraries, and Metal only once
+		if want := "-lobjc -framework Cocoa -framework Metal"; !strings.HasSuffix(ldflags, want) {
+			t.Errorf("app is linked with %q, want it to end with %q", ldflags, want)
+		}
+		if strings.Count(ldflags, "-framework Metal") != 1 {
+			t.Errorf("app links Metal more than once: %q", ldflags)
+		}
+	})
+
+	t.Run("linux", func(t *testing.T) {
+		t.Setenv(TargetOSEnv, "linux")
+		var buf bytes.Buffer
+		msg.SetOutput(&buf)
+		defer msg.SetOutput(os.Stdout)
+		if ldflags := planBuild(t, dir)["app"].Ldflags; slices.Contains(ldflags, "-framework") {
+			t.Errorf("app is linked with frameworks on Linux: %q", ldflags)
+		}
+		if want := `package "ui": ignoring target.frameworks`; !strings.Contains(buf.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, buf.String())
+		}
+	})
+}
+
+func TestStrip(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	log := filepath.Join(t.TempDir(), "strip.log")
+	t.Setenv("STRIP", fakeCompiler(t, "strip", "echo \"$@\" >> "+log+"\n"))
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml":     "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\n\n[dependencies]\nfoo = \"./foo\"\n\n[profile.release]\nstrip = true\n",
+		"main.c":        "int foo(void);\nint main(void) { return foo(); }\n",
+		"foo/Qobs.toml": "[package]\nname = \"foo\"\n\n[target]\nkind = \"staticlib\"\nsources = [\"foo.c\"]\n",
+		"foo/foo.c":     "int foo(void) { return 0; }\n",
+	})
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := func() string {
+		t.Helper()
+		data, _ := os.ReadFile(log)
+		return string(data)
+	}
+
+	if err := b.Build("debug", GeneratorQobs); err != nil {
+		t.Fatal(err)
+	}
+	if got := stripped(); got != "" {
+		t.Errorf("debug build stripped %q", got)
+	}
+	if err := b.Build("release", GeneratorQobs); err != nil {
+		t.Fatal(err)
+	}
+	// only the executable, static libraries are left alone
+	if got, want := stripped(), "--strip-unneeded "+filepath.Join(b.profileBuildDir("release"), "app")+"\n"; got != want {
+		t.Errorf("release build stripped %q, want %q", got, want)
+	}
+
+	// a missing strip is warned about, the build goes on
+	t.Setenv("STRIP", filepath.Join(dir, "no-such-strip"))
+	writeFiles(t, dir, map[string]string{"main.c": "int foo(void);\nint main(void) { return foo() + 0; }\n"})
+	var buf bytes.Buffer
+	msg.SetOutput(&buf)
+	defer msg.SetOutput(os.Stdout)
+	if err := b.Build("release", GeneratorQobs); err != nil {
+		t.Fatal(err)
+	}
+	if want := "not stripping symbols"; !strings.Contains(buf.String(), want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, buf.String())
+	}
+}
+
+func TestTargetWithoutSources(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml":  "[package]\nname = \"app\"\n\n[target]\nsources = [\"src/**.cpp\"]\n",
+		"src/main.c": "int main(void) { return 0; }\n",
+	})
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetDryRun(true)
+	err = b.Build("debug", GeneratorQobs)
+	if want := `package "app" has no sources: target.sources ["src/**.cpp"] matches no files`; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("build failed with %v, want %q", err, want)
+	}
+	b.SetAllowEmpty(true)
+	if err := b.Build("debug", GeneratorQobs); err != nil {
+		t.Errorf("build with --allow-empty failed: %v", err)
+	}
+}
+
+func TestObjectsOfExternalSources(t *testing.T) {
+	dir := t.TempDir()
+	ext1, ext2 := filepath.Join(t.TempDir(), "one"), filepath.Join(t.TempDir(), "two")
+	inside, err := getObjectPath("app", dir, filepath.Join(dir, "src", "foo.c"))
+	if err != nil || inside != "QobsFiles/app.dir/src/foo.c.obj" {
+		t.Errorf("object of a source in the package = %q, %v", inside, err)
+	}
+	obj1, _ := getObjectPath("app", dir, filepath.Join(ext1, "foo.c"))
+	obj2, _ := getObjectPath("app", dir, filepath.Join(ext2, "foo.c"))
+	if obj1 == obj2 || path.Base(obj1) != "foo.c.obj" || !strings.HasPrefix(obj1, "QobsFiles/app.dir/_external/") {
+		t.Errorf("objects of foo.c from different directories are %q and %q", obj1, obj2)
+	}
+	if again, _ := getObjectPath("app", dir, filepath.Join(ext1, "foo.c")); again != obj1 {
+		t.Errorf("object of the same source changed from %q to %q", obj1, again)
+	}
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	writeFiles(t, ext1, map[string]string{"foo.c": "int one(void) { return 1; }\n"})
+	writeFiles(t, ext2, map[string]string{"foo.c": "int two(void) { return 2; }\n"})
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml": fmt.Sprintf("[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\", %q, %q]\n", filepath.Join(ext1, "foo.c"), filepath.Join(ext2, "foo.c")),
+		"main.c":    "int one(void);\nint two(void);\nint main(void) { return one() + two() - 3; }\n",
+	})
+	// with a shared object, one of them would be missing when linking
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Build("debug", GeneratorQobs); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command(filepath.Join(b.profileBuildDir("debug"), "app")).Run(); err != nil {
+		t.Errorf("app failed: %v", err)
+	}
+}
+
+func TestSystemLibs(t *testing.T) {
+	tests := []struct {
+		targetOS string
+		target   string
+		want     []string
+		notWant  string
+	}{
+		{"linux", "app", []string{"-lm", "-lpthread", "-ldl"}, "-lws2_32"},
+		{"windows", "app.exe", []string{"-lm", "-lws2_32"}, "-lpthread"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.targetOS, func(t *testing.T) {
+			t.Setenv(TargetOSEnv, tt.targetOS)
+			dir := t.TempDir()
+			writeFiles(t, dir, map[string]string{
+				"Qobs.toml": "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\nlinks = [\"m\"]\n\n[target.system-libs]\nlinux = [\"pthread\", \"dl\"]\nwindows = [\"ws2_32\"]\n",
+				"main.c":    "int main(void) { return 0; }\n",
+			})
+			app, ok := planBuild(t, dir)[tt.target]
+			if !ok {
+				t.Fatalf("no %s target", tt.target)
+			}
+			for _, flag := range tt.want {
+				if !slices.Contains(app.Ldflags, flag) {
+					t.Errorf("ldflags %q don't contain %s", app.Ldflags, flag)
+				}
+			}
+			if slices.Contains(app.Ldflags, tt.notWant) {
+				t.Errorf("ldflags %q contain %s of another OS", app.Ldflags, tt.notWant)
+			}
+		})
+	}
+}
+
+func TestSwitchingProfilesIsIncremental(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml": "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\n",
+		"main.c":    "int main(void) { return 0; }\n",
+	})
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := func(profile string) os.FileInfo {
+		t.Helper()
+		if err := b.Build(profile, GeneratorQobs); err != nil {
+			t.Fatal(err)
+		}
+		stat, err := os.Stat(filepath.Join(b.profileBuildDir(profile), "QobsFiles", "app.dir", "main.c.obj"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stat
+	}
+
+	debug := build("debug")
+	release := build("release")
+	if b.profileBuildDir("debug") == b.profileBuildDir("release") {
+		t.Fatal("profiles share a build directory")
+	}
+	// nothing is rebuilt when switching back, the release build didn't touch the debug one
+	if again := build("debug"); !again.ModTime().Equal(debug.ModTime()) {
+		t.Error("switching back to the debug profile recompiled")
+	}
+	if again := build("release"); !again.ModTime().Equal(release.ModTime()) {
+		t.Error("switching back to the release profile recompiled")
+	}
+}
+
+func TestVS2022OutputIsStable(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml": "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\n\n[target.defines]\n" +
+			"ZETA = \"1\"\nALPHA = \"\"\nMIDDLE = \"a=b\"\nLIST = \"x;y\"\nPERCENT = \"100%\"\nMSG = '\"x\"'\n\n[dependencies]\nfoo = \"./foo\"\n",
+		"main.c":        "int main(void) { return 0; }\n",
+		"foo/Qobs.toml": "[package]\nname = \"foo\"\n\n[target]\nkind = \"staticlib\"\nsources = [\"foo.c\"]\n",
+		"foo/foo.c":     "int foo(void) { return 0; }\n",
+	})
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildDir := b.profileBuildDir("debug")
+	generate := func() map[string]string {
+		t.Helper()
+		// msbuild isn't there to build it, the files are generated anyway
+		b.Build("debug", GeneratorVS2022)
+		files := make(map[string]string)
+		for _, name := range []string{"app.sln", filepath.Join("app", "app.vcxproj"), filepath.Join("app", "app.vcxproj.filters"), filepath.Join("libfoo.a", "libfoo.a.vcxproj")} {
+			data, err := os.ReadFile(filepath.Join(buildDir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[name] = string(data)
+		}
+		return files
+	}
+	first, second := generate(), generate()
+	if !maps.Equal(first, second) {
+		for name := range first {
+			if first[name] != second[name] {
+				t.Errorf("%s changed between two generations:\n%s\n\nthen:\n%s", name, first[name], second[name])
+			}
+		}
+	}
+	// quotes are escaped for cl, then for XML
+	if want := `ALPHA;LIST=x%3By;MIDDLE=a=b;MSG=\&#34;x\&#34;;PERCENT=100%25;ZETA=1;`; !strings.Contains(first[filepath.Join("app", "app.vcxproj")], want) {
+		t.Errorf("project doesn't define %q in sorted order:\n%s", want, first[filepath.Join("app", "app.vcxproj")])
+	}
+}
+
+func TestLinkOrderOfDiamond(t *testing.T) {
+	dir := t.TempDir()
+	// app -> b, c -> d: the libraries of d resolve symbols used by both b and c
+	lib := func(name, deps string) string {
+		return "[package]\nname = \"" + name + "\"\n\n[target]\nkind = \"staticlib\"\nsources = [\"" + name + ".c\"]\nlinks = [\"" + name + "sys\", \"m\"]\n\n[dependencies]\n" + deps
+	}
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml":   "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\n\n[dependencies]\nb = \"./b\"\nc = \"./c\"\n",
+		"main.c":      "int main(void) { return 0; }\n",
+		"b/Qobs.toml": lib("b", "d = \"../d\"\n"),
+		"b/b.c":       "int b(void) { return 0; }\n",
+		"c/Qobs.toml": lib("c", "d = \"../d\"\n"),
+		"c/c.c":       "int c(void) { return 0; }\n",
+		"d/Qobs.toml": lib("d", ""),
+		"d/d.c":       "int d(void) { return 0; }\n",
+	})
+	app, ok := planBuild(t, dir)["app"]
+	if !ok {
+		t.Fatal("no app target")
+	}
+	index := func(flag string) int {
+		i := slices.Index(app.Ldflags, flag)
+		if i < 0 {
+			t.Fatalf("ldflags %q don't contain %s", app.Ldflags, flag)
+		}
+		return i
+	}
+	if d := index("-ldsys"); d < index("-lbsys") || d < index("-lcsys") {
+		t.Errorf("ldflags %q link d before the packages depending on it", app.Ldflags)
+	}
+	for _, flag := range []string{"-ldsys", "-lm"} {
+		if n := strings.Count(strings.Join(app.Ldflags, " ")+" ", flag+" "); n != 1 {
+			t.Errorf("ldflags %q contain %s %d times, want once", app.Ldflags, flag, n)
+		}
+	}
+	// m is kept where d needs it, after everything that may use it
+	if index("-lm") < index("-ldsys") {
+		t.Errorf("ldflags %q keep an earlier -lm instead of the last one", app.Ldflags)
+	}
+}
+
+func TestEnvReachesCompiler(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	dir := t.TempDir()
+	// the header is only found through CPATH, which gcc reads from its environment
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml": "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\n\n[env]\nCPATH = '" +
+			filepath.Join(dir, "include-{{ target_os }}") + "'\n",
+		"main.c": "#include <answer.h>\nint main(void) { return ANSWER - 42; }\n",
+		filepath.Join("include-"+NewConfigEnv(dir).TargetOS, "answer.h"): "#define ANSWER 42\n",
+	})
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Build("debug", GeneratorQobs); err != nil {
+		t.Fatalf("build without the [env] of the package: %v", err)
+	}
+}
+
+func TestGraphHash(t *testing.T) {
+	hash := func(t *testing.T, version string, change func(b *Builder)) string {
+		t.Helper()
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{
+			"Qobs.toml": "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\n\n[dependencies]\nfoo = \"./foo\"\n",
+			"main.c":    "int main(void) { return 0; }\n",
+			"foo/Qobs.toml": "[package]\nname = \"foo\"\nversion = \"" + version + "\"\n\n[target]\nkind = \"staticlib\"\n" +
+				"sources = [\"foo.c\"]\n",
+			"foo/foo.c": "int foo(void) { return 0; }\n",
+		})
+		b, err := NewBuilderInDirectory(dir, "", nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		change(b)
+		h, err := b.GraphHash("debug")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	same := func(*Builder) {}
+
+	base := hash(t, "1.0.0", same)
+	if h := hash(t, "1.0.0", same); h != base {
+		t.Errorf("hash of the same graph changed: %s, then %s", base, h)
+	}
+	if h := hash(t, "1.1.0", same); h == base {
+		t.Error("hash doesn't depend on the version of a dependency")
+	}
+	if h := hash(t, "1.0.0", func(b *Builder) { b.env.TargetArch += "-other" }); h == base {
+		t.Error("hash doesn't depend on the target architecture")
+	}
+	if h := hash(t, "1.0.0", func(b *Builder) { b.env.TargetOS += "-other" }); h == base {
+		t.Error("hash doesn't depend on the target OS")
+	}
+}
@@ -1,32 +1,40 @@
 package builder
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/qobs-build/qobs/internal/builder/gen"
 )
 
-// TODO: zig cc
 var (
-	commonCCompilers   = []string{"clang", "gcc", "icx", "icc", "tcc", "cl"}
-	commonCxxCompilers = []string{"clang++", "g++", "clang", "gcc", "icpx", "icx", "icpc", "icc", "cl"}
+	commonCCompilers   = []string{"clang", "gcc", "icx", "icc", "tcc", "cl", "zig"}
+	commonCxxCompilers = []string{"clang++", "g++", "clang", "gcc", "icpx", "icx", "icpc", "icc", "cl", "zig"}
 )
 
-// findCompiler attempts to find a suitable C or C++ compiler on the system
-func findCompiler(needCxx bool) string {
-	cc := os.Getenv("CC")
-	cxx := os.Getenv("CXX")
+// findCompiler attempts to find a suitable C or C++ compiler on the system, returning the
+// program followed by its arguments, e.g. ["zig", "cc"], or nil if there's none
+func findCompiler(needCxx bool) []string {
+	cc := compilerCommand(os.Getenv("CC"))
+	cxx := compilerCommand(os.Getenv("CXX"))
 
-	if needCxx && cxx != "" {
+	if needCxx && len(cxx) > 0 {
 		return cxx
 	}
-	if !needCxx && cc != "" {
+	if !needCxx && len(cc) > 0 {
 		return cc
 	}
 
-	if cxx != "" {
+	if len(cxx) > 0 {
 		return cxx
 	}
-	if cc != "" {
+	if len(cc) > 0 {
 		return cc
 	}
 
@@ -39,10 +47,269 @@ func findCompiler(needCxx bool) string {
 
 	for _, compiler := range compilersToTry {
 		path, err := exec.LookPath(compiler)
-		if err == nil {
-			return path
+		if err != nil {
+			continue
+		}
+		// zig is a compiler driver, its C and C++ compilers are `zig cc` and `zig c++`
+		if compiler == "zig" && needCxx {
+			return []string{path, "c++"}
+		}
+		if compiler == "zig" {
+			return []string{path, "cc"}
+		}
+		return []string{path}
+	}
+
+	return nil
+}
+
+// compilerCommand splits a compiler given as a command, e.g. "zig cc", into the program and
+// its arguments. The path of an existing file is kept whole, so that paths with spaces work
+func compilerCommand(command string) []string {
+	if stat, err := os.Stat(command); err == nil && !stat.IsDir() {
+		return []string{command}
+	}
+	return strings.Fields(command)
+}
+
+// isZig checks if the compiler cc is zig cc or zig c++
+func isZig(cc []string) bool {
+	return len(cc) > 1 && strings.TrimSuffix(strings.ToLower(filepath.Base(cc[0])), ".exe") == "zig"
+}
+
+// zigCrossCompiler adds -target to the zig compiler cc when env is a cross build, since zig
+// bundles the toolchains of its targets. Other compilers and ones with a -target are kept as is
+func zigCrossCompiler(cc []string, env ConfigEnv) []string {
+	if !isZig(cc) || (env.TargetOS == env.HostOS && env.TargetArch == env.HostArch) || slices.Contains(cc, "-target") {
+		return cc
+	}
+	return append(slices.Clip(cc), "-target", zigTarget(env.TargetOS, env.TargetArch))
+}
+
+// zigTarget returns the zig target triple (without ABI) for a GOOS and GOARCH, as used by
+// target_os and target_arch. Unknown names are passed through
+func zigTarget(goos, goarch string) string {
+	arch := map[string]string{
+		"amd64":   "x86_64",
+		"386":     "x86",
+		"arm64":   "aarch64",
+		"loong64": "loongarch64",
+		"ppc64":   "powerpc64",
+		"ppc64le": "powerpc64le",
+		"wasm":    "wasm32",
+	}[goarch]
+	if arch == "" {
+		arch = goarch
+	}
+	system := map[string]string{
+		"darwin": "macos",
+		"wasip1": "wasi",
+	}[goos]
+	if system == "" {
+		system = goos
+	}
+	return arch + "-" + system
+}
+
+// checkCompilers returns a descriptive error if a compiler needed to build sources wasn't found.
+// The C++ compiler is only needed for C++ sources, the C compiler for C sources and for linking
+// targets without C++ sources
+func checkCompilers(cc, cxx []string, sources []string) error {
+	isCxx := func(src string) bool { return gen.SourceLanguage(src) == gen.LangCxx }
+	hasCxx := slices.ContainsFunc(sources, isCxx)
+	hasC := slices.ContainsFunc(sources, func(src string) bool { return !isCxx(src) })
+	if len(cc) == 0 && (hasC || !hasCxx) {
+		return fmt.Errorf("no C compiler found: CC is not set and none of %s is in PATH", strings.Join(commonCCompilers, ", "))
+	}
+	if len(cxx) == 0 && hasCxx {
+		return fmt.Errorf("no C++ compiler found: CXX is not set and none of %s is in PATH", strings.Join(commonCxxCompilers, ", "))
+	}
+	return nil
+}
+
+// forceIncludeFlags returns the flags that include headers (relative to pkgPath) at the start of
+// every translation unit: -include for GCC-style compilers, /FI for MSVC-style ones
+func forceIncludeFlags(pkgPath string, headers []string, msvc bool) []string {
+	var flags []string
+	for _, header := range headers {
+		if !filepath.IsAbs(header) {
+			header = filepath.Join(pkgPath, header)
+		}
+		if msvc {
+			flags = append(flags, "/FI"+header)
+		} else {
+			flags = append(flags, "-include", header)
+		}
+	}
+	return flags
+}
+
+// crossCompilerRe matches compilers prefixed with a target triple, e.g. aarch64-linux-gnu-gcc
+var crossCompilerRe = regexp.MustCompile(`^(.+-)(gcc|g\+\+|cc|c\+\+|clang|clang\+\+)(-[0-9.]+)?(\.exe)?$`)
+
+// crossArchiver returns the archiver that goes with the compiler cc: zig ar for zig, the ar with
+// the same target prefix if it's a cross compiler and that ar exists, or ar
+func crossArchiver(cc []string) []string {
+	if isZig(cc) {
+		return []string{cc[0], "ar"}
+	}
+	if len(cc) == 0 {
+		return []string{"ar"}
+	}
+	m := crossCompilerRe.FindStringSubmatch(filepath.Base(cc[0]))
+	if m == nil {
+		return []string{"ar"}
+	}
+	ar := m[1] + "ar"
+	if dir := filepath.Dir(cc[0]); dir != "." {
+		ar = filepath.Join(dir, ar)
+	}
+	if _, err := exec.LookPath(ar); err != nil {
+		return []string{"ar"}
+	}
+	return []string{ar}
+}
+
+// crossStrip returns the strip that goes with the compiler cc, like crossArchiver: the strip with
+// the same target prefix if it's a cross compiler and that strip exists, or strip. Zig has none,
+// so it's llvm-strip for it
+func crossStrip(cc []string) string {
+	if isZig(cc) {
+		return "llvm-strip"
+	}
+	if len(cc) > 0 {
+		if m := crossCompilerRe.FindStringSubmatch(filepath.Base(cc[0])); m != nil {
+			strip := m[1] + "strip"
+			if dir := filepath.Dir(cc[0]); dir != "." {
+				strip = filepath.Join(dir, strip)
+			}
+			if _, err := exec.LookPath(strip); err == nil {
+				return strip
+			}
+		}
+	}
+	return "strip"
+}
+
+// CompilerKind is the family of a C/C++ compiler, which determines its command line syntax
+type CompilerKind int
+
+const (
+	CompilerUnknown CompilerKind = iota
+	CompilerGNU
+	CompilerClang
+	CompilerMSVC
+)
+
+func (k CompilerKind) String() string {
+	switch k {
+	case CompilerGNU:
+		return "GNU"
+	case CompilerClang:
+		return "Clang"
+	case CompilerMSVC:
+		return "MSVC"
+	default:
+		return "Unknown"
+	}
+}
+
+var (
+	compilerKindMu    sync.Mutex
+	compilerKindCache = make(map[string]CompilerKind) // compiler command -> kind
+)
+
+// DetectCompilerKind determines the family of the compiler cc, a program followed by its
+// arguments. The result is cached, so the compiler is only invoked once per command
+func DetectCompilerKind(cc []string) CompilerKind {
+	if len(cc) == 0 {
+		return CompilerUnknown
+	}
+
+	compilerKindMu.Lock()
+	defer compilerKindMu.Unlock()
+
+	key := strings.Join(cc, "\x00")
+	if kind, ok := compilerKindCache[key]; ok {
+		return kind
+	}
+	kind := detectCompilerKind(cc)
+	compilerKindCache[key] = kind
+	return kind
+}
+
+func detectCompilerKind(cc []string) CompilerKind {
+	// cl (and clang-cl, which mimics it) doesn't understand --version
+	name := strings.ToLower(filepath.Base(cc[0]))
+	name = strings.TrimSuffix(name, ".exe")
+	if name == "cl" || name == "clang-cl" {
+		return CompilerMSVC
+	}
+
+	for _, arg := range []string{"--version", "-v"} {
+		// the version banner may be printed to stderr and the exit code is not always zero
+		output, _ := exec.Command(cc[0], slices.Concat(cc[1:], []string{arg})...).CombinedOutput()
+		if kind := parseCompilerBanner(string(output)); kind != CompilerUnknown {
+			return kind
 		}
 	}
+	return CompilerUnknown
+}
+
+// parseCompilerBanner determines the compiler kind from the output of `--version` or `-v`
+func parseCompilerBanner(banner string) CompilerKind {
+	banner = strings.ToLower(banner)
+	switch {
+	case strings.Contains(banner, "microsoft (r) c/c++"):
+		return CompilerMSVC
+	case strings.Contains(banner, "clang"):
+		// also matches Apple clang, icx and zig cc, which are all based on clang
+		return CompilerClang
+	case strings.Contains(banner, "gcc"), strings.Contains(banner, "g++"):
+		return CompilerGNU
+	default:
+		return CompilerUnknown
+	}
+}
 
-	return ""
+var (
+	knownCStandards = []string{
+		"c89", "c90", "c99", "c11", "c17", "c18", "c23",
+		"gnu89", "gnu90", "gnu99", "gnu11", "gnu17", "gnu18", "gnu23",
+	}
+	knownCxxStandards = []string{
+		"c++98", "c++03", "c++11", "c++14", "c++17", "c++20", "c++23", "c++26",
+		"gnu++98", "gnu++03", "gnu++11", "gnu++14", "gnu++17", "gnu++20", "gnu++23", "gnu++26",
+	}
+	// msvcStandards maps standards to the `/std:` values of MSVC, which doesn't support every
+	// standard or the GNU dialects: older ones are mapped to the oldest supported one
+	msvcStandards = map[string]string{
+		"c89": "c11", "c90": "c11", "c99": "c11", "c11": "c11",
+		"c17": "c17", "c18": "c17", "c23": "clatest",
+		"c++98": "c++14", "c++03": "c++14", "c++11": "c++14", "c++14": "c++14",
+		"c++17": "c++17", "c++20": "c++20", "c++23": "c++latest", "c++26": "c++latest",
+	}
+)
+
+// stdFlag returns the flag selecting a C or C++ language standard for a compiler of kind: `/std:`
+// for MSVC and `-std=` for the others. It returns an empty string if std is empty
+func stdFlag(std string, cxx bool, kind CompilerKind) (string, error) {
+	if std == "" {
+		return "", nil
+	}
+
+	known, field := knownCStandards, "c-std"
+	if cxx {
+		known, field = knownCxxStandards, "cxx-std"
+	}
+	for _, k := range known {
+		if !strings.EqualFold(std, k) {
+			continue
+		}
+		if kind == CompilerMSVC {
+			return "/std:" + msvcStandards[strings.Replace(k, "gnu", "c", 1)], nil
+		}
+		return "-std=" + k, nil
+	}
+	return "", fmt.Errorf("unknown %s %q, accepted standards: %s", field, std, strings.Join(known, ", "))
 }
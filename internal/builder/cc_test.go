@@ -0,0 +1,173 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStdFlag(t *testing.T) {
+	tests := []struct {
+		std  string
+		cxx  bool
+		kind CompilerKind
+		want string
+	}{
+		{"", true, CompilerGNU, ""},
+		{"", true, CompilerMSVC, ""},
+		{"c++20", true, CompilerGNU, "-std=c++20"},
+		{"C++20", true, CompilerClang, "-std=c++20"},
+		{"gnu++17", true, CompilerUnknown, "-std=gnu++17"},
+		{"c11", false, CompilerGNU, "-std=c11"},
+		{"c++20", true, CompilerMSVC, "/std:c++20"},
+		{"gnu++17", true, CompilerMSVC, "/std:c++17"},
+		{"c++11", true, CompilerMSVC, "/std:c++14"},
+		{"c++23", true, CompilerMSVC, "/std:c++latest"},
+		{"c99", false, CompilerMSVC, "/std:c11"},
+		{"gnu17", false, CompilerMSVC, "/std:c17"},
+		{"c23", false, CompilerMSVC, "/std:clatest"},
+	}
+	for _, tt := range tests {
+		got, err := stdFlag(tt.std, tt.cxx, tt.kind)
+		if err != nil {
+			t.Errorf("stdFlag(%q, %s): %v", tt.std, tt.kind, err)
+		} else if got != tt.want {
+			t.Errorf("stdFlag(%q, %s) = %q, want %q", tt.std, tt.kind, got, tt.want)
+		}
+	}
+}
+
+func TestStdFlagUnknown(t *testing.T) {
+	for _, kind := range []CompilerKind{CompilerGNU, CompilerMSVC} {
+		if _, err := stdFlag("c++20", false, kind); err == nil {
+			t.Errorf("c++20 accepted as a C standard for %s", kind)
+		}
+		if _, err := stdFlag("c++99", true, kind); err == nil {
+			t.Errorf("c++99 accepted for %s", kind)
+		}
+	}
+}
+
+func TestStdFlagCoversEveryStandardForMSVC(t *testing.T) {
+	for _, std := range append(knownCStandards, knownCxxStandards...) {
+		cxx := slices.Contains(knownCxxStandards, std)
+		if got, _ := stdFlag(std, cxx, CompilerMSVC); got == "/std:" {
+			t.Errorf("no MSVC standard for %s", std)
+		}
+	}
+}
+
+// fakeCompiler writes a shell script named name that runs script, and returns its path
+func fakeCompiler(t *testing.T, name, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake compilers are shell scripts")
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDetectCompilerKind(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   CompilerKind
+	}{
+		{"gcc", "echo 'gcc (Ubuntu 13.2.0-23ubuntu4) 13.2.0'\n", CompilerGNU},
+		{"g++", "echo 'g++ (GCC) 14.1.1 20240522'\n", CompilerGNU},
+		{"cc", "echo 'Apple clang version 15.0.0 (clang-1500.3.9.4)'\necho 'Target: arm64-apple-darwin23.4.0'\n", CompilerClang},
+		{"zig-cc", "echo 'clang version 18.1.6 (https://github.com/ziglang/zig-bootstrap)'\n", CompilerClang},
+		// only -v prints a banner, to stderr with a failing exit code
+		{"old-cc", "if [ \"$1\" = -v ]; then echo 'gcc version 4.8.5 (GCC)' >&2; fi\nexit 1\n", CompilerGNU},
+		{"tcc", "echo 'tcc version 0.9.27 (x86_64 Linux)'\n", CompilerUnknown},
+	}
+	for _, tt := range tests {
+		cc := fakeCompiler(t, tt.name, tt.script)
+		if got := DetectCompilerKind([]string{cc}); got != tt.want {
+			t.Errorf("DetectCompilerKind(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// cl doesn't understand --version and is recognized by its name
+	for _, name := range []string{"cl", "CL.EXE", "clang-cl"} {
+		if got := DetectCompilerKind([]string{filepath.Join(t.TempDir(), name)}); got != CompilerMSVC {
+			t.Errorf("DetectCompilerKind(%s) = %s, want %s", name, got, CompilerMSVC)
+		}
+	}
+}
+
+func TestDetectCompilerKindIsCached(t *testing.T) {
+	count := filepath.Join(t.TempDir(), "count")
+	cc := fakeCompiler(t, "gcc", "echo x >> '"+count+"'\necho 'gcc (GCC) 14.1.1'\n")
+	for range 3 {
+		if got := DetectCompilerKind([]string{cc, "-m32"}); got != CompilerGNU {
+			t.Fatalf("DetectCompilerKind = %s, want %s", got, CompilerGNU)
+		}
+	}
+	if data, _ := os.ReadFile(count); string(data) != "x\n" {
+		t.Errorf("compiler was run %d times, want once", strings.Count(string(data), "x"))
+	}
+}
+
+func TestCheckCompilers(t *testing.T) {
+	cc, cxx := []string{"gcc"}, []string{"g++"}
+	tests := []struct {
+		cc, cxx []string
+		sources []string
+		wantErr string
+	}{
+		{cc, cxx, []string{"a.c", "b.cpp"}, ""},
+		{cc, nil, []string{"a.c"}, ""},
+		{nil, cxx, []string{"b.cpp"}, ""},
+		{nil, cxx, []string{"a.c", "b.cpp"}, "no C compiler found"},
+		{nil, nil, nil, "no C compiler found"},
+		{cc, nil, []string{"a.c", "b.cc"}, "no C++ compiler found"},
+	}
+	for _, tt := range tests {
+		err := checkCompilers(tt.cc, tt.cxx, tt.sources)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("checkCompilers(%q, %q, %q) = %v, want %q", tt.cc, tt.cxx, tt.sources, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBuildWithoutCompiler(t *testing.T) {
+	t.Setenv("PATH", "")
+	t.Setenv("CC", "")
+	t.Setenv("CXX", "")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml": "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\n",
+		"main.c":    "int main(void) { return 0; }\n",
+	})
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Build("debug", GeneratorQobs)
+	for _, want := range []string{`package "app": no C compiler found`, "CC is not set", strings.Join(commonCCompilers, ", ")} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("build failed with %v, want %q", err, want)
+		}
+	}
+}
+
+func TestForceIncludeFlags(t *testing.T) {
+	pkg := filepath.Join(t.TempDir(), "pkg")
+	abs := filepath.Join(t.TempDir(), "abs.h")
+	headers := []string{"config.h", filepath.Join("include", "prefix.h"), abs}
+	gnu := []string{"-include", filepath.Join(pkg, "config.h"), "-include", filepath.Join(pkg, "include", "prefix.h"), "-include", abs}
+	if got := forceIncludeFlags(pkg, headers, false); !slices.Equal(got, gnu) {
+		t.Errorf("forceIncludeFlags = %q, want %q", got, gnu)
+	}
+	msvc := []string{"/FI" + filepath.Join(pkg, "config.h"), "/FI" + filepath.Join(pkg, "include", "prefix.h"), "/FI" + abs}
+	if got := forceIncludeFlags(pkg, headers, true); !slices.Equal(got, msvc) {
+		t.Errorf("forceIncludeFlags with MSVC = %q, want %q", got, msvc)
+	}
+}
@@ -2,19 +2,28 @@ package builder
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"runtime"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/bmatcuk/doublestar/v4"
 	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
 	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+	"github.com/qobs-build/qobs/internal/msg"
+	"gopkg.in/yaml.v3"
 )
 
 var defaultProfiles = map[string]ProfileSection{
@@ -23,6 +32,7 @@ var defaultProfiles = map[string]ProfileSection{
 	},
 	"debug": {
 		OptLevel: intOrString{Value: ""}, // no -O
+		Debug:    true,
 	},
 }
 
@@ -32,7 +42,57 @@ type Config struct {
 	Dependencies       map[string]Dependency     `toml:"dependencies"`
 	Profile            map[string]ProfileSection `toml:"profile"`
 	Features           FeaturesSection           `toml:"features"`
+	Tests              []TestSection             `toml:"tests"`
+	Benches            []TestSection             `toml:"benches"`
+	Env                map[string]string         `toml:"env"` // set for compiler and linker processes, only used for the root package
+	Workspace          WorkspaceSection          `toml:"workspace"`
+	enabledFeatures    map[string]bool
 	enabledDepFeatures map[string][]string
+	matchedConditions  []string
+	env                ConfigEnv
+}
+
+// EnabledFeatures returns the sorted list of features enabled for this package
+func (c Config) EnabledFeatures() []string {
+	features := make([]string, 0, len(c.enabledFeatures))
+	for feature, enabled := range c.enabledFeatures {
+		if enabled {
+			features = append(features, feature)
+		}
+	}
+	slices.Sort(features)
+	return features
+}
+
+// DependencyFeatures returns the sorted features this package requests from its dependency
+// name, listed in the dependency itself or enabled with `name/feature` by one of its features
+func (c Config) DependencyFeatures(name string) []string {
+	dep, ok := c.Dependencies[name]
+	if !ok {
+		return nil
+	}
+	features := slices.Concat(dep.Features, c.enabledDepFeatures[name])
+	slices.Sort(features)
+	return slices.Compact(features)
+}
+
+// FeaturesEnabling returns the sorted enabled features of this package that directly enable its
+// optional dependency name: a feature with the same name, or one listing `dep:name` or
+// `name/feature`. It's empty for dependencies that aren't optional
+func (c Config) FeaturesEnabling(name string) []string {
+	if dep, ok := c.Dependencies[name]; !ok || !dep.Optional {
+		return nil
+	}
+	var features []string
+	for _, feature := range c.EnabledFeatures() {
+		enables := feature == name || slices.ContainsFunc(c.Features[feature], func(f string) bool {
+			return f == "dep:"+name || strings.HasPrefix(f, name+"/")
+		})
+		if enables {
+			features = append(features, feature)
+		}
+	}
+	return features
 }
 
 func (c Config) Profiles() []string {
@@ -48,18 +108,26 @@ type intOrString struct {
 	Value any
 }
 
-func (o *intOrString) UnmarshalTOML(v any) error {
-	switch val := v.(type) {
-	case int64:
-		o.Value = int(val)
-	case string:
-		o.Value = val
+func (o *intOrString) UnmarshalTOML(node *unstable.Node) error {
+	switch node.Kind {
+	case unstable.Integer:
+		v, err := strconv.ParseInt(string(node.Data), 0, 0)
+		if err != nil {
+			return err
+		}
+		o.Value = int(v)
+	case unstable.String:
+		o.Value = string(node.Data)
 	default:
-		return fmt.Errorf("unexpected type: %T", v)
+		return fmt.Errorf("expected an integer or a string, got %s", strings.ToLower(node.Kind.String()))
 	}
 	return nil
 }
 
+func (o intOrString) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
 func (o *intOrString) String() string {
 	if o == nil || o.Value == nil {
 		return ""
@@ -77,7 +145,92 @@ func (o *intOrString) String() string {
 
 // ProfileSection defines the [profile.*] section
 type ProfileSection struct {
-	OptLevel intOrString `toml:"opt-level"`
+	OptLevel intOrString       `toml:"opt-level"`
+	Debug    bool              `toml:"debug"` // emit debug info (-g)
+	LTO      bool              `toml:"lto"`   // link time optimization (-flto), also passed to the linker
+	Strip    bool              `toml:"strip"` // strip symbols from executables and shared libraries after linking
+	Defines  map[string]string `toml:"defines"`
+	Cflags   []string          `toml:"cflags"`
+}
+
+var packageNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidatePackageName checks that name is a valid package name. Package names end up in file
+// and project names, so only letters, digits, '_' and '-' are allowed
+func ValidatePackageName(name string) error {
+	if name == "" {
+		return errors.New("package name is empty")
+	}
+	if !packageNameRe.MatchString(name) {
+		return fmt.Errorf("package name %q may only contain letters, digits, '_' and '-'", name)
+	}
+	return nil
+}
+
+// ValidateProfileName checks that name can be the name of a profile directory in the build
+// directory, and not the build directory itself, a directory outside of it or the dependencies
+func ValidateProfileName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("profile name is empty")
+	case name == "." || name == "..":
+		return fmt.Errorf("invalid profile name %q", name)
+	case name == "_deps":
+		return fmt.Errorf("invalid profile name %q: it's the directory of fetched dependencies", name)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("invalid profile name %q: it may not contain path separators", name)
+	}
+	return nil
+}
+
+var packageVersionRe = regexp.MustCompile(`^(0|[1-9][0-9]*)(\.(0|[1-9][0-9]*)){0,2}(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// ValidatePackageVersion checks that version looks like a semantic version, e.g. "1", "1.2"
+// or "1.2.3-rc.1". The major version becomes a part of the soname of shared libraries
+func ValidatePackageVersion(version string) error {
+	if !packageVersionRe.MatchString(version) {
+		return fmt.Errorf("package version %q must look like MAJOR[.MINOR[.PATCH]][-PRERELEASE][+BUILD]", version)
+	}
+	return nil
+}
+
+// MajorVersion returns the major component of a version validated with ValidatePackageVersion
+func MajorVersion(version string) string {
+	end := strings.IndexAny(version, ".-+")
+	if end < 0 {
+		return version
+	}
+	return version[:end]
+}
+
+// WorkspaceSection defines the [workspace] section
+type WorkspaceSection struct {
+	Members []string `toml:"members"` // globs of member package directories, e.g. ["app", "libs/*"]
+}
+
+// MemberDirs expands the member globs of the workspace rooted at root into the absolute,
+// sorted directories of its member packages. Matched directories without a manifest are skipped
+func (w WorkspaceSection) MemberDirs(root string) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, pattern := range w.Members {
+		matches, err := doublestar.Glob(os.DirFS(root), filepath.ToSlash(filepath.Clean(pattern)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid workspace member %q: %w", pattern, err)
+		}
+		found := false
+		for _, match := range matches {
+			dir := filepath.Join(root, match)
+			if stat, err := os.Stat(ManifestPath(dir)); err != nil || stat.IsDir() {
+				continue
+			}
+			seen[dir] = true
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("workspace member %q matches no packages", pattern)
+		}
+	}
+	return slices.Sorted(maps.Keys(seen)), nil
 }
 
 // PackageSection defines the [package] section
@@ -85,24 +238,216 @@ type PackageSection struct {
 	Name        string   `toml:"name"`
 	Description string   `toml:"description"`
 	Authors     []string `toml:"authors"`
+	Version     string   `toml:"version"` // e.g. "1.2.3"; shared libraries get a versioned soname
 	Build       string   `toml:"build"`
+	// program and arguments run in the package directory before its sources are collected, e.g.
+	// ["python3", "gen.py"], see RunBuildCommand
+	BuildCommand []string `toml:"build-command"`
+	// files the build command reads, it only runs again when they change. Defaults to the files of
+	// the package named in the command, e.g. gen.py
+	BuildCommandInputs []string `toml:"build-command-inputs"`
+	// files the build command writes, they're not watched by qobs build --watch
+	BuildCommandOutputs []string `toml:"build-command-outputs"`
+	// command run with the generated build file as its last argument before the generator is
+	// invoked, e.g. ["python3", "patch_ninja.py"]. Only used for the root package
+	PostGenerate []string `toml:"post-generate"`
 }
 
 // TargetSection defines the [target(.*)] section
 type TargetSection struct {
-	Lib        bool              `toml:"lib"`
-	HeaderOnly bool              `toml:"header-only"`
-	Sources    []string          `toml:"sources"`
-	Headers    []string          `toml:"headers"`
-	Defines    map[string]string `toml:"defines"`
-	Links      []string          `toml:"links"`
-	Cflags     []string          `toml:"cflags"`
+	Kind        string              `toml:"kind"` // "exe", "staticlib" or "sharedlib"
+	Lib         bool                `toml:"lib"`  // deprecated alias for kind = "staticlib"; set for all library kinds after parsing
+	HeaderOnly  bool                `toml:"header-only"`
+	PrebuiltLib []string            `toml:"prebuilt-lib"` // library files relative to the package, linked by dependents instead of building anything
+	Sources     []string            `toml:"sources"`
+	Headers     []string            `toml:"headers"`
+	IncludeDirs []string            `toml:"include-dirs"` // relative to the package, also used by dependents
+	LibDirs     []string            `toml:"lib-dirs"`     // library search paths relative to the package, also used by dependents
+	Defines     map[string]string   `toml:"defines"`
+	Links       []string            `toml:"links"`
+	SystemLibs  map[string][]string `toml:"system-libs"` // target OS -> libraries
+	Frameworks  []string            `toml:"frameworks"`  // Apple frameworks, e.g. "Cocoa"; only linked on macOS
+	FileFlags   map[string][]string `toml:"file-flags"`  // source pattern -> extra cflags of matching sources
+	Cflags      []string            `toml:"cflags"`
+	CStd        string              `toml:"c-std"`   // e.g. "c11", applies only to C sources
+	CxxStd      string              `toml:"cxx-std"` // e.g. "c++20", applies only to C++ sources
+	CC          string              `toml:"cc"`      // C compiler of this package, overrides CC
+	CXX         string              `toml:"cxx"`     // C++ compiler of this package, overrides CXX
+	Pch         string              `toml:"pch"`     // header precompiled for the sources, relative to the package
+	// headers included at the start of every source, e.g. "config.h", relative to the package.
+	// Dependents don't inherit them
+	ForceInclude []string `toml:"force-include"`
+	// command that compiler and linker invocations are prefixed with, e.g. "ccache". Only used
+	// for the root package, overridden by QOBS_COMPILER_LAUNCHER
+	CompilerLauncher string `toml:"compiler-launcher"`
+	// archiver of static libraries, e.g. "llvm-ar", and its flags (default "rcs"). Only used
+	// for the root package, overridden by AR and ARFLAGS
+	AR      string   `toml:"ar"`
+	ARFlags []string `toml:"ar-flags"`
+}
+
+const (
+	KindExe       = "exe"
+	KindStaticLib = "staticlib"
+	KindSharedLib = "sharedlib"
+)
+
+// resolveKind validates the target kind, defaulting it from the deprecated `lib` key.
+// Lib is set for every library kind afterwards, so code that only cares whether the
+// target is a library can keep checking it. Header-only targets only provide include directories
+// to their dependents, they can't have sources or a kind
+func (t *TargetSection) resolveKind() error {
+	if t.HeaderOnly {
+		switch {
+		case len(t.Sources) > 0:
+			return errors.New("target.header-only = true can't be combined with target.sources")
+		case t.Lib || t.Kind != "":
+			return errors.New("target.header-only = true can't be combined with target.lib or target.kind")
+		case t.IsPrebuilt():
+			return errors.New("target.header-only = true can't be combined with target.prebuilt-lib")
+		}
+	}
+	if t.IsPrebuilt() {
+		if len(t.Sources) > 0 {
+			return errors.New("target.prebuilt-lib can't be combined with target.sources")
+		}
+		if t.Kind == "" {
+			t.Lib = true
+		}
+	}
+
+	switch t.Kind {
+	case "":
+		t.Kind = KindExe
+		if t.Lib {
+			t.Kind = KindStaticLib
+		}
+	case KindExe:
+		if t.Lib {
+			return errors.New(`target.lib = true conflicts with target.kind = "exe"`)
+		}
+	case KindStaticLib, KindSharedLib:
+	default:
+		return fmt.Errorf("unknown target kind %q, expected %q, %q or %q", t.Kind, KindExe, KindStaticLib, KindSharedLib)
+	}
+	t.Lib = t.Kind != KindExe
+	if t.IsPrebuilt() && !t.Lib {
+		return errors.New(`target.prebuilt-lib conflicts with target.kind = "exe"`)
+	}
+	return nil
+}
+
+// IsPrebuilt reports whether the package provides prebuilt libraries instead of being built
+func (t TargetSection) IsPrebuilt() bool {
+	return len(t.PrebuiltLib) > 0
+}
+
+// builds reports whether the package has a target that's compiled and linked
+func (t TargetSection) builds() bool {
+	return !t.HeaderOnly && !t.IsPrebuilt()
+}
+
+// LinksFor returns the libraries this target links with when building for targetOS,
+// which includes both `links` and the matching `system-libs` entry
+func (t TargetSection) LinksFor(targetOS string) []string {
+	links := slices.Clone(t.Links)
+	return append(links, t.SystemLibs[targetOS]...)
+}
+
+// FrameworkFlags returns the -framework flags this target links with when building for targetOS,
+// none unless it's macOS
+func (t TargetSection) FrameworkFlags(targetOS string) []string {
+	if targetOS != "darwin" {
+		return nil
+	}
+	flags := make([]string, 0, 2*len(t.Frameworks))
+	for _, framework := range t.Frameworks {
+		flags = append(flags, "-framework", framework)
+	}
+	return flags
+}
+
+// TestSection defines a single [[tests]] or [[benches]] entry, which is built into its own executable
+type TestSection struct {
+	Name         string                `toml:"name"`
+	Sources      []string              `toml:"sources"`
+	Defines      map[string]string     `toml:"defines"`
+	Links        []string              `toml:"links"`
+	Cflags       []string              `toml:"cflags"`
+	Dependencies map[string]Dependency `toml:"dependencies"` // test-only dependencies
 }
 
 type Dependency struct {
 	Source          string   `toml:"dep"`
 	DefaultFeatures bool     `toml:"default-features"`
 	Features        []string `toml:"features"`
+	PkgConfig       string   `toml:"pkg-config"`    // system dependency resolved with pkg-config instead of fetched
+	Static          bool     `toml:"static"`        // pass --static to pkg-config
+	WholeArchive    bool     `toml:"whole-archive"` // link every object of the library, even unreferenced ones
+	Optional        bool     `toml:"optional"`      // only used when enabled by a feature, see ResolveFeatures
+}
+
+// sourceKey describes where the dependency comes from, for comparing dependency specs
+func (d Dependency) sourceKey() string {
+	if d.PkgConfig != "" {
+		return "pkg-config:" + d.PkgConfig
+	}
+	return d.Source
+}
+
+// isGlob reports whether a path dependency is a glob expanding to several packages, see
+// expandDependencyGlobs
+func (d Dependency) isGlob() bool {
+	kind, location, err := ClassifyDependency(d.Source)
+	return err == nil && kind == SourcePath && d.PkgConfig == "" && strings.ContainsAny(location, "*?[{")
+}
+
+// expandDependencyGlobs replaces the path dependencies whose source is a glob, e.g.
+// `vendored = "vendor/*"`, with a dependency on each matched directory that has a manifest. They
+// are named after the directory and get the features of the glob entry. The glob is relative to
+// basedir like other path dependencies, and dependencies listed by name take precedence
+func expandDependencyGlobs(deps map[string]Dependency, basedir string) error {
+	expanded := make(map[string]Dependency)
+	for _, name := range slices.Sorted(maps.Keys(deps)) {
+		dep := deps[name]
+		if !dep.isGlob() {
+			continue
+		}
+		delete(deps, name)
+		// the directory the glob starts in may be outside of basedir, e.g. "../vendor/*"
+		base, pattern := doublestar.SplitPattern(filepath.ToSlash(filepath.Clean(dep.Source)))
+		root := filepath.FromSlash(base)
+		if !filepath.IsAbs(root) {
+			root = filepath.Join(basedir, root)
+		}
+		matches, err := doublestar.Glob(os.DirFS(root), pattern)
+		if err != nil {
+			return fmt.Errorf("invalid dependency %q = %q: %w", name, dep.Source, err)
+		}
+		found := false
+		for _, match := range matches {
+			if stat, err := os.Stat(ManifestPath(filepath.Join(root, match))); err != nil || stat.IsDir() {
+				continue
+			}
+			found = true
+			matchDep := dep
+			matchDep.Source = filepath.Join(filepath.FromSlash(base), filepath.FromSlash(match))
+			matchName := filepath.Base(matchDep.Source)
+			if prev, ok := expanded[matchName]; ok && prev.Source != matchDep.Source {
+				return fmt.Errorf("dependency %q = %q matches two packages named %q: %s and %s", name, dep.Source, matchName, prev.Source, matchDep.Source)
+			}
+			expanded[matchName] = matchDep
+		}
+		if !found {
+			return fmt.Errorf("dependency %q = %q matches no packages", name, dep.Source)
+		}
+	}
+	for name, dep := range expanded {
+		if _, ok := deps[name]; !ok {
+			deps[name] = dep
+		}
+	}
+	return nil
 }
 
 func (d *Dependency) UnmarshalTOML(v any) error {
@@ -115,10 +460,21 @@ func (d *Dependency) UnmarshalTOML(v any) error {
 		if df, ok := val["default-features"].(bool); ok {
 			d.DefaultFeatures = df
 		}
+		if static, ok := val["static"].(bool); ok {
+			d.Static = static
+		}
+		if wholeArchive, ok := val["whole-archive"].(bool); ok {
+			d.WholeArchive = wholeArchive
+		}
+		if optional, ok := val["optional"].(bool); ok {
+			d.Optional = optional
+		}
 		if src, ok := val["dep"].(string); ok {
 			d.Source = src
+		} else if module, ok := val["pkg-config"].(string); ok {
+			d.PkgConfig = module
 		} else {
-			return errors.New("dependency table must contain a `dep` key with a source string")
+			return errors.New("dependency table must contain a `dep` key with a source string or a `pkg-config` key with a module name")
 		}
 		if features, ok := val["features"].([]any); ok {
 			for _, f := range features {
@@ -136,13 +492,19 @@ func (d *Dependency) UnmarshalTOML(v any) error {
 // FeaturesSection defines the [features] section
 type FeaturesSection map[string][]string
 
+// ResolveFeatures returns the features of the package enabled by the requested ones, the features
+// they enable in dependencies (`dep/feature`, which also enables the dependency if it's optional)
+// and the optional dependencies they enable. An optional dependency is enabled by `dep:name`, or by
+// a feature with the same name as the dependency
 func (f FeaturesSection) ResolveFeatures(requested []string, useDefault bool) (
 	ownFeatures map[string]bool,
 	depFeatures map[string][]string,
+	enabledDeps map[string]bool,
 	err error,
 ) {
 	ownFeatures = make(map[string]bool)
 	depFeatures = make(map[string][]string)
+	enabledDeps = make(map[string]bool)
 	queue := slices.Clone(requested)
 
 	if useDefault {
@@ -155,12 +517,19 @@ func (f FeaturesSection) ResolveFeatures(requested []string, useDefault bool) (
 		feature := queue[0]
 		queue = queue[1:]
 
+		// handle `dep:name` syntax, which only enables an optional dependency
+		if depName, ok := strings.CutPrefix(feature, "dep:"); ok {
+			enabledDeps[depName] = true
+			continue
+		}
+
 		// handle `dep/feature` syntax
 		if parts := strings.SplitN(feature, "/", 2); len(parts) == 2 {
 			depName, featureName := parts[0], parts[1]
 			if !slices.Contains(depFeatures[depName], featureName) {
 				depFeatures[depName] = append(depFeatures[depName], featureName)
 			}
+			enabledDeps[depName] = true
 			continue
 		}
 
@@ -169,6 +538,7 @@ func (f FeaturesSection) ResolveFeatures(requested []string, useDefault bool) (
 			continue
 		}
 		ownFeatures[feature] = true
+		enabledDeps[feature] = true
 
 		// if this feature enables other features, add them to the queue
 		if subFeatures, ok := f[feature]; ok {
@@ -176,12 +546,90 @@ func (f FeaturesSection) ResolveFeatures(requested []string, useDefault bool) (
 		}
 	}
 
-	return ownFeatures, depFeatures, nil
+	return ownFeatures, depFeatures, enabledDeps, nil
+}
+
+// mergeMode is how a field of a conditional section is merged into the section, set with the
+// merge key of the conditional section, e.g. merge = { sources = "replace" }
+type mergeMode string
+
+const (
+	mergeAppend  mergeMode = "append"  // the default: slices are appended, maps merged, bools OR'd, other fields set unless empty
+	mergePrepend mergeMode = "prepend" // slices only: the values go before the ones of the section
+	mergeReplace mergeMode = "replace" // the field is set to the value of the conditional section, even if it's empty
+)
+
+// mergeKey is the key of conditional sections that sets how their fields are merged, see mergeMode
+const mergeKey = "merge"
+
+// tomlName returns the key of a struct field in TOML
+func tomlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
 }
 
-// mergeStructs merges the fields of the src struct into the dst struct
-func mergeStructs(dst, src any) error {
+// parseMergeModes parses the merge key of the conditional section named header, whose fields are
+// those of the struct type t, into the merge mode of each field. The section has to set every key
+// with a mode, replacing a field with one the section doesn't set would silently clear it
+func parseMergeModes(raw any, section map[string]any, header string, t reflect.Type) (map[string]mergeMode, error) {
+	table, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid [%s].%s: expected a table of keys and \"append\", \"prepend\" or \"replace\"", header, mergeKey)
+	}
+	fields := make(map[string]reflect.Kind)
+	for i := range t.NumField() {
+		if field := t.Field(i); field.IsExported() {
+			fields[tomlName(field)] = field.Type.Kind()
+		}
+	}
+
+	modes := make(map[string]mergeMode, len(table))
+	for _, key := range slices.Sorted(maps.Keys(table)) {
+		kind, ok := fields[key]
+		if !ok {
+			return nil, fmt.Errorf("invalid [%s].%s: unknown key %q", header, mergeKey, key)
+		}
+		if _, ok := section[key]; !ok {
+			return nil, fmt.Errorf("invalid [%s].%s: %q isn't set in the section, set it (e.g. to []) to replace it", header, mergeKey, key)
+		}
+		value, _ := table[key].(string)
+		switch mode := mergeMode(value); mode {
+		case mergeAppend, mergeReplace:
+			modes[key] = mode
+		case mergePrepend:
+			if kind != reflect.Slice {
+				return nil, fmt.Errorf("invalid [%s].%s: %q isn't a list and can't be prepended to", header, mergeKey, key)
+			}
+			modes[key] = mode
+		default:
+			return nil, fmt.Errorf("invalid [%s].%s: %q must be \"append\", \"prepend\" or \"replace\", got %v", header, mergeKey, key, table[key])
+		}
+	}
+	return modes, nil
+}
+
+// mergeStructs merges the fields of the src struct into the dst struct, or the entries of the
+// src map into the dst map. modes sets how struct fields are merged by their TOML key, fields
+// without a mode are appended, see mergeMode
+func mergeStructs(dst, src any, modes map[string]mergeMode) error {
 	dstVal := reflect.ValueOf(dst)
+	if dstVal.Kind() == reflect.Pointer && dstVal.Elem().Kind() == reflect.Map {
+		// sections keyed by name, like [dependencies]: entries of src replace those of dst
+		srcVal := reflect.Indirect(reflect.ValueOf(src))
+		if srcVal.Type() != dstVal.Elem().Type() {
+			return fmt.Errorf("dst and src must be of the same map type")
+		}
+		if srcVal.Len() > 0 && dstVal.Elem().IsNil() {
+			dstVal.Elem().Set(reflect.MakeMap(srcVal.Type()))
+		}
+		for _, key := range srcVal.MapKeys() {
+			dstVal.Elem().SetMapIndex(key, srcVal.MapIndex(key))
+		}
+		return nil
+	}
 	if dstVal.Kind() != reflect.Pointer || dstVal.Elem().Kind() != reflect.Struct {
 		return fmt.Errorf("dst must be a pointer to a struct")
 	}
@@ -209,6 +657,18 @@ func mergeStructs(dst, src any) error {
 			continue
 		}
 
+		switch modes[tomlName(dstElem.Type().Field(i))] {
+		case mergeReplace:
+			dstField.Set(srcField)
+			continue
+		case mergePrepend:
+			if !srcField.IsNil() {
+				merged := reflect.MakeSlice(dstField.Type(), 0, srcField.Len()+dstField.Len())
+				dstField.Set(reflect.AppendSlice(reflect.AppendSlice(merged, srcField), dstField))
+			}
+			continue
+		}
+
 		switch dstField.Kind() {
 		case reflect.Slice:
 			if !srcField.IsNil() {
@@ -243,18 +703,68 @@ func mustMarshal(v any) string {
 	return string(b)
 }
 
-// unmarshalSection is a helper to parse sections without conditional logic
-func unmarshalSection(rawCfg map[string]any, name string, dst any) error {
-	if data, ok := rawCfg[name]; ok {
-		if err := toml.Unmarshal([]byte(mustMarshal(data)), dst); err != nil {
-			return fmt.Errorf("failed to parse [%s] section: %w", name, err)
+// decodeValue decodes a raw value (as produced by toml.Unmarshal into an any) into dst
+func decodeValue(v any, dst any) error {
+	return toml.NewDecoder(strings.NewReader(mustMarshal(v))).EnableUnmarshalerInterface().Decode(dst)
+}
+
+// decodeTable decodes the raw table data of the section named header into dst, a pointer to a
+// struct or a map of structs. Every key is decoded on its own so that errors name the offending
+// key, e.g. "[profile.release].opt-level"
+func decodeTable(data map[string]any, header string, dst any) error {
+	dstVal := reflect.ValueOf(dst).Elem()
+	switch {
+	case dstVal.Kind() == reflect.Struct:
+		for _, key := range slices.Sorted(maps.Keys(data)) {
+			if err := decodeValue(map[string]any{key: data[key]}, dst); err != nil {
+				return fmt.Errorf("invalid [%s].%s: %w", header, key, err)
+			}
+		}
+		return nil
+	case dstVal.Kind() == reflect.Map && dstVal.Type().Elem().Kind() == reflect.Struct:
+		if dstVal.IsNil() {
+			dstVal.Set(reflect.MakeMap(dstVal.Type()))
+		}
+		for _, key := range slices.Sorted(maps.Keys(data)) {
+			table, ok := data[key].(map[string]any)
+			if !ok {
+				return fmt.Errorf("invalid [%s].%s: expected a table", header, key)
+			}
+			keyVal := reflect.ValueOf(key)
+			elem := reflect.New(dstVal.Type().Elem())
+			if existing := dstVal.MapIndex(keyVal); existing.IsValid() {
+				elem.Elem().Set(existing)
+			}
+			if err := decodeTable(table, header+"."+key, elem.Interface()); err != nil {
+				return err
+			}
+			dstVal.SetMapIndex(keyVal, elem.Elem())
 		}
+		return nil
+	}
+
+	if err := decodeValue(data, dst); err != nil {
+		return fmt.Errorf("invalid [%s] section: %w", header, err)
 	}
 	return nil
 }
 
-// unmarshalConditionalSection is a helper to parse, evaluate and merge multiple sections with conditional logic
-func unmarshalConditionalSection[T any](rawCfg map[string]any, name string, dst *T, env ConfigEnv) error {
+// unmarshalSection is a helper to parse sections without conditional logic
+func unmarshalSection(rawCfg map[string]any, name string, dst any) error {
+	data, ok := rawCfg[name]
+	if !ok {
+		return nil
+	}
+	table, ok := data.(map[string]any)
+	if !ok {
+		return fmt.Errorf("invalid [%s] section format: expected a table", name)
+	}
+	return decodeTable(table, name, dst)
+}
+
+// unmarshalConditionalSection is a helper to parse, evaluate and merge multiple sections with conditional logic.
+// The headers of the conditional sections that matched are appended to matched
+func unmarshalConditionalSection[T any](rawCfg map[string]any, name string, dst *T, env ConfigEnv, matched *[]string) error {
 	sectionData, ok := rawCfg[name]
 	if !ok {
 		return nil
@@ -267,36 +777,49 @@ func unmarshalConditionalSection[T any](rawCfg map[string]any, name string, dst
 
 	baseFields := make(map[string]any)
 	conditionalFields := make(map[string]map[string]any)
+	// only struct sections like [target] can set how their conditional sections are merged
+	mergeable := isStructWithoutField(dst, mergeKey)
 
 	for key, val := range sectionMap {
+		if key == mergeKey && mergeable {
+			return fmt.Errorf("invalid [%s].%s: only conditional sections like [%s.'target_os == \"linux\"'] can set how they're merged", name, mergeKey, name)
+		}
 		if subMap, ok := val.(map[string]any); ok {
-			_, err := expr.Compile(key, env.exprOptions()...)
-			if err == nil {
+			_, err := env.compileExpr(key)
+			switch {
+			case err == nil:
 				conditionalFields[key] = subMap
-			} else {
+			case isStructWithoutField(dst, key):
+				// not a table field of the section, so it must have been meant as a condition
+				return fmt.Errorf("invalid expression in [%s.'%s']: %w", name, key, err)
+			default:
 				baseFields[key] = val
 			}
 		} else {
-			// HACK: would be great to have go-toml recognize the UnmarshalTOML method :/
-			if name == "dependencies" {
-				if s, ok := val.(string); ok {
-					baseFields[key] = map[string]any{"dep": s}
-					continue
-				}
-			}
-
 			baseFields[key] = val
 		}
 	}
+	if name == "dependencies" {
+		// HACK: would be great to have go-toml recognize the UnmarshalTOML method :/
+		for key, val := range baseFields {
+			baseFields[key] = expandDependency(val)
+		}
+	}
 
 	if len(baseFields) > 0 {
-		if err := toml.Unmarshal([]byte(mustMarshal(baseFields)), dst); err != nil {
-			return fmt.Errorf("failed to parse base [%s] section: %w", name, err)
+		if err := decodeTable(baseFields, name, dst); err != nil {
+			return err
 		}
 	}
 
-	for expression, condMap := range conditionalFields {
-		program, err := expr.Compile(expression, env.exprOptions()...)
+	// evaluate conditional sections in a stable order, so that the last matching
+	// section always wins when multiple sections set the same scalar field
+	expressions := slices.Sorted(maps.Keys(conditionalFields))
+	setBy := make(map[string]scalarField) // field name -> last conditional value
+
+	for _, expression := range expressions {
+		condMap := conditionalFields[expression]
+		program, err := env.compileExpr(expression)
 		if err != nil {
 			return fmt.Errorf("failed to compile expression for [%s.%q]: %w", name, expression, err)
 		}
@@ -311,13 +834,146 @@ func unmarshalConditionalSection[T any](rawCfg map[string]any, name string, dst
 			continue
 		}
 
+		if name == "dependencies" {
+			// conditional dependencies can use the string form, too
+			expanded := make(map[string]any, len(condMap))
+			for key, val := range condMap {
+				expanded[key] = expandDependency(val)
+			}
+			condMap = expanded
+		}
+
+		var modes map[string]mergeMode
+		if raw, ok := condMap[mergeKey]; ok && mergeable {
+			if modes, err = parseMergeModes(raw, condMap, fmt.Sprintf("%s.'%s'", name, expression), reflect.TypeOf(dst).Elem()); err != nil {
+				return err
+			}
+			condMap = maps.Clone(condMap)
+			delete(condMap, mergeKey)
+		}
+
 		var condSection T
-		if err := toml.Unmarshal([]byte(mustMarshal(condMap)), &condSection); err != nil {
-			return fmt.Errorf("failed to parse conditional section [%s.%q]: %w", name, expression, err)
+		if err := decodeTable(condMap, fmt.Sprintf("%s.'%s'", name, expression), &condSection); err != nil {
+			return err
 		}
-		if err := mergeStructs(dst, condSection); err != nil {
+		for _, field := range scalarFields(condSection) {
+			if prev, ok := setBy[field.name]; ok && !reflect.DeepEqual(prev.value, field.value) {
+				msg.Warn("conditional sections [%s.%q] and [%s.%q] both set %q; using the value from [%s.%q]",
+					name, prev.expression, name, expression, field.name, name, expression)
+			}
+			field.expression = expression
+			setBy[field.name] = field
+		}
+		if err := mergeStructs(dst, condSection, modes); err != nil {
 			return fmt.Errorf("failed to merge conditional section [%s.%q]: %w", name, expression, err)
 		}
+		*matched = append(*matched, fmt.Sprintf("[%s.'%s']", name, expression))
+	}
+
+	return nil
+}
+
+// expandDependency turns a dependency given as a string into the table form, and turns on the
+// default features of the dependency unless the table says otherwise, like UnmarshalTOML does
+func expandDependency(val any) any {
+	switch dep := val.(type) {
+	case string:
+		return map[string]any{"dep": dep, "default-features": true}
+	case map[string]any:
+		if _, ok := dep["default-features"]; !ok {
+			dep = maps.Clone(dep)
+			dep["default-features"] = true
+		}
+		return dep
+	}
+	return val
+}
+
+// isStructWithoutField reports whether dst points to a struct that has no field called key
+func isStructWithoutField(dst any, key string) bool {
+	t := reflect.TypeOf(dst).Elem()
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for i := range t.NumField() {
+		if tomlName(t.Field(i)) == key {
+			return false
+		}
+	}
+	return true
+}
+
+// scalarField is a non-zero scalar field set by a conditional section
+type scalarField struct {
+	name       string
+	value      any
+	expression string
+}
+
+// scalarFields returns the non-zero fields of a struct that mergeStructs overwrites
+// instead of merging (i.e. everything except slices, maps and bools)
+func scalarFields(v any) []scalarField {
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []scalarField
+	for i := range val.NumField() {
+		field := val.Type().Field(i)
+		fieldVal := val.Field(i)
+		if !field.IsExported() || fieldVal.IsZero() {
+			continue
+		}
+		switch fieldVal.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Bool:
+			continue
+		}
+
+		fields = append(fields, scalarField{name: tomlName(field), value: fieldVal.Interface()})
+	}
+	return fields
+}
+
+// unmarshalTests is a helper to parse the [[tests]] or [[benches]] array, named by key
+func unmarshalTests(rawCfg map[string]any, key string, dst *[]TestSection) error {
+	data, ok := rawCfg[key]
+	if !ok {
+		return nil
+	}
+
+	tests, ok := data.([]any)
+	if !ok {
+		return fmt.Errorf("invalid [[%s]] format: expected an array of tables", key)
+	}
+
+	seen := make(map[string]bool)
+	for i, t := range tests {
+		testMap, ok := t.(map[string]any)
+		if !ok {
+			return fmt.Errorf("invalid [[%s]] entry #%d: expected a table", key, i+1)
+		}
+
+		// HACK: same as in unmarshalConditionalSection, go-toml doesn't recognize UnmarshalTOML
+		if deps, ok := testMap["dependencies"].(map[string]any); ok {
+			for name, dep := range deps {
+				deps[name] = expandDependency(dep)
+			}
+		}
+
+		var test TestSection
+		if err := toml.Unmarshal([]byte(mustMarshal(testMap)), &test); err != nil {
+			return fmt.Errorf("failed to parse [[%s]] entry #%d: %w", key, i+1, err)
+		}
+		if test.Name == "" {
+			return fmt.Errorf("[[%s]] entry #%d is missing a name", key, i+1)
+		}
+		if seen[test.Name] {
+			return fmt.Errorf("duplicate name %q in [[%s]]", test.Name, key)
+		}
+		seen[test.Name] = true
+
+		*dst = append(*dst, test)
 	}
 
 	return nil
@@ -344,7 +1000,7 @@ func evaluateString(s string, env ConfigEnv) (string, error) {
 		builder.WriteString(s[lastIndex:fullMatchStart])
 
 		expression := strings.TrimSpace(s[expressionStart:expressionEnd])
-		program, err := expr.Compile(expression, env.exprOptions()...)
+		program, err := env.compileExpr(expression)
 		if err != nil {
 			return "", fmt.Errorf("failed to compile expression %q: %w", expression, err)
 		}
@@ -363,11 +1019,13 @@ func evaluateString(s string, env ConfigEnv) (string, error) {
 	return builder.String(), nil
 }
 
-// processExpressions recursively walks the parsed TOML data and evaluates expressions in strings
+// processExpressions recursively walks the parsed TOML data and evaluates expressions in strings.
+// Table keys are visited in sorted order and arrays in index order
 func processExpressions(data any, env ConfigEnv) (any, error) {
 	switch v := data.(type) {
 	case map[string]any:
-		for key, val := range v {
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			val := v[key]
 			processedVal, err := processExpressions(val, env)
 			if err != nil {
 				return nil, err
@@ -391,16 +1049,42 @@ func processExpressions(data any, env ConfigEnv) (any, error) {
 	}
 }
 
+// ParseConfig parses a config and resolves its features, expressions and conditional sections.
+//
+// Evaluation order is fixed so that the same config always resolves to the same result:
+// features are resolved in sorted order, then {{...}} expressions are evaluated depth-first with
+// table keys in sorted order, then the [package], [dependencies], [profile] and [target] sections
+// are parsed in that order, with conditional sections merged in sorted order of their expressions
 func ParseConfig(rdr io.Reader, env ConfigEnv, defaultFeatures bool) (*Config, error) {
+	rawConfig, err := decodeTOML(rdr, "")
+	if err != nil {
+		return nil, err
+	}
+	return parseRawConfig(rawConfig, env, defaultFeatures)
+}
+
+// decodeTOML decodes a TOML manifest. Syntax errors point at the offending line and column of
+// the file at path (if known) and show the lines around it
+func decodeTOML(rdr io.Reader, path string) (map[string]any, error) {
 	var rawConfig map[string]any
-	dec := toml.NewDecoder(rdr)
-	if err := dec.Decode(&rawConfig); err != nil {
-		if derr, ok := err.(*toml.DecodeError); ok {
-			return nil, errors.New(derr.String())
+	err := toml.NewDecoder(rdr).Decode(&rawConfig)
+	if derr, ok := err.(*toml.DecodeError); ok {
+		row, col := derr.Position()
+		where := fmt.Sprintf("line %d, column %d", row, col)
+		if path != "" {
+			where = fmt.Sprintf("%s:%d:%d", path, row, col)
 		}
-		return nil, err
+		return nil, fmt.Errorf("%s: %s\n%s", where, strings.TrimPrefix(derr.Error(), "toml: "), derr.String())
+	}
+	if err != nil && path != "" {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
 	}
+	return rawConfig, err
+}
 
+// parseRawConfig is ParseConfig for an already decoded manifest, holding the same types
+// go-toml decodes into
+func parseRawConfig(rawConfig map[string]any, env ConfigEnv, defaultFeatures bool) (*Config, error) {
 	// parse/resolve features
 	var featuresSection FeaturesSection
 	if err := unmarshalSection(rawConfig, "features", &featuresSection); err != nil {
@@ -413,7 +1097,8 @@ func ParseConfig(rdr io.Reader, env ConfigEnv, defaultFeatures bool) (*Config, e
 			requestedFeatures = append(requestedFeatures, feature)
 		}
 	}
-	enabledFeatures, depFeatures, err := featuresSection.ResolveFeatures(requestedFeatures, defaultFeatures)
+	slices.Sort(requestedFeatures)
+	enabledFeatures, depFeatures, enabledDeps, err := featuresSection.ResolveFeatures(requestedFeatures, defaultFeatures)
 	if err != nil {
 		return nil, err
 	}
@@ -421,6 +1106,12 @@ func ParseConfig(rdr io.Reader, env ConfigEnv, defaultFeatures bool) (*Config, e
 	// add features to env and move on with the rest of the config
 	env2 := env
 	env2.Features = enabledFeatures
+	// the version is available to expressions as long as it isn't an expression itself
+	if pkg, ok := rawConfig["package"].(map[string]any); ok {
+		if version, ok := pkg["version"].(string); ok && !strings.Contains(version, "{{") {
+			env2.PackageVersion = version
+		}
+	}
 
 	// process exprs in strings (e.g. "{{ environ[...] }}")
 	processedConfig, err := processExpressions(rawConfig, env2)
@@ -430,26 +1121,88 @@ func ParseConfig(rdr io.Reader, env ConfigEnv, defaultFeatures bool) (*Config, e
 	rawConfig = processedConfig.(map[string]any)
 
 	cfg := new(Config)
-	cfg.Profile = defaultProfiles
+	cfg.Profile = maps.Clone(defaultProfiles)
 	cfg.Features = featuresSection
+	cfg.enabledFeatures = enabledFeatures
+	cfg.env = env2
 	cfg.enabledDepFeatures = depFeatures
 
 	if err := unmarshalSection(rawConfig, "package", &cfg.Package); err != nil {
 		return nil, err
 	}
-	if err := unmarshalConditionalSection(rawConfig, "dependencies", &cfg.Dependencies, env2); err != nil {
+	// workspace roots don't have to be packages themselves
+	if _, isWorkspace := rawConfig["workspace"]; cfg.Package.Name != "" || !isWorkspace {
+		if err := ValidatePackageName(cfg.Package.Name); err != nil {
+			return nil, fmt.Errorf("invalid [package].name: %w", err)
+		}
+	}
+	if cfg.Package.Version != "" {
+		if err := ValidatePackageVersion(cfg.Package.Version); err != nil {
+			return nil, fmt.Errorf("invalid [package].version: %w", err)
+		}
+	}
+	if err := unmarshalSection(rawConfig, "env", &cfg.Env); err != nil {
 		return nil, err
 	}
-	if err := unmarshalConditionalSection(rawConfig, "profile", &cfg.Profile, env2); err != nil {
+	if err := unmarshalSection(rawConfig, "workspace", &cfg.Workspace); err != nil {
 		return nil, err
 	}
-	if err := unmarshalConditionalSection(rawConfig, "target", &cfg.Target, env2); err != nil {
+	if err := unmarshalConditionalSection(rawConfig, "dependencies", &cfg.Dependencies, env2, &cfg.matchedConditions); err != nil {
+		return nil, err
+	}
+	// optional dependencies that no enabled feature asks for aren't part of the package at all
+	for name, dep := range cfg.Dependencies {
+		if dep.Optional && !enabledDeps[name] {
+			delete(cfg.Dependencies, name)
+		}
+	}
+	if err := expandDependencyGlobs(cfg.Dependencies, env.basedir); err != nil {
+		return nil, err
+	}
+	if err := unmarshalConditionalSection(rawConfig, "profile", &cfg.Profile, env2, &cfg.matchedConditions); err != nil {
+		return nil, err
+	}
+	if err := unmarshalConditionalSection(rawConfig, "target", &cfg.Target, env2, &cfg.matchedConditions); err != nil {
+		return nil, err
+	}
+	if err := cfg.Target.resolveKind(); err != nil {
+		return nil, err
+	}
+	if err := unmarshalTests(rawConfig, "tests", &cfg.Tests); err != nil {
+		return nil, err
+	}
+	if err := unmarshalTests(rawConfig, "benches", &cfg.Benches); err != nil {
 		return nil, err
 	}
 
 	return cfg, nil
 }
 
+// Expanded returns the config after evaluating all expressions and merging all conditional
+// sections as TOML, preceded by comments describing the environment it was resolved in
+func (c Config) Expanded() (string, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# target_os = %q, target_arch = %q\n", c.env.TargetOS, c.env.TargetArch)
+	fmt.Fprintf(&sb, "# host_os = %q, host_arch = %q\n", c.env.HostOS, c.env.HostArch)
+	fmt.Fprintf(&sb, "# enabled features: %s\n", strings.Join(c.EnabledFeatures(), ", "))
+	if len(c.matchedConditions) > 0 {
+		sb.WriteString("# matched conditional sections:\n")
+		for _, cond := range c.matchedConditions {
+			sb.WriteString("#   " + cond + "\n")
+		}
+	} else {
+		sb.WriteString("# no conditional sections matched\n")
+	}
+	sb.WriteByte('\n')
+
+	data, err := toml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	sb.Write(data)
+	return sb.String(), nil
+}
+
 // ParseConfigFromFile parses and validates a config file from a filepath
 func ParseConfigFromFile(path string, env ConfigEnv, defaultFeatures bool) (*Config, error) {
 	f, err := os.Open(path)
@@ -458,40 +1211,161 @@ func ParseConfigFromFile(path string, env ConfigEnv, defaultFeatures bool) (*Con
 	}
 	defer f.Close()
 
-	return ParseConfig(bufio.NewReader(f), env, defaultFeatures)
+	// TOML is the default, YAML and JSON manifests are decoded into the same raw types
+	var rawConfig any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.NewDecoder(bufio.NewReader(f)).Decode(&rawConfig); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	case ".json":
+		dec := json.NewDecoder(bufio.NewReader(f))
+		dec.UseNumber()
+		if err := dec.Decode(&rawConfig); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	default:
+		rawMap, err := decodeTOML(bufio.NewReader(f), path)
+		if err != nil {
+			return nil, err
+		}
+		return parseRawConfig(rawMap, env, defaultFeatures)
+	}
+
+	rawConfig, err = normalizeRawValue(rawConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	rawMap, ok := rawConfig.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("failed to parse %s: expected a mapping at the top level", path)
+	}
+	return parseRawConfig(rawMap, env, defaultFeatures)
+}
+
+// manifestNames are the manifest file names of a package, in order of preference
+var manifestNames = []string{"Qobs.toml", "Qobs.yaml", "Qobs.yml", "Qobs.json"}
+
+// ManifestPath returns the path of the manifest of the package in dir,
+// or the path of its Qobs.toml if it has none
+func ManifestPath(dir string) string {
+	for _, name := range manifestNames {
+		path := filepath.Join(dir, name)
+		if stat, err := os.Stat(path); err == nil && !stat.IsDir() {
+			return path
+		}
+	}
+	return filepath.Join(dir, manifestNames[0])
+}
+
+// normalizeRawValue converts values decoded from a YAML or JSON manifest to the types go-toml
+// decodes into, so that the rest of the parsing doesn't depend on the manifest format
+func normalizeRawValue(v any) (any, error) {
+	switch val := v.(type) {
+	case map[string]any:
+		for key, item := range val {
+			normalized, err := normalizeRawValue(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			val[key] = normalized
+		}
+		return val, nil
+	case map[any]any:
+		return nil, errors.New("mapping keys must be strings")
+	case []any:
+		for i, item := range val {
+			normalized, err := normalizeRawValue(item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			val[i] = normalized
+		}
+		return val, nil
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i, nil
+		}
+		return val.Float64()
+	case int:
+		return int64(val), nil
+	case uint64:
+		return int64(val), nil
+	case nil:
+		return nil, errors.New("null values are not supported")
+	}
+	return v, nil
 }
 
 //
 // expr-lang helpers
 //
 
-func (cfg Config) RunBuildScript(env ConfigEnv) error {
+// BuildScriptOutput is what a build script adds to the target of its package when it returns a
+// map instead of a bool, e.g. {"defines": {"HAVE_FOO": "1"}, "ldflags": ["-lfoo"]}
+type BuildScriptOutput struct {
+	Cflags  []string          `toml:"cflags"`
+	Ldflags []string          `toml:"ldflags"`
+	Defines map[string]string `toml:"defines"`
+}
+
+// RunBuildScript runs the build script of the package, which either returns a bool (false fails
+// the build) or a map with the cflags, ldflags and defines it adds, see BuildScriptOutput
+func (cfg Config) RunBuildScript(env ConfigEnv) (BuildScriptOutput, error) {
+	var output BuildScriptOutput
 	if cfg.Package.Build == "" {
-		return nil
+		return output, nil
 	}
 
-	program, err := expr.Compile(cfg.Package.Build, env.exprOptions()...)
+	env.PackageVersion = cfg.Package.Version
+	program, err := env.compileExpr(cfg.Package.Build)
 	if err != nil {
-		return fmt.Errorf("failed to compile build script for package %q: %w", cfg.Package.Name, err)
+		return output, fmt.Errorf("failed to compile build script for package %q: %w", cfg.Package.Name, err)
 	}
 	result, err := expr.Run(program, env)
 	if err != nil {
-		return fmt.Errorf("failed to run build script for package %q: %w", cfg.Package.Name, err)
+		return output, fmt.Errorf("failed to run build script for package %q: %w", cfg.Package.Name, err)
 	}
 
-	if result, ok := result.(bool); !ok || !result {
-		return fmt.Errorf("build script for package %q returned false\n%s", cfg.Package.Name, cfg.Package.Build)
+	switch result := result.(type) {
+	case bool:
+		if !result {
+			return output, fmt.Errorf("build script for package %q returned false\n%s", cfg.Package.Name, cfg.Package.Build)
+		}
+	case map[string]any:
+		for key, val := range result {
+			if key != "cflags" && key != "ldflags" && key != "defines" {
+				return output, fmt.Errorf("build script for package %q returned unknown key %q, expected cflags, ldflags or defines", cfg.Package.Name, key)
+			}
+			// defines can be numbers too, e.g. {"HAVE_FOO": 1}
+			if defines, ok := val.(map[string]any); ok && key == "defines" {
+				for name, v := range defines {
+					if v != nil {
+						defines[name] = fmt.Sprint(v)
+					}
+				}
+			}
+		}
+		if err := decodeTable(result, "package.build", &output); err != nil {
+			return output, fmt.Errorf("build script for package %q: %w", cfg.Package.Name, err)
+		}
+	default:
+		return output, fmt.Errorf("build script for package %q must return a bool or a map of cflags, ldflags and defines, got %T", cfg.Package.Name, result)
 	}
-
-	return nil
+	return output, nil
 }
 
+// ConfigEnv is the environment expressions are evaluated in. The host is the machine qobs runs
+// on, the target is the one the package is built for, which only differs when cross compiling
 type ConfigEnv struct {
-	TargetOS   string            `expr:"target_os"`
-	TargetArch string            `expr:"target_arch"`
-	Environ    map[string]string `expr:"environ"`
-	Features   map[string]bool   `expr:"-"`
-	basedir    string
+	TargetOS       string            `expr:"target_os"`
+	TargetArch     string            `expr:"target_arch"`
+	HostOS         string            `expr:"host_os"`
+	HostArch       string            `expr:"host_arch"`
+	Environ        map[string]string `expr:"environ"`
+	PackageVersion string            `expr:"package_version"` // [package].version of the config being parsed
+	Features       map[string]bool   `expr:"-"`
+	basedir        string
 }
 
 func (e ConfigEnv) exprOptions() []expr.Option {
@@ -512,6 +1386,47 @@ func (e ConfigEnv) exprOptions() []expr.Option {
 	}
 }
 
+type compiledExpr struct {
+	program *vm.Program
+	err     error
+}
+
+var (
+	exprCacheMu sync.Mutex
+	exprCache   = make(map[string]compiledExpr) // features + expression -> compiled program
+)
+
+// compileExpr compiles an expression with the options of this env, caching the result (including
+// compile errors). The compiled `feature()` function depends on the enabled features, so they are
+// a part of the cache key
+func (e ConfigEnv) compileExpr(expression string) (*vm.Program, error) {
+	var key strings.Builder
+	for _, feature := range slices.Sorted(maps.Keys(e.Features)) {
+		if e.Features[feature] {
+			key.WriteString(feature)
+			key.WriteByte(',')
+		}
+	}
+	key.WriteByte(0)
+	key.WriteString(expression)
+
+	exprCacheMu.Lock()
+	defer exprCacheMu.Unlock()
+
+	if compiled, ok := exprCache[key.String()]; ok {
+		return compiled.program, compiled.err
+	}
+	program, err := expr.Compile(expression, e.exprOptions()...)
+	exprCache[key.String()] = compiledExpr{program: program, err: err}
+	return program, err
+}
+
+// environment variables that override the target of a cross build, which defaults to the host
+const (
+	TargetOSEnv   = "QOBS_TARGET_OS"
+	TargetArchEnv = "QOBS_TARGET_ARCH"
+)
+
 func NewConfigEnv(basedir string) ConfigEnv {
 	environ := make(map[string]string)
 	for _, e := range os.Environ() {
@@ -520,13 +1435,22 @@ func NewConfigEnv(basedir string) ConfigEnv {
 		}
 	}
 
-	return ConfigEnv{
+	env := ConfigEnv{
 		TargetOS:   runtime.GOOS,
 		TargetArch: runtime.GOARCH,
+		HostOS:     runtime.GOOS,
+		HostArch:   runtime.GOARCH,
 		Environ:    environ,
 		Features:   make(map[string]bool),
 		basedir:    basedir,
 	}
+	if targetOS := environ[TargetOSEnv]; targetOS != "" {
+		env.TargetOS = targetOS
+	}
+	if targetArch := environ[TargetArchEnv]; targetArch != "" {
+		env.TargetArch = targetArch
+	}
+	return env
 }
 
 func NewConfigEnvWithFeatures(basedir string, features map[string]bool) ConfigEnv {
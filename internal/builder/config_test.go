@@ -0,0 +1,417 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/qobs-build/qobs/internal/msg"
+)
+
+func TestValidateProfileName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"debug", true},
+		{"release", true},
+		{"my-profile_2", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"_deps", false},
+		{"../..", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"/tmp", false},
+	}
+	for _, tt := range tests {
+		err := ValidateProfileName(tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("ValidateProfileName(%q) = %v, want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// parseTestConfig parses a manifest for linux/amd64
+func parseTestConfig(t *testing.T, manifest string) (*Config, error) {
+	t.Helper()
+	env := NewConfigEnv(t.TempDir())
+	env.TargetOS, env.TargetArch = "linux", "amd64"
+	return ParseConfig(strings.NewReader(manifest), env, true)
+}
+
+func TestConditionalMerge(t *testing.T) {
+	const base = `
+[package]
+name = "p"
+
+[target]
+sources = ["a.c"]
+cflags = ["-O2"]
+c-std = "c99"
+`
+	tests := []struct {
+		name    string
+		section string
+		sources []string
+		cflags  []string
+		cStd    string
+	}{
+		{
+			name:    "slices are appended",
+			section: `sources = ["b.c"]`,
+			sources: []string{"a.c", "b.c"},
+			cflags:  []string{"-O2"},
+			cStd:    "c99",
+		},
+		{
+			name:    "scalars are overridden",
+			section: `c-std = "c11"`,
+			sources: []string{"a.c"},
+			cflags:  []string{"-O2"},
+			cStd:    "c11",
+		},
+		{
+			name:    "prepend",
+			section: "cflags = [\"-g\"]\nmerge = { cflags = \"prepend\" }",
+			sources: []string{"a.c"},
+			cflags:  []string{"-g", "-O2"},
+			cStd:    "c99",
+		},
+		{
+			name:    "replace",
+			section: "sources = [\"linux.c\"]\nmerge = { sources = \"replace\" }",
+			sources: []string{"linux.c"},
+			cflags:  []string{"-O2"},
+			cStd:    "c99",
+		},
+		{
+			name:    "replace with an empty list",
+			section: "cflags = []\nmerge = { cflags = \"replace\" }",
+			sources: []string{"a.c"},
+			cflags:  []string{},
+			cStd:    "c99",
+		},
+		{
+			name:    "section that doesn't match",
+			section: "",
+			sources: []string{"a.c"},
+			cflags:  []string{"-O2"},
+			cStd:    "c99",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := `target_os == "linux"`
+			if tt.section == "" {
+				condition, tt.section = `target_os == "windows"`, `sources = ["win.c"]`
+			}
+			cfg, err := parseTestConfig(t, base+"\n[target.'"+condition+"']\n"+tt.section+"\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			target := cfg.Target
+			if !slices.Equal(target.Sources, tt.sources) {
+				t.Errorf("sources = %q, want %q", target.Sources, tt.sources)
+			}
+			if !slices.Equal(target.Cflags, tt.cflags) {
+				t.Errorf("cflags = %q, want %q", target.Cflags, tt.cflags)
+			}
+			if target.CStd != tt.cStd {
+				t.Errorf("c-std = %q, want %q", target.CStd, tt.cStd)
+			}
+		})
+	}
+}
+
+func TestConditionalMergeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		section string
+		want    string
+	}{
+		{"replace a key the section doesn't set", `cflags = ["-g"]` + "\nmerge = { sources = \"replace\" }", "isn't set in the section"},
+		{"prepend to a scalar", `c-std = "c11"` + "\nmerge = { c-std = \"prepend\" }", "can't be prepended to"},
+		{"unknown key", `cflags = ["-g"]` + "\nmerge = { nope = \"replace\" }", "unknown key"},
+		{"unknown mode", `cflags = ["-g"]` + "\nmerge = { cflags = \"merge\" }", "must be"},
+	}
+	for _, tt := range tests {
+		manifest := "[package]\nname = \"p\"\n\n[target]\nsources = [\"a.c\"]\n\n[target.'target_os == \"linux\"']\n" + tt.section + "\n"
+		_, err := parseTestConfig(t, manifest)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestConflictingConditionals(t *testing.T) {
+	// both match on linux/amd64, the sections are merged in the sorted order of their expressions
+	const manifest = `
+[package]
+name = "p"
+
+[target]
+sources = ["a.c"]
+
+[target.'target_os == "linux"']
+c-std = "c11"
+
+[target.'target_arch == "amd64"']
+c-std = "c17"
+`
+	var messages bytes.Buffer
+	msg.SetOutput(&messages)
+	defer msg.SetOutput(os.Stdout)
+	for range 20 {
+		cfg, err := parseTestConfig(t, manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Target.CStd != "c11" {
+			t.Fatalf("c-std = %q, want the value of the last section in sorted order", cfg.Target.CStd)
+		}
+	}
+	if !strings.Contains(messages.String(), `both set "c-std"`) {
+		t.Errorf("no warning about the conflict in %q", messages.String())
+	}
+}
+
+func TestResolutionIsStable(t *testing.T) {
+	const manifest = `
+[package]
+name = "p"
+version = "1.2.3"
+
+[features]
+default = ["a", "b"]
+a = ["c"]
+b = ["c"]
+c = []
+
+[target]
+sources = ["a.c", "{{ target_os }}.c"]
+defines = { VERSION = "{{ package_version }}", OS = "{{ target_os }}", ARCH = "{{ target_arch }}" }
+
+[target.'feature("a")']
+sources = ["feature_a.c"]
+c-std = "c11"
+
+[target.'feature("b")']
+sources = ["feature_b.c"]
+c-std = "c17"
+
+[target.'target_os == "linux"']
+cflags = ["-pthread"]
+`
+	var messages bytes.Buffer
+	msg.SetOutput(&messages)
+	defer msg.SetOutput(os.Stdout)
+	var first string
+	for i := range 50 {
+		cfg, err := parseTestConfig(t, manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expanded, err := cfg.Expanded()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = expanded
+		} else if expanded != first {
+			t.Fatalf("resolution %d differs from the first one:\n%s\nfirst:\n%s", i, expanded, first)
+		}
+	}
+	for _, want := range []string{"feature_a.c", "feature_b.c", "linux.c", "VERSION = '1.2.3'"} {
+		if !strings.Contains(first, want) {
+			t.Errorf("resolved config doesn't contain %q:\n%s", want, first)
+		}
+	}
+}
+
+func TestPackageNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{"", "package name is empty"},
+		{"a/b", "may only contain"},
+		{"../evil", "may only contain"},
+		{"my app", "may only contain"},
+		{"my_lib-2", ""},
+	}
+	for _, tt := range tests {
+		err := ValidatePackageName(tt.name)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("ValidatePackageName(%q) = %v, want %q", tt.name, err, tt.wantErr)
+		}
+		_, err = parseTestConfig(t, fmt.Sprintf("[package]\nname = %q\n", tt.name))
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), "invalid [package].name")) {
+			t.Errorf("parsing package %q: err = %v", tt.name, err)
+		}
+	}
+	// workspace roots don't need a name
+	if _, err := parseTestConfig(t, "[workspace]\nmembers = []\n"); err != nil {
+		t.Errorf("workspace without a package name: %v", err)
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Qobs.toml")
+	if err := os.WriteFile(path, []byte("[package]\nname = \"p\"\nversion = 1.0.0.0\n\n[target]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ParseConfigFromFile(path, NewConfigEnv(dir), true)
+	if err == nil {
+		t.Fatal("malformed manifest was parsed")
+	}
+	for _, want := range []string{path + ":3:14: ", "3| version = 1.0.0.0\n", "|              ~"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error doesn't contain %q:\n%v", want, err)
+		}
+	}
+
+	_, err = parseTestConfig(t, "[package]\nname = \"p\"\n\n[target.'target_os ==']\nsources = []\n")
+	if want := "invalid expression in [target.'target_os ==']"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("err = %v, want %q", err, want)
+	}
+}
+
+func TestHeaderOnly(t *testing.T) {
+	tests := []struct {
+		target  string
+		wantErr string
+	}{
+		{"header-only = true\ninclude-dirs = [\"include\"]\n", ""},
+		{"header-only = true\nsources = [\"a.c\"]\n", "can't be combined with target.sources"},
+		{"header-only = true\nlib = true\n", "can't be combined with target.lib or target.kind"},
+		{"header-only = true\nkind = \"staticlib\"\n", "can't be combined with target.lib or target.kind"},
+		{"header-only = true\nprebuilt-lib = [\"lib/libfoo.a\"]\n", "can't be combined with target.prebuilt-lib"},
+	}
+	for _, tt := range tests {
+		cfg, err := parseTestConfig(t, "[package]\nname = \"p\"\n\n[target]\n"+tt.target)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%q: %v", tt.target, err)
+			} else if cfg.Target.builds() {
+				t.Errorf("%q: header-only target is built", tt.target)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: err = %v, want %q", tt.target, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFrameworkFlags(t *testing.T) {
+	target := TargetSection{Frameworks: []string{"Cocoa", "Metal"}}
+	if got, want := target.FrameworkFlags("darwin"), []string{"-framework", "Cocoa", "-framework", "Metal"}; !slices.Equal(got, want) {
+		t.Errorf("FrameworkFlags(darwin) = %q, want %q", got, want)
+	}
+	for _, targetOS := range []string{"linux", "windows"} {
+		if got := target.FrameworkFlags(targetOS); len(got) > 0 {
+			t.Errorf("FrameworkFlags(%s) = %q, want none", targetOS, got)
+		}
+	}
+}
+
+func TestProfileErrorsNameTheProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		want    string
+	}{
+		{"opt-level of the wrong type", "[profile.release]\nopt-level = true\n", "[profile.release].opt-level"},
+		{"other field of the wrong type", "[profile.fast]\ndebug = \"yes\"\n", "[profile.fast].debug"},
+		{"conditional profile", "[profile.'target_os == \"linux\"'.release]\nopt-level = 1.5\n", `[profile.'target_os == "linux"'.release].opt-level`},
+	}
+	for _, tt := range tests {
+		_, err := parseTestConfig(t, "[package]\nname = \"p\"\n\n"+tt.profile)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want it to name %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestManifestFormats(t *testing.T) {
+	manifests := map[string]string{
+		"Qobs.toml": `
+[package]
+name = "p"
+version = "1.0.0"
+
+[target]
+sources = ["a.c", "{{ target_os }}.c"]
+defines = { VERSION = "{{ package_version }}" }
+
+[target.'target_os == "linux"']
+links = ["pthread"]
+
+[profile.release]
+opt-level = 3
+
+[dependencies]
+foo = { dep = "gh:someone/foo", features = ["bar"] }
+`,
+		"Qobs.yaml": `
+package:
+  name: p
+  version: 1.0.0
+target:
+  sources: [a.c, "{{ target_os }}.c"]
+  defines:
+    VERSION: "{{ package_version }}"
+  'target_os == "linux"':
+    links: [pthread]
+profile:
+  release:
+    opt-level: 3
+dependencies:
+  foo:
+    dep: gh:someone/foo
+    features: [bar]
+`,
+		"Qobs.json": `{
+  "package": {"name": "p", "version": "1.0.0"},
+  "target": {
+    "sources": ["a.c", "{{ target_os }}.c"],
+    "defines": {"VERSION": "{{ package_version }}"},
+    "target_os == \"linux\"": {"links": ["pthread"]}
+  },
+  "profile": {"release": {"opt-level": 3}},
+  "dependencies": {"foo": {"dep": "gh:someone/foo", "features": ["bar"]}}
+}`,
+	}
+	resolved := make(map[string]string)
+	for name, manifest := range manifests {
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{name: manifest})
+		if got := ManifestPath(dir); got != filepath.Join(dir, name) {
+			t.Fatalf("ManifestPath = %s, want %s", got, name)
+		}
+		env := NewConfigEnv(dir)
+		env.TargetOS, env.TargetArch = "linux", "amd64"
+		cfg, err := ParseConfigFromFile(ManifestPath(dir), env, true)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if resolved[name], err = cfg.Expanded(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"'linux.c'", "VERSION = '1.0.0'", "links = ['pthread']", "opt-level = '3'", "features = ['bar']"} {
+		if !strings.Contains(resolved["Qobs.toml"], want) {
+			t.Errorf("TOML manifest resolved without %q:\n%s", want, resolved["Qobs.toml"])
+		}
+	}
+	for _, name := range []string{"Qobs.yaml", "Qobs.json"} {
+		if resolved[name] != resolved["Qobs.toml"] {
+			t.Errorf("%s resolved differently from Qobs.toml:\n%s\nTOML:\n%s", name, resolved[name], resolved["Qobs.toml"])
+		}
+	}
+}
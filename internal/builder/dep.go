@@ -3,13 +3,17 @@ package builder
 import (
 	"archive/tar"
 	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -20,9 +24,13 @@ import (
 
 	"github.com/fatih/color"
 	"github.com/go-git/go-git/v6"
+	"github.com/go-git/go-git/v6/config"
 	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/transport"
 	"github.com/qobs-build/qobs/internal/index"
 	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/qobs-build/qobs/internal/retry"
+	"github.com/ulikunitz/xz"
 )
 
 var depShortcuts = map[string]string{
@@ -35,47 +43,97 @@ var depShortcuts = map[string]string{
 
 var (
 	errIllegalDep = errors.New("empty or illegal dependency string")
+
+	// Frozen forbids fetching dependencies: ones that aren't fetched yet are an error instead
+	Frozen bool
 )
 
-func fetchDependency(dep, basedir string, toWhere *string) (string, error) {
-	if dep == "" {
-		return "", errIllegalDep
-	}
+// kinds of dependency sources
+const (
+	SourceGit     = "git"
+	SourceArchive = "archive"
+	SourcePath    = "path"
+)
 
-	ensureDir := func() {
-		if err := os.MkdirAll(*toWhere, 0755); err != nil && !os.IsExist(err) {
-			msg.Fatal("%v", err)
-		}
+// ClassifyDependency returns what kind of source a dependency string is, along with the
+// URL or path it's fetched from
+func ClassifyDependency(dep string) (kind, location string, err error) {
+	if dep == "" {
+		return "", "", errIllegalDep
 	}
 
 	// check for `git:` prefix, e.g. git:https://github.com/zeozeozeo/libhelloworld.git
 	const gitPrefix = "git:"
 	if strings.HasPrefix(dep, gitPrefix) {
-		ensureDir()
-		return cloneGitRepo(dep[len(gitPrefix):], *toWhere)
+		return SourceGit, dep[len(gitPrefix):], nil
 	}
 	// or suffix
 	if strings.HasSuffix(dep, ".git") {
-		ensureDir()
-		return cloneGitRepo(dep, *toWhere)
+		return SourceGit, dep, nil
 	}
 
 	// check for shortcut prefix, e.g. gh:zeozeozeo/libhelloworld
 	for shortcut, url := range depShortcuts {
 		if strings.HasPrefix(dep, shortcut) {
-			ensureDir()
-			return cloneGitRepo(url+dep[len(shortcut):], *toWhere)
+			return SourceGit, url + dep[len(shortcut):], nil
 		}
 	}
 
 	// if it's a URL, it should be an archive
 	if isURL(dep) {
-		ensureDir()
-		return downloadAndExtractArchive(dep, *toWhere)
+		return SourceArchive, dep, nil
 	}
 
 	// otherwise it's a path
-	*toWhere = filepath.Join(basedir, dep)
+	return SourcePath, dep, nil
+}
+
+// DependencySource returns the dependency string of the Git repository at url, like the ones of
+// index entries, which a package can list in [dependencies]: a shortcut like gh:user/repo where
+// there's one, otherwise the URL, prefixed with git: unless it ends with .git since other URLs
+// are archives
+func DependencySource(url string) string {
+	repo := strings.TrimSuffix(url, ".git")
+	for shortcut, prefix := range depShortcuts {
+		if path, ok := strings.CutPrefix(repo, prefix); ok && path != "" {
+			return shortcut + path
+		}
+	}
+	if kind, _, err := ClassifyDependency(url); err == nil && kind == SourceGit {
+		return url
+	}
+	return "git:" + url
+}
+
+func fetchDependency(ctx context.Context, dep, basedir string, toWhere *string) (string, error) {
+	kind, location, err := ClassifyDependency(dep)
+	if err != nil {
+		return "", err
+	}
+	if Frozen && kind != SourcePath {
+		return "", fmt.Errorf("%s isn't in %s and fetching it is forbidden with --frozen", dep, *toWhere)
+	}
+
+	ensureDir := func() {
+		if err := os.MkdirAll(*toWhere, 0755); err != nil && !os.IsExist(err) {
+			msg.Fatal("%v", err)
+		}
+	}
+
+	switch kind {
+	case SourceGit:
+		ensureDir()
+		return cloneGitRepo(ctx, location, *toWhere)
+	case SourceArchive:
+		ensureDir()
+		return downloadAndExtractArchive(ctx, location, *toWhere)
+	}
+
+	if filepath.IsAbs(location) {
+		*toWhere = filepath.Clean(location)
+	} else {
+		*toWhere = filepath.Join(basedir, location)
+	}
 	return dep, nil
 }
 
@@ -85,15 +143,23 @@ func isURL(maybeURL string) bool {
 }
 
 type gitURL struct {
-	cleanURL    string
-	branch      string
-	commitOrTag string
+	cleanURL       string
+	branch         string
+	commitOrTag    string
+	expectedCommit string // full hash that HEAD must resolve to after checkout
 }
 
 // someone/something@master#0.1.0
 // someone/something@feature-branch#12345abc
 // someone/something#12345abc
+// someone/something@master#0.1.0#commit=<full hash>
+// someone/something#commit=<full hash>
 func parseGitURL(rawURL string) (res gitURL) {
+	if parts := strings.SplitN(rawURL, "#commit=", 2); len(parts) == 2 {
+		rawURL = parts[0]
+		res.expectedCommit = parts[1]
+	}
+
 	parts := strings.SplitN(rawURL, "#", 2)
 	baseURL := parts[0]
 	if len(parts) == 2 {
@@ -114,55 +180,200 @@ func parseGitURL(rawURL string) (res gitURL) {
 }
 
 // cloneGitRepo clones a Git remote into the specified directory
-func cloneGitRepo(url, toWhere string) (string, error) {
+func cloneGitRepo(ctx context.Context, url, toWhere string) (string, error) {
 	parsedURL := parseGitURL(url)
+	if parsedURL.expectedCommit != "" && !plumbing.IsHash(parsedURL.expectedCommit) {
+		return toWhere, fmt.Errorf("expected commit %q of %s must be a full commit hash", parsedURL.expectedCommit, parsedURL.cleanURL)
+	}
+
+	fmt.Fprintf(msg.Output(), "  %s %s\n", color.HiGreenString("Cloning"), parsedURL.cleanURL)
+
+	if parsedURL.commitOrTag == "" {
+		// we can do a shallow clone of the latest commit
+		if _, err := cloneWithRetry(ctx, parsedURL, toWhere, parsedURL.cloneOptions(1)); err != nil {
+			return toWhere, describeFetchError(parsedURL, err)
+		}
+	} else if err := checkoutPinnedRevision(ctx, parsedURL, toWhere); err != nil {
+		return toWhere, err
+	}
+	if err := verifyCheckedOutCommit(parsedURL, toWhere); err != nil {
+		// don't leave the unexpected checkout behind for the next build to pick up
+		os.RemoveAll(toWhere)
+		return toWhere, err
+	}
 
-	cloneOptions := &git.CloneOptions{
-		URL:               parsedURL.cleanURL,
-		Progress:          &msg.IndentWriter{Indent: "    ", W: os.Stdout},
+	maybeFetchConfigFromIndex(ctx, toWhere, parsedURL.cleanURL)
+
+	return toWhere, nil
+}
+
+// cloneWithRetry clones a repository into toWhere, starting over with an empty directory after
+// transient network failures
+func cloneWithRetry(ctx context.Context, u gitURL, toWhere string, opts *git.CloneOptions) (*git.Repository, error) {
+	var repo *git.Repository
+	retrying := false
+	err := retry.Do(ctx, "cloning "+u.cleanURL, func() error {
+		if retrying {
+			if err := os.RemoveAll(toWhere); err != nil {
+				return err
+			}
+		}
+		retrying = true
+		var err error
+		repo, err = git.PlainCloneContext(ctx, toWhere, opts)
+		return err
+	})
+	return repo, err
+}
+
+func (u gitURL) cloneOptions(depth int) *git.CloneOptions {
+	opts := &git.CloneOptions{
+		URL:               u.cleanURL,
+		Progress:          &msg.IndentWriter{Indent: "    ", W: msg.Output()},
 		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+		Depth:             depth,
 	}
+	if u.branch != "" {
+		opts.ReferenceName = plumbing.NewBranchReferenceName(u.branch)
+		opts.SingleBranch = true
+	}
+	return opts
+}
 
-	if parsedURL.commitOrTag == "" {
-		cloneOptions.Depth = 1 // we can do a shallow clone of the latest commit
+// checkoutPinnedRevision fetches only the pinned commit or tag of the remote and checks it out.
+// If the server can't serve it directly (no shallow support, no fetching of arbitrary commits,
+// or an abbreviated commit hash was given), it falls back to a full clone
+func checkoutPinnedRevision(ctx context.Context, u gitURL, toWhere string) error {
+	err := fetchRevisionShallow(ctx, u, toWhere)
+	if err == nil {
+		return nil
+	}
+	if isNetworkError(err) || errors.Is(err, transport.ErrRepositoryNotFound) ||
+		errors.Is(err, transport.ErrAuthenticationRequired) || errors.Is(err, transport.ErrAuthorizationFailed) {
+		return describeFetchError(u, err)
 	}
 
-	if parsedURL.branch != "" {
-		cloneOptions.ReferenceName = plumbing.NewBranchReferenceName(parsedURL.branch)
-		cloneOptions.SingleBranch = true
+	// start over with a full clone
+	if err := os.RemoveAll(filepath.Join(toWhere, git.GitDirName)); err != nil {
+		return err
+	}
+	repo, err := cloneWithRetry(ctx, u, toWhere, u.cloneOptions(0))
+	if err != nil {
+		return describeFetchError(u, err)
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(u.commitOrTag))
+	if err != nil {
+		return fmt.Errorf("ref %q not found on remote %s", u.commitOrTag, u.cleanURL)
 	}
+	return checkoutHash(repo, u.commitOrTag, *hash)
+}
 
-	fmt.Printf("  %s %s\n", color.HiGreenString("Cloning"), parsedURL.cleanURL)
+// fetchRevisionShallow initializes a repository in toWhere and fetches just the pinned commit
+// (which must be a full hash) or tag, with a depth of 1
+func fetchRevisionShallow(ctx context.Context, u gitURL, toWhere string) error {
+	repo, err := git.PlainInit(toWhere, false)
+	if err != nil {
+		return err
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{u.cleanURL},
+	}); err != nil {
+		return err
+	}
 
-	repo, err := git.PlainClone(toWhere, cloneOptions)
+	revision := u.commitOrTag
+	refspec := config.RefSpec(fmt.Sprintf("+refs/tags/%s:refs/tags/%s", revision, revision))
+	if plumbing.IsHash(revision) {
+		refspec = config.RefSpec(revision + ":refs/heads/qobs-pinned")
+	}
+	err = retry.Do(ctx, "fetching "+u.cleanURL, func() error {
+		return repo.FetchContext(ctx, &git.FetchOptions{
+			RefSpecs: []config.RefSpec{refspec},
+			Depth:    1,
+			Tags:     plumbing.NoTags,
+			Progress: &msg.IndentWriter{Indent: "    ", W: msg.Output()},
+		})
+	})
 	if err != nil {
-		return toWhere, err
+		return err
 	}
 
-	if parsedURL.commitOrTag != "" {
-		w, err := repo.Worktree()
-		if err != nil {
-			return toWhere, fmt.Errorf("could not get worktree: %w", err)
-		}
+	hash, err := repo.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return err
+	}
+	return checkoutHash(repo, revision, *hash)
+}
 
-		revision := parsedURL.commitOrTag
-		hash, err := repo.ResolveRevision(plumbing.Revision(revision))
-		if err != nil {
-			return toWhere, fmt.Errorf("could not resolve revision %q: %w", revision, err)
-		}
+// checkoutHash checks out hash in the worktree of repo and updates its submodules
+func checkoutHash(repo *git.Repository, revision string, hash plumbing.Hash) error {
+	w, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("could not get worktree: %w", err)
+	}
 
-		err = w.Checkout(&git.CheckoutOptions{
-			Hash:  *hash,
-			Force: true,
-		})
-		if err != nil {
-			return toWhere, fmt.Errorf("failed to checkout %q: %w", revision, err)
-		}
+	err = w.Checkout(&git.CheckoutOptions{
+		Hash:  hash,
+		Force: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to checkout %q: %w", revision, err)
+	}
+
+	submodules, err := w.Submodules()
+	if err != nil {
+		return fmt.Errorf("could not read submodules: %w", err)
+	}
+	if err := submodules.Update(&git.SubmoduleUpdateOptions{
+		Init:              true,
+		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+	}); err != nil {
+		return fmt.Errorf("failed to update submodules: %w", err)
+	}
+	return nil
+}
+
+// verifyCheckedOutCommit makes sure that HEAD of the repository in dir is the commit the
+// dependency expects, so that a moved branch or a re-pointed tag is noticed
+func verifyCheckedOutCommit(u gitURL, dir string) error {
+	if u.expectedCommit == "" {
+		return nil
 	}
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("could not resolve HEAD of %s: %w", u.cleanURL, err)
+	}
+	if actual := head.Hash().String(); !strings.EqualFold(u.expectedCommit, actual) {
+		return fmt.Errorf("commit mismatch for %s: expected %s, got %s", u.cleanURL, strings.ToLower(u.expectedCommit), actual)
+	}
+	return nil
+}
 
-	maybeFetchConfigFromIndex(toWhere, parsedURL.cleanURL)
+// describeFetchError tells a missing ref or repository apart from a network error
+func describeFetchError(u gitURL, err error) error {
+	switch {
+	case errors.Is(err, git.ErrRemoteRefNotFound), errors.Is(err, plumbing.ErrReferenceNotFound):
+		ref := u.commitOrTag
+		if ref == "" {
+			ref = u.branch
+		}
+		return fmt.Errorf("ref %q not found on remote %s: %w", ref, u.cleanURL, err)
+	case errors.Is(err, transport.ErrRepositoryNotFound):
+		return fmt.Errorf("repository %s not found: %w", u.cleanURL, err)
+	case isNetworkError(err):
+		return fmt.Errorf("network error while fetching %s: %w", u.cleanURL, err)
+	}
+	return fmt.Errorf("failed to fetch %s: %w", u.cleanURL, err)
+}
 
-	return toWhere, nil
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
 }
 
 // determineArchiveFormat checks the archive format using the file magic, Content-Type and the URL suffix
@@ -174,18 +385,24 @@ func determineArchiveFormat(filePath string, resp *http.Response, originalURL st
 	}
 	defer file.Close()
 
-	header := make([]byte, 4)
+	header := make([]byte, 6)
 	_, err = file.Read(header)
 	if err != nil && err != io.EOF {
 		return "", err
 	}
 
-	if bytes.Equal(header, []byte{0x50, 0x4b, 0x03, 0x04}) {
+	if bytes.Equal(header[:4], []byte{0x50, 0x4b, 0x03, 0x04}) {
 		return "zip", nil
 	}
 	if bytes.Equal(header[:2], []byte{0x1f, 0x8b}) {
 		return "tar.gz", nil
 	}
+	if bytes.Equal(header, []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}) {
+		return "tar.xz", nil
+	}
+	if bytes.Equal(header[:3], []byte("BZh")) {
+		return "tar.bz2", nil
+	}
 
 	// fallback to mimetype
 	contentType := resp.Header.Get("Content-Type")
@@ -194,6 +411,10 @@ func determineArchiveFormat(filePath string, resp *http.Response, originalURL st
 		return "zip", nil
 	case "application/gzip", "application/x-gzip", "application/x-tar":
 		return "tar.gz", nil
+	case "application/x-xz":
+		return "tar.xz", nil
+	case "application/x-bzip2", "application/x-bzip":
+		return "tar.bz2", nil
 	}
 
 	// fallback to URL suffix
@@ -203,8 +424,12 @@ func determineArchiveFormat(filePath string, resp *http.Response, originalURL st
 		switch ext {
 		case ".zip":
 			return "zip", nil
-		case ".tgz", ".tar.gz":
+		case ".tgz", ".gz":
 			return "tar.gz", nil
+		case ".txz", ".xz":
+			return "tar.xz", nil
+		case ".tbz2", ".tbz", ".bz2":
+			return "tar.bz2", nil
 		}
 	}
 
@@ -212,7 +437,7 @@ func determineArchiveFormat(filePath string, resp *http.Response, originalURL st
 }
 
 // downloadAndExtractArchive downloads and extracts an archive
-func downloadAndExtractArchive(downloadURL, toWhere string) (string, error) {
+func downloadAndExtractArchive(ctx context.Context, downloadURL, toWhere string) (string, error) {
 	cleanURL := downloadURL
 	var expectedMD5 string
 	if parts := strings.SplitN(downloadURL, "#MD5=", 2); len(parts) == 2 {
@@ -220,17 +445,7 @@ func downloadAndExtractArchive(downloadURL, toWhere string) (string, error) {
 		expectedMD5 = parts[1]
 	}
 
-	fmt.Printf("  %s %s\n", color.HiGreenString("Fetching"), cleanURL)
-
-	resp, err := http.Get(cleanURL)
-	if err != nil {
-		return "", fmt.Errorf("failed to download from url %s: %w", cleanURL, err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to download from url %s: status code %d", cleanURL, resp.StatusCode)
-	}
+	fmt.Fprintf(msg.Output(), "  %s %s\n", color.HiGreenString("Fetching"), cleanURL)
 
 	tmpFile, err := os.CreateTemp(toWhere, "archive-*.tmp")
 	if err != nil {
@@ -240,23 +455,26 @@ func downloadAndExtractArchive(downloadURL, toWhere string) (string, error) {
 	defer os.Remove(archivePath)
 
 	hash := md5.New()
-
-	pb := &msg.ProgressBar{
-		Total:  resp.ContentLength,
-		Indent: 1,
-		W:      os.Stdout,
-		Start:  time.Now(),
-	}
-
-	_, err = io.Copy(io.MultiWriter(tmpFile, hash, pb), resp.Body)
+	var resp *http.Response
+	err = retry.Do(ctx, "downloading "+cleanURL, func() error {
+		// start over with an empty file after a failed attempt
+		if err := tmpFile.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		hash.Reset()
+		resp, err = downloadTo(ctx, cleanURL, io.MultiWriter(tmpFile, hash))
+		return err
+	})
 	if err != nil {
 		tmpFile.Close()
-		return "", fmt.Errorf("failed to write to temporary file: %w", err)
+		return "", err
 	}
 	if err := tmpFile.Close(); err != nil {
 		return "", fmt.Errorf("failed to close temporary file: %w", err)
 	}
-	pb.Finish()
 
 	if expectedMD5 != "" {
 		calculatedMD5 := hex.EncodeToString(hash.Sum(nil))
@@ -276,17 +494,47 @@ func downloadAndExtractArchive(downloadURL, toWhere string) (string, error) {
 		extractErr = unzip(archivePath, toWhere)
 	case "tar.gz":
 		extractErr = untar(archivePath, toWhere)
+	case "tar.xz":
+		extractErr = untarXz(archivePath, toWhere)
+	case "tar.bz2":
+		extractErr = untarBz2(archivePath, toWhere)
 	}
 
 	if extractErr != nil {
 		return "", fmt.Errorf("failed to extract archive: %w", extractErr)
 	}
 
-	maybeFetchConfigFromIndex(toWhere, cleanURL)
+	maybeFetchConfigFromIndex(ctx, toWhere, cleanURL)
 
 	return toWhere, nil
 }
 
+// downloadTo downloads url to w, showing a progress bar
+func downloadTo(ctx context.Context, url string, w io.Writer) (*http.Response, error) {
+	resp, err := httpGet(ctx, url)
+	if err != nil {
+		return nil, downloadError(url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &retry.StatusError{URL: url, Code: resp.StatusCode}
+	}
+
+	pb := &msg.ProgressBar{
+		Total:  resp.ContentLength,
+		Indent: 1,
+		W:      msg.Output(),
+		Start:  time.Now(),
+	}
+	if _, err := io.Copy(io.MultiWriter(w, pb), resp.Body); err != nil {
+		pb.Clear()
+		return nil, downloadError(url, err)
+	}
+	pb.Finish()
+	return resp, nil
+}
+
 // unzip extracts a zip archive to a destination directory
 func unzip(src, dest string) error {
 	r, err := zip.OpenReader(src)
@@ -295,39 +543,21 @@ func unzip(src, dest string) error {
 	}
 	defer r.Close()
 
-	var rootDir string
-	if len(r.File) > 0 {
-		firstPath := r.File[0].Name
-		isSingleRoot := true
-		if r.File[0].FileInfo().IsDir() {
-			rootDir = firstPath
-			for _, f := range r.File {
-				if !strings.HasPrefix(f.Name, rootDir) {
-					isSingleRoot = false
-					break
-				}
-			}
-		} else {
-			isSingleRoot = false
-		}
-		if !isSingleRoot {
-			rootDir = ""
-		}
+	entries := make([]archiveEntry, 0, len(r.File))
+	for _, f := range r.File {
+		entries = append(entries, archiveEntry{archiveEntryName(f.Name), f.FileInfo().IsDir()})
 	}
+	rootDir := archiveRoot(entries)
 
 	for _, f := range r.File {
-		name := f.Name
-		if rootDir != "" {
-			name = strings.TrimPrefix(name, rootDir)
-		}
+		name := stripArchiveRoot(archiveEntryName(f.Name), rootDir)
 		if name == "" {
 			continue
 		}
 
-		fpath := filepath.Join(dest, name)
-
-		if !strings.HasPrefix(fpath, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return fmt.Errorf("illegal file path: %s", fpath)
+		fpath, err := archiveEntryPath(dest, name)
+		if err != nil {
+			return err
 		}
 
 		if f.FileInfo().IsDir() {
@@ -339,7 +569,7 @@ func unzip(src, dest string) error {
 			return err
 		}
 
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+		outFile, err := createArchiveFile(fpath, f.Mode())
 		if err != nil {
 			return err
 		}
@@ -363,23 +593,41 @@ func unzip(src, dest string) error {
 
 // untar extracts a tar.gz archive to a destination directory
 func untar(src, dest string) error {
+	return extractTar(src, dest, func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	})
+}
+
+// untarXz extracts a tar.xz archive to a destination directory
+func untarXz(src, dest string) error {
+	return extractTar(src, dest, func(r io.Reader) (io.Reader, error) {
+		return xz.NewReader(bufio.NewReader(r))
+	})
+}
+
+// untarBz2 extracts a tar.bz2 archive to a destination directory
+func untarBz2(src, dest string) error {
+	return extractTar(src, dest, func(r io.Reader) (io.Reader, error) {
+		return bzip2.NewReader(bufio.NewReader(r)), nil
+	})
+}
+
+// decompressor turns a compressed archive into an uncompressed tar stream
+type decompressor func(r io.Reader) (io.Reader, error)
+
+// readTar calls fn for every entry of the tar archive src, stopping at the first error
+func readTar(src string, decompress decompressor, fn func(tr *tar.Reader, header *tar.Header) error) error {
 	file, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	gzr, err := gzip.NewReader(file)
+	r, err := decompress(file)
 	if err != nil {
 		return err
 	}
-	defer gzr.Close()
-
-	tr := tar.NewReader(gzr)
-
-	var rootDir string
-	firstEntry := true
-
+	tr := tar.NewReader(r)
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
@@ -388,29 +636,41 @@ func untar(src, dest string) error {
 		if err != nil {
 			return err
 		}
+		if err := fn(tr, header); err != nil {
+			return err
+		}
+	}
+}
 
-		if firstEntry {
-			if header.Typeflag == tar.TypeDir {
-				rootDir = header.Name
-			}
-			firstEntry = false
-		} else {
-			if rootDir != "" && !strings.HasPrefix(header.Name, rootDir) {
-				rootDir = ""
-			}
+// extractTar extracts the tar archive src, compressed as undone by decompress, to a destination directory.
+// the archive is read twice: once to find its root directory and once to extract it
+func extractTar(src, dest string, decompress decompressor) error {
+	var entries []archiveEntry
+	err := readTar(src, decompress, func(_ *tar.Reader, header *tar.Header) error {
+		if isTarMetadata(header) {
+			// e.g. the pax_global_header at the start of git archive and GitHub tarballs
+			return nil
 		}
+		entries = append(entries, archiveEntry{archiveEntryName(header.Name), header.Typeflag == tar.TypeDir})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	rootDir := archiveRoot(entries)
 
-		name := header.Name
-		if rootDir != "" {
-			name = strings.TrimPrefix(name, rootDir)
+	return readTar(src, decompress, func(tr *tar.Reader, header *tar.Header) error {
+		if isTarMetadata(header) {
+			return nil
 		}
+		name := stripArchiveRoot(archiveEntryName(header.Name), rootDir)
 		if name == "" {
-			continue
+			return nil
 		}
 
-		target := filepath.Join(dest, name)
-		if !strings.HasPrefix(target, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return fmt.Errorf("illegal file path: %s", target)
+		target, err := archiveEntryPath(dest, name)
+		if err != nil {
+			return err
 		}
 
 		switch header.Typeflag {
@@ -424,7 +684,7 @@ func untar(src, dest string) error {
 			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
 				return err
 			}
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+			f, err := createArchiveFile(target, os.FileMode(header.Mode))
 			if err != nil {
 				return err
 			}
@@ -433,16 +693,182 @@ func untar(src, dest string) error {
 			if err != nil {
 				return err
 			}
+		case tar.TypeSymlink:
+			if err := checkSymlinkTarget(dest, target, header.Linkname); err != nil {
+				return fmt.Errorf("illegal symlink %s -> %s: %w", name, header.Linkname, err)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(filepath.FromSlash(header.Linkname), target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			// hard links name another entry of the archive
+			linkname := stripArchiveRoot(archiveEntryName(header.Linkname), rootDir)
+			source, err := archiveEntryPath(dest, linkname)
+			if err != nil {
+				return fmt.Errorf("illegal hard link %s -> %s: %w", name, header.Linkname, err)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// isTarMetadata reports whether a tar entry holds pax records instead of a file
+func isTarMetadata(header *tar.Header) bool {
+	return header.Typeflag == tar.TypeXGlobalHeader || header.Typeflag == tar.TypeXHeader
+}
+
+// archiveEntry is the normalized name of an archive entry and whether it's a directory
+type archiveEntry struct {
+	name  string
+	isDir bool
+}
+
+// archiveRoot returns the top level directory of an archive, with a trailing slash, if it's the only top level
+// entry and contains everything else, as in release archives of the form name-1.2.3/... otherwise it returns ""
+// and the archive is extracted as is. The directory doesn't need an entry of its own
+func archiveRoot(entries []archiveEntry) string {
+	var root string
+	for _, e := range entries {
+		if e.name == "" {
+			continue
+		}
+		top, _, nested := strings.Cut(e.name, "/")
+		if !nested && !e.isDir {
+			// a file at the top level
+			return ""
+		}
+		if root == "" {
+			root = top
+		} else if top != root {
+			return ""
+		}
+	}
+	if root == "" {
+		return ""
+	}
+	return root + "/"
+}
+
+// stripArchiveRoot returns the name of an entry relative to the root directory of its archive, see
+// archiveRoot. The entry of the root itself becomes ""
+func stripArchiveRoot(name, root string) string {
+	if root == "" {
+		return name
+	}
+	if name+"/" == root {
+		return ""
+	}
+	return strings.TrimPrefix(name, root)
+}
+
+// archiveEntryName normalizes the name of a zip or tar entry to a relative slash separated path,
+// dropping leading slashes of entries with absolute names and the ./ of archives created from "."
+func archiveEntryName(name string) string {
+	name = strings.TrimLeft(strings.ReplaceAll(name, "\\", "/"), "/")
+	for strings.HasPrefix(name, "./") {
+		name = strings.TrimLeft(name[2:], "/")
+	}
+	if name == "." {
+		return ""
+	}
+	return name
+}
+
+// archiveEntryPath returns the path an archive entry called name is extracted to, making sure that
+// it's inside dest and doesn't go through a symlink extracted earlier, which could point anywhere
+func archiveEntryPath(dest, name string) (string, error) {
+	target := filepath.Join(dest, filepath.FromSlash(name))
+	if !strings.HasPrefix(target, filepath.Clean(dest)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("illegal file path: %s", target)
+	}
+
+	rel, err := filepath.Rel(dest, filepath.Dir(target))
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return target, nil
+	}
+	dir := filepath.Clean(dest)
+	for part := range strings.SplitSeq(rel, string(os.PathSeparator)) {
+		dir = filepath.Join(dir, part)
+		if stat, err := os.Lstat(dir); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("illegal file path: %s goes through the symlink %s", target, dir)
+		}
+	}
+	return target, nil
+}
+
+// checkSymlinkTarget checks that a symlink at target, inside dest, pointing to linkname can't
+// lead outside of dest, whatever else the archive extracts later. The link may only go up with
+// leading "..", through the real directories it's in, and it may not go through other symlinks
+func checkSymlinkTarget(dest, target, linkname string) error {
+	if filepath.IsAbs(linkname) || strings.HasPrefix(linkname, "/") || strings.HasPrefix(linkname, "\\") {
+		return errors.New("absolute link target")
+	}
+	dir := filepath.Dir(target)
+	descended := false
+	for part := range strings.SplitSeq(strings.ReplaceAll(linkname, "\\", "/"), "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			// after a link or directory that may itself be a link, ".." could go anywhere
+			if descended {
+				return errors.New("link target goes back up with \"..\" after descending")
+			}
+			dir = filepath.Dir(dir)
+		default:
+			descended = true
+			dir = filepath.Join(dir, part)
+			if stat, err := os.Lstat(dir); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("link target goes through the symlink %s", dir)
+			}
+		}
+		if !isInsideDir(dest, dir) {
+			return errors.New("link target is outside of the archive")
 		}
 	}
+	return nil
+}
+
+// createArchiveFile creates a regular file extracted from an archive. Whatever is already at path is
+// removed first instead of being opened, so that a symlink there can't redirect the write elsewhere
+func createArchiveFile(path string, mode os.FileMode) (*os.File, error) {
+	if stat, err := os.Lstat(path); err == nil {
+		if stat.IsDir() {
+			return nil, fmt.Errorf("illegal file path: %s is a directory", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, mode.Perm())
+}
+
+// isInsideDir reports whether path is dir or inside of it
+func isInsideDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
 }
 
-func maybeFetchConfigFromIndex(path, url string) {
-	if stat, err := os.Stat(filepath.Join(path, "Qobs.toml")); err == nil && !stat.IsDir() {
+func maybeFetchConfigFromIndex(ctx context.Context, path, url string) {
+	if stat, err := os.Stat(ManifestPath(path)); err == nil && !stat.IsDir() {
 		return // already has config in repo
 	}
 
-	index, err := index.GetIndexAnyhow()
+	index, err := index.GetIndexAnyhow(ctx)
 	if err != nil {
 		msg.Error("couldn't fetch index, continuing without: %v", err)
 		return
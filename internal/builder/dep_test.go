@@ -0,0 +1,538 @@
+package builder
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v6"
+	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/go-git/go-git/v6/plumbing/object"
+	"github.com/qobs-build/qobs/internal/retry"
+)
+
+// testEntry is an entry of an archive written by writeTarGz or writeZip
+type testEntry struct {
+	name string
+	link string // symlink target, the entry is a regular file if empty
+	body string
+	dir  bool
+	pax  bool // a pax global header like git archive writes, tar only
+}
+
+func writeTarGz(t *testing.T, path string, entries []testEntry) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+		switch {
+		case e.pax:
+			header = &tar.Header{Name: e.name, Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "0123456789abcdef"}}
+		case e.dir:
+			header.Typeflag, header.Mode, header.Size = tar.TypeDir, 0755, 0
+		case e.link != "":
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, e.link, 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeZip(t *testing.T, path string, entries []testEntry) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		body := e.body
+		switch {
+		case e.dir:
+			header.Name += "/"
+			header.SetMode(os.ModeDir | 0755)
+		case e.link != "":
+			header.SetMode(os.ModeSymlink | 0777)
+			body = e.link
+		default:
+			header.SetMode(0644)
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// archiveFormats extract archives written by the matching writer
+var archiveFormats = []struct {
+	name    string
+	ext     string
+	write   func(t *testing.T, path string, entries []testEntry)
+	extract func(src, dest string) error
+}{
+	{"tar", ".tar.gz", writeTarGz, untar},
+	{"zip", ".zip", writeZip, unzip},
+}
+
+func TestExtractSymlinkChainStaysInside(t *testing.T) {
+	for _, format := range archiveFormats {
+		t.Run(format.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			dest := filepath.Join(tmp, "dest")
+			archive := filepath.Join(tmp, "a"+format.ext)
+			// d/.. is the parent of dest on disk, although "d/../x" looks like "x"
+			format.write(t, archive, []testEntry{
+				{name: "d", link: "."},
+				{name: "l", link: "d/../x"},
+				{name: "l/escaped", body: "pwned"},
+			})
+			format.extract(archive, dest) // failing is fine, escaping isn't
+
+			if _, err := os.Stat(filepath.Join(tmp, "x")); err == nil {
+				t.Fatal("extraction wrote outside of the destination")
+			}
+			if _, err := os.Lstat(filepath.Join(tmp, "x", "escaped")); err == nil {
+				t.Fatal("extraction wrote outside of the destination")
+			}
+			if stat, err := os.Lstat(filepath.Join(dest, "l")); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+				target, _ := os.Readlink(filepath.Join(dest, "l"))
+				t.Fatalf("symlink l -> %s was created", target)
+			}
+		})
+	}
+}
+
+func TestExtractDoesNotFollowExistingSymlink(t *testing.T) {
+	for _, format := range archiveFormats {
+		t.Run(format.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			dest := filepath.Join(tmp, "dest")
+			outside := filepath.Join(tmp, "outside.txt")
+			if err := os.WriteFile(outside, []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(outside, filepath.Join(dest, "f")); err != nil {
+				t.Fatal(err)
+			}
+			archive := filepath.Join(tmp, "a"+format.ext)
+			format.write(t, archive, []testEntry{{name: "f", body: "new"}, {name: "g", body: "other"}})
+			if err := format.extract(archive, dest); err != nil {
+				t.Fatal(err)
+			}
+
+			if data, _ := os.ReadFile(outside); string(data) != "old" {
+				t.Fatalf("file outside of the destination was overwritten with %q", data)
+			}
+			stat, err := os.Lstat(filepath.Join(dest, "f"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !stat.Mode().IsRegular() {
+				t.Fatalf("f is %v, want a regular file", stat.Mode())
+			}
+			if data, _ := os.ReadFile(filepath.Join(dest, "f")); string(data) != "new" {
+				t.Fatalf("f = %q, want %q", data, "new")
+			}
+		})
+	}
+}
+
+func TestExtractAllowsSymlinksInside(t *testing.T) {
+	tmp := t.TempDir()
+	dest := filepath.Join(tmp, "dest")
+	archive := filepath.Join(tmp, "a.tar.gz")
+	writeTarGz(t, archive, []testEntry{
+		{name: "lib", dir: true},
+		{name: "lib/libfoo.so.1", body: "elf"},
+		{name: "lib/libfoo.so", link: "libfoo.so.1"},
+		{name: "include", dir: true},
+		{name: "include/up", link: "../lib/libfoo.so.1"},
+	})
+	if err := untar(archive, dest); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{"lib/libfoo.so", "include/up"} {
+		if data, err := os.ReadFile(filepath.Join(dest, link)); err != nil || string(data) != "elf" {
+			t.Errorf("%s = %q, %v, want %q", link, data, err, "elf")
+		}
+	}
+}
+
+func TestArchiveRoot(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []archiveEntry
+		want    string
+	}{
+		{"single dir root", []archiveEntry{{"pkg-1.2.3", true}, {"pkg-1.2.3/src", true}, {"pkg-1.2.3/src/a.c", false}}, "pkg-1.2.3/"},
+		{"root without its own entry", []archiveEntry{{"pkg/LICENSE", false}, {"pkg/src/a.c", false}}, "pkg/"},
+		{"files and dir at top level", []archiveEntry{{"LICENSE", false}, {"src", true}, {"src/a.c", false}}, ""},
+		{"two top level dirs", []archiveEntry{{"include/a.h", false}, {"src/a.c", false}}, ""},
+		{"single file", []archiveEntry{{"a.c", false}}, ""},
+		{"empty archive", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := archiveRoot(tt.entries); got != tt.want {
+			t.Errorf("%s: archiveRoot = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// extractedFiles returns the slash separated paths of the files and directories in dir
+func extractedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, _ os.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	slices.Sort(files)
+	return files
+}
+
+func TestExtractStripsRoot(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testEntry
+		want    []string
+		tarOnly bool
+	}{
+		{
+			name:    "single dir root",
+			entries: []testEntry{{name: "pkg-1.2.3", dir: true}, {name: "pkg-1.2.3/LICENSE"}, {name: "pkg-1.2.3/src/a.c"}},
+			want:    []string{"LICENSE", "src", "src/a.c"},
+		},
+		{
+			name:    "git archive with a pax global header",
+			entries: []testEntry{{name: "pax_global_header", pax: true}, {name: "repo", dir: true}, {name: "repo/src/a.c"}},
+			want:    []string{"src", "src/a.c"},
+			tarOnly: true,
+		},
+		{
+			name:    "files and dir at top level",
+			entries: []testEntry{{name: "LICENSE"}, {name: "src", dir: true}, {name: "src/a.c"}},
+			want:    []string{"LICENSE", "src", "src/a.c"},
+		},
+		{
+			name:    "empty archive",
+			entries: nil,
+			want:    nil,
+		},
+	}
+	for _, format := range archiveFormats {
+		for _, tt := range tests {
+			if tt.tarOnly && format.name != "tar" {
+				continue
+			}
+			t.Run(format.name+"/"+tt.name, func(t *testing.T) {
+				tmp := t.TempDir()
+				dest := filepath.Join(tmp, "dest")
+				archive := filepath.Join(tmp, "a"+format.ext)
+				format.write(t, archive, tt.entries)
+				if err := format.extract(archive, dest); err != nil {
+					t.Fatal(err)
+				}
+				if got := extractedFiles(t, dest); !slices.Equal(got, tt.want) {
+					t.Errorf("extracted %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestDependencySource(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://github.com/foo/bar.git", "gh:foo/bar"},
+		{"https://github.com/foo/bar", "gh:foo/bar"},
+		{"https://codeberg.org/foo/bar.git", "cb:foo/bar"},
+		{"https://git.example.com/foo/bar.git", "https://git.example.com/foo/bar.git"},
+		{"https://git.example.com/foo/bar", "git:https://git.example.com/foo/bar"},
+		{"https://github.com/", "git:https://github.com/"},
+	}
+	for _, tt := range tests {
+		got := DependencySource(tt.url)
+		if got != tt.want {
+			t.Errorf("DependencySource(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+		if kind, _, err := ClassifyDependency(got); err != nil || kind != SourceGit {
+			t.Errorf("%q is a %s dependency, want a Git one", got, kind)
+		}
+	}
+}
+
+func TestDownloadStopsWithContext(t *testing.T) {
+	// the server never answers, only the context ends the download
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := downloadAndExtractArchive(ctx, srv.URL+"/a.tar.gz", t.TempDir())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("download failed with %v, want the deadline of the context", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("download stopped after %s, long after the context ended", elapsed)
+	}
+}
+
+func TestExtractCompressedTarFixtures(t *testing.T) {
+	tests := []struct {
+		fixture string
+		format  string
+		extract func(src, dest string) error
+	}{
+		{"pkg.tar.xz", "tar.xz", untarXz},
+		{"pkg.tar.bz2", "tar.bz2", untarBz2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			src := filepath.Join("testdata", tt.fixture)
+			// recognized by its magic bytes, without a content type or an extension in the URL
+			format, err := determineArchiveFormat(src, &http.Response{Header: http.Header{}}, "https://example.com/download")
+			if err != nil || format != tt.format {
+				t.Fatalf("determineArchiveFormat = %q, %v, want %q", format, err, tt.format)
+			}
+			dest := filepath.Join(t.TempDir(), "dest")
+			if err := tt.extract(src, dest); err != nil {
+				t.Fatal(err)
+			}
+			// the pkg-1.0 root directory is stripped like for zip and tar.gz
+			want := []string{"Qobs.toml", "src", "src/a.c"}
+			if got := extractedFiles(t, dest); !slices.Equal(got, want) {
+				t.Errorf("extracted %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestArchiveFormatFallbacks(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "archive")
+	if err := os.WriteFile(src, []byte("not magic"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		contentType string
+		url         string
+		want        string
+	}{
+		{"application/x-xz", "https://example.com/download", "tar.xz"},
+		{"application/x-bzip2", "https://example.com/download", "tar.bz2"},
+		{"", "https://example.com/pkg-1.0.tar.xz", "tar.xz"},
+		{"", "https://example.com/pkg-1.0.txz?raw=1", "tar.xz"},
+		{"", "https://example.com/pkg-1.0.tar.bz2", "tar.bz2"},
+		{"", "https://example.com/pkg-1.0.tbz2", "tar.bz2"},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.contentType != "" {
+			resp.Header.Set("Content-Type", tt.contentType)
+		}
+		if got, err := determineArchiveFormat(src, resp, tt.url); err != nil || got != tt.want {
+			t.Errorf("determineArchiveFormat(%q, %q) = %q, %v, want %q", tt.contentType, tt.url, got, err, tt.want)
+		}
+	}
+}
+
+// gitFixture creates a bare repository ending in .git with three commits of a package whose
+// version.txt is 1, 2 and 3, the second tagged v2. It returns the repository and the commits
+func gitFixture(t *testing.T) (string, []plumbing.Hash) {
+	t.Helper()
+	work := filepath.Join(t.TempDir(), "work")
+	repo, err := git.PlainInit(work, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, work, map[string]string{"Qobs.toml": "[package]\nname = \"fixture\"\n"})
+	var commits []plumbing.Hash
+	for _, version := range []string{"1", "2", "3"} {
+		writeFiles(t, work, map[string]string{"version.txt": version})
+		if err := w.AddGlob("."); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := w.Commit("version "+version, &git.CommitOptions{
+			Author: &object.Signature{Name: "qobs", Email: "qobs@example.com", When: time.Unix(0, 0)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits = append(commits, hash)
+	}
+	if _, err := repo.CreateTag("v2", commits[1], nil); err != nil {
+		t.Fatal(err)
+	}
+	remote := filepath.Join(t.TempDir(), "fixture.git")
+	if _, err := git.PlainClone(remote, &git.CloneOptions{URL: work, Bare: true}); err != nil {
+		t.Fatal(err)
+	}
+	return remote, commits
+}
+
+func TestClonePinnedRevision(t *testing.T) {
+	remote, commits := gitFixture(t)
+	// tags are fetched alone, the local server doesn't serve commits by hash so they fall back
+	// to a full clone
+	tests := []struct {
+		name, url, want string
+	}{
+		{"tip", remote, "3"},
+		{"commit", remote + "#" + commits[0].String(), "1"},
+		{"abbreviated commit", remote + "#" + commits[0].String()[:8], "1"},
+		{"tag", remote + "#v2", "2"},
+		{"expected commit", remote + "#v2#commit=" + commits[1].String(), "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "dep")
+			if _, err := cloneGitRepo(context.Background(), tt.url, dir); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := os.ReadFile(filepath.Join(dir, "version.txt")); err != nil || string(got) != tt.want {
+				t.Errorf("checked out version %q (%v), want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestClonePinnedRevisionErrors(t *testing.T) {
+	defer func(attempts int) { retry.Attempts = attempts }(retry.Attempts)
+	retry.Attempts = 1
+
+	remote, commits := gitFixture(t)
+	tests := []struct {
+		name, url, want string
+	}{
+		{"missing tag", remote + "#v9", `ref "v9" not found on remote`},
+		{"missing commit", remote + "#" + strings.Repeat("ab", 20), "not found on remote"},
+		{"moved tag", remote + "#v2#commit=" + commits[2].String(), "commit mismatch"},
+		{"network", "http://127.0.0.1:1/fixture#v2", "network error while fetching"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := cloneGitRepo(context.Background(), tt.url, filepath.Join(t.TempDir(), "dep"))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("cloning failed with %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpectedCommit(t *testing.T) {
+	u := parseGitURL("https://example.com/foo@main#v2#commit=ABC")
+	if u.cleanURL != "https://example.com/foo.git" || u.branch != "main" || u.commitOrTag != "v2" || u.expectedCommit != "ABC" {
+		t.Errorf("parsed %+v", u)
+	}
+
+	remote, commits := gitFixture(t)
+	dir := filepath.Join(t.TempDir(), "dep")
+	// the tip moved on from the expected commit
+	_, err := cloneGitRepo(context.Background(), remote+"#commit="+strings.ToUpper(commits[1].String()), dir)
+	want := fmt.Sprintf("expected %s, got %s", commits[1], commits[2])
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("cloning failed with %v, want %q", err, want)
+	}
+	if _, err := os.Stat(dir); err == nil {
+		t.Error("the unexpected checkout was left behind")
+	}
+
+	_, err = cloneGitRepo(context.Background(), remote+"#commit="+commits[2].String()[:12], dir)
+	if err == nil || !strings.Contains(err.Error(), "must be a full commit hash") {
+		t.Errorf("cloning with an abbreviated expected commit failed with %v", err)
+	}
+	if _, err := cloneGitRepo(context.Background(), remote+"#commit="+strings.ToUpper(commits[2].String()), dir); err != nil {
+		t.Errorf("cloning the expected commit failed: %v", err)
+	}
+}
+
+func TestFrozen(t *testing.T) {
+	defer func() { Frozen = false }()
+	Frozen = true
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"app/Qobs.toml":   "[package]\nname = \"app\"\n\n[dependencies]\nlocal = \"../local\"\nfetched = \"gh:foo/fetched\"\nmissing = \"http://127.0.0.1:1/missing.tar.gz\"\n",
+		"local/Qobs.toml": "[package]\nname = \"local\"\n\n[target]\nlib = true\n",
+		// fetched by an earlier build
+		"app/build/_deps/fetched/Qobs.toml": "[package]\nname = \"fetched\"\n\n[target]\nlib = true\n",
+	})
+	b, err := NewBuilderInDirectory(filepath.Join(dir, "app"), "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.ResolveGraph()
+	if err == nil {
+		t.Fatal("missing dependency was resolved")
+	}
+	for _, want := range []string{`dependency "missing"`, filepath.Join(b.depsDir(), "missing"), "forbidden with --frozen"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't contain %q", err, want)
+		}
+	}
+
+	// path dependencies and the ones already fetched are fine
+	writeFiles(t, dir, map[string]string{
+		"app/Qobs.toml": "[package]\nname = \"app\"\n\n[dependencies]\nlocal = \"../local\"\nfetched = \"gh:foo/fetched\"\n",
+	})
+	paths := resolvedPaths(t, filepath.Join(dir, "app"))
+	if want := filepath.Join(dir, "app", "build", "_deps", "fetched"); paths["fetched"] != want {
+		t.Errorf("resolved %q, want fetched in %s", paths, want)
+	}
+}
@@ -0,0 +1,253 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+var (
+	tableHeaderRe = regexp.MustCompile(`^\s*\[\[?([^\[\]]+)\]\]?\s*(#.*)?$`)
+	bareKeyRe     = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// ReadDependency returns the dependency called name declared in the [dependencies] section
+// of a TOML manifest, if there is one
+func ReadDependency(manifest []byte, name string) (dep Dependency, ok bool, err error) {
+	var raw map[string]any
+	if err := toml.Unmarshal(manifest, &raw); err != nil {
+		return dep, false, err
+	}
+	deps, _ := raw["dependencies"].(map[string]any)
+	v, ok := deps[name]
+	if !ok {
+		return dep, false, nil
+	}
+	if err := dep.UnmarshalTOML(v); err != nil {
+		return dep, false, fmt.Errorf("invalid dependency %q: %w", name, err)
+	}
+	return dep, true, nil
+}
+
+// SetDependency inserts or replaces the dependency called name in a TOML manifest, leaving the
+// rest of the file as it is. Dependencies without features and with default features are written
+// in the string form, others as an inline table
+func SetDependency(manifest []byte, name string, dep Dependency) ([]byte, error) {
+	lines, eol := splitLines(manifest)
+	key := tomlKey(name)
+
+	// a [dependencies.name] table is rewritten in place
+	if start, end, ok := findTable(lines, "dependencies."+name); ok {
+		body := []string{lines[start]}
+		for _, field := range dependencyFields(dep) {
+			body = append(body, field+eol)
+		}
+		lines = replaceLines(lines, start, trimTrailingBlank(lines, start, end), body)
+		return validateManifest(strings.Join(lines, ""))
+	}
+
+	entry := key + " = " + dependencyValue(dep) + eol
+	start, end, ok := findTable(lines, "dependencies")
+	if !ok {
+		// no [dependencies] section yet, add one at the end
+		out := strings.Join(lines, "")
+		if out != "" && !strings.HasSuffix(out, "\n") {
+			out += eol
+		}
+		if out != "" {
+			out += eol
+		}
+		return validateManifest(out + "[dependencies]" + eol + entry)
+	}
+
+	if keyLines := findKeyLines(lines, start+1, end, name); len(keyLines) > 0 {
+		// replace the first line of the existing entry, dropping the rest of its (dotted) keys
+		for i := len(keyLines) - 1; i > 0; i-- {
+			lines = replaceLines(lines, keyLines[i], keyLines[i]+1, nil)
+		}
+		lines[keyLines[0]] = entry
+		return validateManifest(strings.Join(lines, ""))
+	}
+
+	// append after the last entry of the section
+	at := trimTrailingBlank(lines, start, end)
+	if at > 0 && !strings.HasSuffix(lines[at-1], "\n") {
+		lines[at-1] += eol
+	}
+	lines = replaceLines(lines, at, at, []string{entry})
+	return validateManifest(strings.Join(lines, ""))
+}
+
+// RemoveDependency removes the dependency called name from a TOML manifest, reporting whether
+// it was declared
+func RemoveDependency(manifest []byte, name string) ([]byte, bool, error) {
+	lines, _ := splitLines(manifest)
+
+	if start, end, ok := findTable(lines, "dependencies."+name); ok {
+		lines = replaceLines(lines, start, trimTrailingBlank(lines, start, end), nil)
+		out, err := validateManifest(strings.Join(lines, ""))
+		return out, true, err
+	}
+
+	start, end, ok := findTable(lines, "dependencies")
+	if !ok {
+		return manifest, false, nil
+	}
+	keyLines := findKeyLines(lines, start+1, end, name)
+	if len(keyLines) == 0 {
+		return manifest, false, nil
+	}
+	for i := len(keyLines) - 1; i >= 0; i-- {
+		lines = replaceLines(lines, keyLines[i], keyLines[i]+1, nil)
+	}
+	out, err := validateManifest(strings.Join(lines, ""))
+	return out, true, err
+}
+
+// dependencyFields returns the `key = value` pairs that describe dep, in the shape read by
+// Dependency.UnmarshalTOML
+func dependencyFields(dep Dependency) []string {
+	var fields []string
+	if dep.PkgConfig != "" {
+		fields = append(fields, "pkg-config = "+strconv.Quote(dep.PkgConfig))
+	} else {
+		fields = append(fields, "dep = "+strconv.Quote(dep.Source))
+	}
+	if !dep.DefaultFeatures {
+		fields = append(fields, "default-features = false")
+	}
+	if len(dep.Features) > 0 {
+		quoted := make([]string, len(dep.Features))
+		for i, feature := range dep.Features {
+			quoted[i] = strconv.Quote(feature)
+		}
+		fields = append(fields, "features = ["+strings.Join(quoted, ", ")+"]")
+	}
+	if dep.Static {
+		fields = append(fields, "static = true")
+	}
+	if dep.WholeArchive {
+		fields = append(fields, "whole-archive = true")
+	}
+	if dep.Optional {
+		fields = append(fields, "optional = true")
+	}
+	return fields
+}
+
+// dependencyValue returns the TOML value of dep, using the string form where possible
+func dependencyValue(dep Dependency) string {
+	fields := dependencyFields(dep)
+	if len(fields) == 1 && dep.PkgConfig == "" {
+		return strconv.Quote(dep.Source)
+	}
+	return "{ " + strings.Join(fields, ", ") + " }"
+}
+
+func tomlKey(name string) string {
+	if bareKeyRe.MatchString(name) {
+		return name
+	}
+	return strconv.Quote(name)
+}
+
+// splitLines splits s into lines that keep their line endings, also returning the line ending
+// used by the file
+func splitLines(s []byte) ([]string, string) {
+	eol := "\n"
+	if bytes.Contains(s, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+	if len(s) == 0 {
+		return nil, eol
+	}
+	return strings.SplitAfter(string(s), "\n"), eol
+}
+
+func replaceLines(lines []string, start, end int, with []string) []string {
+	out := append([]string{}, lines[:start]...)
+	out = append(out, with...)
+	return append(out, lines[end:]...)
+}
+
+// normalizeTableName turns a table header like `dependencies . "foo"` into `dependencies.foo`
+func normalizeTableName(header string) string {
+	var parts []string
+	for part := range strings.SplitSeq(header, ".") {
+		part = strings.TrimSpace(part)
+		if unquoted, err := strconv.Unquote(part); err == nil {
+			part = unquoted
+		} else if len(part) >= 2 && part[0] == '\'' && part[len(part)-1] == '\'' {
+			part = part[1 : len(part)-1]
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// findTable returns the line range of the table called name, starting at its header and ending
+// before the next header
+func findTable(lines []string, name string) (start, end int, ok bool) {
+	start = -1
+	for i, line := range lines {
+		m := tableHeaderRe.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+		if m == nil {
+			continue
+		}
+		if start >= 0 {
+			return start, i, true
+		}
+		if normalizeTableName(m[1]) == name {
+			start = i
+		}
+	}
+	if start >= 0 {
+		return start, len(lines), true
+	}
+	return 0, 0, false
+}
+
+// findKeyLines returns the lines in [start, end) that assign name, either directly or as a dotted key
+func findKeyLines(lines []string, start, end int, name string) []int {
+	var found []int
+	for i := start; i < end; i++ {
+		line := strings.TrimSpace(lines[i])
+		eq := strings.Index(line, "=")
+		if eq < 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key := line[:eq]
+		if dot := strings.Index(key, "."); dot >= 0 && !strings.ContainsAny(key[:dot], `"'`) {
+			key = key[:dot]
+		}
+		if normalizeTableName(key) == name {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+// trimTrailingBlank returns the index after the last line in (start, end) that isn't blank or a comment
+func trimTrailingBlank(lines []string, start, end int) int {
+	for end > start+1 {
+		line := strings.TrimSpace(lines[end-1])
+		if line != "" && !strings.HasPrefix(line, "#") {
+			break
+		}
+		end--
+	}
+	return end
+}
+
+// validateManifest checks that an edited manifest is still valid TOML
+func validateManifest(s string) ([]byte, error) {
+	var raw map[string]any
+	if err := toml.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, fmt.Errorf("edited manifest is invalid: %w", err)
+	}
+	return []byte(s), nil
+}
@@ -0,0 +1,128 @@
+package gen
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// EmitMode is what the qobs builder's compile jobs produce
+type EmitMode int
+
+const (
+	EmitObjects      EmitMode = iota // object files, which are linked (the default)
+	EmitPreprocessed                 // preprocessed sources (.i/.ii), nothing is linked
+	EmitAsm                          // assembly (.s, .asm for MSVC), nothing is linked
+)
+
+// isMsvcCompiler checks if cc takes MSVC style arguments, which are used by cl and clang-cl
+func isMsvcCompiler(cc []string) bool {
+	if len(cc) == 0 {
+		return false
+	}
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(cc[0])), ".exe")
+	return name == "cl" || name == "clang-cl"
+}
+
+// emitPath returns the path of the diagnostic output for the object file at obj
+func emitPath(obj string, mode EmitMode, isCxx, msvc bool) string {
+	base := strings.TrimSuffix(obj, filepath.Ext(obj))
+	switch {
+	case mode == EmitPreprocessed && isCxx && !msvc:
+		return base + ".ii"
+	case mode == EmitPreprocessed:
+		return base + ".i"
+	case msvc:
+		return base + ".asm"
+	default:
+		return base + ".s"
+	}
+}
+
+// emitArgs returns the compiler arguments that write the diagnostic output of src to out
+func emitArgs(mode EmitMode, src, out string, msvc bool) []string {
+	switch {
+	case mode == EmitPreprocessed && msvc:
+		return []string{"/P", "/Fi" + out, src}
+	case mode == EmitPreprocessed:
+		return []string{"-E", src, "-o", out}
+	case msvc:
+		return []string{"/c", "/FA", "/Fa" + out, "/Fo" + out + ".obj", src}
+	default:
+		return []string{"-S", src, "-o", out}
+	}
+}
+
+// emitAll writes the diagnostic output of every source of every target, without linking
+// anything or touching the build state
+func (g *QobsBuilder) emitAll(sortedTargetNames []string) error {
+	var jobs []compileJob
+	for _, targetName := range sortedTargetNames {
+		target := g.targets[targetName]
+		cc, cxx := target.compilers(g.cc, g.cxx)
+		for _, src := range target.sources {
+			if src.Lang == LangAsm {
+				continue // already assembly
+			}
+			compiler := cc
+			if src.Lang == LangCxx {
+				compiler = cxx
+			}
+			jobs = append(jobs, compileJob{
+				src:    src.Src,
+				obj:    emitPath(filepath.Join(g.buildDir, src.Obj), g.emit, src.Lang == LangCxx, isMsvcCompiler(compiler)),
+				cflags: slices.Concat(target.cflags, g.emitPchCflags(target, compiler), src.Cflags),
+				lang:   src.Lang,
+				cc:     compiler,
+			})
+		}
+	}
+	if len(jobs) == 0 {
+		g.noWork()
+		return nil
+	}
+
+	g.progress = g.newReporter(len(jobs), 0)
+	err := runJobs(jobs, g.runEmitJob, g.jobs, g.keepGoing)
+	g.progress.finish()
+	if err != nil {
+		return failureSummary(err)
+	}
+	return nil
+}
+
+// runEmitJob runs a single compile job that writes a diagnostic output to job.obj
+func (g *QobsBuilder) runEmitJob(job compileJob) error {
+	if err := os.MkdirAll(filepath.Dir(job.obj), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	event := jobEvent{kind: "compile", phase: "Compiling", action: "ASM", name: job.obj, src: job.src, out: job.obj}
+	if g.emit == EmitPreprocessed {
+		event.phase, event.action = "Preprocessing", "CPP"
+	}
+	g.progress.jobStarted(event)
+
+	args := append(job.cflags[:len(job.cflags):len(job.cflags)], emitArgs(g.emit, job.src, job.obj, isMsvcCompiler(job.cc))...)
+	cmd, rsp, err := g.command(g.launcher, job.cc, args)
+	if err != nil {
+		return fmt.Errorf("failed to write response file: %w", err)
+	}
+	if rsp != "" {
+		defer os.Remove(rsp)
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		g.progress.jobFailed(event, output, err)
+		if g.emit == EmitPreprocessed {
+			return &jobError{"preprocess", job.src}
+		}
+		return &jobError{"compile", job.src}
+	}
+
+	event.name = g.jobName(job.obj, rsp, g.launcher)
+	g.progress.jobDone(event)
+	return nil
+}
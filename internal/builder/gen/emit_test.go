@@ -0,0 +1,90 @@
+package gen
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEmitPathAndArgs(t *testing.T) {
+	tests := []struct {
+		mode  EmitMode
+		isCxx bool
+		msvc  bool
+		path  string
+		args  []string
+	}{
+		{EmitPreprocessed, false, false, "a.c.i", []string{"-E", "a.c", "-o", "a.c.i"}},
+		{EmitPreprocessed, true, false, "a.cpp.ii", []string{"-E", "a.cpp", "-o", "a.cpp.ii"}},
+		{EmitPreprocessed, true, true, "a.cpp.i", []string{"/P", "/Fia.cpp.i", "a.cpp"}},
+		{EmitAsm, false, false, "a.c.s", []string{"-S", "a.c", "-o", "a.c.s"}},
+		{EmitAsm, false, true, "a.c.asm", []string{"/c", "/FA", "/Faa.c.asm", "/Foa.c.asm.obj", "a.c"}},
+	}
+	for _, tt := range tests {
+		src := "a.c"
+		if tt.isCxx {
+			src = "a.cpp"
+		}
+		path := emitPath(src+".obj", tt.mode, tt.isCxx, tt.msvc)
+		if path != tt.path {
+			t.Errorf("emitPath(%s, msvc: %v) = %q, want %q", src, tt.msvc, path, tt.path)
+		}
+		if args := emitArgs(tt.mode, src, path, tt.msvc); !slices.Equal(args, tt.args) {
+			t.Errorf("emitArgs(%s, msvc: %v) = %q, want %q", src, tt.msvc, args, tt.args)
+		}
+	}
+	for _, cc := range [][]string{{"cl"}, {"/opt/vs/bin/CL.EXE"}, {"clang-cl", "--target=x86_64-pc-windows-msvc"}} {
+		if !isMsvcCompiler(cc) {
+			t.Errorf("%q isn't recognized as MSVC", cc)
+		}
+	}
+	if isMsvcCompiler([]string{"clang"}) {
+		t.Error("clang is recognized as MSVC")
+	}
+}
+
+func TestEmitPreprocessed(t *testing.T) {
+	if _, err := exec.LookPath("g++"); err != nil {
+		t.Skip("g++ not found")
+	}
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"main.c":   "#define ANSWER 42\nint main(void) { return ANSWER; }\n",
+		"util.cpp": "#define TWICE(x) ((x) * 2)\nint twice(int x) { return TWICE(x); }\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g := NewQobsBuilder()
+	g.SetCompiler([]string{"gcc"}, []string{"g++"})
+	g.SetEmit(EmitPreprocessed)
+	sources := []SourceFile{
+		{Src: filepath.Join(dir, "main.c"), Obj: "QobsFiles/app.dir/main.c.o", Lang: LangC},
+		{Src: filepath.Join(dir, "util.cpp"), Obj: "QobsFiles/app.dir/util.cpp.o", Lang: LangCxx},
+	}
+	g.AddTarget("app", dir, sources, nil, nil, Executable, nil, nil, nil, nil)
+	buildDir := filepath.Join(dir, "build")
+	if err := g.Invoke(buildDir); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"main.c.i": "return 42;", "util.cpp.ii": "((x) * 2)"} {
+		data, err := os.ReadFile(filepath.Join(buildDir, "QobsFiles", "app.dir", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), want) {
+			t.Errorf("%s isn't preprocessed:\n%s", name, data)
+		}
+	}
+	// nothing is compiled to objects or linked, and the next normal build doesn't trust the outputs
+	for _, name := range []string{"app", filepath.Join("QobsFiles", "app.dir", "main.c.o"), g.BuildFile()} {
+		if _, err := os.Stat(filepath.Join(buildDir, name)); err == nil {
+			t.Errorf("%s was written", name)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package gen
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// reporter reports the progress of build jobs: progress prints it for people, jsonEvents as a
+// stream of JSON objects for CI systems and IDEs. Jobs report concurrently
+type reporter interface {
+	jobStarted(job jobEvent)
+	jobDone(job jobEvent)
+	jobFailed(job jobEvent, output []byte, err error)
+	// finish is called once after the jobs ran, or didn't have to
+	finish()
+}
+
+// jobEvent describes a compile or link job for a reporter
+type jobEvent struct {
+	kind   string // "compile" or "link"
+	phase  string // shown on the updating progress line, e.g. "Compiling"
+	action string // e.g. "CC", "LINK" or "AR"
+	name   string // shown after the action, with the launcher and response file when verbose
+	src    string // source file of compile jobs
+	out    string // object or artifact the job writes
+	cached bool   // the object was taken from the compile cache
+}
+
+// SetJSONEvents makes the builder print one JSON object per line for every job that starts and
+// finishes and a summary at the end, instead of its progress output
+func (g *QobsBuilder) SetJSONEvents(jsonEvents bool) {
+	g.jsonEvents = jsonEvents
+}
+
+// newReporter creates the reporter of a build running total jobs, with upToDate sources that
+// don't have to be compiled. The jobs it reports are counted for Summary
+func (g *QobsBuilder) newReporter(total, upToDate int) reporter {
+	var r reporter
+	if g.jsonEvents {
+		r = newJSONEvents(total, upToDate, os.Stdout)
+	} else {
+		r = newProgress(total, g.verbose)
+	}
+	g.counter = newCountingReporter(r, upToDate)
+	return g.counter
+}
+
+// jsonJob is the JSON form of a job that started or finished
+type jsonJob struct {
+	Event      string   `json:"event"` // "compile-started", "compile-finished", "link-started" or "link-finished"
+	Action     string   `json:"action"`
+	Source     string   `json:"source,omitempty"`
+	Output     string   `json:"output"`
+	Success    *bool    `json:"success,omitempty"`
+	Cached     bool     `json:"cached,omitempty"`
+	DurationMs *float64 `json:"duration_ms,omitempty"`
+	Message    string   `json:"message,omitempty"` // output of the compiler or linker of a failed job
+}
+
+// jsonSummary is the JSON form of the end of a build
+type jsonSummary struct {
+	Event      string  `json:"event"` // "summary"
+	Success    bool    `json:"success"`
+	Jobs       int     `json:"jobs"` // planned jobs, jobs that didn't run after a failure aren't counted below
+	Succeeded  int     `json:"succeeded"`
+	Failed     int     `json:"failed"`
+	Compiled   int     `json:"compiled"`
+	UpToDate   int     `json:"up_to_date"` // sources that didn't have to be compiled
+	Linked     int     `json:"linked"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// jsonEvents writes build events as JSON lines. Events are encoded under a mutex, so that lines of
+// concurrent jobs never interleave
+type jsonEvents struct {
+	mu        sync.Mutex
+	enc       *json.Encoder
+	start     time.Time
+	started   map[string]time.Time // kind and output of a running job -> when it started
+	total     int
+	upToDate  int
+	succeeded int
+	failed    int
+	compiled  int
+	linked    int
+}
+
+func newJSONEvents(total, upToDate int, w io.Writer) *jsonEvents {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &jsonEvents{
+		enc:      enc,
+		start:    time.Now(),
+		started:  make(map[string]time.Time),
+		total:    total,
+		upToDate: upToDate,
+	}
+}
+
+func (e *jsonEvents) jobStarted(job jobEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.started[job.kind+"\x00"+job.out] = time.Now()
+	e.enc.Encode(jsonJob{Event: job.kind + "-started", Action: job.action, Source: job.src, Output: job.out})
+}
+
+func (e *jsonEvents) jobDone(job jobEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.succeeded++
+	if job.kind == "compile" {
+		e.compiled++
+	} else {
+		e.linked++
+	}
+	e.finished(job, true, "")
+}
+
+func (e *jsonEvents) jobFailed(job jobEvent, output []byte, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failed++
+	if len(output) == 0 {
+		output = []byte(err.Error())
+	}
+	e.finished(job, false, string(output))
+}
+
+// finished writes the event of a finished job, e.mu must be held
+func (e *jsonEvents) finished(job jobEvent, success bool, message string) {
+	key := job.kind + "\x00" + job.out
+	duration := milliseconds(time.Since(e.started[key]))
+	delete(e.started, key)
+	e.enc.Encode(jsonJob{
+		Event:      job.kind + "-finished",
+		Action:     job.action,
+		Source:     job.src,
+		Output:     job.out,
+		Success:    &success,
+		Cached:     job.cached,
+		DurationMs: &duration,
+		Message:    message,
+	})
+}
+
+func (e *jsonEvents) finish() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.enc.Encode(jsonSummary{
+		Event:      "summary",
+		Success:    e.failed == 0,
+		Jobs:       e.total,
+		Succeeded:  e.succeeded,
+		Failed:     e.failed,
+		Compiled:   e.compiled,
+		UpToDate:   e.upToDate,
+		Linked:     e.linked,
+		DurationMs: milliseconds(time.Since(e.start)),
+	})
+}
@@ -1,26 +1,309 @@
 package gen
 
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
 // SourceFile represents a single source file and its corresponding object file path
 type SourceFile struct {
-	Src   string
-	Obj   string // relative to build directory
-	IsCxx bool   // C++ file
+	Src    string
+	Obj    string   // relative to build directory
+	Lang   Language // C, C++ or assembly, see SourceLanguage
+	Cflags []string // extra flags for this file only, appended after the target cflags
+}
+
+// Language is the language of a source file, see SourceLanguage
+type Language int
+
+const (
+	LangC Language = iota
+	LangCxx
+	LangAsm // assembly, .S is preprocessed; built with the C compiler
+)
+
+// String returns the name of the language in the build plan
+func (l Language) String() string {
+	switch l {
+	case LangCxx:
+		return "cxx"
+	case LangAsm:
+		return "asm"
+	}
+	return "c"
+}
+
+// cxxExtensions are the extensions of C++ sources, including module interfaces. Case matters:
+// .C is C++ and .c is C, like GCC and Clang see them
+var cxxExtensions = []string{".cc", ".cp", ".cxx", ".cpp", ".CPP", ".c++", ".C", ".cppm", ".ixx"}
+
+// SourceLanguage returns the language of the source file at path by its extension. Files that
+// aren't C++ or assembly are compiled as C
+func SourceLanguage(path string) Language {
+	ext := filepath.Ext(path)
+	switch {
+	case slices.Contains(cxxExtensions, ext):
+		return LangCxx
+	case ext == ".s" || ext == ".S":
+		return LangAsm
+	}
+	return LangC
+}
+
+// LanguageFlags returns the flags that make the compiler treat the source file at path as lang when
+// it wouldn't tell by the extension: GCC doesn't know module interfaces, and MSVC only knows .cpp,
+// .cxx, .cc and .ixx as C++. msvc is whether the compiler takes MSVC style flags
+func LanguageFlags(path string, lang Language, msvc bool) []string {
+	if lang != LangCxx {
+		return nil
+	}
+	ext := filepath.Ext(path)
+	if msvc {
+		switch strings.ToLower(ext) {
+		case ".cpp", ".cxx", ".cc", ".ixx":
+			return nil
+		case ".cppm":
+			return []string{"/interface", "/TP"}
+		}
+		return []string{"/TP"}
+	}
+	if ext == ".cppm" || ext == ".ixx" {
+		return []string{"-x", "c++"}
+	}
+	return nil
+}
+
+// TargetKind is the kind of artifact a target produces
+type TargetKind int
+
+const (
+	Executable TargetKind = iota
+	StaticLib
+	SharedLib
+)
+
+// String returns the name of the kind in target.kind of the manifest
+func (k TargetKind) String() string {
+	switch k {
+	case StaticLib:
+		return "staticlib"
+	case SharedLib:
+		return "sharedlib"
+	}
+	return "exe"
 }
 
 // buildUnit represents a single unit to be built (a library or an executable)
 type buildUnit struct {
 	name            string
-	isLib           bool
+	kind            TargetKind
 	sources         []SourceFile
 	dependencies    []string
+	wholeArchive    []string // dependencies that are linked as whole archives
+	cc, cxx         []string // compilers of this target, empty to use the ones set with SetCompiler
 	cflags, ldflags []string
 	basedir         string
 }
 
+// defaultArchiver is the archiver used when none is set with SetArchiver
+var defaultArchiver = []string{"ar", "rcs"}
+
 type Generator interface {
-	SetCompiler(cc, cxx string)
-	AddTarget(name, basedir string, sources []SourceFile, dependencies []string, isLib bool, cflags, ldflags []string)
-	Generate() string
+	// SetCompiler sets the C and C++ compilers, each a program followed by its arguments, e.g.
+	// ["zig", "cc"]
+	SetCompiler(cc, cxx []string)
+	// SetLauncher sets a command that compiler and linker invocations are prefixed with,
+	// e.g. ["ccache"]. Archiving isn't launched through it
+	SetLauncher(launcher []string)
+	// SetArchiver sets the command static libraries are created with, followed by the output
+	// and the objects, e.g. ["llvm-ar", "rcs"]
+	SetArchiver(archiver []string)
+	// SetEnv sets extra environment variables for the compiler and linker processes
+	SetEnv(env map[string]string)
+	// AddTarget adds a target to the build graph. cc and cxx override the compilers set with
+	// SetCompiler for this target, if they're not empty
+	AddTarget(name, basedir string, sources []SourceFile, dependencies, wholeArchive []string, kind TargetKind, cc, cxx []string, cflags, ldflags []string)
+	// Generate writes the files of the build other than the build file and returns the contents of
+	// the build file, or "" if the generator doesn't use one
+	Generate() (string, error)
 	BuildFile() string
 	Invoke(buildDir string) error
+	// Artifacts returns the files that linking the target named name writes when the generator is
+	// invoked in buildDir: the artifact, followed by the import library of a DLL
+	Artifacts(buildDir, name string) []string
+}
+
+func (u buildUnit) isLib() bool {
+	return u.kind != Executable
+}
+
+// compilers returns the C and C++ compilers of the target, falling back to cc and cxx
+func (u buildUnit) compilers(cc, cxx []string) ([]string, []string) {
+	if len(u.cc) > 0 {
+		cc = u.cc
+	}
+	if len(u.cxx) > 0 {
+		cxx = u.cxx
+	}
+	return cc, cxx
+}
+
+// hasSharedDependency checks if target directly links with a shared library
+func hasSharedDependency(targets map[string]buildUnit, target buildUnit) bool {
+	for _, depName := range target.dependencies {
+		if depTarget, exists := targets[depName]; exists && depTarget.kind == SharedLib {
+			return true
+		}
+	}
+	return false
+}
+
+// cxxTargets returns which targets have C++ sources, themselves or in one of the targets they
+// transitively depend on, and so must be linked with the C++ driver. Every target is visited once
+func cxxTargets(targets map[string]buildUnit) map[string]bool {
+	hasCxx := make(map[string]bool, len(targets))
+	visited := make(map[string]bool, len(targets))
+	var visit func(target buildUnit) bool
+	visit = func(target buildUnit) bool {
+		if visited[target.name] {
+			return hasCxx[target.name]
+		}
+		visited[target.name] = true // before recursing, so that cycles end
+		cxx := slices.ContainsFunc(target.sources, func(src SourceFile) bool { return src.Lang == LangCxx })
+		for _, depName := range target.dependencies {
+			if depTarget, exists := targets[depName]; exists && visit(depTarget) {
+				cxx = true
+			}
+		}
+		hasCxx[target.name] = cxx
+		return cxx
+	}
+	for _, target := range targets {
+		visit(target)
+	}
+	return hasCxx
+}
+
+// wholeArchiveArgs returns the linker arguments that link every object of the archive at path,
+// including ones nothing references (e.g. objects that only register themselves in static initializers)
+func wholeArchiveArgs(path string) []string {
+	if runtime.GOOS == "darwin" {
+		return []string{"-Wl,-force_load," + path}
+	}
+	return []string{"-Wl,--whole-archive", path, "-Wl,--no-whole-archive"}
+}
+
+// targetLinkArgs returns the linker arguments implied by the kind of target and the kinds of its
+// dependencies. dir is where the target is linked to, relative to the linker's working directory
+func targetLinkArgs(targets map[string]buildUnit, target buildUnit, dir string) []string {
+	var args []string
+	if target.kind == SharedLib {
+		args = append(args, sharedLibArgs(dir, target.name)...)
+	}
+	if hasSharedDependency(targets, target) {
+		args = append(args, rpathArgs()...)
+	}
+	return args
+}
+
+// sharedLibArgs returns the extra linker arguments for linking the shared library named name in
+// dir, whose extension tells the OS it's built for. The soname/install name makes dependents record
+// just the library name instead of its path, DLLs come with an import library for dependents
+func sharedLibArgs(dir, name string) []string {
+	switch {
+	case strings.HasSuffix(name, ".dll"):
+		return []string{"-shared", "-Wl,--out-implib," + filepath.Join(dir, ImportLibrary(name))}
+	case strings.HasSuffix(name, ".dylib"):
+		return []string{"-dynamiclib", "-fPIC", "-Wl,-install_name,@rpath/" + name}
+	default:
+		return []string{"-shared", "-fPIC", "-Wl,-soname," + name}
+	}
+}
+
+// ImportLibrary returns the name of the import library written next to the DLL named name, which
+// dependents link with instead of the DLL (foo.lib for foo.dll), or "" if name isn't a DLL
+func ImportLibrary(name string) string {
+	if base, ok := strings.CutSuffix(name, ".dll"); ok {
+		return base + ".lib"
+	}
+	return ""
+}
+
+// artifacts returns the artifact of the target named name in dir, followed by the import library
+// of a DLL
+func artifacts(dir, name string) []string {
+	paths := []string{filepath.Join(dir, name)}
+	if implib := ImportLibrary(name); implib != "" {
+		paths = append(paths, filepath.Join(dir, implib))
+	}
+	return paths
+}
+
+// linkInput returns what a target links with for its dependency named dep: the import library of
+// a DLL, or the dependency itself
+func linkInput(targets map[string]buildUnit, dep string) string {
+	if target, ok := targets[dep]; ok && target.kind == SharedLib && ImportLibrary(dep) != "" {
+		return ImportLibrary(dep)
+	}
+	return dep
+}
+
+// sharedLibLinkName returns the unversioned name of a shared library with a versioned name like
+// libfoo.so.1, or an empty string if the name isn't versioned
+func sharedLibLinkName(target buildUnit) string {
+	if target.kind != SharedLib {
+		return ""
+	}
+	i := strings.Index(target.name, ".so.")
+	if i < 0 {
+		return ""
+	}
+	return target.name[:i+len(".so")]
+}
+
+// updateSharedLibLink points the unversioned name of a versioned shared library in dir at the
+// library (libfoo.so -> libfoo.so.1), so that it can also be found by -lfoo. Nothing is done
+// if the link is already up to date
+func updateSharedLibLink(dir string, target buildUnit) error {
+	linkName := sharedLibLinkName(target)
+	if linkName == "" {
+		return nil
+	}
+	link := filepath.Join(dir, linkName)
+	if dest, err := os.Readlink(link); err == nil && dest == target.name {
+		return nil
+	}
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target.name, link)
+}
+
+// rpathArgs returns the linker arguments that make a binary look for shared libraries in its own directory
+func rpathArgs() []string {
+	switch runtime.GOOS {
+	case "windows":
+		return nil // dlls next to the executable are always found
+	case "darwin":
+		return []string{"-Wl,-rpath,@loader_path"}
+	default:
+		return []string{"-Wl,-rpath,$ORIGIN"}
+	}
+}
+
+// environ returns the environment of the current process with env added on top,
+// or nil (meaning inherit the environment as is) if env is empty
+func environ(env map[string]string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	environ := os.Environ()
+	for _, key := range slices.Sorted(maps.Keys(env)) {
+		environ = append(environ, key+"="+env[key])
+	}
+	return environ
 }
@@ -0,0 +1,302 @@
+package gen
+
+import (
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSourceLanguage(t *testing.T) {
+	tests := []struct {
+		path string
+		want Language
+	}{
+		{"a.c", LangC},
+		{"a.cc", LangCxx},
+		{"a.cp", LangCxx},
+		{"a.cxx", LangCxx},
+		{"a.cpp", LangCxx},
+		{"a.CPP", LangCxx},
+		{"a.c++", LangCxx},
+		{"a.C", LangCxx},
+		{"a.cppm", LangCxx},
+		{"a.ixx", LangCxx},
+		{"a.s", LangAsm},
+		{"a.S", LangAsm},
+		{"dir.cpp/a.c", LangC},
+		{"a", LangC},
+	}
+	for _, tt := range tests {
+		if got := SourceLanguage(tt.path); got != tt.want {
+			t.Errorf("SourceLanguage(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestLanguageFlags(t *testing.T) {
+	tests := []struct {
+		path      string
+		gnu, msvc []string
+	}{
+		{"a.c", nil, nil},
+		{"a.s", nil, nil},
+		{"a.cpp", nil, nil},
+		{"a.CPP", nil, nil},
+		{"a.cc", nil, nil},
+		{"a.cxx", nil, nil},
+		{"a.cp", nil, []string{"/TP"}},
+		{"a.C", nil, []string{"/TP"}},
+		{"a.c++", nil, []string{"/TP"}},
+		{"a.cppm", []string{"-x", "c++"}, []string{"/interface", "/TP"}},
+		{"a.ixx", []string{"-x", "c++"}, nil},
+	}
+	for _, tt := range tests {
+		lang := SourceLanguage(tt.path)
+		if got := LanguageFlags(tt.path, lang, false); !slices.Equal(got, tt.gnu) {
+			t.Errorf("LanguageFlags(%q) = %q, want %q", tt.path, got, tt.gnu)
+		}
+		if got := LanguageFlags(tt.path, lang, true); !slices.Equal(got, tt.msvc) {
+			t.Errorf("LanguageFlags(%q) with MSVC = %q, want %q", tt.path, got, tt.msvc)
+		}
+	}
+}
+
+func TestCompileModuleExtensionsAsCxx(t *testing.T) {
+	if _, err := exec.LookPath("g++"); err != nil {
+		t.Skip("g++ not found")
+	}
+	dir := t.TempDir()
+	// only compiles as C++, GCC would pass a file it doesn't know the extension of to the linker
+	code := "namespace ns { int f() { return 0; } }\n"
+	var sources []SourceFile
+	for _, name := range []string{"a.cppm", "b.ixx", "c.C"} {
+		src := filepath.Join(dir, name)
+		if err := os.WriteFile(src, []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, SourceFile{Src: src, Obj: name + ".o", Lang: LangCxx, Cflags: LanguageFlags(src, LangCxx, false)})
+	}
+	g := NewQobsBuilder()
+	g.SetCompiler([]string{"gcc"}, []string{"g++"})
+	g.AddTarget("lib", dir, sources, nil, nil, StaticLib, nil, nil, nil, nil)
+	if err := g.Invoke(filepath.Join(dir, "build")); err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range sources {
+		if _, err := os.Stat(filepath.Join(dir, "build", src.Obj)); err != nil {
+			t.Errorf("%s wasn't compiled: %v", filepath.Base(src.Src), err)
+		}
+	}
+}
+
+// generate returns the build file of g, failing the test if it can't be generated
+func generate(t *testing.T, g Generator) string {
+	t.Helper()
+	out, err := g.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// addDLLTargets adds a DLL and an executable linking it to g
+func addDLLTargets(g Generator) {
+	lib := []SourceFile{{Src: "foo.c", Obj: "QobsFiles/foo.dll.dir/foo.c.obj", Lang: LangC}}
+	app := []SourceFile{{Src: "main.c", Obj: "QobsFiles/app.exe.dir/main.c.obj", Lang: LangC}}
+	g.AddTarget("foo.dll", ".", lib, nil, nil, SharedLib, nil, nil, nil, nil)
+	g.AddTarget("app.exe", ".", app, []string{"foo.dll"}, nil, Executable, nil, nil, nil, nil)
+}
+
+func TestLinkWithImportLibrary(t *testing.T) {
+	if got := ImportLibrary("foo.dll"); got != "foo.lib" {
+		t.Errorf("ImportLibrary(foo.dll) = %q, want foo.lib", got)
+	}
+	if got := ImportLibrary("libfoo.so.1"); got != "" {
+		t.Errorf("ImportLibrary(libfoo.so.1) = %q, want none", got)
+	}
+
+	t.Run("qobs", func(t *testing.T) {
+		g := NewQobsBuilder()
+		g.buildDir = t.TempDir()
+		addDLLTargets(g)
+		lib, err := g.createLinkJob(g.targets["foo.dll"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if implib := "-Wl,--out-implib," + filepath.Join(g.buildDir, "foo.lib"); !slices.Contains(lib.ldflags, implib) {
+			t.Errorf("DLL is linked with %q, want %q", lib.ldflags, implib)
+		}
+		app, err := g.createLinkJob(g.targets["app.exe"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{filepath.Join(g.buildDir, "foo.lib")}; !slices.Equal(app.deps, want) {
+			t.Errorf("executable links with %q, want %q", app.deps, want)
+		}
+	})
+
+	t.Run("ninja", func(t *testing.T) {
+		g := NewNinjaGen()
+		addDLLTargets(g)
+		ninja := generate(t, g)
+		for _, want := range []string{
+			"build foo.dll | foo.lib: link QobsFiles/foo.dll.dir/foo.c.obj\n",
+			"build app.exe: link QobsFiles/app.exe.dir/main.c.obj foo.lib\n",
+			"-Wl,--out-implib,foo.lib",
+		} {
+			if !strings.Contains(ninja, want) {
+				t.Errorf("build.ninja doesn't contain %q:\n%s", want, ninja)
+			}
+		}
+	})
+}
+
+func TestArtifacts(t *testing.T) {
+	buildDir := filepath.Join("build", "release")
+	tests := []struct {
+		name string
+		g    Generator
+		want []string
+	}{
+		{"qobs", NewQobsBuilder(), []string{filepath.Join(buildDir, "foo.dll"), filepath.Join(buildDir, "foo.lib")}},
+		{"ninja", NewNinjaGen(), []string{filepath.Join(buildDir, "foo.dll"), filepath.Join(buildDir, "foo.lib")}},
+		{"vs2022", NewVS2022Gen(buildDir, nil), []string{filepath.Join(buildDir, "Debug", "foo.dll"), filepath.Join(buildDir, "Debug", "foo.lib")}},
+	}
+	release := NewVS2022Gen(buildDir, []string{"ARM64", "x64"})
+	release.SetConfiguration("Release")
+	tests = append(tests, struct {
+		name string
+		g    Generator
+		want []string
+	}{"vs2022 release", release, []string{filepath.Join(buildDir, "ARM64", "Release", "foo.dll"), filepath.Join(buildDir, "ARM64", "Release", "foo.lib")}})
+	for _, tt := range tests {
+		if got := tt.g.Artifacts(buildDir, "foo.dll"); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: Artifacts = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if got := NewQobsBuilder().Artifacts(buildDir, "libfoo.a"); !slices.Equal(got, []string{filepath.Join(buildDir, "libfoo.a")}) {
+		t.Errorf("Artifacts of a static library = %q", got)
+	}
+}
+
+// addWholeArchiveTargets adds the static libraries plugin and other, and the executable app
+// linking only plugin as a whole archive to g
+func addWholeArchiveTargets(g Generator, plugin, other, app string) {
+	g.AddTarget(plugin, ".", []SourceFile{{Src: "plugin.c", Obj: "QobsFiles/" + plugin + ".dir/plugin.c.o", Lang: LangC}}, nil, nil, StaticLib, nil, nil, nil, nil)
+	g.AddTarget(other, ".", []SourceFile{{Src: "other.c", Obj: "QobsFiles/" + other + ".dir/other.c.o", Lang: LangC}}, nil, nil, StaticLib, nil, nil, nil, nil)
+	g.AddTarget(app, ".", []SourceFile{{Src: "main.c", Obj: "QobsFiles/" + app + ".dir/main.c.o", Lang: LangC}}, []string{plugin, other}, []string{plugin}, Executable, nil, nil, nil, nil)
+}
+
+func TestWholeArchive(t *testing.T) {
+	t.Run("qobs", func(t *testing.T) {
+		g := NewQobsBuilder()
+		g.buildDir = t.TempDir()
+		addWholeArchiveTargets(g, "libplugin.a", "libother.a", "app")
+		job, err := g.createLinkJob(g.targets["app"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		plugin, other := filepath.Join(g.buildDir, "libplugin.a"), filepath.Join(g.buildDir, "libother.a")
+		want := append(wholeArchiveArgs(plugin), other)
+		if !slices.Equal(job.deps, want) {
+			t.Errorf("executable links with %q, want %q", job.deps, want)
+		}
+	})
+
+	t.Run("ninja", func(t *testing.T) {
+		g := NewNinjaGen()
+		addWholeArchiveTargets(g, "libplugin.a", "libother.a", "app")
+		ninja := generate(t, g)
+		if want := strings.Join(wholeArchiveArgs("libplugin.a"), " "); !strings.Contains(ninja, "  ldflags = "+want+"\n") {
+			t.Errorf("build.ninja doesn't link libplugin.a with %q:\n%s", want, ninja)
+		}
+		if strings.Contains(ninja, "libother.a -Wl,--no-whole-archive") || strings.Contains(ninja, "-force_load,libother.a") {
+			t.Errorf("libother.a is linked as a whole archive:\n%s", ninja)
+		}
+	})
+
+	t.Run("vs2022", func(t *testing.T) {
+		g := NewVS2022Gen(t.TempDir(), []string{"x64"})
+		addWholeArchiveTargets(g, "plugin.lib", "other.lib", "app.exe")
+		for _, group := range g.createPlatformItemDefinitionGroups(g.targets["app"], "x64") {
+			if options := group.Link.AdditionalOptions; !strings.Contains(options, "/WHOLEARCHIVE:plugin.lib") || strings.Contains(options, "other") {
+				t.Errorf("%s: linker options %q, want only plugin.lib as a whole archive", group.Condition, options)
+			}
+		}
+	})
+}
+
+func TestCxxTargets(t *testing.T) {
+	c := func(name string) []SourceFile {
+		return []SourceFile{{Src: name + ".c", Obj: name + ".c.o", Lang: LangC}}
+	}
+	targets := map[string]buildUnit{
+		"app":      {name: "app", sources: c("main"), dependencies: []string{"libmid.a"}},
+		"libmid.a": {name: "libmid.a", sources: c("mid"), dependencies: []string{"libcpp.a"}},
+		"libcpp.a": {name: "libcpp.a", sources: []SourceFile{{Src: "cpp.cpp", Obj: "cpp.cpp.o", Lang: LangCxx}}},
+		"tool":     {name: "tool", sources: c("tool"), dependencies: []string{"libc.a"}},
+		"libc.a":   {name: "libc.a", sources: c("c")},
+		// a cycle doesn't recurse forever
+		"liba.a": {name: "liba.a", sources: c("a"), dependencies: []string{"libb.a"}},
+		"libb.a": {name: "libb.a", sources: c("b"), dependencies: []string{"liba.a"}},
+	}
+	want := map[string]bool{"app": true, "libmid.a": true, "libcpp.a": true, "tool": false, "libc.a": false, "liba.a": false, "libb.a": false}
+	if got := cxxTargets(targets); !maps.Equal(got, want) {
+		t.Errorf("cxxTargets = %v, want %v", got, want)
+	}
+}
+
+func TestLinkCWithCxxLibrary(t *testing.T) {
+	if _, err := exec.LookPath("g++"); err != nil {
+		t.Skip("g++ not found")
+	}
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.c":    "int mid(void);\nint main(void) { return mid(); }\n",
+		"mid.c":     "int greet(void);\nint mid(void) { return greet(); }\n",
+		"greet.cpp": "#include <string>\nextern \"C\" int greet() { return std::string(\"hi\").size() - 2; }\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	source := func(name string, lang Language) []SourceFile {
+		return []SourceFile{{Src: filepath.Join(dir, name), Obj: "QobsFiles/" + name + ".o", Lang: lang}}
+	}
+	addTargets := func(g Generator) {
+		g.AddTarget("libgreet.a", dir, source("greet.cpp", LangCxx), nil, nil, StaticLib, nil, nil, nil, nil)
+		g.AddTarget("libmid.a", dir, source("mid.c", LangC), []string{"libgreet.a"}, nil, StaticLib, nil, nil, nil, nil)
+		g.AddTarget("app", dir, source("main.c", LangC), []string{"libmid.a", "libgreet.a"}, nil, Executable, nil, nil, nil, nil)
+	}
+
+	// only C sources, but the C++ library needs the C++ standard library
+	g := NewQobsBuilder()
+	g.SetCompiler([]string{"gcc"}, []string{"g++"})
+	addTargets(g)
+	g.buildDir = filepath.Join(dir, "build")
+	g.cxxTargets = cxxTargets(g.targets)
+	job, err := g.createLinkJob(g.targets["app"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.isCxx || !slices.Equal(job.cc, []string{"g++"}) {
+		t.Errorf("app is linked with %q (C++: %v), want g++", job.cc, job.isCxx)
+	}
+	if err := g.Invoke(g.buildDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command(filepath.Join(g.buildDir, "app")).Run(); err != nil {
+		t.Errorf("app failed: %v", err)
+	}
+
+	ninja := NewNinjaGen()
+	addTargets(ninja)
+	if want := "build app: linkxx "; !strings.Contains(generate(t, ninja), want) {
+		t.Errorf("build.ninja doesn't contain %q", want)
+	}
+}
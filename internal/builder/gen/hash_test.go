@@ -0,0 +1,71 @@
+package gen
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// hashTree writes a target with n small sources and a precompiled header that included n
+// headers in the previous build, returning a generator for it
+func hashTree(tb testing.TB, n int) *QobsBuilder {
+	tb.Helper()
+	dir := tb.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			tb.Fatal(err)
+		}
+		return path
+	}
+	g := NewQobsBuilder()
+	state := &BuildState{PchDeps: make(map[string]string)}
+	var sources []SourceFile
+	for i := range n {
+		src := write(fmt.Sprintf("s%d.c", i), fmt.Sprintf("int f%d(void) { return %d; }\n%s", i, i, strings.Repeat("//\n", 1000)))
+		sources = append(sources, SourceFile{Src: src, Obj: src + ".o", Lang: LangC})
+		state.PchDeps[write(fmt.Sprintf("h%d.h", i), fmt.Sprintf("#define H%d\n", i))] = ""
+	}
+	g.AddTarget("app", dir, sources, nil, nil, Executable, nil, nil, nil, nil)
+	g.SetPch("app", write("pch.h", "#include <stdio.h>\n"))
+	g.buildState["app"] = state
+	return g
+}
+
+func TestHashSources(t *testing.T) {
+	g := hashTree(t, 20)
+	g.hashSources([]string{"app"})
+	want := []string{g.pch["app"]}
+	for _, src := range g.targets["app"].sources {
+		want = append(want, src.Src)
+	}
+	for file := range g.buildState["app"].PchDeps {
+		want = append(want, file)
+	}
+	for _, file := range want {
+		if _, ok := g.hashCache[file]; !ok {
+			t.Errorf("%s wasn't hashed", file)
+		}
+	}
+	if len(g.hashCache) != len(want) {
+		t.Errorf("hashed %d files, want %d", len(g.hashCache), len(want))
+	}
+}
+
+func BenchmarkHashSources(b *testing.B) {
+	g := hashTree(b, 2000)
+	// serially, then with a job per CPU
+	for _, jobs := range slices.Compact([]int{1, runtime.NumCPU()}) {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			g.SetJobs(jobs)
+			for b.Loop() {
+				g.hashCache = make(map[string]string)
+				g.hashSources([]string{"app"})
+			}
+		})
+	}
+}
@@ -1,101 +1,174 @@
 package gen
 
 import (
+	"maps"
 	"os"
 	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 )
 
 type NinjaGen struct {
-	cc, cxx string
-	targets map[string]buildUnit
+	cc, cxx  []string
+	launcher []string
+	archiver []string
+	targets  map[string]buildUnit
+	env      []string
+	jobs     int
 }
 
-func (g *NinjaGen) SetCompiler(cc, cxx string) {
+func NewNinjaGen() *NinjaGen {
+	return &NinjaGen{
+		targets: make(map[string]buildUnit),
+	}
+}
+
+func (g *NinjaGen) SetCompiler(cc, cxx []string) {
 	g.cc, g.cxx = cc, cxx
 }
 
+func (g *NinjaGen) SetLauncher(launcher []string) {
+	g.launcher = launcher
+}
+
+func (g *NinjaGen) SetArchiver(archiver []string) {
+	g.archiver = archiver
+}
+
 func (g *NinjaGen) BuildFile() string { return "build.ninja" }
 
-var ninjaPathEscaper = strings.NewReplacer(":", "$:", " ", "$ ")
+// Artifacts returns the files of the target named name, which ninja links in buildDir
+func (g *NinjaGen) Artifacts(buildDir, name string) []string { return artifacts(buildDir, name) }
 
-func quote(s string) string { return ninjaPathEscaper.Replace(s) }
+var (
+	ninjaPathEscaper  = strings.NewReplacer("$", "$$", ":", "$:", " ", "$ ")
+	ninjaValueEscaper = strings.NewReplacer("$", "$$")
+)
+
+func quote(s string) string       { return ninjaPathEscaper.Replace(s) }
+func escapeValue(s string) string { return ninjaValueEscaper.Replace(s) }
+
+// commandLine joins args into a ninja variable that's part of a command. ninja runs commands with
+// /bin/sh, and passes them to CreateProcess as they are on Windows, so each argument is quoted
+// for that and $ is escaped for ninja
+func commandLine(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		if runtime.GOOS == "windows" {
+			quoted = append(quoted, quoteResponseFileArg(arg, true))
+		} else {
+			quoted = append(quoted, shellQuote(arg))
+		}
+	}
+	return escapeValue(strings.Join(quoted, " "))
+}
+
+// shellQuote quotes arg for a POSIX shell, if it has characters the shell would interpret
+func shellQuote(arg string) string {
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_@%+=:,./-") == "" {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
 
 // AddTarget adds a package (library or executable) to the build graph
-func (g *NinjaGen) AddTarget(name, basedir string, sources []SourceFile, dependencies []string, isLib bool, cflags, ldflags []string) {
+func (g *NinjaGen) AddTarget(name, basedir string, sources []SourceFile, dependencies, wholeArchive []string, kind TargetKind, cc, cxx []string, cflags, ldflags []string) {
 	if g.targets == nil {
 		g.targets = make(map[string]buildUnit)
 	}
 
 	g.targets[name] = buildUnit{
 		name:         name,
-		isLib:        isLib,
+		kind:         kind,
 		sources:      sources,
 		dependencies: dependencies,
+		wholeArchive: wholeArchive,
+		cc:           cc,
+		cxx:          cxx,
 		cflags:       cflags,
 		ldflags:      ldflags,
+		basedir:      basedir,
 	}
 }
 
-func (g *NinjaGen) Generate() string {
+func (g *NinjaGen) Generate() (string, error) {
 	var sb strings.Builder
 
 	writeln(&sb, "# This file is @generated by Qobs: DO NOT EDIT!")
 	writeln(&sb, "ninja_required_version = 1.1")
-	//writeln(&sb, "cflags = ", g.cflags)
-	//writeln(&sb, "ldflags = ", g.ldflags)
-	writeln(&sb, "cc = ", g.cc)
-	writeln(&sb, "cxx = ", g.cxx)
+	writeln(&sb, "cc = ", commandLine(g.cc))
+	writeln(&sb, "cxx = ", commandLine(g.cxx))
+	writeln(&sb, "launcher = ", commandLine(g.launcher))
+	archiver := g.archiver
+	if len(archiver) == 0 {
+		archiver = defaultArchiver
+	}
+	writeln(&sb, "archiver = ", commandLine(archiver))
 	writeln(&sb)
 
 	// gen rules
 	write(&sb,
 		`rule cc
-  command = $cc $cflags -c $in -o $out
+  command = $launcher $cc $cflags -c $in -o $out
   description = CC $out
 `)
 	write(&sb,
 		`rule cxx
-  command = $cxx $cflags -c $in -o $out
+  command = $launcher $cxx $cflags -c $in -o $out
   description = CXX $out
 `)
 	write(&sb,
 		`rule link
-  command = $cc -o $out $in $ldflags
+  command = $launcher $cc -o $out $in $ldflags
   description = LINK $out
 `)
 	write(&sb,
 		`rule linkxx
-  command = $cxx -o $out $in $ldflags
+  command = $launcher $cxx -o $out $in $ldflags
   description = LINK $out
 `)
 	write(&sb,
 		`rule ar
-  command = ar rcs $out $in
+  command = $archiver $out $in
   description = AR $out
 `)
-	writeln(&sb)
+	write(&sb,
+		`rule symlink
+  command = ln -sf $in $out
+  description = SYMLINK $out
+`)
+
+	// cflags and ldflags are bound on each build statement, so they're scoped to the target
+	cxx := cxxTargets(g.targets)
+	for _, name := range slices.Sorted(maps.Keys(g.targets)) {
+		target := g.targets[name]
 
-	// build object files
-	var useCxxLinker bool
-	for _, target := range g.targets {
+		writeln(&sb)
+		writeln(&sb, "# target ", target.name)
+
+		// build object files
 		for _, source := range target.sources {
-			if source.IsCxx {
-				writeln(&sb, "build ", source.Obj, ": cxx ", quote(source.Src))
-				useCxxLinker = true
-			} else {
-				writeln(&sb, "build ", source.Obj, ": cc ", quote(source.Src))
+			rule := "cc"
+			if source.Lang == LangCxx {
+				rule = "cxx"
 			}
-			writeln(&sb, "  cflags = ", strings.Join(target.cflags, " "))
+			writeln(&sb, "build ", quote(source.Obj), ": ", rule, " ", quote(source.Src))
+			cflags := append(slices.Clone(target.cflags), source.Cflags...)
+			writeln(&sb, "  cflags = ", commandLine(cflags))
+			writeCompilerOverrides(&sb, target)
 		}
-	}
 
-	// ar/link
-	for _, target := range g.targets {
-		write(&sb, "build ", target.name, ": ")
-		if target.isLib {
+		// ar/link
+		write(&sb, "build ", quote(target.name))
+		if implib := ImportLibrary(target.name); implib != "" && target.kind == SharedLib {
+			write(&sb, " | ", quote(implib))
+		}
+		write(&sb, ": ")
+		if target.kind == StaticLib {
 			write(&sb, "ar")
-		} else if useCxxLinker {
+		} else if cxx[target.name] {
 			write(&sb, "linkxx")
 		} else {
 			write(&sb, "link")
@@ -103,20 +176,69 @@ func (g *NinjaGen) Generate() string {
 
 		// add the object files and dependencies of this package
 		for _, source := range target.sources {
-			write(&sb, " ", source.Obj)
+			write(&sb, " ", quote(source.Obj))
+		}
+		// whole archives are passed through ldflags so they can be wrapped, and are implicit inputs instead
+		var wholeArchiveFlags []string
+		for _, dep := range target.dependencies {
+			if !slices.Contains(target.wholeArchive, dep) {
+				write(&sb, " ", quote(linkInput(g.targets, dep)))
+			}
 		}
 		for _, dep := range target.dependencies {
-			write(&sb, " ", dep)
+			if slices.Contains(target.wholeArchive, dep) {
+				if wholeArchiveFlags == nil {
+					write(&sb, " |")
+				}
+				write(&sb, " ", quote(dep))
+				wholeArchiveFlags = append(wholeArchiveFlags, wholeArchiveArgs(dep)...)
+			}
 		}
 		writeln(&sb)
-		writeln(&sb, "  ldflags = ", strings.Join(target.ldflags, " "))
+		ldflags := append(targetLinkArgs(g.targets, target, ""), wholeArchiveFlags...)
+		ldflags = append(ldflags, target.ldflags...)
+		writeln(&sb, "  ldflags = ", commandLine(ldflags))
+		if target.kind != StaticLib {
+			writeCompilerOverrides(&sb, target)
+		}
+
+		// versioned shared libraries can also be found by their unversioned name
+		if linkName := sharedLibLinkName(target); linkName != "" {
+			writeln(&sb, "build ", quote(linkName), ": symlink ", quote(target.name))
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// writeCompilerOverrides overrides the cc and cxx variables of a build statement if the
+// target has its own compilers
+func writeCompilerOverrides(sb *strings.Builder, target buildUnit) {
+	if len(target.cc) > 0 {
+		writeln(sb, "  cc = ", commandLine(target.cc))
 	}
+	if len(target.cxx) > 0 {
+		writeln(sb, "  cxx = ", commandLine(target.cxx))
+	}
+}
 
-	return sb.String()
+// SetEnv sets extra environment variables for ninja, which passes them on to the compiler and linker
+func (g *NinjaGen) SetEnv(env map[string]string) {
+	g.env = environ(env)
+}
+
+// SetJobs sets how many jobs ninja runs at the same time, 0 leaves it to ninja
+func (g *NinjaGen) SetJobs(jobs int) {
+	g.jobs = jobs
 }
 
 func (g *NinjaGen) Invoke(buildDir string) error {
-	cmd := exec.Command("ninja", "-C", buildDir)
+	args := []string{"-C", buildDir}
+	if g.jobs > 0 {
+		args = append(args, "-j", strconv.Itoa(g.jobs))
+	}
+	cmd := exec.Command("ninja", args...)
+	cmd.Env = g.env
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -0,0 +1,46 @@
+package gen
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestNinjaTargetFlags(t *testing.T) {
+	g := NewNinjaGen()
+	g.SetCompiler([]string{"gcc"}, []string{"g++"})
+	core := []SourceFile{{Src: "core.c", Obj: "QobsFiles/libcore.a.dir/core.c.o", Lang: LangC}}
+	app := []SourceFile{
+		{Src: "main.c", Obj: "QobsFiles/app.dir/main.c.o", Lang: LangC},
+		{Src: "util.cpp", Obj: "QobsFiles/app.dir/util.cpp.o", Lang: LangCxx, Cflags: []string{"-fno-rtti"}},
+	}
+	g.AddTarget("libcore.a", ".", core, nil, nil, StaticLib, nil, nil, []string{"-DCORE"}, nil)
+	g.AddTarget("app", ".", app, []string{"libcore.a"}, nil, Executable, nil, nil, []string{"-DAPP", "-DMSG=hello world"}, []string{"-lm", "-Wl,-rpath,$ORIGIN"})
+	ninja := generate(t, g)
+
+	// each flag is one argument of the command ninja runs
+	msgFlag, rpathFlag := `'-DMSG=hello world'`, `'-Wl,-rpath,$$ORIGIN'`
+	if runtime.GOOS == "windows" {
+		msgFlag, rpathFlag = `"-DMSG=hello world"`, `-Wl,-rpath,$$ORIGIN`
+	}
+	for _, want := range []string{
+		"build QobsFiles/app.dir/main.c.o: cc main.c\n  cflags = -DAPP " + msgFlag + "\n",
+		"build QobsFiles/app.dir/util.cpp.o: cxx util.cpp\n  cflags = -DAPP " + msgFlag + " -fno-rtti\n",
+		// C++ objects are linked with the C++ compiler
+		"build app: linkxx QobsFiles/app.dir/main.c.o QobsFiles/app.dir/util.cpp.o libcore.a\n  ldflags = -lm " + rpathFlag + "\n",
+		"build QobsFiles/libcore.a.dir/core.c.o: cc core.c\n  cflags = -DCORE\n",
+	} {
+		if !strings.Contains(ninja, want) {
+			t.Errorf("build.ninja doesn't contain %q:\n%s", want, ninja)
+		}
+	}
+	// flags are only bound on build statements, never at the top level where all targets see them
+	for _, line := range strings.Split(ninja, "\n") {
+		if strings.HasPrefix(line, "cflags =") || strings.HasPrefix(line, "ldflags =") {
+			t.Errorf("build.ninja has the global %q", line)
+		}
+	}
+	if strings.Contains(ninja, "-DCORE -DAPP") || strings.Contains(ninja, "-DAPP -DCORE") {
+		t.Errorf("flags of one target leaked into the other:\n%s", ninja)
+	}
+}
@@ -0,0 +1,111 @@
+package gen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+
+	"github.com/qobs-build/qobs/internal/atomicfile"
+)
+
+// objCache is a compile cache shared between projects, mapping compilations to object files.
+// Compilations are keyed by their preprocessed source instead of the source file, so changes
+// to included headers are never missed. The line markers and the source path are part of the
+// key, since objects embed the paths of their sources in __FILE__ and debug info
+type objCache struct {
+	dir string
+}
+
+// key returns the cache key of a compile job run with env: the compiler identity, the source path,
+// the flags that aren't already reflected in the preprocessed source and the preprocessed source
+// itself, with line markers
+func (c *objCache) key(job compileJob, env []string) (string, error) {
+	compiler, err := exec.LookPath(job.cc[0])
+	if err != nil {
+		return "", err
+	}
+	stat, err := os.Stat(compiler)
+	if err != nil {
+		return "", err
+	}
+
+	var preprocessed []byte
+	if job.lang == LangAsm && filepath.Ext(job.src) == ".s" {
+		// plain assembly isn't preprocessed, -E prints nothing for it
+		if preprocessed, err = os.ReadFile(job.src); err != nil {
+			return "", err
+		}
+	} else {
+		// -E is understood by MSVC too, -P isn't: it writes a .i file there
+		args := append(job.cflags[:len(job.cflags):len(job.cflags)], "-E", job.src)
+		cmd := exec.Command(job.cc[0], slices.Concat(job.cc[1:], args)...)
+		cmd.Env = env
+		if preprocessed, err = cmd.Output(); err != nil {
+			return "", fmt.Errorf("failed to preprocess %s: %w", job.src, err)
+		}
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "compiler\n%s\n%d\n%d\n", compiler, stat.Size(), stat.ModTime().UnixNano())
+	fmt.Fprintf(h, "compiler kind\n%s\n", compilerKind(job.cc))
+	for _, arg := range job.cc[1:] {
+		fmt.Fprintf(h, "compiler arg\n%s\n", arg)
+	}
+	fmt.Fprintf(h, "source\n%s\n", job.src)
+	fmt.Fprintf(h, "lang\n%s\n", job.lang)
+	for _, flag := range job.cflags {
+		if !isPreprocessorOnlyFlag(flag) {
+			fmt.Fprintf(h, "flag\n%s\n", flag)
+		}
+	}
+	h.Write(preprocessed)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// compilerKind returns the flavor of the compiler cc, which decides how the preprocessed source
+// looks, e.g. the syntax of line markers
+func compilerKind(cc []string) string {
+	switch {
+	case isMsvcCompiler(cc):
+		return "msvc"
+	case isClangCompiler(cc):
+		return "clang"
+	}
+	return "gcc"
+}
+
+func (c *objCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".o")
+}
+
+// get copies the cached object for key to obj, returning false if there's none
+func (c *objCache) get(key, obj string) bool {
+	return copyFileAtomic(c.path(key), obj) == nil
+}
+
+// put stores obj in the cache under key
+func (c *objCache) put(key, obj string) error {
+	return copyFileAtomic(obj, c.path(key))
+}
+
+// copyFileAtomic copies src to dst through a temporary file, so that dst is never seen half-written
+func copyFileAtomic(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return atomicfile.Write(dst, 0644, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+}
@@ -0,0 +1,56 @@
+package gen
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestObjCacheKeyDependsOnSourcePath(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	dir := t.TempDir()
+	code := []byte("const char *file(void) { return __FILE__; }\n")
+	var keys []string
+	for _, name := range []string{"a/lib.c", "b/lib.c", "a/lib.c"} {
+		src := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(src, code, 0644); err != nil {
+			t.Fatal(err)
+		}
+		cache := &objCache{dir: filepath.Join(dir, "cache")}
+		key, err := cache.key(compileJob{src: src, obj: src + ".o", lang: LangC, cc: []string{"gcc"}}, os.Environ())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if keys[0] == keys[1] {
+		t.Error("identical sources at different paths share a cache entry")
+	}
+	if keys[0] != keys[2] {
+		t.Error("the key of the same compilation changed")
+	}
+}
+
+func TestCompilerKind(t *testing.T) {
+	tests := []struct {
+		cc   []string
+		want string
+	}{
+		{[]string{"gcc"}, "gcc"},
+		{[]string{"/usr/bin/clang++"}, "clang"},
+		{[]string{"zig", "cc"}, "clang"},
+		{[]string{"cl.exe"}, "msvc"},
+		{[]string{"clang-cl"}, "msvc"},
+	}
+	for _, tt := range tests {
+		if got := compilerKind(tt.cc); got != tt.want {
+			t.Errorf("compilerKind(%q) = %q, want %q", tt.cc, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package gen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/qobs-build/qobs/internal/msg"
+)
+
+// PrecompiledHeaders is implemented by generators that can precompile a header for a target
+type PrecompiledHeaders interface {
+	// SetPch makes every C or C++ source of the target include header first, which is precompiled
+	// once instead of being parsed for every source. Called after the target is added
+	SetPch(target, header string)
+}
+
+// SetPch precompiles header for the sources of target. The header is precompiled for each of C and
+// C++ if the target has sources in both, and rebuilt along with the sources using it whenever the
+// header, the flags or the compiler change
+func (g *QobsBuilder) SetPch(target, header string) {
+	if g.pch == nil {
+		g.pch = make(map[string]string)
+	}
+	g.pch[target] = header
+}
+
+// pchLanguages returns the languages of the sources of target that use its precompiled header
+func pchLanguages(target buildUnit) []Language {
+	var langs []Language
+	for _, lang := range []Language{LangC, LangCxx} {
+		if slices.ContainsFunc(target.sources, func(src SourceFile) bool { return src.Lang == lang }) {
+			langs = append(langs, lang)
+		}
+	}
+	return langs
+}
+
+// pchInclude returns the header that sources of lang include with -include to use the precompiled
+// header of target, and the precompiled header next to it, where GCC and Clang look for it
+func (g *QobsBuilder) pchInclude(target buildUnit, lang Language, cc []string) (include, out string) {
+	include = filepath.Join(g.buildDir, "QobsFiles", target.name+".dir", "pch-"+lang.String(), filepath.Base(g.pch[target.name]))
+	if isClangCompiler(cc) {
+		return include, include + ".pch"
+	}
+	return include, include + ".gch"
+}
+
+// pchFlags returns the flags the header of target is precompiled with for lang: the flags of the
+// target and the language standard, which the sources have to match for the header to be used
+func pchFlags(target buildUnit, lang Language) []string {
+	flags := slices.Clone(target.cflags)
+	for _, src := range target.sources {
+		if src.Lang != lang {
+			continue
+		}
+		for _, flag := range src.Cflags {
+			if strings.HasPrefix(flag, "-std=") {
+				flags = append(flags, flag)
+			}
+		}
+		break
+	}
+	return flags
+}
+
+// pchKey identifies the precompiled header of target for lang: it changes with the header, its
+// flags and the compiler
+func (g *QobsBuilder) pchKey(target buildUnit, lang Language, cc []string) (string, error) {
+	hash, err := g.fileHash(g.pch[target.name])
+	if err != nil {
+		return "", fmt.Errorf("precompiled header %s: %w", g.pch[target.name], err)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "header\n%s\n", hash)
+	for _, arg := range cc {
+		fmt.Fprintf(h, "compiler arg\n%s\n", arg)
+	}
+	for _, flag := range compileFlags(pchFlags(target, lang)) {
+		fmt.Fprintf(h, "flag\n%s\n", flag)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// pchKeys returns the keys of the precompiled headers of target by language, see pchKey
+func (g *QobsBuilder) pchKeys(target buildUnit) (map[string]string, error) {
+	if g.pch[target.name] == "" {
+		return nil, nil
+	}
+	cc, cxx := target.compilers(g.cc, g.cxx)
+	keys := make(map[string]string)
+	for _, lang := range pchLanguages(target) {
+		compiler := cc
+		if lang == LangCxx {
+			compiler = cxx
+		}
+		key, err := g.pchKey(target, lang, compiler)
+		if err != nil {
+			return nil, err
+		}
+		keys[lang.String()] = key
+	}
+	return keys, nil
+}
+
+// planPch returns the jobs that precompile the header of target, which run before all other compile
+// jobs, and why the sources of each language have to be recompiled because of it
+func (g *QobsBuilder) planPch(target buildUnit, oldState *BuildState, cc, cxx []string) ([]compileJob, map[Language]string, error) {
+	header := g.pch[target.name]
+	if header == "" {
+		if oldState != nil && len(oldState.Pch) > 0 {
+			// the sources included the header, now they don't
+			return nil, map[Language]string{LangC: "precompiled header removed", LangCxx: "precompiled header removed"}, nil
+		}
+		return nil, nil, nil
+	}
+	if isMsvcCompiler(cc) || isMsvcCompiler(cxx) {
+		msg.Warn("target %q: ignoring target.pch, the qobs generator only precompiles headers with GCC and Clang", target.name)
+		delete(g.pch, target.name)
+		return nil, nil, nil
+	}
+
+	var jobs []compileJob
+	recompile := make(map[Language]string)
+	for _, lang := range pchLanguages(target) {
+		compiler := cc
+		if lang == LangCxx {
+			compiler = cxx
+		}
+		key, err := g.pchKey(target, lang, compiler)
+		if err != nil {
+			return nil, nil, err
+		}
+		include, out := g.pchInclude(target, lang, compiler)
+
+		reason := ""
+		switch {
+		case oldState == nil:
+			reason = "no previous build state"
+		case oldState.Pch[lang.String()] != key:
+			reason = "precompiled header changed"
+			recompile[lang] = reason
+		case g.pchDepsChanged(oldState):
+			reason = "header included by the precompiled header changed"
+			recompile[lang] = reason
+		}
+		if reason == "" {
+			for _, path := range []string{include, out} {
+				if _, err := os.Stat(path); err != nil {
+					reason = "precompiled header is missing"
+				}
+			}
+		}
+		if reason != "" {
+			jobs = append(jobs, compileJob{
+				src:    header,
+				obj:    out,
+				cflags: pchFlags(target, lang),
+				lang:   lang,
+				cc:     compiler,
+				reason: reason,
+				pch:    true,
+			})
+		}
+	}
+	return jobs, recompile, nil
+}
+
+// pchDepfile returns the depfile written when the precompiled header out is built, which lists the
+// headers it includes
+func pchDepfile(out string) string {
+	return out + ".d"
+}
+
+// pchDeps returns the hashes of the headers that the precompiled headers of target include, read
+// from their depfiles
+func (g *QobsBuilder) pchDeps(target buildUnit) (map[string]string, error) {
+	if g.pch[target.name] == "" {
+		return nil, nil
+	}
+	cc, cxx := target.compilers(g.cc, g.cxx)
+	var files []string
+	for _, lang := range pchLanguages(target) {
+		compiler := cc
+		if lang == LangCxx {
+			compiler = cxx
+		}
+		_, out := g.pchInclude(target, lang, compiler)
+		langFiles, err := parseDepfile(pchDepfile(out))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the headers included by the precompiled header: %w", err)
+		}
+		files = append(files, langFiles...)
+	}
+	g.hashFiles(files)
+	deps := make(map[string]string, len(files))
+	for _, file := range files {
+		hash, err := g.fileHash(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s, included by the precompiled header: %w", file, err)
+		}
+		deps[file] = hash
+	}
+	return deps, nil
+}
+
+// pchDepsChanged reports whether a header that the precompiled header included in the build of
+// oldState changed or is gone since
+func (g *QobsBuilder) pchDepsChanged(oldState *BuildState) bool {
+	for file, prevHash := range oldState.PchDeps {
+		if hash, err := g.fileHash(file); err != nil || hash != prevHash {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDepfile returns the prerequisites of the Makefile rule in the depfile at path, as written
+// by -MD: "out.gch: a.h b\\ c.h \\<newline> d.h"
+func parseDepfile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\\\n", " ")
+	// the target ends at the first colon followed by whitespace, drive letters have none
+	_, prereqs, ok := strings.Cut(text, ": ")
+	if !ok {
+		return nil, fmt.Errorf("%s: not a depfile", path)
+	}
+
+	var files []string
+	var file strings.Builder
+	flush := func() {
+		if file.Len() > 0 {
+			files = append(files, file.String())
+			file.Reset()
+		}
+	}
+	for i := 0; i < len(prereqs); i++ {
+		switch c := prereqs[i]; {
+		case c == '\\' && i+1 < len(prereqs) && (prereqs[i+1] == ' ' || prereqs[i+1] == '#'):
+			file.WriteByte(prereqs[i+1])
+			i++
+		case c == '$' && i+1 < len(prereqs) && prereqs[i+1] == '$':
+			file.WriteByte('$')
+			i++
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		default:
+			file.WriteByte(c)
+		}
+	}
+	flush()
+	return files, nil
+}
+
+// pchCflags returns the flags that make a source of lang use the precompiled header of target
+func (g *QobsBuilder) pchCflags(target buildUnit, lang Language, cc []string) []string {
+	if g.pch[target.name] == "" || (lang != LangC && lang != LangCxx) {
+		return nil
+	}
+	include, _ := g.pchInclude(target, lang, cc)
+	return []string{"-include", include}
+}
+
+// emitPchCflags returns the flags that include the precompiled header of target in sources whose
+// diagnostic output is emitted, which include the header itself instead
+func (g *QobsBuilder) emitPchCflags(target buildUnit, cc []string) []string {
+	header := g.pch[target.name]
+	switch {
+	case header == "":
+		return nil
+	case isMsvcCompiler(cc):
+		return []string{"/FI" + header}
+	}
+	return []string{"-include", header}
+}
+
+// runPchJob precompiles a header. Sources include it through a header in the same directory as the
+// precompiled one, which includes the original header if the precompiled one can't be used
+func (g *QobsBuilder) runPchJob(job compileJob) error {
+	event := jobEvent{kind: "compile", phase: "Precompiling", action: "PCH", name: job.src, src: job.src, out: job.obj}
+	g.progress.jobStarted(event)
+
+	include := strings.TrimSuffix(job.obj, filepath.Ext(job.obj))
+	if err := os.MkdirAll(filepath.Dir(include), 0755); err != nil {
+		return fmt.Errorf("failed to create precompiled header directory: %w", err)
+	}
+	wrapper := fmt.Sprintf("#include %q\n", filepath.ToSlash(job.src))
+	if err := os.WriteFile(include, []byte(wrapper), 0644); err != nil {
+		return err
+	}
+
+	language := "c-header"
+	if job.lang == LangCxx {
+		language = "c++-header"
+	}
+	args := append(slices.Clone(job.cflags), "-MD", "-MF", pchDepfile(job.obj), "-x", language, job.src, "-o", job.obj)
+	// no launcher, compiler caches don't handle precompiled headers well
+	cmd, rsp, err := g.command(nil, job.cc, args)
+	if err != nil {
+		return fmt.Errorf("failed to write response file: %w", err)
+	}
+	if rsp != "" {
+		defer os.Remove(rsp)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		g.progress.jobFailed(event, output, err)
+		return &jobError{"precompile", job.src}
+	}
+	event.name = g.jobName(job.src, rsp, nil)
+	g.progress.jobDone(event)
+	return nil
+}
+
+// isClangCompiler reports whether cc is Clang, which looks for precompiled headers with a .pch
+// extension instead of GCC's .gch
+func isClangCompiler(cc []string) bool {
+	if len(cc) == 0 {
+		return false
+	}
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(cc[0])), ".exe")
+	return strings.Contains(name, "clang") || name == "zig"
+}
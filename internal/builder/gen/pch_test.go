@@ -0,0 +1,151 @@
+package gen
+
+import (
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseDepfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pch.h.gch.d")
+	depfile := "out/pch.h.gch: src/pch.h \\\r\n  /usr/include/stdio.h my\\ dir/a.h \\\n cost$$.h\n"
+	if err := os.WriteFile(path, []byte(depfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseDepfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"src/pch.h", "/usr/include/stdio.h", "my dir/a.h", "cost$.h"}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseDepfile = %q, want %q", got, want)
+	}
+}
+
+// pchProject is a C++ executable whose precompiled header includes another header
+type pchProject struct {
+	dir, buildDir string
+	pch           bool
+}
+
+func newPchProject(t *testing.T) *pchProject {
+	t.Helper()
+	if _, err := exec.LookPath("g++"); err != nil {
+		t.Skip("g++ not found")
+	}
+	p := &pchProject{dir: t.TempDir(), pch: true}
+	p.buildDir = filepath.Join(p.dir, "build")
+	p.write(t, "inc.h", "#define ANSWER 42\n")
+	p.write(t, "pch.h", "#include \"inc.h\"\n")
+	p.write(t, "main.cpp", "int main() { return ANSWER - 42; }\n")
+	return p
+}
+
+func (p *pchProject) write(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(p.dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// builder returns a generator for the project, which loads the state of the previous build
+func (p *pchProject) builder() *QobsBuilder {
+	g := NewQobsBuilder()
+	g.SetCompiler([]string{"gcc"}, []string{"g++"})
+	sources := []SourceFile{{Src: filepath.Join(p.dir, "main.cpp"), Obj: "QobsFiles/app.dir/main.cpp.o", Lang: LangCxx}}
+	g.AddTarget("app", p.dir, sources, nil, nil, Executable, nil, nil, nil, nil)
+	if p.pch {
+		g.SetPch("app", filepath.Join(p.dir, "pch.h"))
+	}
+	return g
+}
+
+func (p *pchProject) build(t *testing.T) {
+	t.Helper()
+	if err := p.builder().Invoke(p.buildDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reasons returns why each planned compile job would run, by source file name
+func (p *pchProject) reasons(t *testing.T) map[string]string {
+	t.Helper()
+	g := p.builder()
+	g.buildDir = p.buildDir
+	g.stateFile = filepath.Join(p.buildDir, g.BuildFile())
+	if err := g.loadBuildState(); err != nil {
+		t.Fatal(err)
+	}
+	names, err := g.topologicalSortTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.cxxTargets = cxxTargets(g.targets)
+	jobs, _, err := g.planBuild(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]string)
+	for _, job := range jobs {
+		reasons[filepath.Base(job.src)] = job.reason
+	}
+	return reasons
+}
+
+func TestPchRebuild(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, p *pchProject)
+		want   map[string]string
+	}{
+		{
+			name:   "nothing changed",
+			change: func(*testing.T, *pchProject) {},
+			want:   map[string]string{},
+		},
+		{
+			name:   "included header changed",
+			change: func(t *testing.T, p *pchProject) { p.write(t, "inc.h", "#define ANSWER (40 + 2)\n") },
+			want: map[string]string{
+				"pch.h":    "header included by the precompiled header changed",
+				"main.cpp": "header included by the precompiled header changed",
+			},
+		},
+		{
+			name:   "header changed",
+			change: func(t *testing.T, p *pchProject) { p.write(t, "pch.h", "#include \"inc.h\"\n#include <cstdio>\n") },
+			want: map[string]string{
+				"pch.h":    "precompiled header changed",
+				"main.cpp": "precompiled header changed",
+			},
+		},
+		{
+			name: "precompiled header deleted",
+			change: func(t *testing.T, p *pchProject) {
+				gch := filepath.Join(p.buildDir, "QobsFiles", "app.dir", "pch-cxx", "pch.h.gch")
+				if err := os.Remove(gch); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{"pch.h": "precompiled header is missing"},
+		},
+		{
+			name:   "precompiled header removed",
+			change: func(t *testing.T, p *pchProject) { p.pch = false },
+			want:   map[string]string{"main.cpp": "precompiled header removed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPchProject(t)
+			p.build(t)
+			tt.change(t, p)
+			if got := p.reasons(t); !maps.Equal(got, tt.want) {
+				t.Errorf("planned %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
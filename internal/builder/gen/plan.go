@@ -0,0 +1,105 @@
+package gen
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// PlanFile is the file the complete build plan is written to in the build directory, see SetEmitPlan
+const PlanFile = "qobs_plan.json"
+
+// planSource is a source file of a planned target
+type planSource struct {
+	Src    string   `json:"src"`
+	Obj    string   `json:"obj"`
+	Lang   string   `json:"lang"`
+	Cflags []string `json:"cflags"` // all compilation flags, including the ones of the target
+}
+
+// planTarget is a target of the build plan with everything needed to build it from scratch
+type planTarget struct {
+	Name         string       `json:"name"`
+	Kind         string       `json:"kind"`
+	Basedir      string       `json:"basedir"`
+	Output       string       `json:"output"`
+	CC           []string     `json:"cc,omitempty"`
+	CXX          []string     `json:"cxx,omitempty"`
+	Linker       []string     `json:"linker"` // compiler driver or archiver the output is created with
+	Cflags       []string     `json:"cflags"`
+	Ldflags      []string     `json:"ldflags"` // all linker flags, including the ones added for the target kind
+	Dependencies []string     `json:"dependencies"`
+	WholeArchive []string     `json:"whole_archive,omitempty"`
+	Sources      []planSource `json:"sources"`
+}
+
+// SetEmitPlan makes every build write the complete build plan to PlanFile: all targets in build
+// order with their sources, objects, flags and dependencies, whether or not they're out of date
+func (g *QobsBuilder) SetEmitPlan(emitPlan bool) {
+	g.emitPlan = emitPlan
+}
+
+// writePlan writes the build plan of the targets, which are sorted in build order
+func (g *QobsBuilder) writePlan(sortedTargetNames []string) error {
+	targets := make([]planTarget, 0, len(sortedTargetNames))
+	for _, name := range sortedTargetNames {
+		target := g.targets[name]
+		job, err := g.createLinkJob(target)
+		if err != nil {
+			return err
+		}
+		cc, cxx := target.compilers(g.cc, g.cxx)
+		linker := job.cc
+		if job.isLib {
+			linker = g.archiver
+			if len(linker) == 0 {
+				linker = defaultArchiver
+			}
+		}
+
+		sources := make([]planSource, 0, len(target.sources))
+		for _, src := range target.sources {
+			sources = append(sources, planSource{
+				Src:    src.Src,
+				Obj:    filepath.Join(g.buildDir, src.Obj),
+				Lang:   src.Lang.String(),
+				Cflags: nonNil(slices.Concat(target.cflags, g.emitPchCflags(target, cc), src.Cflags)),
+			})
+		}
+		targets = append(targets, planTarget{
+			Name:         name,
+			Kind:         target.kind.String(),
+			Basedir:      target.basedir,
+			Output:       job.out,
+			CC:           cc,
+			CXX:          cxx,
+			Linker:       linker,
+			Cflags:       nonNil(target.cflags),
+			Ldflags:      nonNil(job.ldflags),
+			Dependencies: nonNil(target.dependencies),
+			WholeArchive: target.wholeArchive,
+			Sources:      sources,
+		})
+	}
+
+	data, err := json.MarshalIndent(struct {
+		Targets []planTarget `json:"targets"`
+	}{targets}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(g.buildDir, PlanFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write the build plan: %w", err)
+	}
+	return nil
+}
+
+// nonNil returns s, or an empty slice if it's nil, so that it's written as [] rather than null
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,92 @@
+package gen
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	"github.com/qobs-build/qobs/internal/msg"
+)
+
+// progress reports completed build jobs. On a terminal it keeps a single updating line
+// like "Compiling [42/137] ~10s left", otherwise (or when verbose) it prints a line for every job
+type progress struct {
+	start   time.Time
+	total   int
+	done    atomic.Int64
+	tty     bool
+	verbose bool
+	mu      sync.Mutex // keeps lines from concurrent jobs apart
+	onLine  bool       // whether the updating line is shown
+}
+
+func newProgress(total int, verbose bool) *progress {
+	return &progress{
+		start:   time.Now(),
+		total:   total,
+		tty:     isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd()),
+		verbose: verbose,
+	}
+}
+
+func (p *progress) jobStarted(job jobEvent) {}
+
+// jobDone records that a job finished. Its phase is shown on the updating line (e.g. "Compiling"),
+// its action and name on the per-job line (e.g. "CC src/main.c")
+func (p *progress) jobDone(job jobEvent) {
+	done := p.done.Add(1)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty && !p.verbose {
+		fmt.Printf("%s%s [%d/%d]", sameLine, job.phase, done, p.total)
+		p.onLine = true
+		if remaining := int64(p.total) - done; remaining > 0 {
+			// assume the remaining jobs take as long as the finished ones on average
+			eta := time.Since(p.start) / time.Duration(done) * time.Duration(remaining)
+			fmt.Printf(" ~%s left", eta.Round(time.Second))
+		}
+	} else {
+		action := job.action
+		if job.cached {
+			action += " (cached)"
+		}
+		fmt.Printf("[%d/%d] %s %s\n", done, p.total, action, job.name)
+	}
+}
+
+// jobFailed prints the output of a failed job at once, headed by the name of the file it was
+// working on, so that failures of concurrent jobs don't interleave
+func (p *progress) jobFailed(job jobEvent, output []byte, err error) {
+	name := job.src
+	if name == "" {
+		name = job.out
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.onLine {
+		fmt.Print(sameLine)
+		p.onLine = false
+	}
+	msg.Error("%s", name)
+	if len(output) == 0 {
+		output = []byte(err.Error())
+	}
+	fmt.Print(string(output))
+	if output[len(output)-1] != '\n' {
+		fmt.Println()
+	}
+}
+
+// finish ends the updating line, if there is one
+func (p *progress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.onLine {
+		fmt.Println()
+		p.onLine = false
+	}
+}
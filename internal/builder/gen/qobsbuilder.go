@@ -9,12 +9,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"slices"
+	"strings"
+	"sync"
 
+	"github.com/qobs-build/qobs/internal/atomicfile"
 	"github.com/qobs-build/qobs/internal/msg"
 	"golang.org/x/sync/errgroup"
 )
@@ -25,10 +29,17 @@ const (
 
 // BuildState represents the state of a build target for incremental builds
 type BuildState struct {
-	Sources      map[string]string `json:"sources,omitempty"`      // source file -> hash
-	Dependencies map[string]string `json:"dependencies,omitempty"` // dependency string -> hash
-	Cflags       []string          `json:"cflags,omitempty"`       // compilation flags
-	Ldflags      []string          `json:"ldflags,omitempty"`      // linker flags
+	Sources      map[string]string   `json:"sources,omitempty"`       // source file -> hash
+	Dependencies map[string]string   `json:"dependencies,omitempty"`  // dependency string -> hash
+	Cflags       []string            `json:"cflags,omitempty"`        // compilation flags
+	Ldflags      []string            `json:"ldflags,omitempty"`       // linker flags
+	SourceCflags map[string][]string `json:"source_cflags,omitempty"` // source file -> extra compilation flags
+	WholeArchive []string            `json:"whole_archive,omitempty"` // dependencies linked as whole archives
+	CC           string              `json:"cc,omitempty"`            // C compiler
+	CXX          string              `json:"cxx,omitempty"`           // C++ compiler
+	Stripped     bool                `json:"stripped,omitempty"`      // symbols were stripped after linking
+	Pch          map[string]string   `json:"pch,omitempty"`           // language -> key of the precompiled header
+	PchDeps      map[string]string   `json:"pch_deps,omitempty"`      // header included by the precompiled header -> hash
 }
 
 // compileJob represents a single compilation job
@@ -36,8 +47,10 @@ type compileJob struct {
 	src    string
 	obj    string
 	cflags []string
-	isCxx  bool
-	cc     string
+	lang   Language
+	cc     []string
+	reason string // why the source is compiled, shown by dry runs
+	pch    bool   // precompiles the header src, see runPchJob
 }
 
 // linkJob represents a linking job
@@ -47,19 +60,41 @@ type linkJob struct {
 	deps    []string
 	out     string
 	ldflags []string
-	isLib   bool
+	isLib   bool // static library, archived instead of linked
 	isCxx   bool
-	cc      string
+	cc      []string
+	reason  string // why the target is linked, shown by dry runs
 }
 
+// QobsBuilder is qobs's own builder and its only incremental build path: planBuild decides
+// per source which objects are dirty and only relinks targets whose objects, flags or
+// dependencies changed
 type QobsBuilder struct {
-	cc, cxx    string
-	targets    map[string]buildUnit
-	buildDir   string
-	stateFile  string
-	buildState map[string]*BuildState
-	jobs       int
-	hashCache  map[string]string
+	cc, cxx      []string
+	targets      map[string]buildUnit
+	cxxTargets   map[string]bool
+	pch          map[string]string // target -> header precompiled for it, see SetPch
+	buildDir     string
+	stateFile    string
+	buildState   map[string]*BuildState
+	jobs         int
+	hashCache    map[string]string
+	hashMu       sync.Mutex
+	objCache     *objCache // nil if the compile cache is disabled
+	env          []string  // environment of compiler and linker processes, nil to inherit
+	verbose      bool
+	progress     reporter
+	counter      *countingReporter // counts the jobs of the last build, see Summary
+	emit         EmitMode
+	rspThreshold int      // command line length above which response files are used, 0 for the default
+	keepGoing    bool     // run all jobs even if some fail, instead of stopping at the first failure
+	launcher     []string // prefix of compiler and linker command lines, e.g. ["ccache"]
+	archiver     []string // archiver and its flags, defaultArchiver if empty
+	dryRun       bool     // only print the planned jobs
+	timings      *timings // nil unless jobs are timed
+	jsonEvents   bool     // report jobs as JSON instead of progress output
+	emitPlan     bool     // write the build plan to PlanFile
+	strip        []string // command stripping linked executables and shared libraries, nil to keep symbols
 }
 
 func NewQobsBuilder() *QobsBuilder {
@@ -71,29 +106,94 @@ func NewQobsBuilder() *QobsBuilder {
 	}
 }
 
-func (g *QobsBuilder) SetCompiler(cc, cxx string) {
+func (g *QobsBuilder) SetCompiler(cc, cxx []string) {
 	g.cc, g.cxx = cc, cxx
 }
 
+func (g *QobsBuilder) SetLauncher(launcher []string) {
+	g.launcher = launcher
+}
+
+func (g *QobsBuilder) SetArchiver(archiver []string) {
+	g.archiver = archiver
+}
+
+func (g *QobsBuilder) SetEnv(env map[string]string) {
+	g.env = environ(env)
+}
+
+// SetEmit sets what compile jobs produce. Anything but EmitObjects skips linking
+func (g *QobsBuilder) SetEmit(mode EmitMode) {
+	g.emit = mode
+}
+
+// SetJobs sets how many jobs run at the same time, jobs <= 0 runs one per CPU
+func (g *QobsBuilder) SetJobs(jobs int) {
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	g.jobs = jobs
+}
+
+// SetKeepGoing makes the builder run every compile job even if some of them fail, reporting all
+// failures at the end instead of stopping at the first one
+func (g *QobsBuilder) SetKeepGoing(keepGoing bool) {
+	g.keepGoing = keepGoing
+}
+
+// SetStrip sets the command that strips the symbols of every executable and shared library after
+// it's linked, followed by its flags, e.g. ["strip", "--strip-unneeded"]. nil keeps all symbols
+func (g *QobsBuilder) SetStrip(strip []string) {
+	g.strip = strip
+}
+
+// SetDryRun makes Invoke print the jobs it would run and why, without running them
+func (g *QobsBuilder) SetDryRun(dryRun bool) {
+	g.dryRun = dryRun
+}
+
+// SetVerbose makes the builder print a line for every job, even on a terminal
+func (g *QobsBuilder) SetVerbose(verbose bool) {
+	g.verbose = verbose
+}
+
+// SetCacheDir enables the compile cache shared between projects, stored in dir.
+// An empty dir disables it
+func (g *QobsBuilder) SetCacheDir(dir string) {
+	if dir == "" {
+		g.objCache = nil
+		return
+	}
+	g.objCache = &objCache{dir: dir}
+}
+
 func (g *QobsBuilder) BuildFile() string {
 	return "qobs_build_state.json"
 }
 
+// Artifacts returns the files of the target named name, which are linked in buildDir
+func (g *QobsBuilder) Artifacts(buildDir, name string) []string {
+	return artifacts(buildDir, name)
+}
+
 // AddTarget adds a package (library or executable) to the build graph
-func (g *QobsBuilder) AddTarget(name, basedir string, sources []SourceFile, dependencies []string, isLib bool, cflags, ldflags []string) {
+func (g *QobsBuilder) AddTarget(name, basedir string, sources []SourceFile, dependencies, wholeArchive []string, kind TargetKind, cc, cxx []string, cflags, ldflags []string) {
 	g.targets[name] = buildUnit{
 		name:         name,
-		isLib:        isLib,
+		kind:         kind,
 		sources:      sources,
 		dependencies: dependencies,
+		wholeArchive: wholeArchive,
+		cc:           cc,
+		cxx:          cxx,
 		cflags:       cflags,
 		ldflags:      ldflags,
 		basedir:      basedir,
 	}
 }
 
-func (g *QobsBuilder) Generate() string {
-	return "" // no build file needed
+func (g *QobsBuilder) Generate() (string, error) {
+	return "", nil // no build file needed
 }
 
 // Invoke performs the actual build
@@ -109,20 +209,39 @@ func (g *QobsBuilder) Invoke(buildDir string) error {
 	if err != nil {
 		return err
 	}
+	g.cxxTargets = cxxTargets(g.targets)
+
+	if g.emit != EmitObjects {
+		return g.emitAll(sortedTargetNames)
+	}
+
+	if g.emitPlan {
+		if err := g.writePlan(sortedTargetNames); err != nil {
+			return err
+		}
+	}
 
 	compileJobs, linkJobs, err := g.planBuild(sortedTargetNames)
 	if err != nil {
 		return fmt.Errorf("build planning failed: %w", err)
 	}
 
-	if len(compileJobs) == 0 && len(linkJobs) == 0 {
-		fmt.Println("qobs: no work to do.")
+	if g.dryRun {
+		printPlan(compileJobs, linkJobs)
 		return nil
 	}
 
+	if len(compileJobs) == 0 && len(linkJobs) == 0 {
+		g.noWork()
+		return g.updateSharedLibLinks()
+	}
+
 	if err := g.executeBuild(compileJobs, linkJobs); err != nil {
 		return err
 	}
+	if err := g.updateSharedLibLinks(); err != nil {
+		return err
+	}
 
 	if err := g.saveBuildState(); err != nil {
 		msg.Warn("failed to save build state: %v", err)
@@ -131,68 +250,109 @@ func (g *QobsBuilder) Invoke(buildDir string) error {
 	return nil
 }
 
+// updateSharedLibLinks creates the unversioned links of all versioned shared libraries
+func (g *QobsBuilder) updateSharedLibLinks() error {
+	for _, name := range slices.Sorted(maps.Keys(g.targets)) {
+		if err := updateSharedLibLink(g.buildDir, g.targets[name]); err != nil {
+			return fmt.Errorf("failed to link %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
 // planBuild determines which compile and link jobs are necessary
 func (g *QobsBuilder) planBuild(sortedTargetNames []string) (allCompileJobs []compileJob, allLinkJobs []linkJob, err error) {
 	rebuiltTargets := make(map[string]bool)
+	g.hashSources(sortedTargetNames)
 
 	for _, targetName := range sortedTargetNames {
 		target := g.targets[targetName]
 		oldState := g.buildState[targetName]
-		needsRelink := false
+		relinkReason := ""
 
 		// reason 1 for relink: output file is missing
 		outputPath := filepath.Join(g.buildDir, target.name)
 		if _, err := os.Stat(outputPath); os.IsNotExist(err) {
-			needsRelink = true
+			relinkReason = "output is missing"
 		}
 
-		// reason 2 for relink: flags have changed
-		if oldState != nil && (!slices.Equal(oldState.Cflags, target.cflags) || !slices.Equal(oldState.Ldflags, target.ldflags)) {
-			needsRelink = true
+		// reason 2 for relink: linker flags have changed. Compilation flags that changed cause
+		// every source to be recompiled instead, which also relinks the target
+		cc, cxx := target.compilers(g.cc, g.cxx)
+		var recompileReason string
+		if oldState != nil && !slices.Equal(compileFlags(oldState.Cflags), compileFlags(target.cflags)) {
+			recompileReason = "compile flags changed"
+		}
+		// a different compiler produces different objects, too
+		if oldState != nil && (oldState.CC != strings.Join(cc, " ") || oldState.CXX != strings.Join(cxx, " ")) {
+			recompileReason = "compiler changed"
+		}
+		if relinkReason == "" && oldState != nil && !slices.Equal(linkFlags(oldState.Ldflags), linkFlags(target.ldflags)) {
+			relinkReason = "linker flags changed"
+		}
+		if relinkReason == "" && oldState != nil && !slices.Equal(oldState.WholeArchive, target.wholeArchive) {
+			relinkReason = "whole-archive dependencies changed"
+		}
+		if relinkReason == "" && oldState != nil && target.kind != StaticLib && oldState.Stripped != (len(g.strip) > 0) {
+			relinkReason = "stripping changed"
 		}
 
 		// reason 3 for relink: a dependency was rebuilt
 		for _, depName := range target.dependencies {
+			if relinkReason != "" {
+				break
+			}
 			if rebuiltTargets[depName] {
-				needsRelink = true
+				relinkReason = "dependency " + depName + " is rebuilt"
 				break
 			}
 			depPath := filepath.Join(g.buildDir, depName)
 			hash, err := g.fileHash(depPath)
 			if err != nil {
 				if os.IsNotExist(err) {
-					needsRelink = true
+					relinkReason = "dependency " + depName + " is missing"
 					break
 				}
 				return nil, nil, fmt.Errorf("failed to hash dependency %s: %w", depName, err)
 			}
 			if oldState == nil || oldState.Dependencies[depName] != hash {
-				needsRelink = true
+				relinkReason = "dependency " + depName + " changed"
 				break
 			}
 		}
 
+		// the precompiled header is built first, sources using it are recompiled when it changes
+		pchJobs, pchRecompile, err := g.planPch(target, oldState, cc, cxx)
+		if err != nil {
+			return nil, nil, err
+		}
+		allCompileJobs = append(allCompileJobs, pchJobs...)
+
 		// determine which source files in this target are dirty
 		var targetCompileJobs []compileJob
 		for _, src := range target.sources {
 			absoluteObjPath := filepath.Join(g.buildDir, src.Obj)
 
 			// check if source is dirty
-			isDirty, err := g.isSourceFileDirty(src, absoluteObjPath, oldState)
+			reason, err := g.isSourceFileDirty(src, absoluteObjPath, oldState, recompileReason)
 			if err != nil {
 				return nil, nil, fmt.Errorf("could not check status of %s: %w", src.Src, err)
 			}
-			if isDirty {
-				compiler := g.cc
-				if src.IsCxx {
-					compiler = g.cxx
+			if reason == "" {
+				reason = pchRecompile[src.Lang]
+			}
+			if reason != "" {
+				compiler := cc
+				if src.Lang == LangCxx {
+					compiler = cxx
 				}
 				targetCompileJobs = append(targetCompileJobs, compileJob{
 					src:    src.Src,
 					obj:    absoluteObjPath,
-					cflags: target.cflags,
-					isCxx:  src.IsCxx,
+					cflags: slices.Concat(target.cflags, g.pchCflags(target, src.Lang, compiler), src.Cflags),
+					lang:   src.Lang,
 					cc:     compiler,
+					reason: reason,
 				})
 			}
 		}
@@ -200,15 +360,18 @@ func (g *QobsBuilder) planBuild(sortedTargetNames []string) (allCompileJobs []co
 		// reason 4 for relink: one or more of its source files were recompiled
 		if len(targetCompileJobs) > 0 {
 			allCompileJobs = append(allCompileJobs, targetCompileJobs...)
-			needsRelink = true
+			if relinkReason == "" {
+				relinkReason = "sources are recompiled"
+			}
 		}
 
-		if needsRelink {
+		if relinkReason != "" {
 			rebuiltTargets[target.name] = true
 			linkJob, err := g.createLinkJob(target)
 			if err != nil {
 				return nil, nil, err
 			}
+			linkJob.reason = relinkReason
 			allLinkJobs = append(allLinkJobs, linkJob)
 		}
 	}
@@ -218,13 +381,40 @@ func (g *QobsBuilder) planBuild(sortedTargetNames []string) (allCompileJobs []co
 
 // executeBuild runs the planned compile and link jobs and updates the build state
 func (g *QobsBuilder) executeBuild(compileJobs []compileJob, linkJobs []linkJob) error {
-	if err := runJobs(compileJobs, runCompileJob, g.jobs, 0, len(compileJobs)+len(linkJobs)); err != nil {
-		fmt.Print(err.Error())
-		return nil
+	// precompiled headers come first, the other compile jobs use them
+	var pchJobs, sourceJobs []compileJob
+	for _, job := range compileJobs {
+		if job.pch {
+			pchJobs = append(pchJobs, job)
+		} else {
+			sourceJobs = append(sourceJobs, job)
+		}
 	}
-	if err := runJobs(linkJobs, runLinkJob, g.jobs, len(compileJobs), len(compileJobs)+len(linkJobs)); err != nil {
-		fmt.Print(err.Error())
-		return nil
+	g.progress = g.newReporter(len(compileJobs)+len(linkJobs), g.sourceCount()-len(sourceJobs))
+	if g.timings != nil {
+		g.timings.begin()
+	}
+	runCompileJob := timed(g.timings, "compile", func(job compileJob) string { return job.src }, g.runCompileJob)
+	runPchJob := timed(g.timings, "compile", func(job compileJob) string { return job.src }, g.runPchJob)
+	runLinkJob := timed(g.timings, "link", func(job linkJob) string { return job.out }, g.runLinkJob)
+	if err := runJobs(pchJobs, runPchJob, g.jobs, g.keepGoing); err != nil {
+		g.progress.finish()
+		return failureSummary(err)
+	}
+	if err := runJobs(sourceJobs, runCompileJob, g.jobs, g.keepGoing); err != nil {
+		g.progress.finish()
+		return failureSummary(err)
+	}
+	if err := runJobs(linkJobs, runLinkJob, g.jobs, g.keepGoing); err != nil {
+		g.progress.finish()
+		return failureSummary(err)
+	}
+	g.progress.finish()
+
+	if g.timings != nil {
+		if err := g.timings.report(); err != nil {
+			msg.Warn("%v", err)
+		}
 	}
 
 	for _, job := range linkJobs {
@@ -240,28 +430,57 @@ func (g *QobsBuilder) executeBuild(compileJobs []compileJob, linkJobs []linkJob)
 	return nil
 }
 
-// isSourceFileDirty checks if a single source file needs to be recompiled
-func (g *QobsBuilder) isSourceFileDirty(src SourceFile, objPath string, state *BuildState) (bool, error) {
+// isSourceFileDirty checks if a single source file needs to be recompiled, returning why or an
+// empty string if it doesn't. recompileReason is set if the whole target has to be recompiled
+func (g *QobsBuilder) isSourceFileDirty(src SourceFile, objPath string, state *BuildState, recompileReason string) (string, error) {
 	if _, err := os.Stat(objPath); os.IsNotExist(err) {
-		return true, nil
+		return "object is missing", nil
 	}
 
 	if state == nil {
-		return true, nil
+		return "no previous build state", nil
+	}
+	if recompileReason != "" {
+		return recompileReason, nil
+	}
+
+	if !slices.Equal(compileFlags(state.SourceCflags[src.Src]), compileFlags(src.Cflags)) {
+		return "source flags changed", nil
 	}
 
 	hash, err := g.fileHash(src.Src)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return true, fmt.Errorf("source file %q not found", src.Src)
+			return "", fmt.Errorf("source file %q not found", src.Src)
 		}
-		return true, err
+		return "", err
 	}
-	if prevHash, exists := state.Sources[src.Src]; !exists || prevHash != hash {
-		return true, nil
+	if prevHash, exists := state.Sources[src.Src]; !exists {
+		return "source is new", nil
+	} else if prevHash != hash {
+		return "source changed", nil
 	}
 
-	return false, nil
+	return "", nil
+}
+
+// printPlan prints the planned jobs of a dry run along with the reasons they're needed
+func printPlan(compileJobs []compileJob, linkJobs []linkJob) {
+	for _, job := range compileJobs {
+		action := "CC"
+		if job.pch {
+			action = "PCH"
+		}
+		fmt.Fprintf(msg.Output(), "%s %s (%s)\n", action, job.src, job.reason)
+	}
+	for _, job := range linkJobs {
+		action := "LINK"
+		if job.isLib {
+			action = "AR"
+		}
+		fmt.Fprintf(msg.Output(), "%s %s (%s)\n", action, job.out, job.reason)
+	}
+	fmt.Fprintf(msg.Output(), "qobs: dry run, %d compile and %d link jobs planned.\n", len(compileJobs), len(linkJobs))
 }
 
 // createLinkJob constructs a linkJob for a given buildUnit
@@ -273,15 +492,19 @@ func (g *QobsBuilder) createLinkJob(target buildUnit) (linkJob, error) {
 
 	dependencies := make([]string, 0, len(target.dependencies))
 	for _, dep := range target.dependencies {
-		dependencies = append(dependencies, filepath.Join(g.buildDir, dep))
+		path := filepath.Join(g.buildDir, linkInput(g.targets, dep))
+		if slices.Contains(target.wholeArchive, dep) {
+			dependencies = append(dependencies, wholeArchiveArgs(path)...)
+		} else {
+			dependencies = append(dependencies, path)
+		}
 	}
 
-	isCxx := g.hasCxxInTarget(target)
-	var linker string
+	isCxx := g.cxxTargets[target.name]
+	cc, cxx := target.compilers(g.cc, g.cxx)
+	linker := cc
 	if isCxx {
-		linker = g.cxx
-	} else {
-		linker = g.cc
+		linker = cxx
 	}
 
 	return linkJob{
@@ -289,8 +512,8 @@ func (g *QobsBuilder) createLinkJob(target buildUnit) (linkJob, error) {
 		objs:    objects,
 		deps:    dependencies,
 		out:     filepath.Join(g.buildDir, target.name),
-		ldflags: target.ldflags,
-		isLib:   target.isLib,
+		ldflags: append(targetLinkArgs(g.targets, target, g.buildDir), target.ldflags...),
+		isLib:   target.kind == StaticLib,
 		isCxx:   isCxx,
 		cc:      linker,
 	}, nil
@@ -306,7 +529,8 @@ func (g *QobsBuilder) topologicalSortTargets() ([]string, error) {
 	}
 
 	// build graph
-	for name, target := range g.targets {
+	for _, name := range slices.Sorted(maps.Keys(g.targets)) {
+		target := g.targets[name]
 		for _, depName := range target.dependencies {
 			if _, ok := g.targets[depName]; !ok {
 				return nil, fmt.Errorf("target %q lists a non-existent dependency: %q", name, depName)
@@ -370,7 +594,17 @@ func (g *QobsBuilder) loadBuildState() error {
 		return err
 	}
 	defer f.Close()
-	return json.NewDecoder(bufio.NewReader(f)).Decode(&g.buildState)
+	if err := json.NewDecoder(bufio.NewReader(f)).Decode(&g.buildState); err != nil {
+		// start over with a full rebuild, keeping the broken file around for inspection
+		g.buildState = make(map[string]*BuildState)
+		f.Close()
+		backup := g.stateFile + ".corrupt"
+		if rerr := os.Rename(g.stateFile, backup); rerr != nil {
+			return fmt.Errorf("build state is corrupt, rebuilding everything: %w", err)
+		}
+		return fmt.Errorf("build state is corrupt (moved to %s), rebuilding everything: %w", backup, err)
+	}
+	return nil
 }
 
 // saveBuildState saves the current build state to disk
@@ -380,13 +614,16 @@ func (g *QobsBuilder) saveBuildState() error {
 		return err
 	}
 
-	return os.WriteFile(g.stateFile, data, 0644)
+	return atomicfile.WriteFile(g.stateFile, data, 0644)
 }
 
-// fileHash computes the SHA256 hash of a file with an in-memory cache
+// fileHash computes the SHA256 hash of a file with an in-memory cache, safe for concurrent use
 func (g *QobsBuilder) fileHash(path string) (string, error) {
-	if hash, ok := g.hashCache[path]; ok {
-		return hash, nil
+	g.hashMu.Lock()
+	cached, ok := g.hashCache[path]
+	g.hashMu.Unlock()
+	if ok {
+		return cached, nil
 	}
 
 	file, err := os.Open(path)
@@ -401,95 +638,296 @@ func (g *QobsBuilder) fileHash(path string) (string, error) {
 	}
 
 	hexHash := hex.EncodeToString(hash.Sum(nil))
+	g.hashMu.Lock()
 	g.hashCache[path] = hexHash
+	g.hashMu.Unlock()
 	return hexHash, nil
 }
 
-// hasCxxInTarget checks if target or its dependencies have C++ sources
-func (g *QobsBuilder) hasCxxInTarget(target buildUnit) bool {
-	for _, src := range target.sources {
-		if src.IsCxx {
-			return true
+// hashSources hashes the sources of the targets, their precompiled headers and the headers
+// those included in the previous build in parallel, filling the hash cache so that checking
+// which sources are dirty doesn't hash them one by one. Errors are left for the checks to report
+func (g *QobsBuilder) hashSources(targetNames []string) {
+	var files []string
+	for _, name := range targetNames {
+		for _, src := range g.targets[name].sources {
+			files = append(files, src.Src)
+		}
+		if pch := g.pch[name]; pch != "" {
+			files = append(files, pch)
+		}
+		if state := g.buildState[name]; state != nil {
+			for file := range state.PchDeps {
+				files = append(files, file)
+			}
 		}
 	}
+	g.hashFiles(files)
+}
 
-	// TODO: cache this?
-	for _, depName := range target.dependencies {
-		if depTarget, exists := g.targets[depName]; exists {
-			if g.hasCxxInTarget(depTarget) {
-				return true
-			}
+// hashFiles hashes files in parallel into the hash cache, skipping the ones hashed already.
+// Errors are left for the callers of fileHash to report
+func (g *QobsBuilder) hashFiles(files []string) {
+	seen := make(map[string]bool, len(files))
+	g.hashMu.Lock()
+	files = slices.DeleteFunc(slices.Clone(files), func(file string) bool {
+		_, cached := g.hashCache[file]
+		skip := cached || seen[file]
+		seen[file] = true
+		return skip
+	})
+	g.hashMu.Unlock()
+	runJobs(files, func(file string) error {
+		g.fileHash(file)
+		return nil
+	}, g.jobs, true)
+}
+
+// forgetHash drops the cached hash of a file that was just written
+func (g *QobsBuilder) forgetHash(path string) {
+	g.hashMu.Lock()
+	delete(g.hashCache, path)
+	g.hashMu.Unlock()
+}
+
+// compileFlags returns the flags that affect compilation, leaving out linker-only flags
+// that ended up in cflags, so that changing them doesn't cause a recompile
+func compileFlags(flags []string) []string {
+	var out []string
+	for _, flag := range flags {
+		if isLinkerOnlyFlag(flag) {
+			continue
+		}
+		out = append(out, flag)
+	}
+	return out
+}
+
+// linkFlags returns the flags that affect linking, leaving out preprocessor-only flags
+// that ended up in ldflags, so that changing them doesn't cause a relink
+func linkFlags(flags []string) []string {
+	var out []string
+	for _, flag := range flags {
+		if isPreprocessorOnlyFlag(flag) {
+			continue
 		}
+		out = append(out, flag)
 	}
+	return out
+}
 
-	return false
+func isLinkerOnlyFlag(flag string) bool {
+	return strings.HasPrefix(flag, "-L") || strings.HasPrefix(flag, "-l") || strings.HasPrefix(flag, "-Wl,")
+}
+
+func isPreprocessorOnlyFlag(flag string) bool {
+	return strings.HasPrefix(flag, "-I") || strings.HasPrefix(flag, "-D") || strings.HasPrefix(flag, "-U")
 }
 
 // runJobs runs jobs in parallel
-func runJobs[T any](jobs []T, jobfunc func(job T, done, total int) error, limit, start, total int) error {
+func runJobs[T any](jobs []T, jobfunc func(job T) error, limit int, keepGoing bool) error {
 	if len(jobs) == 0 {
 		return nil
 	}
 
-	eg, _ := errgroup.WithContext(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var eg errgroup.Group
 	eg.SetLimit(limit)
 
-	defer fmt.Println()
-	for i, job := range jobs {
+	var mu sync.Mutex
+	var errs []error
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			break // a job failed, don't start new ones
+		}
 		eg.Go(func() error {
-			return jobfunc(job, start+i+1, total)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err := jobfunc(job); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				if !keepGoing {
+					cancel()
+				}
+			}
+			return nil
 		})
 	}
 
-	return eg.Wait()
+	eg.Wait()
+	return errors.Join(errs...)
 }
 
-// runCompileJob runs a single compilation job
-func runCompileJob(job compileJob, done, total int) error {
+// jobError is the error of a failed job, naming what the job failed to produce
+type jobError struct {
+	verb string // e.g. "compile"
+	name string
+}
+
+func (e *jobError) Error() string {
+	return fmt.Sprintf("failed to %s %s", e.verb, e.name)
+}
+
+// failureSummary turns the errors of failed jobs returned by runJobs into a single error
+// that lists them all
+func failureSummary(err error) error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok || len(joined.Unwrap()) == 1 {
+		return err
+	}
+	errs := joined.Unwrap()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d jobs failed:", len(errs))
+	for _, err := range errs {
+		sb.WriteString("\n  " + err.Error())
+	}
+	return errors.New(sb.String())
+}
+
+// runCompileJob runs a single compilation job, reusing an object from the compile cache if possible
+func (g *QobsBuilder) runCompileJob(job compileJob) error {
 	if err := os.MkdirAll(filepath.Dir(job.obj), 0755); err != nil {
 		return fmt.Errorf("failed to create object directory: %w", err)
 	}
+	event := jobEvent{kind: "compile", phase: "Compiling", action: "CC", name: job.src, src: job.src, out: job.obj}
+	if job.lang == LangAsm {
+		event.phase, event.action = "Assembling", "AS"
+	}
+	g.progress.jobStarted(event)
+
+	var cacheKey string
+	if g.objCache != nil {
+		key, err := g.objCache.key(job, g.env)
+		if err != nil {
+			// the compiler will report the actual error, if there is one
+			msg.Warn("not using the compile cache for %s: %v", job.src, err)
+		} else if g.objCache.get(key, job.obj) {
+			event.cached = true
+			g.progress.jobDone(event)
+			return nil
+		} else {
+			cacheKey = key
+		}
+	}
 
 	args := make([]string, 0, len(job.cflags)+4)
 	args = append(args, job.cflags...)
 	args = append(args, "-c", job.src, "-o", job.obj)
 
-	fmt.Printf("%s[%d/%d] CC %s", sameLine, done, total, job.src)
-	cmd := exec.Command(job.cc, args...)
+	cmd, rsp, err := g.command(g.launcher, job.cc, args)
+	if err != nil {
+		return fmt.Errorf("failed to write response file: %w", err)
+	}
+	if rsp != "" {
+		defer os.Remove(rsp)
+	}
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return errors.New(string(output))
+		g.progress.jobFailed(event, output, err)
+		return &jobError{"compile", job.src}
 	}
+
+	if cacheKey != "" {
+		if err := g.objCache.put(cacheKey, job.obj); err != nil {
+			msg.Warn("failed to store %s in the compile cache: %v", job.obj, err)
+		}
+	}
+	event.name = g.jobName(job.src, rsp, g.launcher)
+	g.progress.jobDone(event)
 	return nil
 }
 
 // runLinkJob runs a single linking job
-func runLinkJob(job linkJob, done, total int) error {
-	var cmd *exec.Cmd
+func (g *QobsBuilder) runLinkJob(job linkJob) error {
+	var tool, args []string
+	action := "LINK"
+	launcher := g.launcher
+	name := job.out
 	if job.isLib {
-		args := []string{"rcs", job.out}
+		archiver := g.archiver
+		if len(archiver) == 0 {
+			archiver = defaultArchiver
+		}
+		args = append(slices.Clone(archiver[1:]), job.out)
 		args = append(args, job.objs...)
 
-		fmt.Printf("%s[%d/%d] AR %s", sameLine, done, total, job.out)
-		cmd = exec.Command("ar", args...)
+		action = "AR"
+		tool = archiver[:1]
+		launcher = nil // compiler launchers don't know what to do with ar
+		if g.verbose {
+			name += " (" + strings.Join(archiver, " ") + ")"
+		}
 	} else {
-		args := []string{"-o", job.out}
+		args = []string{"-o", job.out}
 		args = append(args, job.objs...)
 		args = append(args, job.deps...)
 		args = append(args, job.ldflags...)
 
-		fmt.Printf("%s[%d/%d] LINK %s", sameLine, done, total, job.out)
-		cmd = exec.Command(job.cc, args...)
+		tool = job.cc
+	}
+	event := jobEvent{kind: "link", phase: "Linking", action: action, name: name, out: job.out}
+	g.progress.jobStarted(event)
+
+	cmd, rsp, err := g.command(launcher, tool, args)
+	if err != nil {
+		return fmt.Errorf("failed to write response file: %w", err)
+	}
+	if rsp != "" {
+		defer os.Remove(rsp)
 	}
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return errors.New(string(output))
+		g.progress.jobFailed(event, output, err)
+		verb := "link"
+		if job.isLib {
+			verb = "archive"
+		}
+		return &jobError{verb, job.out}
+	}
+	if !job.isLib && len(g.strip) > 0 {
+		strip := exec.Command(g.strip[0], append(slices.Clone(g.strip[1:]), job.out)...)
+		strip.Env = g.env
+		if output, err := strip.CombinedOutput(); err != nil {
+			g.progress.jobFailed(event, output, err)
+			return &jobError{"strip", job.out}
+		}
 	}
+	g.forgetHash(job.out) // dependents record the hash of the new output
+	event.name = g.jobName(name, rsp, launcher)
+	g.progress.jobDone(event)
 	return nil
 }
 
+// noWork reports a build that's up to date
+func (g *QobsBuilder) noWork() {
+	if g.jsonEvents {
+		g.newReporter(0, g.sourceCount()).finish()
+		return
+	}
+	fmt.Fprintln(msg.Output(), "qobs: no work to do.")
+}
+
+// jobName is the name of a job shown in the progress output, which mentions the launcher and
+// the response file the job used when verbose
+func (g *QobsBuilder) jobName(name, rsp string, launcher []string) string {
+	if !g.verbose {
+		return name
+	}
+	if len(launcher) > 0 {
+		name += " (via " + strings.Join(launcher, " ") + ")"
+	}
+	if rsp != "" {
+		name += " (response file " + rsp + ")"
+	}
+	return name
+}
+
 // updateBuildState updates the build state for a target after a successful build
 func (g *QobsBuilder) updateBuildState(target buildUnit) error {
 	state := &BuildState{
@@ -497,6 +935,19 @@ func (g *QobsBuilder) updateBuildState(target buildUnit) error {
 		Dependencies: make(map[string]string),
 		Cflags:       slices.Clone(target.cflags),
 		Ldflags:      slices.Clone(target.ldflags),
+		SourceCflags: make(map[string][]string),
+		WholeArchive: slices.Clone(target.wholeArchive),
+		Stripped:     target.kind != StaticLib && len(g.strip) > 0,
+	}
+	cc, cxx := target.compilers(g.cc, g.cxx)
+	state.CC, state.CXX = strings.Join(cc, " "), strings.Join(cxx, " ")
+	pch, err := g.pchKeys(target)
+	if err != nil {
+		return err
+	}
+	state.Pch = pch
+	if state.PchDeps, err = g.pchDeps(target); err != nil {
+		return err
 	}
 
 	// hash source files
@@ -506,6 +957,9 @@ func (g *QobsBuilder) updateBuildState(target buildUnit) error {
 			return fmt.Errorf("failed to hash source file %s: %w", src.Src, err)
 		}
 		state.Sources[src.Src] = hash
+		if len(src.Cflags) > 0 {
+			state.SourceCflags[src.Src] = slices.Clone(src.Cflags)
+		}
 	}
 
 	// hash dependencies
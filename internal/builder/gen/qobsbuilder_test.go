@@ -0,0 +1,82 @@
+package gen
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// flagsProject returns a generator for an executable in dir built with cflags and ldflags
+func flagsProject(dir string, cflags, ldflags []string) *QobsBuilder {
+	g := NewQobsBuilder()
+	g.SetCompiler([]string{"gcc"}, []string{"g++"})
+	sources := []SourceFile{{Src: filepath.Join(dir, "main.c"), Obj: "QobsFiles/app.dir/main.c.o", Lang: LangC}}
+	g.AddTarget("app", dir, sources, nil, nil, Executable, nil, nil, cflags, ldflags)
+	return g
+}
+
+// plannedReasons plans the build of g in buildDir after a previous build, returning why each
+// source would be compiled and each target linked
+func plannedReasons(t *testing.T, g *QobsBuilder, buildDir string) (compile, link map[string]string) {
+	t.Helper()
+	g.buildDir = buildDir
+	g.stateFile = filepath.Join(buildDir, g.BuildFile())
+	if err := g.loadBuildState(); err != nil {
+		t.Fatal(err)
+	}
+	names, err := g.topologicalSortTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.cxxTargets = cxxTargets(g.targets)
+	compileJobs, linkJobs, err := g.planBuild(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compile, link = make(map[string]string), make(map[string]string)
+	for _, job := range compileJobs {
+		compile[filepath.Base(job.src)] = job.reason
+	}
+	for _, job := range linkJobs {
+		link[job.name] = job.reason
+	}
+	return compile, link
+}
+
+func TestFlagChangesRebuildOnlyTheirPhase(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	cflags, ldflags := []string{"-O2", "-DAPP"}, []string{"-lm"}
+	tests := []struct {
+		name            string
+		cflags, ldflags []string
+		compile, link   string
+	}{
+		{"nothing changed", cflags, ldflags, "", ""},
+		{"ldflag changed", cflags, []string{"-lm", "-Wl,--as-needed"}, "", "linker flags changed"},
+		{"linker flag added to cflags", []string{"-O2", "-DAPP", "-L/opt/lib"}, ldflags, "", ""},
+		{"preprocessor flag added to ldflags", cflags, []string{"-lm", "-DUNUSED"}, "", ""},
+		{"cflag changed", []string{"-O0", "-DAPP"}, ldflags, "compile flags changed", "sources are recompiled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "main.c"), []byte("int main(void) { return 0; }\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			buildDir := filepath.Join(dir, "build")
+			if err := flagsProject(dir, cflags, ldflags).Invoke(buildDir); err != nil {
+				t.Fatal(err)
+			}
+			compile, link := plannedReasons(t, flagsProject(dir, tt.cflags, tt.ldflags), buildDir)
+			if compile["main.c"] != tt.compile {
+				t.Errorf("main.c is compiled because %q, want %q", compile["main.c"], tt.compile)
+			}
+			if link["app"] != tt.link {
+				t.Errorf("app is linked because %q, want %q", link["app"], tt.link)
+			}
+		})
+	}
+}
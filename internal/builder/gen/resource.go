@@ -0,0 +1,7 @@
+package gen
+
+// ResourceScripts is implemented by generators that compile Windows resource scripts (.rc) themselves
+type ResourceScripts interface {
+	// AddResource compiles the resource script rc and links it into target
+	AddResource(target, rc string)
+}
@@ -0,0 +1,116 @@
+package gen
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// defaultResponseFileThreshold returns the command line length above which arguments are passed
+// in a response file, a bit below the limit of the OS. Windows limits command lines to 32767
+// characters, others limit the length of a single argument, which is at least 128 KiB on Linux
+func defaultResponseFileThreshold() int {
+	if runtime.GOOS == "windows" {
+		return 30000
+	}
+	return 128 * 1024
+}
+
+// SetResponseFileThreshold sets the command line length above which compiler, linker and archiver
+// arguments are passed in a response file. Zero uses a default close to the limit of the OS
+func (g *QobsBuilder) SetResponseFileThreshold(threshold int) {
+	g.rspThreshold = threshold
+}
+
+// command creates the command running tool (a program and its leading arguments, e.g. ["zig", "cc"])
+// with args, prefixed with launcher if it's not empty. If the command line would be longer than
+// the response file threshold, args are written to a temporary response file that's passed as
+// @file instead; its path is returned and must be removed by the caller
+func (g *QobsBuilder) command(launcher, tool, args []string) (*exec.Cmd, string, error) {
+	threshold := g.rspThreshold
+	if threshold <= 0 {
+		threshold = defaultResponseFileThreshold()
+	}
+
+	length := 0
+	for _, arg := range slices.Concat(launcher, tool, args) {
+		length += len(arg) + 1
+	}
+	if length <= threshold {
+		cmd := launch(launcher, tool, args)
+		cmd.Env = g.env
+		return cmd, "", nil
+	}
+
+	f, err := os.CreateTemp("", "qobs-*.rsp")
+	if err != nil {
+		return nil, "", err
+	}
+	msvc := isMsvcCompiler(tool)
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quoteResponseFileArg(arg, msvc)
+	}
+	_, err = f.WriteString(strings.Join(quoted, "\n") + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+
+	cmd := launch(launcher, tool, []string{"@" + f.Name()})
+	cmd.Env = g.env
+	return cmd, f.Name(), nil
+}
+
+// launch creates the command running tool with args through launcher, if it's not empty
+func launch(launcher, tool, args []string) *exec.Cmd {
+	command := slices.Concat(launcher, tool, args)
+	return exec.Command(command[0], command[1:]...)
+}
+
+// quoteResponseFileArg quotes arg for a response file. GCC, Clang and ar split response files
+// on whitespace and unescape backslashes; cl and link follow the rules of the Windows command line,
+// where backslashes are only special before a quote
+func quoteResponseFileArg(arg string, msvc bool) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\") {
+		return arg
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('"')
+	if !msvc {
+		for _, r := range arg {
+			if r == '"' || r == '\\' {
+				sb.WriteByte('\\')
+			}
+			sb.WriteRune(r)
+		}
+		sb.WriteByte('"')
+		return sb.String()
+	}
+
+	backslashes := 0
+	for _, r := range arg {
+		switch r {
+		case '\\':
+			backslashes++
+		case '"':
+			// double the backslashes before the quote and escape the quote itself
+			sb.WriteString(strings.Repeat("\\", 2*backslashes+1))
+			sb.WriteRune(r)
+			backslashes = 0
+		default:
+			sb.WriteString(strings.Repeat("\\", backslashes))
+			sb.WriteRune(r)
+			backslashes = 0
+		}
+	}
+	sb.WriteString(strings.Repeat("\\", 2*backslashes)) // they come before the closing quote
+	sb.WriteByte('"')
+	return sb.String()
+}
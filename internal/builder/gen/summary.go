@@ -0,0 +1,83 @@
+package gen
+
+import (
+	"sync"
+	"time"
+)
+
+// BuildSummary counts the jobs of a build run by the qobs generator
+type BuildSummary struct {
+	Compiled int // compile jobs that succeeded, including precompiled headers and cached objects
+	UpToDate int // sources that didn't have to be compiled
+	Linked   int // link and archive jobs that succeeded
+	Failed   int // jobs that failed, the ones that didn't run after a failure aren't counted
+	Duration time.Duration
+}
+
+// Summarizer is implemented by generators that run the jobs of a build themselves
+type Summarizer interface {
+	// Summary returns the counts of the jobs run by the last Invoke, false if it didn't run any
+	Summary() (BuildSummary, bool)
+}
+
+// Summary returns the counts of the jobs run by the last Invoke, false if it didn't run any
+func (g *QobsBuilder) Summary() (BuildSummary, bool) {
+	if g.counter == nil {
+		return BuildSummary{}, false
+	}
+	summary := g.counter.summary()
+	return summary, summary.Compiled+summary.Linked+summary.Failed > 0
+}
+
+// countingReporter counts the jobs reported to another reporter, see BuildSummary
+type countingReporter struct {
+	reporter
+	mu     sync.Mutex
+	start  time.Time
+	counts BuildSummary
+}
+
+func newCountingReporter(r reporter, upToDate int) *countingReporter {
+	return &countingReporter{reporter: r, start: time.Now(), counts: BuildSummary{UpToDate: upToDate}}
+}
+
+func (r *countingReporter) jobDone(job jobEvent) {
+	r.mu.Lock()
+	if job.kind == "compile" {
+		r.counts.Compiled++
+	} else {
+		r.counts.Linked++
+	}
+	r.mu.Unlock()
+	r.reporter.jobDone(job)
+}
+
+func (r *countingReporter) jobFailed(job jobEvent, output []byte, err error) {
+	r.mu.Lock()
+	r.counts.Failed++
+	r.mu.Unlock()
+	r.reporter.jobFailed(job, output, err)
+}
+
+func (r *countingReporter) finish() {
+	r.mu.Lock()
+	r.counts.Duration = time.Since(r.start)
+	r.mu.Unlock()
+	r.reporter.finish()
+}
+
+// summary returns the counts so far
+func (r *countingReporter) summary() BuildSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts
+}
+
+// sourceCount returns how many sources the targets have
+func (g *QobsBuilder) sourceCount() int {
+	n := 0
+	for _, target := range g.targets {
+		n += len(target.sources)
+	}
+	return n
+}
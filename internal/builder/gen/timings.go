@@ -0,0 +1,118 @@
+package gen
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/qobs-build/qobs/internal/msg"
+)
+
+// slowestJobs is how many of the slowest translation units the timing summary lists
+const slowestJobs = 10
+
+// jobTiming is when a compile or link job ran, relative to the start of the build
+type jobTiming struct {
+	Kind       string  `json:"kind"` // "compile" or "link"
+	Name       string  `json:"name"`
+	StartMs    float64 `json:"start_ms"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// timings records how long the jobs of a build take. It's only created with --timings or
+// --timings-json, so that builds without them don't pay for it
+type timings struct {
+	show     bool   // print a summary after the build
+	jsonPath string // write the timings to this file, if not empty
+	start    time.Time
+	mu       sync.Mutex
+	jobs     []jobTiming
+}
+
+// SetTimings makes the builder time every job and print a summary with the slowest ones after
+// the build if show is set, or write them as JSON to jsonPath if it's not empty
+func (g *QobsBuilder) SetTimings(show bool, jsonPath string) {
+	if !show && jsonPath == "" {
+		g.timings = nil
+		return
+	}
+	g.timings = &timings{show: show, jsonPath: jsonPath}
+}
+
+// timed wraps jobfunc to record how long every job takes, if timings are enabled
+func timed[T any](t *timings, kind string, name func(T) string, jobfunc func(T) error) func(T) error {
+	if t == nil {
+		return jobfunc
+	}
+	return func(job T) error {
+		start := time.Now()
+		err := jobfunc(job)
+		t.record(kind, name(job), start, time.Since(start))
+		return err
+	}
+}
+
+// begin starts the clock of the build
+func (t *timings) begin() {
+	t.start = time.Now()
+	t.jobs = nil
+}
+
+func (t *timings) record(kind, name string, start time.Time, duration time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.jobs = append(t.jobs, jobTiming{
+		Kind:       kind,
+		Name:       name,
+		StartMs:    milliseconds(start.Sub(t.start)),
+		DurationMs: milliseconds(duration),
+	})
+}
+
+// report prints the summary and writes the JSON file, as requested
+func (t *timings) report() error {
+	wall := time.Since(t.start)
+	slices.SortStableFunc(t.jobs, func(a, b jobTiming) int {
+		return cmp.Compare(b.DurationMs, a.DurationMs)
+	})
+
+	if t.show {
+		fmt.Fprintf(msg.Output(), "qobs: %d jobs in %s\n", len(t.jobs), wall.Round(time.Millisecond))
+		shown := 0
+		for _, job := range t.jobs {
+			if job.Kind != "compile" {
+				continue
+			}
+			if shown == 0 {
+				fmt.Fprintln(msg.Output(), "slowest translation units:")
+			}
+			fmt.Fprintf(msg.Output(), "  %8s  %s\n", time.Duration(job.DurationMs*float64(time.Millisecond)).Round(time.Millisecond), job.Name)
+			if shown++; shown == slowestJobs {
+				break
+			}
+		}
+	}
+
+	if t.jsonPath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(struct {
+		WallMs float64     `json:"wall_ms"`
+		Jobs   []jobTiming `json:"jobs"`
+	}{milliseconds(wall), t.jobs}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(t.jsonPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write timings: %w", err)
+	}
+	return nil
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
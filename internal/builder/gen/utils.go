@@ -2,6 +2,7 @@ package gen
 
 import (
 	"errors"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -47,3 +48,35 @@ func FindMsbuild() (string, error) {
 
 	return "", errors.New("msbuild.exe not found in any Visual Studio installation")
 }
+
+// FindVcvarsall returns the path of vcvarsall.bat of a Visual Studio installation with the C++ build tools
+func FindVcvarsall() (string, error) {
+	instances, err := vssetup.Instances(true)
+	if err != nil {
+		return "", err
+	}
+
+	for _, instance := range instances {
+		defer instance.Close()
+
+		packages, err := instance.Packages()
+		if err != nil {
+			continue
+		}
+
+		for _, pkg := range packages {
+			if id, _ := pkg.ID(); id == "Microsoft.VisualStudio.Component.VC.Tools.x86.x64" {
+				installPath, err := instance.InstallationPath()
+				if err != nil {
+					return "", err
+				}
+				vcvarsall := filepath.Join(installPath, "VC", "Auxiliary", "Build", "vcvarsall.bat")
+				if _, err := os.Stat(vcvarsall); err == nil {
+					return vcvarsall, nil
+				}
+			}
+		}
+	}
+
+	return "", errors.New("vcvarsall.bat not found in any Visual Studio installation with the C++ build tools")
+}
@@ -3,9 +3,11 @@ package gen
 import (
 	"encoding/xml"
 	"fmt"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/google/uuid"
@@ -32,6 +34,7 @@ type VSItemGroup struct {
 	ProjectConfigurations []VSProjectConfiguration `xml:"ProjectConfiguration,omitempty"`
 	ClCompiles            []VSClCompile            `xml:"ClCompile,omitempty"`
 	ProjectReferences     []VSProjectReference     `xml:"ProjectReference,omitempty"`
+	ResourceCompiles      []VSResourceCompile      `xml:"ResourceCompile,omitempty"`
 }
 
 type VSProjectConfiguration struct {
@@ -41,6 +44,14 @@ type VSProjectConfiguration struct {
 }
 
 type VSClCompile struct {
+	Include               string `xml:"Include,attr"`
+	PrecompiledHeader     string `xml:"PrecompiledHeader,omitempty"` // "Create" or "Use"
+	PrecompiledHeaderFile string `xml:"PrecompiledHeaderFile,omitempty"`
+	ForcedIncludeFiles    string `xml:"ForcedIncludeFiles,omitempty"`
+	CompileAs             string `xml:"CompileAs,omitempty"` // for C++ sources MSVC doesn't know by the extension
+}
+
+type VSResourceCompile struct {
 	Include string `xml:"Include,attr"`
 }
 
@@ -94,6 +105,7 @@ type VSCppCompileDef struct {
 	SDLCheck                     bool   `xml:"SDLCheck"`
 	AdditionalIncludeDirectories string `xml:"AdditionalIncludeDirectories"`
 	PreprocessorDefinitions      string `xml:"PreprocessorDefinitions"`
+	ForcedIncludeFiles           string `xml:"ForcedIncludeFiles,omitempty"`
 	ConformanceMode              bool   `xml:"ConformanceMode"`
 	Optimization                 string `xml:"Optimization,omitempty"`
 	BasicRuntimeChecks           string `xml:"BasicRuntimeChecks,omitempty"`
@@ -101,6 +113,8 @@ type VSCppCompileDef struct {
 	RuntimeLibrary               string `xml:"RuntimeLibrary,omitempty"`
 	FunctionLevelLinking         *bool  `xml:"FunctionLevelLinking,omitempty"`
 	IntrinsicFunctions           *bool  `xml:"IntrinsicFunctions,omitempty"`
+	LanguageStandard             string `xml:"LanguageStandard,omitempty"`
+	LanguageStandard_C           string `xml:"LanguageStandard_C,omitempty"`
 }
 
 type VSLinkDef struct {
@@ -112,6 +126,8 @@ type VSLinkDef struct {
 	AdditionalOptions        string `xml:"AdditionalOptions,omitempty"`
 	EnableCOMDATFolding      *bool  `xml:"EnableCOMDATFolding,omitempty"`
 	OptimizeReferences       *bool  `xml:"OptimizeReferences,omitempty"`
+	// -L directories of the target and its dependencies
+	AdditionalLibraryDirectories string `xml:"AdditionalLibraryDirectories,omitempty"`
 }
 
 type VSFiltersProject struct {
@@ -142,86 +158,166 @@ type VSFiltersFilter struct {
 //
 
 type VS2022Gen struct {
-	targets map[string]buildUnit
+	targets      map[string]buildUnit
+	buildDir     string
+	platforms    []string
+	env          []string
+	solutionName string
+	pch          map[string]string   // target -> precompiled header
+	resources    map[string][]string // target -> resource scripts
+	config       string              // configuration built by Invoke
+}
+
+// VSPlatforms maps the platforms supported by the generator to their /machine linker option
+var VSPlatforms = map[string]string{
+	"x64":   "x64",
+	"Win32": "X86",
+	"ARM64": "ARM64",
+	"ARM":   "ARM",
 }
 
-func NewVS2022Gen() *VS2022Gen {
+// NewVS2022Gen creates a generator for the given platforms (see VSPlatforms). If no platforms
+// are given, it defaults to x64. The first platform is the one built by Invoke
+func NewVS2022Gen(buildDir string, platforms []string) *VS2022Gen {
+	if len(platforms) == 0 {
+		platforms = []string{"x64"}
+	}
 	return &VS2022Gen{
-		targets: make(map[string]buildUnit),
+		targets:   make(map[string]buildUnit),
+		buildDir:  buildDir,
+		platforms: platforms,
+		config:    "Debug",
+	}
+}
+
+// SetConfiguration sets the configuration built by Invoke, one of vsConfigurations. It defaults
+// to Debug
+func (g *VS2022Gen) SetConfiguration(configuration string) {
+	g.config = configuration
+}
+
+// vsOutDir returns where msbuild writes the artifacts of configuration for platform
+func vsOutDir(buildDir, platform, configuration string) string {
+	// x64 is the default platform, so it keeps the output directories it always had
+	if platform != "x64" {
+		buildDir = filepath.Join(buildDir, platform)
+	}
+	return filepath.Join(buildDir, configuration)
+}
+
+// vsConfigurations are the configurations generated for every platform
+var vsConfigurations = []string{"Debug", "Release"}
+
+func vsCondition(configuration, platform string) string {
+	return "'$(Configuration)|$(Platform)'=='" + configuration + "|" + platform + "'"
+}
+
+func (g *VS2022Gen) SetCompiler(cc, cxx []string) {}
+
+// SetLauncher does nothing, msbuild always runs MSVC directly
+func (g *VS2022Gen) SetLauncher(launcher []string) {}
+
+// SetArchiver does nothing, MSBuild always archives with lib.exe
+func (g *VS2022Gen) SetArchiver(archiver []string) {}
+
+// SetEnv sets extra environment variables for msbuild, which passes them on to the compiler and linker
+func (g *VS2022Gen) SetEnv(env map[string]string) {
+	g.env = environ(env)
+}
+
+// SetSolutionName names the solution after the root package. Without a name, it's named after
+// the first executable target in sorted order, or the first target if there are none
+func (g *VS2022Gen) SetSolutionName(name string) {
+	g.solutionName = name
+}
+
+// SetPch precompiles header with /Yc in a source that only includes it, which is generated in the
+// project directory, and uses it with /Yu in the C++ sources of the target, or its C sources if it
+// has no C++ ones
+func (g *VS2022Gen) SetPch(target, header string) {
+	if g.pch == nil {
+		g.pch = make(map[string]string)
 	}
+	g.pch[vsTargetName(target)] = header
 }
 
-func (g *VS2022Gen) SetCompiler(cc, cxx string) {}
+// AddResource adds rc to the project of target as a ResourceCompile item, which msbuild compiles
+// with rc.exe and links into the target
+func (g *VS2022Gen) AddResource(target, rc string) {
+	if g.resources == nil {
+		g.resources = make(map[string][]string)
+	}
+	name := vsTargetName(target)
+	g.resources[name] = append(g.resources[name], rc)
+}
 
 func (g *VS2022Gen) BuildFile() string {
-	var solutionName string
-	for name, target := range g.targets {
-		if !target.isLib {
-			solutionName = name
-			break
-		}
+	if g.solutionName != "" {
+		return g.solutionName + ".sln"
 	}
-	if solutionName == "" {
-		for name := range g.targets {
+	names := slices.Sorted(maps.Keys(g.targets))
+	for _, name := range names {
+		if !g.targets[name].isLib() {
 			return name + ".sln"
 		}
 	}
-	return solutionName + ".sln"
+	if len(names) > 0 {
+		return names[0] + ".sln"
+	}
+	return ".sln"
 }
 
-func (g *VS2022Gen) AddTarget(name, basedir string, sources []SourceFile, dependencies []string, isLib bool, cflags, ldflags []string) {
+func (g *VS2022Gen) AddTarget(name, basedir string, sources []SourceFile, dependencies, wholeArchive []string, kind TargetKind, cc, cxx []string, cflags, ldflags []string) {
 	if g.targets == nil {
 		g.targets = make(map[string]buildUnit)
 	}
 
 	// since the builder passes the name prefixed with .lib/.a/.exe we need to remove it
 	// TODO: maybe this should always be decided by the generator?
-	name = strings.TrimSuffix(name, getTargetExt(isLib))
+	name = strings.TrimSuffix(name, getTargetExt(kind))
 	cleanedDependencies := make([]string, 0, len(dependencies))
 	for _, dep := range dependencies {
-		cleanedDependencies = append(cleanedDependencies, strings.TrimSuffix(dep, getTargetExt(true)))
+		cleanedDependencies = append(cleanedDependencies, trimLibraryExt(dep))
+	}
+	cleanedWholeArchive := make([]string, 0, len(wholeArchive))
+	for _, dep := range wholeArchive {
+		cleanedWholeArchive = append(cleanedWholeArchive, trimLibraryExt(dep))
 	}
 
 	g.targets[name] = buildUnit{
 		name:         name,
-		isLib:        isLib,
+		kind:         kind,
 		sources:      sources,
 		dependencies: cleanedDependencies,
+		wholeArchive: cleanedWholeArchive,
 		cflags:       cflags,
 		ldflags:      ldflags,
 		basedir:      basedir,
 	}
 }
 
-func (g *VS2022Gen) Generate() string {
+func (g *VS2022Gen) Generate() (string, error) {
 	projectGuids := make(map[string]string)
 	for name := range g.targets {
-		projectGuids[name] = randomGuid()
+		projectGuids[name] = nameGuid("project:" + name)
 	}
 
-	var mainBuildDir string
-	for _, target := range g.targets {
-		if !target.isLib {
-			mainBuildDir = filepath.Join(target.basedir, "build")
-			break
-		}
-	}
-	if mainBuildDir == "" {
-		for _, target := range g.targets {
-			mainBuildDir = filepath.Join(target.basedir, "build")
-			break
+	for _, name := range slices.Sorted(maps.Keys(g.targets)) {
+		target := g.targets[name]
+		projectDir := filepath.Join(g.buildDir, name)
+		if err := os.MkdirAll(projectDir, 0755); err != nil {
+			return "", err
 		}
-	}
-
-	for name, target := range g.targets {
-		projectDir := filepath.Join(mainBuildDir, name)
-		os.MkdirAll(projectDir, 0755)
 
-		g.generateProjectFile(mainBuildDir, projectDir, name, target, projectGuids)
-		g.generateFiltersFile(projectDir, name, target)
+		if err := g.generateProjectFile(g.buildDir, projectDir, name, target, projectGuids); err != nil {
+			return "", fmt.Errorf("failed to generate project %s: %w", name, err)
+		}
+		if err := g.generateFiltersFile(projectDir, name, target); err != nil {
+			return "", fmt.Errorf("failed to generate project %s: %w", name, err)
+		}
 	}
 
-	return g.generateSolutionFile(projectGuids)
+	return g.generateSolutionFile(projectGuids), nil
 }
 
 func (g *VS2022Gen) generateSolutionFile(projectGuids map[string]string) string {
@@ -229,7 +325,9 @@ func (g *VS2022Gen) generateSolutionFile(projectGuids map[string]string) string
 
 	writeln(&sb, "Microsoft Visual Studio Solution File, Format Version 12.00")
 	writeln(&sb, "# Visual Studio Version 17")
-	for name, guid := range projectGuids {
+	names := slices.Sorted(maps.Keys(projectGuids))
+	for _, name := range names {
+		guid := projectGuids[name]
 		// Windows (Visual C++) https://github.com/VISTALL/visual-studio-project-type-guids
 		writeln(&sb,
 			`Project("{8BC9CEB8-8B4A-11D0-8D11-00A0C91BC942}") = "`, name, `", "`, name, `\`, name, `.vcxproj", "{`, guid, `}"`,
@@ -238,22 +336,30 @@ func (g *VS2022Gen) generateSolutionFile(projectGuids map[string]string) string
 	}
 	writeln(&sb, "Global")
 	writeln(&sb, "\tGlobalSection(SolutionConfigurationPlatforms) = preSolution")
-	writeln(&sb, "\t\tDebug|x64 = Debug|x64")
-	writeln(&sb, "\t\tRelease|x64 = Release|x64")
+	for _, platform := range g.platforms {
+		for _, configuration := range vsConfigurations {
+			cfg := configuration + "|" + platform
+			writeln(&sb, "\t\t", cfg, " = ", cfg)
+		}
+	}
 	writeln(&sb, "\tEndGlobalSection")
 	writeln(&sb, "\tGlobalSection(ProjectConfigurationPlatforms) = postSolution")
-	for _, guid := range projectGuids {
-		writeln(&sb, "\t\t{", guid, "}.Debug|x64.ActiveCfg = Debug|x64")
-		writeln(&sb, "\t\t{", guid, "}.Debug|x64.Build.0 = Debug|x64")
-		writeln(&sb, "\t\t{", guid, "}.Release|x64.ActiveCfg = Release|x64")
-		writeln(&sb, "\t\t{", guid, "}.Release|x64.Build.0 = Release|x64")
+	for _, name := range names {
+		guid := projectGuids[name]
+		for _, platform := range g.platforms {
+			for _, configuration := range vsConfigurations {
+				cfg := configuration + "|" + platform
+				writeln(&sb, "\t\t{", guid, "}.", cfg, ".ActiveCfg = ", cfg)
+				writeln(&sb, "\t\t{", guid, "}.", cfg, ".Build.0 = ", cfg)
+			}
+		}
 	}
 	writeln(&sb, "\tEndGlobalSection")
 	writeln(&sb, "\tGlobalSection(SolutionProperties) = preSolution")
 	writeln(&sb, "\t\tHideSolutionNode = FALSE")
 	writeln(&sb, "\tEndGlobalSection")
 	writeln(&sb, "\tGlobalSection(ExtensibilityGlobals) = postSolution")
-	writeln(&sb, "\t\tSolutionGuid = {", randomGuid(), "}")
+	writeln(&sb, "\t\tSolutionGuid = {", nameGuid("solution:"+strings.Join(names, ";")), "}")
 	writeln(&sb, "\tEndGlobalSection")
 	writeln(&sb, "EndGlobal")
 
@@ -262,9 +368,47 @@ func (g *VS2022Gen) generateSolutionFile(projectGuids map[string]string) string
 
 func (g *VS2022Gen) generateProjectFile(buildDir, projectDir, name string, target buildUnit, projectGuids map[string]string) error {
 	clCompiles := make([]VSClCompile, 0, len(target.sources))
+	header := g.pch[name]
+	pchLang := vsPchLanguage(target.sources)
 	for _, source := range target.sources {
 		relPath, _ := filepath.Rel(projectDir, source.Src)
-		clCompiles = append(clCompiles, VSClCompile{Include: relPath})
+		compile := VSClCompile{Include: relPath}
+		if flags := LanguageFlags(source.Src, source.Lang, true); slices.Contains(flags, "/interface") {
+			compile.CompileAs = "CompileAsCppModule"
+		} else if len(flags) > 0 {
+			compile.CompileAs = "CompileAsCpp"
+		}
+		if header != "" && source.Lang != LangAsm {
+			// sources of the other language include the header without precompiling it
+			compile.ForcedIncludeFiles = header + ";%(ForcedIncludeFiles)"
+			if source.Lang == pchLang {
+				compile.PrecompiledHeader = "Use"
+				compile.PrecompiledHeaderFile = header
+			}
+		}
+		clCompiles = append(clCompiles, compile)
+	}
+	if header != "" {
+		// the precompiled header is created by compiling a source that includes it
+		stub := "qobs_pch.c"
+		if pchLang == LangCxx {
+			stub = "qobs_pch.cpp"
+		}
+		// the include is written as is, it isn't a string literal whose backslashes are escapes
+		include := header
+		if relPath, err := filepath.Rel(projectDir, header); err == nil {
+			include = relPath
+		}
+		if err := os.WriteFile(filepath.Join(projectDir, stub), []byte("#include \""+include+"\"\n"), 0644); err != nil {
+			return err
+		}
+		clCompiles = append(clCompiles, VSClCompile{Include: stub, PrecompiledHeader: "Create", PrecompiledHeaderFile: header})
+	}
+
+	var resourceCompiles []VSResourceCompile
+	for _, rc := range g.resources[name] {
+		relPath, _ := filepath.Rel(projectDir, rc)
+		resourceCompiles = append(resourceCompiles, VSResourceCompile{Include: relPath})
 	}
 
 	projectRefs := make([]VSProjectReference, 0, len(target.dependencies))
@@ -289,17 +433,28 @@ func (g *VS2022Gen) generateProjectFile(buildDir, projectDir, name string, targe
 	}
 	allPropertyGroups = append(allPropertyGroups, g.createConfigurationPropertyGroups(target, buildDir)...)
 
+	var projectConfigurations []VSProjectConfiguration
+	for _, platform := range g.platforms {
+		for _, configuration := range vsConfigurations {
+			projectConfigurations = append(projectConfigurations, VSProjectConfiguration{
+				Include:       configuration + "|" + platform,
+				Configuration: configuration,
+				Platform:      platform,
+			})
+		}
+	}
+
 	allItemGroups := []VSItemGroup{
 		{
-			Label: "ProjectConfigurations",
-			ProjectConfigurations: []VSProjectConfiguration{
-				{Include: "Debug|x64", Configuration: "Debug", Platform: "x64"},
-				{Include: "Release|x64", Configuration: "Release", Platform: "x64"},
-			},
+			Label:                 "ProjectConfigurations",
+			ProjectConfigurations: projectConfigurations,
 		},
 		{ProjectReferences: projectRefs},
 		{ClCompiles: clCompiles},
 	}
+	if len(resourceCompiles) > 0 {
+		allItemGroups = append(allItemGroups, VSItemGroup{ResourceCompiles: resourceCompiles})
+	}
 
 	allImports := []VSImport{
 		{Project: `$(VCTargetsPath)\Microsoft.Cpp.Default.props`},
@@ -327,45 +482,54 @@ func (g *VS2022Gen) generateProjectFile(buildDir, projectDir, name string, targe
 }
 
 func (g *VS2022Gen) createConfigurationPropertyGroups(target buildUnit, buildDir string) []VSPropertyGroup {
+	var groups []VSPropertyGroup
+	for _, platform := range g.platforms {
+		groups = append(groups, g.createPlatformPropertyGroups(target, buildDir, platform)...)
+	}
+	return groups
+}
+
+func (g *VS2022Gen) createPlatformPropertyGroups(target buildUnit, buildDir, platform string) []VSPropertyGroup {
 	trueVal, falseVal := true, false
-	debugOutDir := filepath.Join(buildDir, "Debug") + `\`
-	releaseOutDir := filepath.Join(buildDir, "Release") + `\`
-	debugIntDir := filepath.Join(buildDir, target.name, "int", "Debug") + `\`
-	releaseIntDir := filepath.Join(buildDir, target.name, "int", "Release") + `\`
+
+	debugOutDir := vsOutDir(buildDir, platform, "Debug") + `\`
+	releaseOutDir := vsOutDir(buildDir, platform, "Release") + `\`
+	debugIntDir := filepath.Join(buildDir, target.name, "int", platform, "Debug") + `\`
+	releaseIntDir := filepath.Join(buildDir, target.name, "int", platform, "Release") + `\`
 
 	return []VSPropertyGroup{
 		{
-			Condition:         "'$(Configuration)|$(Platform)'=='Debug|x64'",
+			Condition:         vsCondition("Debug", platform),
 			Label:             "Configuration",
-			ConfigurationType: getConfigurationType(target.isLib),
+			ConfigurationType: getConfigurationType(target.kind),
 			PlatformToolset:   "v143",
 			CharacterSet:      "Unicode",
 			UseDebugLibraries: &trueVal,
 		},
 		{
-			Condition:                "'$(Configuration)|$(Platform)'=='Release|x64'",
+			Condition:                vsCondition("Release", platform),
 			Label:                    "Configuration",
-			ConfigurationType:        getConfigurationType(target.isLib),
+			ConfigurationType:        getConfigurationType(target.kind),
 			PlatformToolset:          "v143",
 			CharacterSet:             "Unicode",
 			UseDebugLibraries:        &falseVal,
 			WholeProgramOptimization: &trueVal,
 		},
 		{
-			Condition:        "'$(Configuration)|$(Platform)'=='Debug|x64'",
+			Condition:        vsCondition("Debug", platform),
 			OutDir:           debugOutDir,
 			IntDir:           debugIntDir,
 			TargetName:       target.name,
-			TargetExt:        getTargetExt(target.isLib),
+			TargetExt:        getTargetExt(target.kind),
 			LinkIncremental:  &trueVal,
 			GenerateManifest: true,
 		},
 		{
-			Condition:        "'$(Configuration)|$(Platform)'=='Release|x64'",
+			Condition:        vsCondition("Release", platform),
 			OutDir:           releaseOutDir,
 			IntDir:           releaseIntDir,
 			TargetName:       target.name,
-			TargetExt:        getTargetExt(target.isLib),
+			TargetExt:        getTargetExt(target.kind),
 			LinkIncremental:  &falseVal,
 			GenerateManifest: true,
 		},
@@ -373,55 +537,81 @@ func (g *VS2022Gen) createConfigurationPropertyGroups(target buildUnit, buildDir
 }
 
 func (g *VS2022Gen) createItemDefinitionGroups(target buildUnit) []VSItemDefinitionGroup {
+	var groups []VSItemDefinitionGroup
+	for _, platform := range g.platforms {
+		groups = append(groups, g.createPlatformItemDefinitionGroups(target, platform)...)
+	}
+	return groups
+}
+
+func (g *VS2022Gen) createPlatformItemDefinitionGroups(target buildUnit, platform string) []VSItemDefinitionGroup {
 	trueVal, falseVal := true, false
+	machineOption := "%(AdditionalOptions) /machine:" + VSPlatforms[platform]
+	for _, dep := range target.wholeArchive {
+		machineOption += " /WHOLEARCHIVE:" + dep + ".lib"
+	}
 	subsystem := "Windows" // TODO: make this configurable
-	if !target.isLib {
+	if !target.isLib() {
 		subsystem = "Console"
 	}
+	var importLibrary string
+	if target.kind == SharedLib {
+		importLibrary = `$(OutDir)$(TargetName).lib`
+	}
 
 	return []VSItemDefinitionGroup{
 		{
-			Condition: "'$(Configuration)|$(Platform)'=='Debug|x64'",
+			Condition: vsCondition("Debug", platform),
 			ClCompile: VSCppCompileDef{
 				WarningLevel:                 "Level3",
 				SDLCheck:                     true,
 				AdditionalIncludeDirectories: parseIncludes(target.cflags),
 				PreprocessorDefinitions:      parseDefines(target.cflags, true),
+				ForcedIncludeFiles:           parseForcedIncludes(target.cflags),
 				ConformanceMode:              true,
 				Optimization:                 "Disabled",
 				BasicRuntimeChecks:           "EnableFastChecks",
 				DebugInformationFormat:       "ProgramDatabase",
 				RuntimeLibrary:               "MultiThreadedDebugDLL",
+				LanguageStandard:             parseLanguageStandard(target.sources, LangCxx),
+				LanguageStandard_C:           parseLanguageStandard(target.sources, LangC),
 			},
 			Link: VSLinkDef{
-				SubSystem:                subsystem,
-				GenerateDebugInformation: &trueVal,
-				AdditionalDependencies:   parseLibraries(target.ldflags, !target.isLib),
-				ProgramDataBaseFile:      `$(OutDir)$(TargetName).pdb`,
-				AdditionalOptions:        "%(AdditionalOptions) /machine:x64",
+				SubSystem:                    subsystem,
+				GenerateDebugInformation:     &trueVal,
+				AdditionalDependencies:       parseLibraries(target.ldflags, target.kind != StaticLib),
+				AdditionalLibraryDirectories: parseLibraryDirs(target.ldflags),
+				ProgramDataBaseFile:          `$(OutDir)$(TargetName).pdb`,
+				ImportLibrary:                importLibrary,
+				AdditionalOptions:            machineOption,
 			},
 		},
 		{
-			Condition: "'$(Configuration)|$(Platform)'=='Release|x64'",
+			Condition: vsCondition("Release", platform),
 			ClCompile: VSCppCompileDef{
 				WarningLevel:                 "Level3",
 				SDLCheck:                     true,
 				AdditionalIncludeDirectories: parseIncludes(target.cflags),
 				PreprocessorDefinitions:      parseDefines(target.cflags, false),
+				ForcedIncludeFiles:           parseForcedIncludes(target.cflags),
 				ConformanceMode:              true,
 				Optimization:                 "MaxSpeed",
 				RuntimeLibrary:               "MultiThreadedDLL",
 				FunctionLevelLinking:         &trueVal,
 				IntrinsicFunctions:           &trueVal,
+				LanguageStandard:             parseLanguageStandard(target.sources, LangCxx),
+				LanguageStandard_C:           parseLanguageStandard(target.sources, LangC),
 			},
 			Link: VSLinkDef{
-				SubSystem:                subsystem,
-				GenerateDebugInformation: &falseVal,
-				AdditionalDependencies:   parseLibraries(target.ldflags, !target.isLib),
-				EnableCOMDATFolding:      &trueVal,
-				OptimizeReferences:       &trueVal,
-				ProgramDataBaseFile:      `$(OutDir)$(TargetName).pdb`,
-				AdditionalOptions:        "%(AdditionalOptions) /machine:x64",
+				SubSystem:                    subsystem,
+				GenerateDebugInformation:     &falseVal,
+				AdditionalDependencies:       parseLibraries(target.ldflags, target.kind != StaticLib),
+				AdditionalLibraryDirectories: parseLibraryDirs(target.ldflags),
+				EnableCOMDATFolding:          &trueVal,
+				OptimizeReferences:           &trueVal,
+				ProgramDataBaseFile:          `$(OutDir)$(TargetName).pdb`,
+				ImportLibrary:                importLibrary,
+				AdditionalOptions:            machineOption,
 			},
 		},
 	}
@@ -438,7 +628,7 @@ func (g *VS2022Gen) generateFiltersFile(projectDir, name string, target buildUni
 		XMLNS:        "http://schemas.microsoft.com/developer/msbuild/2003",
 		ItemGroups: []VSFiltersItemGroup{
 			{ClCompiles: clCompiles},
-			{Filters: []VSFiltersFilter{{Include: "Source Files", UniqueIdentifier: "{" + randomGuid() + "}", Extensions: "cpp;c;cc;cxx;c++;cppm;ixx;def;odl;idl;hpj;bat;asm;asmx"}}},
+			{Filters: []VSFiltersFilter{{Include: "Source Files", UniqueIdentifier: "{" + nameGuid("filter:"+name) + "}", Extensions: "cpp;c;cc;cxx;c++;cppm;ixx;def;odl;idl;hpj;bat;asm;asmx"}}},
 		},
 	}
 	output, err := xml.MarshalIndent(filters, "", "  ")
@@ -448,34 +638,57 @@ func (g *VS2022Gen) generateFiltersFile(projectDir, name string, target buildUni
 	return os.WriteFile(filepath.Join(projectDir, name+".vcxproj.filters"), []byte(xml.Header+string(output)), 0644)
 }
 
+// Artifacts returns the files of the target named name in the output directory of the
+// configuration and platform built by Invoke
+func (g *VS2022Gen) Artifacts(buildDir, name string) []string {
+	return artifacts(vsOutDir(buildDir, g.platforms[0], g.config), name)
+}
+
 func (g *VS2022Gen) Invoke(buildDir string) error {
 	msbuild, err := FindMsbuild()
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command(msbuild, g.BuildFile())
+	cmd := exec.Command(msbuild, g.BuildFile(), "/p:Configuration="+g.config, "/p:Platform="+g.platforms[0])
 	cmd.Dir = buildDir
+	cmd.Env = g.env
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
 	return cmd.Run()
 }
 
-func getConfigurationType(isLib bool) string {
-	if isLib {
+func getConfigurationType(kind TargetKind) string {
+	switch kind {
+	case StaticLib:
 		return "StaticLibrary"
+	case SharedLib:
+		return "DynamicLibrary"
 	}
 	return "Application"
 }
 
-func getTargetExt(isLib bool) string {
-	if isLib {
+func getTargetExt(kind TargetKind) string {
+	switch kind {
+	case StaticLib:
 		return ".lib"
+	case SharedLib:
+		return ".dll"
 	}
 	return ".exe"
 }
 
+// vsTargetName returns the name of the project of a target added as name, the file name of its artifact
+func vsTargetName(name string) string {
+	return strings.TrimSuffix(trimLibraryExt(name), getTargetExt(Executable))
+}
+
+// trimLibraryExt removes the extension of a static or shared library name
+func trimLibraryExt(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, getTargetExt(StaticLib)), getTargetExt(SharedLib))
+}
+
 func parseIncludes(cflags []string) string {
 	var includes []string
 	for _, flag := range cflags {
@@ -486,6 +699,17 @@ func parseIncludes(cflags []string) string {
 	return strings.Join(includes, ";") + ";%(AdditionalIncludeDirectories)"
 }
 
+// parseForcedIncludes returns the headers force-included with /FI
+func parseForcedIncludes(cflags []string) string {
+	var headers []string
+	for _, flag := range cflags {
+		if after, ok := strings.CutPrefix(flag, "/FI"); ok {
+			headers = append(headers, after)
+		}
+	}
+	return strings.Join(headers, ";")
+}
+
 func parseDefines(cflags []string, isDebug bool) string {
 	defines := []string{"WIN32", "_WINDOWS"}
 	if isDebug {
@@ -495,12 +719,52 @@ func parseDefines(cflags []string, isDebug bool) string {
 	}
 	for _, flag := range cflags {
 		if after, ok := strings.CutPrefix(flag, "-D"); ok {
-			defines = append(defines, after)
+			defines = append(defines, msbuildEscaper.Replace(after))
 		}
 	}
 	return strings.Join(defines, ";") + ";%(PreprocessorDefinitions)"
 }
 
+// msbuildEscaper escapes characters that have a special meaning in MSBuild item lists. Quotes are
+// escaped for the command line of cl, which would otherwise strip them from the value
+var msbuildEscaper = strings.NewReplacer(
+	"%", "%25", "$", "%24", "@", "%40", "'", "%27", ";", "%3B", "?", "%3F", "*", "%2A", `"`, `\"`,
+)
+
+// msvcStandards maps `-std=` values to MSVC's LanguageStandard/LanguageStandard_C values.
+// MSVC doesn't support every standard, so older ones are mapped to the oldest supported one
+var msvcStandards = map[string]string{
+	"c89": "stdc11", "c90": "stdc11", "c99": "stdc11", "c11": "stdc11",
+	"c17": "stdc17", "c18": "stdc17", "c23": "stdclatest",
+	"c++98": "stdcpp14", "c++03": "stdcpp14", "c++11": "stdcpp14", "c++14": "stdcpp14",
+	"c++17": "stdcpp17", "c++20": "stdcpp20", "c++23": "stdcpplatest", "c++26": "stdcpplatest",
+}
+
+// vsPchLanguage returns the language of the sources that use the precompiled header of a target: C++,
+// unless it only has C sources. MSVC can't use a header precompiled for one language in the other
+func vsPchLanguage(sources []SourceFile) Language {
+	if slices.ContainsFunc(sources, func(src SourceFile) bool { return src.Lang == LangCxx }) {
+		return LangCxx
+	}
+	return LangC
+}
+
+// parseLanguageStandard returns the MSVC language standard for the C or C++ sources of a target
+func parseLanguageStandard(sources []SourceFile, lang Language) string {
+	for _, source := range sources {
+		if source.Lang != lang {
+			continue
+		}
+		for _, flag := range source.Cflags {
+			if std, ok := strings.CutPrefix(flag, "-std="); ok {
+				std = strings.Replace(std, "gnu", "c", 1)
+				return msvcStandards[std]
+			}
+		}
+	}
+	return ""
+}
+
 func parseLibraries(ldflags []string, isExe bool) string {
 	var libs []string
 	if isExe {
@@ -518,4 +782,21 @@ func parseLibraries(ldflags []string, isExe bool) string {
 	return strings.Join(libs, ";") + ";%(AdditionalDependencies)"
 }
 
-func randomGuid() string { return strings.ToUpper(uuid.New().String()) }
+// parseLibraryDirs returns the library search paths of -L flags, in the format of AdditionalLibraryDirectories
+func parseLibraryDirs(ldflags []string) string {
+	var dirs []string
+	for _, flag := range ldflags {
+		if dir, ok := strings.CutPrefix(flag, "-L"); ok {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return ""
+	}
+	return strings.Join(dirs, ";") + ";%(AdditionalLibraryDirectories)"
+}
+
+// nameGuid returns a GUID derived from name, so that regenerating the same project produces the same files
+func nameGuid(name string) string {
+	return strings.ToUpper(uuid.NewSHA1(uuid.NameSpaceURL, []byte("qobs:"+name)).String())
+}
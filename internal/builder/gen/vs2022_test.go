@@ -0,0 +1,103 @@
+package gen
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// addVSTargets adds the static libraries zlib and png and the executables tool and app to g, in
+// the given order
+func addVSTargets(g *VS2022Gen, order []string) {
+	for _, name := range order {
+		kind := Executable
+		if name == "zlib.lib" || name == "png.lib" {
+			kind = StaticLib
+		}
+		sources := []SourceFile{{Src: name + ".c", Obj: "QobsFiles/" + name + ".dir/" + name + ".c.obj", Lang: LangC}}
+		g.AddTarget(name, ".", sources, nil, nil, kind, nil, nil, nil, nil)
+	}
+}
+
+func TestVS2022Solution(t *testing.T) {
+	first := NewVS2022Gen(t.TempDir(), nil)
+	addVSTargets(first, []string{"zlib.lib", "png.lib", "tool.exe", "app.exe"})
+	second := NewVS2022Gen(t.TempDir(), nil)
+	addVSTargets(second, []string{"app.exe", "tool.exe", "png.lib", "zlib.lib"})
+	if a, b := generate(t, first), generate(t, second); a != b {
+		t.Errorf("solution depends on the order targets are added in:\n%s\n---\n%s", a, b)
+	}
+
+	// the first executable in sorted order, not whichever the map yields
+	for range 10 {
+		if got := first.BuildFile(); got != "app.sln" {
+			t.Fatalf("BuildFile = %q, want app.sln", got)
+		}
+	}
+	first.SetSolutionName("tool")
+	if got := first.BuildFile(); got != "tool.sln" {
+		t.Errorf("BuildFile with a solution name = %q, want tool.sln", got)
+	}
+
+	libs := NewVS2022Gen(t.TempDir(), nil)
+	addVSTargets(libs, []string{"zlib.lib", "png.lib"})
+	if got := libs.BuildFile(); got != "png.sln" {
+		t.Errorf("BuildFile of libraries = %q, want png.sln", got)
+	}
+}
+
+func TestVS2022ForcedIncludeFiles(t *testing.T) {
+	g := NewVS2022Gen(t.TempDir(), []string{"x64"})
+	sources := []SourceFile{{Src: "main.c", Obj: "QobsFiles/app.exe.dir/main.c.obj", Lang: LangC}}
+	g.AddTarget("app.exe", ".", sources, nil, nil, Executable, nil, nil, []string{"/FIC:\\app\\config.h", "-DX", "/FIprefix.h"}, nil)
+	for _, group := range g.createPlatformItemDefinitionGroups(g.targets["app"], "x64") {
+		if got, want := group.ClCompile.ForcedIncludeFiles, "C:\\app\\config.h;prefix.h"; got != want {
+			t.Errorf("%s: ForcedIncludeFiles = %q, want %q", group.Condition, got, want)
+		}
+	}
+}
+
+func TestVS2022LibraryDirectories(t *testing.T) {
+	g := NewVS2022Gen(t.TempDir(), []string{"x64"})
+	sources := []SourceFile{{Src: "main.c", Obj: "QobsFiles/app.exe.dir/main.c.obj", Lang: LangC}}
+	g.AddTarget("app.exe", ".", sources, nil, nil, Executable, nil, nil, nil, []string{"-LC:\\foo\\lib", "-lbar", "-LC:\\baz"})
+	for _, group := range g.createPlatformItemDefinitionGroups(g.targets["app"], "x64") {
+		if got, want := group.Link.AdditionalLibraryDirectories, "C:\\foo\\lib;C:\\baz;%(AdditionalLibraryDirectories)"; got != want {
+			t.Errorf("%s: AdditionalLibraryDirectories = %q, want %q", group.Condition, got, want)
+		}
+	}
+}
+
+func TestVS2022PchStub(t *testing.T) {
+	dir := t.TempDir()
+	buildDir := filepath.Join(dir, "build")
+	header := filepath.Join(dir, "include", "pch.h")
+	sources := []SourceFile{{Src: filepath.Join(dir, "main.c"), Obj: "QobsFiles/app.exe.dir/main.c.obj", Lang: LangC}}
+
+	g := NewVS2022Gen(buildDir, []string{"x64"})
+	g.AddTarget("app.exe", dir, sources, nil, nil, Executable, nil, nil, nil, nil)
+	g.SetPch("app.exe", header)
+	generate(t, g)
+	data, err := os.ReadFile(filepath.Join(buildDir, "app", "qobs_pch.c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// verbatim and relative to the project, not a Go string literal with doubled backslashes
+	if got, want := string(data), "#include \""+filepath.Join("..", "..", "include", "pch.h")+"\"\n"; got != want {
+		t.Errorf("qobs_pch.c = %q, want %q", got, want)
+	}
+
+	t.Run("write error", func(t *testing.T) {
+		buildDir := t.TempDir()
+		// a directory where the stub goes
+		if err := os.MkdirAll(filepath.Join(buildDir, "app", "qobs_pch.c"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		g := NewVS2022Gen(buildDir, []string{"x64"})
+		g.AddTarget("app.exe", dir, sources, nil, nil, Executable, nil, nil, nil, nil)
+		g.SetPch("app.exe", header)
+		if _, err := g.Generate(); err == nil {
+			t.Error("Generate succeeded without writing qobs_pch.c")
+		}
+	})
+}
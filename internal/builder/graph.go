@@ -0,0 +1,82 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-git/v6"
+)
+
+// ResolveGraph resolves the dependency graph of the package, fetching dependencies if needed.
+// The returned packages are sorted by name
+func (b *Builder) ResolveGraph() ([]*Package, error) {
+	depsDir := b.depsDir()
+	if err := os.MkdirAll(depsDir, 0755); err != nil {
+		return nil, err
+	}
+
+	packages, err := b.resolveBuildGraph(depsDir, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve dependency graph: %w", err)
+	}
+
+	sorted := make([]*Package, 0, len(packages))
+	for _, name := range slices.Sorted(maps.Keys(packages)) {
+		sorted = append(sorted, packages[name])
+	}
+	return sorted, nil
+}
+
+// GraphHash returns a stable hash of everything in the resolved dependency graph that affects
+// the build output of the given profile: the target platform, the versions, sources and commits
+// of every package, their enabled features and their target configuration
+func (b *Builder) GraphHash(profile string) (string, error) {
+	profileCflags, err := b.makeCflags(profile)
+	if err != nil {
+		return "", err
+	}
+
+	packages, err := b.ResolveGraph()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "profile %s %s\n", profile, strings.Join(profileCflags, " "))
+	fmt.Fprintf(h, "target-platform %s %s\n", b.env.TargetOS, b.env.TargetArch)
+	for _, pkg := range packages {
+		fmt.Fprintf(h, "package %s %s\n", pkg.Name, pkg.Config.Package.Version)
+		fmt.Fprintf(h, "source %s\n", pkg.Source)
+		fmt.Fprintf(h, "commit %s\n", gitCommit(pkg.Path))
+		fmt.Fprintf(h, "features %s\n", strings.Join(pkg.Config.EnabledFeatures(), ","))
+		fmt.Fprintf(h, "dependencies %s\n", strings.Join(slices.Sorted(maps.Keys(pkg.Config.Dependencies)), ","))
+		fmt.Fprintf(h, "target\n%s\n", mustMarshal(pkg.Config.Target))
+		if pkg.pkgConfig != nil {
+			fmt.Fprintf(h, "pkg-config %s %s\n", strings.Join(pkg.pkgConfig.cflags, " "), strings.Join(pkg.pkgConfig.libs, " "))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// gitCommit returns the commit checked out in the Git repository at path, or an empty string
+// if path isn't a Git repository
+func gitCommit(path string) string {
+	if _, err := os.Stat(filepath.Join(path, ".git")); err != nil {
+		return ""
+	}
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return ""
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return ""
+	}
+	return head.Hash().String()
+}
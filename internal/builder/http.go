@@ -0,0 +1,84 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/qobs-build/qobs/internal/msg"
+)
+
+// TimeoutEnv is the environment variable that sets the timeout of downloads, see HTTPTimeout
+const TimeoutEnv = "QOBS_HTTP_TIMEOUT"
+
+// maxRedirects is how many redirects a download follows before giving up
+const maxRedirects = 10
+
+var (
+	// HTTPTimeout is how long a single download may take in total, including reading the body.
+	// Zero means no timeout
+	HTTPTimeout = 5 * time.Minute
+	// UserAgent is sent with every download
+	UserAgent = "qobs/dev"
+)
+
+// DefaultHTTPTimeout returns the timeout set in TimeoutEnv, or the default one
+func DefaultHTTPTimeout() time.Duration {
+	v := os.Getenv(TimeoutEnv)
+	if v == "" {
+		return HTTPTimeout
+	}
+	timeout, err := time.ParseDuration(v)
+	if err != nil || timeout < 0 {
+		msg.Warn("ignoring %s=%q: expected a non-negative duration like 90s or 5m", TimeoutEnv, v)
+		return HTTPTimeout
+	}
+	return timeout
+}
+
+// userAgentTransport sets the user agent of every request
+type userAgentTransport struct {
+	base http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", UserAgent)
+	return t.base.RoundTrip(req)
+}
+
+// httpClient is used for all downloads. The default transport takes proxies from HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY
+var httpClient = &http.Client{
+	Transport: userAgentTransport{http.DefaultTransport},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	},
+}
+
+// httpGet gets url with the shared client, giving up after HTTPTimeout, which includes reading the body
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := *httpClient
+	client.Timeout = HTTPTimeout
+	return client.Do(req)
+}
+
+// downloadError describes err, which happened while downloading url, telling timeouts apart
+func downloadError(url string, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("timed out after %s downloading from url %s (set --timeout or %s to wait longer): %w", HTTPTimeout, url, TimeoutEnv, err)
+	}
+	return fmt.Errorf("failed to download from url %s: %w", url, err)
+}
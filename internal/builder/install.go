@@ -0,0 +1,163 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/fatih/color"
+	"github.com/qobs-build/qobs/internal/builder/gen"
+)
+
+// Install builds the package and copies its artifacts below prefix: executables to bin, libraries
+// to lib (DLLs to bin) and the headers of libraries to include, keeping their directory structure
+// relative to the non-glob part of their pattern. destdir, if not empty, is prepended to every
+// destination, for staging an installation
+func (b *Builder) Install(profile, generator, prefix, destdir string) error {
+	if b.emit != gen.EmitObjects {
+		return errors.New("can't install a package built without linking (--emit)")
+	}
+	if err := b.Build(profile, generator); err != nil {
+		return err
+	}
+
+	root, err := filepath.Abs(prefix)
+	if err != nil {
+		return err
+	}
+	if destdir != "" {
+		// filepath.Join drops the volume name of root, so that it can be staged on Windows too
+		root = filepath.Join(destdir, root[len(filepath.VolumeName(root)):])
+	}
+
+	g := b.createGenerator(generator, profile)
+	for _, pkg := range b.rootPackages() {
+		if pkg.Config.Target.builds() {
+			if err := b.installArtifact(g, pkg, profile, root); err != nil {
+				return err
+			}
+		}
+		for _, lib := range pkg.prebuiltLibs() {
+			if err := installFile(lib, filepath.Join(root, "lib", filepath.Base(lib))); err != nil {
+				return err
+			}
+		}
+		if pkg.Config.Target.Lib || pkg.Config.Target.HeaderOnly {
+			if err := installHeaders(pkg, filepath.Join(root, "include")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// installArtifact copies the executable or library built for pkg by g to bin or lib below root,
+// along with the import library of a DLL
+func (b *Builder) installArtifact(g gen.Generator, pkg *Package, profile, root string) error {
+	outputName := pkg.outputName(b.env.TargetOS)
+	paths := g.Artifacts(b.profileBuildDir(profile), outputName)
+	for _, path := range paths {
+		if stat, err := os.Stat(path); err != nil || stat.IsDir() {
+			return fmt.Errorf("can't install %q: %s wasn't built", pkg.Name, path)
+		}
+	}
+
+	dir := "lib"
+	if !pkg.Config.Target.Lib || (pkg.Config.Target.Kind == KindSharedLib && b.env.TargetOS == "windows") {
+		dir = "bin"
+	}
+	if err := installFile(paths[0], filepath.Join(root, dir, outputName)); err != nil {
+		return err
+	}
+	// DLLs come with an import library to link with
+	for _, implib := range paths[1:] {
+		if err := installFile(implib, filepath.Join(root, "lib", filepath.Base(implib))); err != nil {
+			return err
+		}
+	}
+
+	// versioned shared libraries come with a link from their unversioned name
+	if unversioned, _, ok := strings.Cut(outputName, ".so."); ok && pkg.Config.Target.Kind == KindSharedLib {
+		return installSymlink(outputName, filepath.Join(root, dir, unversioned+".so"))
+	}
+	return nil
+}
+
+// installHeaders copies the headers matched by target.headers of pkg to includeDir
+func installHeaders(pkg *Package, includeDir string) error {
+	patterns, exclude, err := splitExcludes(pkg.Config.Target.Headers)
+	if err != nil {
+		return err
+	}
+	fsys := os.DirFS(pkg.Path)
+	for _, pattern := range patterns {
+		base, _ := doublestar.SplitPattern(filepath.ToSlash(pattern))
+		matches, err := doublestar.Glob(fsys, filepath.ToSlash(pattern), doublestar.WithFilesOnly())
+		if err != nil {
+			return fmt.Errorf("invalid header pattern %q: %w", pattern, err)
+		}
+		for _, match := range matches {
+			if isExcluded(exclude, pkg.Path, filepath.Join(pkg.Path, match)) {
+				continue
+			}
+			rel, err := filepath.Rel(filepath.FromSlash(base), filepath.FromSlash(match))
+			if err != nil {
+				return err
+			}
+			if err := installFile(filepath.Join(pkg.Path, match), filepath.Join(includeDir, rel)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// installSymlink creates a symlink at dst pointing to target, replacing whatever was there
+func installSymlink(target, dst string) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(target, dst); err != nil {
+		return err
+	}
+	fmt.Printf("%s %s -> %s\n", color.HiGreenString("Installed"), dst, target)
+	return nil
+}
+
+// installFile copies src to dst, keeping its permissions
+func installFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	// remove the old file first, so that a running executable can be replaced
+	os.Remove(dst)
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s %s\n", color.HiGreenString("Installed"), dst)
+	return nil
+}
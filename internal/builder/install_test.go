@@ -0,0 +1,75 @@
+package builder
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/qobs-build/qobs/internal/builder/gen"
+)
+
+func TestInstall(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml":       "[package]\nname = \"foo\"\nversion = \"1.2.3\"\n\n[target]\nkind = \"sharedlib\"\nsources = [\"foo.c\"]\nheaders = [\"include/**/*.h\"]\n",
+		"foo.c":           "int foo(void) { return 0; }\n",
+		"include/foo/a.h": "int foo(void);\n",
+	})
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := filepath.Join(dir, "prefix")
+	if err := b.Install("release", GeneratorQobs, prefix, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"lib/libfoo.so.1", "include/foo/a.h"} {
+		if _, err := os.Stat(filepath.Join(prefix, path)); err != nil {
+			t.Errorf("%s wasn't installed: %v", path, err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(prefix, "lib", "libfoo.so")); err != nil || target != "libfoo.so.1" {
+		t.Errorf("lib/libfoo.so -> %q, %v, want a link to libfoo.so.1", target, err)
+	}
+}
+
+// releaseDirGen is a generator that links targets in a Release directory, like vs2022
+type releaseDirGen struct {
+	gen.Generator
+}
+
+func (releaseDirGen) Artifacts(buildDir, name string) []string {
+	return gen.NewNinjaGen().Artifacts(filepath.Join(buildDir, "Release"), name)
+}
+
+func TestInstallArtifactsOfGenerator(t *testing.T) {
+	t.Setenv(TargetOSEnv, "windows")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml":                     "[package]\nname = \"foo\"\n\n[target]\nkind = \"sharedlib\"\nsources = [\"foo.c\"]\n",
+		"build/release/Release/foo.dll": "dll",
+		"build/release/Release/foo.lib": "import library",
+	})
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := filepath.Join(dir, "prefix")
+	if err := b.installArtifact(releaseDirGen{}, b.rootPackages()[0], "release", prefix); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{"bin/foo.dll": "dll", "lib/foo.lib": "import library"} {
+		if data, err := os.ReadFile(filepath.Join(prefix, path)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", path, data, err, want)
+		}
+	}
+
+	os.Remove(filepath.Join(dir, "build", "release", "Release", "foo.lib"))
+	if err := b.installArtifact(releaseDirGen{}, b.rootPackages()[0], "release", prefix); err == nil {
+		t.Error("DLL without its import library installed")
+	}
+}
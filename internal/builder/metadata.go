@@ -0,0 +1,112 @@
+package builder
+
+import (
+	"maps"
+	"slices"
+)
+
+// MetadataVersion is the version of the schema of Metadata. It's only increased when fields are
+// removed or change meaning, new fields can be added without changing it
+const MetadataVersion = 1
+
+// Metadata describes the resolved project for tools, see Builder.Metadata. All paths are absolute
+type Metadata struct {
+	Version  int               `json:"version"`
+	Roots    []string          `json:"roots"` // names of the root packages: the package, or the members of a workspace
+	Packages []MetadataPackage `json:"packages"`
+	Build    MetadataBuild     `json:"build"`
+}
+
+// MetadataPackage is a package of the resolved dependency graph
+type MetadataPackage struct {
+	Name         string   `json:"name"`
+	Version      string   `json:"version"`
+	Source       string   `json:"source"` // dependency source, empty for root packages
+	Path         string   `json:"path"`   // empty for pkg-config dependencies
+	Root         bool     `json:"root"`
+	Lib          bool     `json:"lib"`
+	Kind         string   `json:"kind"`   // exe, staticlib, sharedlib, header-only or prebuilt
+	Output       string   `json:"output"` // file name of the artifact in the profile directory, empty if nothing is built
+	Features     []string `json:"features"`
+	Dependencies []string `json:"dependencies"`
+	Sources      []string `json:"sources"`
+	IncludeDirs  []string `json:"include_dirs"`
+}
+
+// MetadataBuild is the layout of the build directory
+type MetadataBuild struct {
+	Dir      string            `json:"dir"`
+	DepsDir  string            `json:"deps_dir"` // where dependencies are fetched to
+	Profiles map[string]string `json:"profiles"` // profile -> directory its artifacts and build state are placed in
+}
+
+// Metadata resolves the dependency graph, fetching dependencies if needed, and describes every
+// package in it without building anything
+func (b *Builder) Metadata() (*Metadata, error) {
+	packages, err := b.ResolveGraph()
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &Metadata{
+		Version:  MetadataVersion,
+		Roots:    []string{},
+		Packages: make([]MetadataPackage, 0, len(packages)),
+		Build: MetadataBuild{
+			Dir:      b.buildDir,
+			DepsDir:  b.depsDir(),
+			Profiles: make(map[string]string),
+		},
+	}
+	for _, profile := range b.cfg.Profiles() {
+		meta.Build.Profiles[profile] = b.profileBuildDir(profile)
+	}
+
+	for _, pkg := range packages {
+		if pkg.IsRoot {
+			meta.Roots = append(meta.Roots, pkg.Name)
+		}
+		sources := []string{}
+		if pkg.Config.Target.builds() {
+			if sources, err = b.targetSources(pkg); err != nil {
+				return nil, err
+			}
+		}
+		includeDirs, err := b.includeDirs(pkg)
+		if err != nil {
+			return nil, err
+		}
+
+		target := pkg.Config.Target
+		kind, output := pkg.targetKind().String(), pkg.outputName(b.env.TargetOS)
+		switch {
+		case target.HeaderOnly:
+			kind, output = "header-only", ""
+		case target.IsPrebuilt():
+			kind, output = "prebuilt", ""
+		}
+		meta.Packages = append(meta.Packages, MetadataPackage{
+			Name:         pkg.Name,
+			Version:      pkg.Config.Package.Version,
+			Source:       pkg.Source,
+			Path:         pkg.Path,
+			Root:         pkg.IsRoot,
+			Lib:          target.Lib || target.HeaderOnly || target.IsPrebuilt(),
+			Kind:         kind,
+			Output:       output,
+			Features:     pkg.Config.EnabledFeatures(),
+			Dependencies: nonNilStrings(slices.Sorted(maps.Keys(pkg.Config.Dependencies))),
+			Sources:      nonNilStrings(sources),
+			IncludeDirs:  nonNilStrings(includeDirs),
+		})
+	}
+	return meta, nil
+}
+
+// nonNilStrings returns s, or an empty slice if it's nil, so that it's written as [] rather than null
+func nonNilStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,127 @@
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/qobs-build/qobs/internal/builder/gen"
+	"github.com/qobs-build/qobs/internal/msg"
+)
+
+// vcvarsArchs maps GOARCH values to vcvarsall.bat architectures
+var vcvarsArchs = map[string]string{
+	"amd64": "x64",
+	"386":   "x86",
+	"arm64": "arm64",
+	"arm":   "arm",
+}
+
+// vcvarsArch returns the vcvarsall.bat argument for building on the host for targetArch
+func vcvarsArch(targetArch string) (string, error) {
+	host, ok := vcvarsArchs[runtime.GOARCH]
+	if !ok {
+		return "", fmt.Errorf("unsupported host architecture %q", runtime.GOARCH)
+	}
+	target, ok := vcvarsArchs[targetArch]
+	if !ok {
+		return "", fmt.Errorf("unsupported target architecture %q", targetArch)
+	}
+	if host == target {
+		return target, nil
+	}
+	return host + "_" + target, nil
+}
+
+// msvcEnvironment returns the environment variables that vcvarsall.bat sets up (INCLUDE, LIB,
+// PATH and so on) for building for targetArch, like a Visual Studio developer prompt does
+func msvcEnvironment(targetArch string) (map[string]string, error) {
+	vcvarsall, err := gen.FindVcvarsall()
+	if err != nil {
+		return nil, err
+	}
+	arch, err := vcvarsArch(targetArch)
+	if err != nil {
+		return nil, err
+	}
+
+	// going through a script avoids cmd.exe's quoting rules for the vcvarsall.bat path
+	script, err := os.CreateTemp("", "qobs-vcvars-*.bat")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(script.Name())
+	fmt.Fprintf(script, "@echo off\r\ncall \"%s\" %s >nul || exit /b 1\r\nset\r\n", vcvarsall, arch)
+	if err := script.Close(); err != nil {
+		return nil, err
+	}
+
+	output, err := exec.Command("cmd", "/c", script.Name()).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s: %w", vcvarsall, err)
+	}
+
+	// only keep what vcvarsall.bat changed
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || key == "" {
+			continue
+		}
+		if os.Getenv(key) != value {
+			env[key] = value
+		}
+	}
+	if env["INCLUDE"] == "" {
+		return nil, fmt.Errorf("%s didn't set INCLUDE", vcvarsall)
+	}
+	return env, nil
+}
+
+// lookPathIn is exec.LookPath using the directories of pathEnv instead of PATH
+func lookPathIn(file, pathEnv string) (string, error) {
+	for _, dir := range filepath.SplitList(pathEnv) {
+		path := filepath.Join(dir, file)
+		if stat, err := os.Stat(path); err == nil && !stat.IsDir() {
+			return path, nil
+		}
+	}
+	return "", exec.ErrNotFound
+}
+
+// compilerEnv returns the environment variables for compiler and linker processes: the [env]
+// section, on top of the MSVC developer environment when building with cl outside of a developer
+// prompt. cc and cxx are resolved to cl from that environment if no other compiler was found
+func (b *Builder) compilerEnv(generator string, cc, cxx []string) (map[string]string, []string, []string) {
+	usesMsvc := func(compiler []string) bool {
+		return len(compiler) == 0 || DetectCompilerKind(compiler) == CompilerMSVC
+	}
+	if runtime.GOOS != "windows" || generator == GeneratorVS2022 || os.Getenv("INCLUDE") != "" || !usesMsvc(cc) || !usesMsvc(cxx) {
+		return b.cfg.Env, cc, cxx
+	}
+
+	msvcEnv, err := msvcEnvironment(b.env.TargetArch)
+	if err != nil {
+		msg.Warn("couldn't set up the MSVC environment: %v", err)
+		return b.cfg.Env, cc, cxx
+	}
+	if cl, err := lookPathIn("cl.exe", msvcEnv["PATH"]); err == nil {
+		if len(cc) == 0 {
+			cc = []string{cl}
+		}
+		if len(cxx) == 0 {
+			cxx = []string{cl}
+		}
+	}
+
+	env := maps.Clone(msvcEnv)
+	maps.Copy(env, b.cfg.Env) // the package's own environment wins
+	return env, cc, cxx
+}
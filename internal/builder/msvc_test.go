@@ -0,0 +1,87 @@
+package builder
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/qobs-build/qobs/internal/builder/gen"
+)
+
+func TestVcvarsArch(t *testing.T) {
+	host, ok := vcvarsArchs[runtime.GOARCH]
+	if !ok {
+		t.Skipf("no vcvarsall.bat architecture for %s", runtime.GOARCH)
+	}
+	if got, err := vcvarsArch(runtime.GOARCH); err != nil || got != host {
+		t.Errorf("vcvarsArch(%s) = %q, %v, want %q", runtime.GOARCH, got, err, host)
+	}
+	for goarch, target := range vcvarsArchs {
+		if target == host {
+			continue
+		}
+		if got, err := vcvarsArch(goarch); err != nil || got != host+"_"+target {
+			t.Errorf("vcvarsArch(%s) = %q, %v, want %q", goarch, got, err, host+"_"+target)
+		}
+	}
+	if _, err := vcvarsArch("riscv64"); err == nil {
+		t.Error("vcvarsArch(riscv64) succeeded")
+	}
+}
+
+func TestLookPathIn(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"bin/cl.exe": ""})
+	if err := os.MkdirAll(filepath.Join(dir, "other", "cl.exe"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	pathEnv := filepath.Join(dir, "other") + string(filepath.ListSeparator) + filepath.Join(dir, "bin")
+	if got, err := lookPathIn("cl.exe", pathEnv); err != nil || got != filepath.Join(dir, "bin", "cl.exe") {
+		t.Errorf("lookPathIn = %q, %v, want the file, not the directory", got, err)
+	}
+	if _, err := lookPathIn("link.exe", pathEnv); err == nil {
+		t.Error("lookPathIn found a missing file")
+	}
+}
+
+func TestMSVCEnvironment(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("vcvarsall.bat only runs on Windows")
+	}
+	if _, err := gen.FindVcvarsall(); err != nil {
+		t.Skipf("no Visual Studio C++ build tools: %v", err)
+	}
+	t.Setenv("INCLUDE", "")
+	env, err := msvcEnvironment(runtime.GOARCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env["INCLUDE"] == "" || env["LIB"] == "" {
+		t.Errorf("INCLUDE = %q and LIB = %q, want both set up", env["INCLUDE"], env["LIB"])
+	}
+	if _, err := lookPathIn("cl.exe", env["PATH"]); err != nil {
+		t.Errorf("cl.exe isn't in the PATH of the environment: %v", err)
+	}
+}
+
+func TestCompilerEnvWithoutMSVC(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml": "[package]\nname = \"app\"\n\n[env]\nFOO = \"bar\"\n",
+	})
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a developer prompt already has INCLUDE set up, and other compilers don't need it
+	t.Setenv("INCLUDE", `C:\already\set`)
+	env, cc, cxx := b.compilerEnv(GeneratorQobs, []string{"gcc"}, []string{"g++"})
+	if want := map[string]string{"FOO": "bar"}; !maps.Equal(env, want) {
+		t.Errorf("environment = %q, want only the [env] of the package %q", env, want)
+	}
+	if len(cc) != 1 || cc[0] != "gcc" || len(cxx) != 1 || cxx[0] != "g++" {
+		t.Errorf("compilers = %q, %q, want them unchanged", cc, cxx)
+	}
+}
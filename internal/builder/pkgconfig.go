@@ -0,0 +1,64 @@
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// pkgConfigFlags holds the flags pkg-config reported for a module
+type pkgConfigFlags struct {
+	cflags []string
+	libs   []string
+}
+
+// findPkgConfig returns the pkg-config executable, honoring the PKG_CONFIG environment variable
+func findPkgConfig() (string, error) {
+	name := "pkg-config"
+	if env := os.Getenv("PKG_CONFIG"); env != "" {
+		name = env
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%s was not found in PATH", name)
+	}
+	return path, nil
+}
+
+// queryPkgConfig runs pkg-config to get the compile and link flags of a module
+func queryPkgConfig(module string, static bool) (*pkgConfigFlags, error) {
+	pkgConfig, err := findPkgConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	run := func(args ...string) ([]string, error) {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(pkgConfig, append(args, module)...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if errMsg := strings.TrimSpace(stderr.String()); errMsg != "" {
+				return nil, errors.New(errMsg)
+			}
+			return nil, fmt.Errorf("pkg-config failed for module %q: %w", module, err)
+		}
+		return strings.Fields(stdout.String()), nil
+	}
+
+	var flags pkgConfigFlags
+	if flags.cflags, err = run("--cflags"); err != nil {
+		return nil, err
+	}
+	libsArgs := []string{"--libs"}
+	if static {
+		libsArgs = append(libsArgs, "--static")
+	}
+	if flags.libs, err = run(libsArgs...); err != nil {
+		return nil, err
+	}
+	return &flags, nil
+}
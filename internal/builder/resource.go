@@ -0,0 +1,182 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/qobs-build/qobs/internal/builder/gen"
+	"github.com/qobs-build/qobs/internal/msg"
+)
+
+// windowsVersion returns the numeric MAJOR,MINOR,PATCH,0 form of a version validated with
+// ValidatePackageVersion, as used by FILEVERSION and PRODUCTVERSION of version resources
+func windowsVersion(version string) (string, error) {
+	if end := strings.IndexAny(version, "-+"); end >= 0 {
+		version = version[:end]
+	}
+	parts := strings.Split(version, ".")
+	for len(parts) < 4 {
+		parts = append(parts, "0")
+	}
+	for _, part := range parts {
+		if _, err := strconv.ParseUint(part, 10, 16); err != nil {
+			return "", fmt.Errorf("version %q doesn't fit a Windows version resource, whose components go up to 65535", version)
+		}
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// rcString quotes s as a resource script string literal
+func rcString(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// versionResource returns a resource script (.rc) with the version information of pkg, whose
+// artifact is named outputName: the file and product version shown in the properties of the
+// executable or DLL on Windows
+func versionResource(pkg *Package, outputName string) (string, error) {
+	version := pkg.Config.Package.Version
+	numeric, err := windowsVersion(version)
+	if err != nil {
+		return "", err
+	}
+	fileType := "0x1L" // VFT_APP
+	if pkg.Config.Target.Kind == KindSharedLib {
+		fileType = "0x2L" // VFT_DLL
+	}
+	description := pkg.Config.Package.Description
+	if description == "" {
+		description = pkg.Name
+	}
+
+	var sb strings.Builder
+	writeln := func(s ...string) { sb.WriteString(strings.Join(s, "") + "\n") }
+	writeln("// generated by qobs from [package] of ", pkg.Name, ", don't edit")
+	writeln("1 VERSIONINFO")
+	writeln("FILEVERSION ", numeric)
+	writeln("PRODUCTVERSION ", numeric)
+	writeln("FILEFLAGSMASK 0x3fL")
+	writeln("FILEFLAGS 0x0L")
+	writeln("FILEOS 0x40004L") // VOS_NT_WINDOWS32
+	writeln("FILETYPE ", fileType)
+	writeln("FILESUBTYPE 0x0L")
+	writeln("BEGIN")
+	writeln("  BLOCK \"StringFileInfo\"")
+	writeln("  BEGIN")
+	writeln("    BLOCK \"040904b0\"") // U.S. English, Unicode
+	writeln("    BEGIN")
+	writeln("      VALUE \"FileDescription\", ", rcString(description))
+	writeln("      VALUE \"FileVersion\", ", rcString(version))
+	writeln("      VALUE \"InternalName\", ", rcString(pkg.Name))
+	writeln("      VALUE \"OriginalFilename\", ", rcString(outputName))
+	writeln("      VALUE \"ProductName\", ", rcString(pkg.Name))
+	writeln("      VALUE \"ProductVersion\", ", rcString(version))
+	writeln("    END")
+	writeln("  END")
+	writeln("  BLOCK \"VarFileInfo\"")
+	writeln("  BEGIN")
+	writeln("    VALUE \"Translation\", 0x409, 1200")
+	writeln("  END")
+	writeln("END")
+	return sb.String(), nil
+}
+
+// resourceCompiler returns the resource compiler that goes with the compiler cc, a program
+// followed by its arguments, and whether it takes rc.exe style arguments: the one set in RC, rc
+// or llvm-rc for MSVC and windres (with the target prefix of a cross compiler) or llvm-windres
+// otherwise. path is the PATH the compiler runs with
+func resourceCompiler(cc []string, path string) ([]string, bool, error) {
+	msvc := DetectCompilerKind(cc) == CompilerMSVC
+	if rc := strings.Fields(os.Getenv("RC")); len(rc) > 0 {
+		return rc, msvc, nil
+	}
+	candidates := []string{"windres", "llvm-windres"}
+	if msvc {
+		candidates = []string{"rc.exe", "rc", "llvm-rc"}
+	} else if len(cc) > 0 && !isZig(cc) {
+		if m := crossCompilerRe.FindStringSubmatch(filepath.Base(cc[0])); m != nil {
+			windres := m[1] + "windres"
+			if dir := filepath.Dir(cc[0]); dir != "." {
+				windres = filepath.Join(dir, windres)
+			}
+			candidates = slices.Insert(candidates, 0, windres)
+		}
+	}
+	for _, candidate := range candidates {
+		if found, err := lookPathIn(candidate, path); err == nil {
+			return []string{found}, msvc, nil
+		}
+		if found, err := exec.LookPath(candidate); err == nil {
+			return []string{found}, msvc, nil
+		}
+	}
+	return nil, msvc, fmt.Errorf("none of %s found, set RC", strings.Join(candidates, ", "))
+}
+
+// addVersionResource gives the executable or shared library of pkg, built for Windows, a version
+// resource if the package has a version. Generators that compile resource scripts get the script,
+// otherwise it's compiled here with the resource compiler matching cc and the returned linker
+// inputs are added to the link of the target. Nothing is written on a dry run
+func (b *Builder) addVersionResource(g gen.Generator, pkg *Package, buildDir string, cc []string, env map[string]string) ([]string, error) {
+	if b.env.TargetOS != "windows" || b.emit != gen.EmitObjects || pkg.Config.Package.Version == "" || pkg.Config.Target.Lib && pkg.Config.Target.Kind != KindSharedLib {
+		return nil, nil
+	}
+	if b.dryRun {
+		return nil, nil
+	}
+	outputName := pkg.outputName(b.env.TargetOS)
+	script, err := versionResource(pkg, outputName)
+	if err != nil {
+		return nil, fmt.Errorf("package %q: %w", pkg.Name, err)
+	}
+	dir := filepath.Join(buildDir, "QobsFiles", outputName+".dir")
+	rc := filepath.Join(dir, "version.rc")
+	// only written when it changes, so that the resource isn't compiled again for nothing
+	if old, err := os.ReadFile(rc); err != nil || !bytes.Equal(old, []byte(script)) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(rc, []byte(script), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	if rg, ok := g.(gen.ResourceScripts); ok {
+		rg.AddResource(outputName, rc)
+		return nil, nil
+	}
+	compiler, msvc, err := resourceCompiler(cc, env["PATH"])
+	if err != nil {
+		msg.Warn("package %q is built without a version resource, no resource compiler was found: %v", pkg.Name, err)
+		return nil, nil
+	}
+	out := filepath.Join(dir, "version.o") // a COFF object, windres converts the compiled resource
+	args := slices.Concat(compiler, []string{"-O", "coff", "-i", rc, "-o", out})
+	if msvc {
+		out = filepath.Join(dir, "version.res")
+		args = slices.Concat(compiler, []string{"/nologo", "/fo", out, rc})
+	}
+	if stat, err := os.Stat(out); err == nil {
+		if rcStat, err := os.Stat(rc); err == nil && !rcStat.ModTime().After(stat.ModTime()) {
+			return []string{out}, nil
+		}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if len(env) > 0 {
+		cmd.Env = os.Environ()
+		for _, key := range slices.Sorted(maps.Keys(env)) {
+			cmd.Env = append(cmd.Env, key+"="+env[key])
+		}
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to compile the version resource of %q: %w\n%s", pkg.Name, err, output)
+	}
+	return []string{out}, nil
+}
@@ -0,0 +1,181 @@
+package builder
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/qobs-build/qobs/internal/builder/gen"
+)
+
+func TestOutputName(t *testing.T) {
+	tests := []struct {
+		kind     string
+		version  string
+		targetOS string
+		want     string
+	}{
+		{KindExe, "", "linux", "foo"},
+		{KindExe, "", "windows", "foo.exe"},
+		{KindStaticLib, "1.2.3", "linux", "libfoo.a"},
+		{KindStaticLib, "1.2.3", "windows", "foo.lib"},
+		{KindSharedLib, "", "linux", "libfoo.so"},
+		{KindSharedLib, "1.2.3", "linux", "libfoo.so.1"},
+		{KindSharedLib, "1.2.3", "darwin", "libfoo.dylib"},
+		{KindSharedLib, "1.2.3", "windows", "foo.dll"},
+	}
+	for _, tt := range tests {
+		pkg := &Package{Name: "foo", Config: &Config{
+			Package: PackageSection{Name: "foo", Version: tt.version},
+			Target:  TargetSection{Kind: tt.kind, Lib: tt.kind != KindExe},
+		}}
+		if got := pkg.outputName(tt.targetOS); got != tt.want {
+			t.Errorf("outputName(%s) of a %s with version %q = %q, want %q", tt.targetOS, tt.kind, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestCrossBuildOutputNames(t *testing.T) {
+	t.Setenv(TargetOSEnv, "windows")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml":     "[package]\nname = \"app\"\n\n[target]\nsources = [\"main.c\"]\n\n[dependencies]\nfoo = \"./foo\"\n",
+		"main.c":        "int foo(void);\nint main(void) { return foo(); }\n",
+		"foo/Qobs.toml": "[package]\nname = \"foo\"\nversion = \"1.2.3\"\n\n[target]\nkind = \"sharedlib\"\nsources = [\"foo.c\"]\n",
+		"foo/foo.c":     "int foo(void) { return 0; }\n",
+	})
+	targets := planBuild(t, dir)
+	for _, name := range []string{"app.exe", "foo.dll"} {
+		if _, ok := targets[name]; !ok {
+			t.Errorf("no %s target in %v", name, targets)
+		}
+	}
+}
+
+func TestWindowsVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+		wantErr bool
+	}{
+		{"1", "1,0,0,0", false},
+		{"1.2", "1,2,0,0", false},
+		{"1.2.3", "1,2,3,0", false},
+		{"1.2.3-rc.1+build.5", "1,2,3,0", false},
+		{"1.65535.0", "1,65535,0,0", false},
+		{"1.65536.0", "", true},
+		{"2024.1.20240101", "", true},
+	}
+	for _, tt := range tests {
+		got, err := windowsVersion(tt.version)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("windowsVersion(%q) = %q, %v, want %q (error: %v)", tt.version, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// versionedPackage writes a versioned executable package to a new directory and returns a builder
+// for it that targets Windows
+func versionedPackage(t *testing.T) *Builder {
+	t.Helper()
+	t.Setenv(TargetOSEnv, "windows")
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"Qobs.toml": "[package]\nname = \"app\"\ndescription = \"says \\\"hi\\\"\"\nversion = \"1.2.3-rc.1\"\n\n[target]\nsources = [\"main.c\"]\n",
+		"main.c":    "int main(void) { return 0; }\n",
+	})
+	b, err := NewBuilderInDirectory(dir, "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestVersionResource(t *testing.T) {
+	b := versionedPackage(t)
+	script, err := versionResource(b.rootPackages()[0], "app.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"FILEVERSION 1,2,3,0\n",
+		"PRODUCTVERSION 1,2,3,0\n",
+		"FILETYPE 0x1L\n",
+		`VALUE "FileDescription", "says ""hi"""`,
+		`VALUE "ProductVersion", "1.2.3-rc.1"`,
+		`VALUE "OriginalFilename", "app.exe"`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("version resource doesn't contain %q:\n%s", want, script)
+		}
+	}
+}
+
+// utf16le encodes s like the strings of compiled resources
+func utf16le(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(c), byte(c>>8))
+	}
+	return b
+}
+
+func TestCompileVersionResource(t *testing.T) {
+	var windres string
+	for _, name := range []string{"windres", "llvm-windres", "llvm-windres-14"} {
+		if path, err := exec.LookPath(name); err == nil {
+			windres = path
+			break
+		}
+	}
+	if windres == "" {
+		t.Skip("no windres found")
+	}
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+	t.Setenv("RC", windres)
+	b := versionedPackage(t)
+	buildDir := b.profileBuildDir("debug")
+
+	inputs, err := b.addVersionResource(gen.NewQobsBuilder(), b.rootPackages()[0], buildDir, []string{"gcc"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) != 1 {
+		t.Fatalf("linker inputs = %q, want the compiled resource", inputs)
+	}
+	data, err := os.ReadFile(inputs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, utf16le("1.2.3-rc.1")) {
+		t.Errorf("compiled resource %s doesn't contain the version", inputs[0])
+	}
+
+	// compiled again only when the script changes
+	stat, _ := os.Stat(inputs[0])
+	if _, err := b.addVersionResource(gen.NewQobsBuilder(), b.rootPackages()[0], buildDir, []string{"gcc"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if stat2, _ := os.Stat(inputs[0]); !stat2.ModTime().Equal(stat.ModTime()) {
+		t.Error("unchanged version resource was compiled again")
+	}
+}
+
+func TestVS2022VersionResource(t *testing.T) {
+	b := versionedPackage(t)
+	// msbuild isn't there to build it, the project is generated anyway
+	b.Build("debug", GeneratorVS2022)
+	project, err := os.ReadFile(filepath.Join(b.profileBuildDir("debug"), "app", "app.vcxproj"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(project), `<ResourceCompile Include="..`+string(filepath.Separator)+filepath.Join("QobsFiles", "app.exe.dir", "version.rc")+`">`) {
+		t.Errorf("project doesn't compile the version resource:\n%s", project)
+	}
+}
@@ -0,0 +1,102 @@
+package builder
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// testPackages creates a package for every [[tests]] or [[benches]] entry whose name contains
+// filter, named with prefix
+func (b *Builder) testPackages(tests []TestSection, prefix, filter string) []*Package {
+	var packages []*Package
+	for _, test := range tests {
+		if !strings.Contains(test.Name, filter) {
+			continue
+		}
+
+		deps := maps.Clone(test.Dependencies)
+		if deps == nil {
+			deps = make(map[string]Dependency)
+		}
+		// tests of a library link with the library itself
+		if b.cfg.Target.Lib {
+			deps[b.cfg.Package.Name] = Dependency{}
+		}
+
+		name := prefix + test.Name
+		packages = append(packages, &Package{
+			Name: name,
+			Path: b.basedir,
+			Config: &Config{
+				Package: PackageSection{Name: name},
+				Target: TargetSection{
+					Sources: test.Sources,
+					Defines: test.Defines,
+					Links:   test.Links,
+					Cflags:  test.Cflags,
+				},
+				Dependencies: deps,
+			},
+			IsTest: true,
+		})
+	}
+	return packages
+}
+
+// RunTests builds every test whose name contains filter and runs them one after another,
+// a test passes if it exits with a zero exit code. It returns the names of the failed tests
+func (b *Builder) RunTests(profile, filter string) (failed []string, err error) {
+	tests := b.testPackages(b.cfg.Tests, "test-", filter)
+	if len(tests) == 0 {
+		return nil, fmt.Errorf("no tests matching %q in package %q", filter, b.cfg.Package.Name)
+	}
+
+	if err := b.build(profile, GeneratorQobs, tests); err != nil {
+		return nil, err
+	}
+	return b.runTestPackages(profile, "test", tests, nil), nil
+}
+
+// RunBenches builds every benchmark whose name contains filter and runs them one after another
+// with args, showing their output. It returns the names of the benchmarks that failed
+func (b *Builder) RunBenches(profile, filter string, args []string) (failed []string, err error) {
+	benches := b.testPackages(b.cfg.Benches, "bench-", filter)
+	if len(benches) == 0 {
+		return nil, fmt.Errorf("no benchmarks matching %q in package %q", filter, b.cfg.Package.Name)
+	}
+
+	if err := b.build(profile, GeneratorQobs, benches); err != nil {
+		return nil, err
+	}
+	return b.runTestPackages(profile, "bench", benches, args), nil
+}
+
+// runTestPackages runs the built test or benchmark (kind) packages sequentially with args,
+// returning the names of the ones that exited with a non-zero exit code
+func (b *Builder) runTestPackages(profile, kind string, packages []*Package, args []string) (failed []string) {
+	slices.SortFunc(packages, func(a, b *Package) int { return strings.Compare(a.Name, b.Name) })
+	for _, pkg := range packages {
+		name := strings.TrimPrefix(pkg.Name, kind+"-")
+		fmt.Printf("  %s %s %s\n", color.HiGreenString("Running"), kind, name)
+
+		cmd := exec.Command(filepath.Join(b.profileBuildDir(profile), pkg.outputName(b.env.TargetOS)), args...)
+		cmd.Dir = b.basedir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Stdin = os.Stdin
+		if err := cmd.Run(); err != nil {
+			fmt.Printf("  %s %s: %v\n", color.HiRedString("FAILED"), name, err)
+			failed = append(failed, name)
+		} else {
+			fmt.Printf("  %s %s\n", color.HiGreenString("ok"), name)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,225 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/qobs-build/qobs/internal/msg"
+)
+
+const (
+	// watchInterval is how often watched files are checked for changes when they're polled
+	watchInterval = 300 * time.Millisecond
+	// watchDebounce is how long files have to stay unchanged before a rebuild starts, so that
+	// saving several files at once (or a formatter rewriting them) triggers a single rebuild
+	watchDebounce = 200 * time.Millisecond
+)
+
+// SetWatch makes builds record the files they depend on, see WatchedFiles
+func (b *Builder) SetWatch(watch bool) {
+	b.watch = watch
+}
+
+// WatchedFiles returns the files whose changes call for a rebuild: the manifests, sources and
+// headers of the packages that aren't fetched, along with their directories so that new files
+// are noticed too. Without a successful dependency resolution, it's just the root manifests
+func (b *Builder) WatchedFiles() []string {
+	if len(b.watched) > 0 {
+		return b.watched
+	}
+	files := []string{ManifestPath(b.basedir), b.basedir}
+	for _, member := range b.members {
+		files = append(files, ManifestPath(member.Path), member.Path)
+	}
+	return files
+}
+
+// watchedFiles collects the files to watch in the resolved packages
+func (b *Builder) watchedFiles(packages map[string]*Package) []string {
+	seen := make(map[string]bool)
+	add := func(path string) {
+		seen[path] = true
+		seen[filepath.Dir(path)] = true
+	}
+	for _, pkg := range packages {
+		// fetched dependencies and system libraries don't change while working on a package
+		if pkg.pkgConfig != nil || pkg.Path == "" || strings.HasPrefix(pkg.Path, b.depsDir()+string(filepath.Separator)) {
+			continue
+		}
+		add(ManifestPath(pkg.Path))
+		// the build command rewriting them would start the next build
+		outputs := make(map[string]bool)
+		if patterns := pkg.Config.Package.BuildCommandOutputs; len(patterns) > 0 {
+			files, _ := b.collectFiles(pkg, patterns, false)
+			for _, file := range files {
+				outputs[file] = true
+			}
+		}
+		inputs, _ := b.buildCommandInputs(pkg)
+		for _, patterns := range [][]string{pkg.Config.Target.Sources, pkg.Config.Target.Headers, inputs} {
+			files, err := b.collectFiles(pkg, patterns, false)
+			if err != nil {
+				continue // the build reports it
+			}
+			for _, file := range files {
+				if !outputs[file] {
+					add(file)
+				}
+			}
+		}
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// fileStamp is what changes when a file is modified
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func snapshot(files []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(files))
+	for _, file := range files {
+		if stat, err := os.Stat(file); err == nil {
+			stamps[file] = fileStamp{stat.ModTime(), stat.Size()}
+		} else {
+			stamps[file] = fileStamp{} // so that it's noticed when it's created
+		}
+	}
+	return stamps
+}
+
+// WatchPollEnv is the environment variable that makes watching poll files for changes instead of
+// waiting for the OS to report them, for file systems that don't, e.g. network shares
+const WatchPollEnv = "QOBS_WATCH_POLL"
+
+// WatchLoop calls build, then waits for one of the files it returns to change and calls it again,
+// until ctx is done. build returns the files to watch even if it fails, see WatchedFiles
+func WatchLoop(ctx context.Context, build func() []string) {
+	for {
+		files := build()
+		if !waitForChanges(ctx, files) {
+			return
+		}
+	}
+}
+
+// waitForChanges waits for one of files to change and then for nothing to change for a while, so
+// that saving several files at once triggers a single rebuild. It returns false if ctx is done
+// before. Files are polled if WatchPollEnv is set or the OS can't watch them
+func waitForChanges(ctx context.Context, files []string) bool {
+	if v := os.Getenv(WatchPollEnv); v == "" || v == "0" {
+		watcher, err := watchDirs(files)
+		if err == nil {
+			defer watcher.Close()
+			return waitForEvents(ctx, watcher, files)
+		}
+		msg.Warn("polling for changes: %v", err)
+	}
+	return pollForChanges(ctx, files)
+}
+
+// watchDirs returns a watcher of the directories of files, or of files themselves if they're
+// directories. Watching directories notices files that editors save by replacing them
+func watchDirs(files []string) (*fsnotify.Watcher, error) {
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		if stat, err := os.Stat(file); err == nil && stat.IsDir() {
+			dirs[file] = true
+		} else {
+			dirs[filepath.Dir(file)] = true
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range slices.Sorted(maps.Keys(dirs)) {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+	return watcher, nil
+}
+
+// waitForEvents is waitForChanges with the events of watcher
+func waitForEvents(ctx context.Context, watcher *fsnotify.Watcher, files []string) bool {
+	watched := make(map[string]bool, len(files))
+	for _, file := range files {
+		watched[filepath.Clean(file)] = true
+	}
+	var settled <-chan time.Time // nil until something changes
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return pollForChanges(ctx, files)
+			}
+			if changesWatched(event, watched) {
+				settled = time.After(watchDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return pollForChanges(ctx, files)
+			}
+			// e.g. too many events at once, something may have changed
+			msg.Warn("watching for changes: %v", err)
+			settled = time.After(watchDebounce)
+		case <-settled:
+			return true
+		}
+	}
+}
+
+// changesWatched reports whether event changes one of the watched files, or the entries of one of
+// the watched directories
+func changesWatched(event fsnotify.Event, watched map[string]bool) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	if watched[event.Name] {
+		return true
+	}
+	return watched[filepath.Dir(event.Name)] && event.Has(fsnotify.Create|fsnotify.Remove|fsnotify.Rename)
+}
+
+// pollForChanges is waitForChanges with the files polled every watchInterval
+func pollForChanges(ctx context.Context, files []string) bool {
+	// poll until something changes
+	for before := snapshot(files); maps.Equal(before, snapshot(files)); {
+		if !sleep(ctx, watchInterval) {
+			return false
+		}
+	}
+	// then until nothing changed for a while
+	for {
+		current := snapshot(files)
+		if !sleep(ctx, watchDebounce) {
+			return false
+		}
+		if maps.Equal(current, snapshot(files)) {
+			return true
+		}
+	}
+}
+
+// sleep waits for d, returning false if ctx is done before
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,81 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchLoop(t *testing.T) {
+	for _, poll := range []string{"", "1"} {
+		name := "events"
+		if poll != "" {
+			name = "poll"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(WatchPollEnv, poll)
+			src := filepath.Join(t.TempDir(), "main.c")
+			if err := os.WriteFile(src, []byte("int main(void) { return 0; }\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			builds := 0
+			WatchLoop(ctx, func() []string {
+				builds++
+				switch builds {
+				case 1:
+					// changed after the loop started waiting
+					time.AfterFunc(2*watchInterval, func() {
+						os.WriteFile(src, []byte("int main(void) { return 10; }\n"), 0644)
+					})
+				case 2:
+					cancel()
+				}
+				return []string{src}
+			})
+			if builds != 2 {
+				t.Errorf("built %d times, want a rebuild after the change", builds)
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				t.Error("the change wasn't noticed")
+			}
+		})
+	}
+}
+
+func TestWatchLoopNewFile(t *testing.T) {
+	t.Setenv(WatchPollEnv, "")
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.c")
+	if err := os.WriteFile(src, []byte("int main(void) { return 0; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	builds := 0
+	WatchLoop(ctx, func() []string {
+		builds++
+		switch builds {
+		case 1:
+			time.AfterFunc(2*watchDebounce, func() {
+				// written in a directory that isn't watched, then a new source of a watched one
+				os.WriteFile(filepath.Join(t.TempDir(), "other.c"), nil, 0644)
+				os.WriteFile(filepath.Join(dir, "util.c"), nil, 0644)
+			})
+		case 2:
+			cancel()
+		}
+		return []string{dir, src}
+	})
+	if builds != 2 {
+		t.Errorf("built %d times, want a rebuild after the new file", builds)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		t.Error("the new file wasn't noticed")
+	}
+}
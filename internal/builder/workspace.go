@@ -0,0 +1,86 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// loadWorkspace parses the manifests of the members of the workspace rooted at b.basedir
+func (b *Builder) loadWorkspace() error {
+	dirs, err := b.cfg.Workspace.MemberDirs(b.basedir)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]string) // package name -> directory
+	if b.cfg.Package.Name != "" {
+		names[b.cfg.Package.Name] = b.basedir
+	}
+	for _, dir := range dirs {
+		if dir == b.basedir {
+			continue // the workspace root is a package itself
+		}
+
+		env := b.packageEnv(dir, b.env.Features)
+		cfg, err := ParseConfigFromFile(ManifestPath(dir), env, b.defaultFeatures)
+		if err != nil {
+			return fmt.Errorf("failed to parse workspace member %s: %w", dir, err)
+		}
+		if other, exists := names[cfg.Package.Name]; exists {
+			return fmt.Errorf("workspace members %s and %s are both called %q", other, dir, cfg.Package.Name)
+		}
+		names[cfg.Package.Name] = dir
+
+		b.members = append(b.members, &Package{
+			Name:   cfg.Package.Name,
+			Path:   dir,
+			Config: cfg,
+			IsRoot: true,
+		})
+	}
+	return nil
+}
+
+// rootPackages returns the packages that are built at the top level: the package in b.basedir,
+// unless it's a workspace root without a [package] section, and the workspace members
+func (b *Builder) rootPackages() []*Package {
+	var roots []*Package
+	if len(b.members) == 0 || b.cfg.Package.Name != "" {
+		roots = append(roots, &Package{
+			Name:   b.cfg.Package.Name,
+			Path:   b.basedir,
+			Config: b.cfg,
+			IsRoot: true,
+		})
+	}
+	return append(roots, b.members...)
+}
+
+// IsWorkspace reports whether the builder builds the members of a workspace
+func (b *Builder) IsWorkspace() bool {
+	return len(b.members) > 0
+}
+
+// findWorkspaceRoot returns the directory of the workspace that the package in path is
+// a member of, or an empty string if it's not part of a workspace
+func findWorkspaceRoot(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if stat, err := os.Stat(ManifestPath(dir)); err == nil && !stat.IsDir() {
+			cfg, err := ParseConfigFromFile(ManifestPath(dir), NewConfigEnv(dir), true)
+			if err == nil && len(cfg.Workspace.Members) > 0 {
+				if members, err := cfg.Workspace.MemberDirs(dir); err == nil && slices.Contains(members, path) {
+					return dir
+				}
+			}
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return ""
+		}
+	}
+}
@@ -2,69 +2,163 @@ package index
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/fatih/color"
 	"github.com/go-git/go-git/v6"
 	"github.com/go-git/go-git/v6/plumbing"
+	"github.com/qobs-build/qobs/internal/atomicfile"
 	"github.com/qobs-build/qobs/internal/msg"
+	"github.com/qobs-build/qobs/internal/retry"
 )
 
 const (
+	// IndexFilename is the flat index, a map from dependency URL to path that every version of
+	// qobs reads. It's written along with EntriesFilename
 	IndexFilename = "qobs_index.json"
-	indexRepoURL  = "https://github.com/qobs-build/index.git"
-	indexBranch   = "main"
+	// EntriesFilename is the structured index, see indexFile. It's a file of its own so that
+	// versions of qobs that only know IndexFilename keep working with new indexes
+	EntriesFilename = "qobs_index_entries.json"
+	indexVersion    = 1 // version of the format of EntriesFilename
+	indexRepoURL    = "https://github.com/qobs-build/index.git"
+	indexBranch     = "main"
 )
 
+// Frozen forbids cloning and updating the index, only an index that's already there is used
+var Frozen bool
+
 type Index struct {
 	// on windows: %LocalAppData%/qobs/index
 	// on linux: ~/.cache/qobs/index
 	basePath string
-	// dependency URL -> path in index
-	Deps map[string]string
+	// dependency URL -> entry
+	Deps map[string]*Entry
+}
+
+// Entry describes a package in the index
+type Entry struct {
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	URL         string   `json:"url"`                // repository URL, what dependencies refer to the package by
+	Path        string   `json:"path"`               // directory in the index with the manifest of the package
+	Versions    []string `json:"versions,omitempty"` // available versions (tags)
+	License     string   `json:"license,omitempty"`  // SPDX expression, e.g. "MIT"
+}
+
+// indexFile is the format of EntriesFilename. The flat IndexFilename is a map from dependency URL
+// to path, ParseIndex reads both
+type indexFile struct {
+	Version  int      `json:"version"`
+	Packages []*Entry `json:"packages"`
 }
 
 func ParseIndex(rdr io.Reader, basePath string) (*Index, error) {
-	var deps map[string]string
-	if err := json.NewDecoder(bufio.NewReader(rdr)).Decode(&deps); err != nil {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(bufio.NewReader(rdr)).Decode(&raw); err != nil {
 		return nil, err
 	}
+
+	deps := make(map[string]*Entry)
+	if packages, ok := raw["packages"]; ok {
+		var version int
+		if v, ok := raw["version"]; ok {
+			if err := json.Unmarshal(v, &version); err != nil {
+				return nil, fmt.Errorf("invalid index version: %w", err)
+			}
+		}
+		if version > indexVersion {
+			return nil, fmt.Errorf("the index has format version %d, newer than this version of qobs supports (%d), update qobs", version, indexVersion)
+		}
+		var entries []*Entry
+		if err := json.Unmarshal(packages, &entries); err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.URL == "" {
+				return nil, fmt.Errorf("index entry %q has no url", entry.Name)
+			}
+			deps[entry.URL] = entry
+		}
+	} else {
+		for url, value := range raw {
+			var path string
+			if err := json.Unmarshal(value, &path); err != nil {
+				return nil, fmt.Errorf("index entry %q: %w", url, err)
+			}
+			deps[url] = &Entry{Name: NameFromURL(url), URL: url, Path: path}
+		}
+	}
 	return &Index{Deps: deps, basePath: basePath}, nil
 }
 
+// NameFromURL guesses the name of a package from its repository URL: its last path element
+// without a .git suffix
+func NameFromURL(url string) string {
+	url = strings.TrimSuffix(strings.TrimRight(url, "/"), ".git")
+	return url[strings.LastIndexAny(url, "/:")+1:]
+}
+
+// Save writes the index to basePath, as EntriesFilename and as the flat IndexFilename that older
+// versions of qobs read
 func (index Index) Save(basePath string) error {
-	path := filepath.Join(basePath, IndexFilename)
-	f, err := os.Create(path)
-	if err != nil {
+	entries := slices.SortedFunc(maps.Values(index.Deps), func(a, b *Entry) int {
+		return strings.Compare(a.URL, b.URL)
+	})
+	if err := writeJSON(filepath.Join(basePath, EntriesFilename), indexFile{Version: indexVersion, Packages: entries}); err != nil {
 		return err
 	}
-	defer f.Close()
-
-	bufw := bufio.NewWriter(f)
-	defer bufw.Flush()
+	flat := make(map[string]string, len(index.Deps))
+	for url, entry := range index.Deps {
+		flat[url] = entry.Path
+	}
+	return writeJSON(filepath.Join(basePath, IndexFilename), flat)
+}
 
-	enc := json.NewEncoder(bufw)
-	enc.SetIndent("", "  ")
-	return enc.Encode(index.Deps)
+// writeJSON writes v as indented JSON to path, atomically so that an interrupted save doesn't leave
+// a truncated index behind
+func writeJSON(path string, v any) error {
+	return atomicfile.Write(path, 0644, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	})
 }
 
-func FetchIndex(basePath string) (*Index, error) {
+func FetchIndex(ctx context.Context, basePath string) (*Index, error) {
+	if Frozen {
+		return nil, errors.New("fetching the qobs index is forbidden with --frozen")
+	}
 	if err := os.MkdirAll(basePath, 0755); err != nil {
 		return nil, err
 	}
 	if _, err := os.Stat(filepath.Join(basePath, ".git")); os.IsNotExist(err) {
-		fmt.Printf("  %s qobs index\n", color.HiGreenString("Fetching"))
-		_, err := git.PlainClone(basePath, &git.CloneOptions{
-			URL:           indexRepoURL,
-			ReferenceName: plumbing.NewBranchReferenceName(indexBranch),
-			SingleBranch:  true,
-			Depth:         1,
-			Progress:      &msg.IndentWriter{Indent: "    ", W: os.Stdout},
+		fmt.Fprintf(msg.Output(), "  %s qobs index\n", color.HiGreenString("Fetching"))
+		retrying := false
+		err := retry.Do(ctx, "fetching the qobs index", func() error {
+			if retrying {
+				// start over without the partial clone
+				if err := os.RemoveAll(filepath.Join(basePath, ".git")); err != nil {
+					return err
+				}
+			}
+			retrying = true
+			_, err := git.PlainCloneContext(ctx, basePath, &git.CloneOptions{
+				URL:           indexRepoURL,
+				ReferenceName: plumbing.NewBranchReferenceName(indexBranch),
+				SingleBranch:  true,
+				Depth:         1,
+				Progress:      &msg.IndentWriter{Indent: "    ", W: msg.Output()},
+			})
+			return err
 		})
 		if err != nil {
 			return nil, err
@@ -78,12 +172,14 @@ func FetchIndex(basePath string) (*Index, error) {
 		if err != nil {
 			return nil, err
 		}
-		err = w.Pull(&git.PullOptions{
-			RemoteName:    "origin",
-			ReferenceName: plumbing.NewBranchReferenceName(indexBranch),
-			SingleBranch:  true,
-			Depth:         1,
-			Progress:      os.Stdout,
+		err = retry.Do(ctx, "updating the qobs index", func() error {
+			return w.PullContext(ctx, &git.PullOptions{
+				RemoteName:    "origin",
+				ReferenceName: plumbing.NewBranchReferenceName(indexBranch),
+				SingleBranch:  true,
+				Depth:         1,
+				Progress:      msg.Output(),
+			})
 		})
 		if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
 			return nil, err
@@ -93,9 +189,13 @@ func FetchIndex(basePath string) (*Index, error) {
 	return ParseIndexInPath(basePath)
 }
 
+// ParseIndexInPath reads the index in basePath: EntriesFilename, or IndexFilename in indexes
+// written before it existed
 func ParseIndexInPath(basePath string) (*Index, error) {
-	path := filepath.Join(basePath, IndexFilename)
-	f, err := os.Open(path)
+	f, err := os.Open(filepath.Join(basePath, EntriesFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(basePath, IndexFilename))
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -103,7 +203,7 @@ func ParseIndexInPath(basePath string) (*Index, error) {
 	return ParseIndex(bufio.NewReader(f), basePath)
 }
 
-func LoadOrFetchIndex(basePath string) (*Index, error) {
+func LoadOrFetchIndex(ctx context.Context, basePath string) (*Index, error) {
 	path := filepath.Join(basePath, IndexFilename)
 
 	if _, err := os.Stat(path); err == nil {
@@ -112,12 +212,12 @@ func LoadOrFetchIndex(basePath string) (*Index, error) {
 		return nil, err
 	}
 
-	return FetchIndex(basePath)
+	return FetchIndex(ctx, basePath)
 }
 
 var globalIndex *Index
 
-func GetIndexAnyhow() (*Index, error) {
+func GetIndexAnyhow(ctx context.Context) (*Index, error) {
 	if globalIndex != nil {
 		return globalIndex, nil
 	}
@@ -125,7 +225,7 @@ func GetIndexAnyhow() (*Index, error) {
 	if err != nil {
 		return nil, err
 	}
-	index, err := LoadOrFetchIndex(filepath.Join(cacheDir, "qobs", "index"))
+	index, err := LoadOrFetchIndex(ctx, filepath.Join(cacheDir, "qobs", "index"))
 	if err != nil {
 		return nil, err
 	}
@@ -135,20 +235,41 @@ func GetIndexAnyhow() (*Index, error) {
 
 // Copy copies all files from the related index entry (if any) to the destination path `destPath`
 func (index Index) Copy(destPath, url string) error {
-	path, ok := index.Deps[url]
+	entry, ok := index.lookup(url)
 	if !ok {
 		return errors.New("dependency not found in index")
 	}
 
-	fromPath := filepath.Join(index.basePath, path)
+	fromPath := filepath.Join(index.basePath, entry.Path)
 	return os.CopyFS(destPath, os.DirFS(fromPath))
 }
 
-func (idx *Index) SetDep(url, path string) {
+// lookup returns the entry of the repository at url, which may or may not end with .git like the
+// URL of the entry, e.g. when the dependency was given as gh:user/repo
+func (index Index) lookup(url string) (*Entry, bool) {
+	if entry, ok := index.Deps[url]; ok {
+		return entry, true
+	}
+	if trimmed, ok := strings.CutSuffix(url, ".git"); ok {
+		entry, ok := index.Deps[trimmed]
+		return entry, ok
+	}
+	entry, ok := index.Deps[url+".git"]
+	return entry, ok
+}
+
+// SetDep sets the path of the dependency at url, keeping the rest of its entry if it exists
+func (idx *Index) SetDep(url, path string) *Entry {
 	if idx.Deps == nil {
-		idx.Deps = make(map[string]string)
+		idx.Deps = make(map[string]*Entry)
+	}
+	entry, ok := idx.Deps[url]
+	if !ok {
+		entry = &Entry{Name: NameFromURL(url), URL: url}
+		idx.Deps[url] = entry
 	}
-	idx.Deps[url] = path
+	entry.Path = path
+	return entry
 }
 
 func (idx *Index) HasDep(url string) bool {
@@ -167,10 +288,10 @@ func (idx *Index) RemoveDep(url string) bool {
 	return false
 }
 
-func UpdateGlobalIndex() (*Index, error) {
+func UpdateGlobalIndex(ctx context.Context) (*Index, error) {
 	cacheDir, err := os.UserCacheDir()
 	if err != nil {
 		return nil, err
 	}
-	return FetchIndex(filepath.Join(cacheDir, "qobs", "index"))
+	return FetchIndex(ctx, filepath.Join(cacheDir, "qobs", "index"))
 }
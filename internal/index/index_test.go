@@ -0,0 +1,129 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveKeepsFlatIndexReadable(t *testing.T) {
+	dir := t.TempDir()
+	idx := &Index{}
+	entry := idx.SetDep("https://github.com/foo/bar.git", "bar")
+	entry.Description = "a bar"
+	entry.Versions = []string{"v1.0.0"}
+	if err := idx.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// what versions of qobs from before EntriesFilename read
+	data, err := os.ReadFile(filepath.Join(dir, IndexFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flat map[string]string
+	if err := json.Unmarshal(data, &flat); err != nil {
+		t.Fatalf("%s isn't a flat map: %v", IndexFilename, err)
+	}
+	if flat["https://github.com/foo/bar.git"] != "bar" {
+		t.Errorf("flat index = %v", flat)
+	}
+
+	parsed, err := ParseIndexInPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := parsed.Deps["https://github.com/foo/bar.git"]
+	if got == nil || got.Description != "a bar" || got.Path != "bar" || len(got.Versions) != 1 {
+		t.Errorf("parsed entry = %+v", got)
+	}
+}
+
+func TestParseFlatIndex(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, IndexFilename), []byte(`{"https://github.com/foo/bar.git": "bar"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := ParseIndexInPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := idx.Deps["https://github.com/foo/bar.git"]
+	if entry == nil || entry.Name != "bar" || entry.Path != "bar" {
+		t.Errorf("entry = %+v", entry)
+	}
+}
+
+func TestParseIndexNewerVersion(t *testing.T) {
+	_, err := ParseIndex(strings.NewReader(`{"version": 99, "packages": []}`), "")
+	if err == nil || !strings.Contains(err.Error(), "update qobs") {
+		t.Errorf("err = %v, want a newer version error", err)
+	}
+}
+
+func TestCopyMatchesURLWithoutGitSuffix(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "bar"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bar", "Qobs.toml"), []byte("[package]\nname = \"bar\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	idx := &Index{basePath: dir}
+	idx.SetDep("https://github.com/foo/bar.git", "bar")
+
+	// what gh:foo/bar is fetched from
+	dest := filepath.Join(t.TempDir(), "bar")
+	if err := idx.Copy(dest, "https://github.com/foo/bar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "Qobs.toml")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFailedSaveKeepsOldIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), IndexFilename)
+	if err := writeJSON(path, map[string]string{"https://github.com/foo/bar.git": "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	old, _ := os.ReadFile(path)
+	// channels can't be encoded, the encoder fails halfway through
+	if err := writeJSON(path, map[string]any{"a": "b", "z": make(chan int)}); err == nil {
+		t.Fatal("writeJSON of a channel succeeded")
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(old) {
+		t.Errorf("index = %q after a failed save, want %q", data, old)
+	}
+}
+
+func TestFrozen(t *testing.T) {
+	defer func() { Frozen = false }()
+	Frozen = true
+
+	missing := filepath.Join(t.TempDir(), "index")
+	if _, err := LoadOrFetchIndex(context.Background(), missing); err == nil || !strings.Contains(err.Error(), "forbidden with --frozen") {
+		t.Errorf("fetching the index failed with %v, want it to be forbidden", err)
+	}
+	if _, err := os.Stat(missing); err == nil {
+		t.Error("index directory was created")
+	}
+
+	// an index that's already there is used
+	dir := t.TempDir()
+	idx := &Index{}
+	idx.SetDep("https://github.com/foo/bar.git", "bar")
+	if err := idx.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrFetchIndex(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.HasDep("https://github.com/foo/bar.git") {
+		t.Errorf("loaded index %+v doesn't have the saved entry", loaded.Deps)
+	}
+}
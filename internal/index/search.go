@@ -0,0 +1,157 @@
+package index
+
+import (
+	"container/heap"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Match is an entry found by Search and how well it matches, higher is better
+type Match struct {
+	Entry *Entry
+	Score int
+}
+
+// Search finds the entries that match every word of query and returns them best first, along with
+// how many entries matched in total. A word matches if its letters appear in the name in order, e.g.
+// "jsnp" matches "json-parser", or if it's part of the description or URL; whole words and names score
+// higher. With a positive limit, only the best limit matches are kept, without sorting all of them
+func (idx *Index) Search(query string, limit int) ([]Match, int) {
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return nil, 0
+	}
+
+	var best matchHeap
+	total := 0
+	for _, entry := range idx.Deps {
+		score, ok := entryScore(entry, words)
+		if !ok {
+			continue
+		}
+		total++
+		m := Match{entry, score}
+		switch {
+		case limit <= 0 || best.Len() < limit:
+			heap.Push(&best, m)
+		case worseMatch(best[0], m):
+			best[0] = m
+			heap.Fix(&best, 0)
+		}
+	}
+
+	slices.SortFunc(best, func(a, b Match) int {
+		if worseMatch(a, b) {
+			return 1
+		}
+		if worseMatch(b, a) {
+			return -1
+		}
+		return 0
+	})
+	return best, total
+}
+
+// entryScore scores entry against every word of a query, which must all match
+func entryScore(entry *Entry, words []string) (int, bool) {
+	name := strings.ToLower(entry.Name)
+	description := strings.ToLower(entry.Description)
+	url := strings.ToLower(entry.URL)
+
+	total := 0
+	for _, word := range words {
+		// the name is what users look for. Letters scattered over a description or URL match
+		// almost anything, so only whole words count there
+		score := fuzzyScore(word, name, true) * 3
+		score = max(score, fuzzyScore(word, description, false))
+		score = max(score, fuzzyScore(word, url, false))
+		if score <= 0 {
+			return 0, false
+		}
+		total += score
+	}
+	return total, true
+}
+
+// fuzzyScore scores how well text contains word, both lowercase, or only its letters in order if
+// subsequence is set. It's 0 if it doesn't. Consecutive letters and letters at the start of words
+// count more, gaps count less
+func fuzzyScore(word, text string, subsequence bool) int {
+	switch {
+	case text == word:
+		return 1000
+	case strings.HasPrefix(text, word):
+		return 500 + 100*len(word)/len(text)
+	}
+	if i := strings.Index(text, word); i >= 0 {
+		score := 200 + 100*len(word)/len(text)
+		if isWordStart(text, i) {
+			score += 100
+		}
+		return score
+	}
+	if !subsequence {
+		return 0
+	}
+
+	// subsequence: match every letter as early as possible
+	score := 0
+	pos, last := 0, -1
+	for _, r := range word {
+		i := strings.IndexRune(text[pos:], r)
+		if i < 0 {
+			return 0
+		}
+		i += pos
+		switch {
+		case i == last+1 && last >= 0:
+			score += 15
+		case isWordStart(text, i):
+			score += 10
+		default:
+			score += 5
+			if last >= 0 {
+				score -= min(i-last-1, 5)
+			}
+		}
+		last = i
+		pos = i + len(string(r))
+	}
+	// below any match of the whole word
+	return min(max(score, 1), 199)
+}
+
+// isWordStart reports whether the letter at i of text starts a word, e.g. the p of "json-parser"
+func isWordStart(text string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	prev := rune(text[i-1])
+	return !unicode.IsLetter(prev) && !unicode.IsDigit(prev)
+}
+
+// worseMatch orders matches by score, and by name and URL between equal scores so that results are stable
+func worseMatch(a, b Match) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+	if a.Entry.Name != b.Entry.Name {
+		return a.Entry.Name > b.Entry.Name
+	}
+	return a.Entry.URL > b.Entry.URL
+}
+
+// matchHeap is a min-heap of matches, the worst match is at the top
+type matchHeap []Match
+
+func (h matchHeap) Len() int           { return len(h) }
+func (h matchHeap) Less(i, j int) bool { return worseMatch(h[i], h[j]) }
+func (h matchHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *matchHeap) Push(x any)        { *h = append(*h, x.(Match)) }
+func (h *matchHeap) Pop() any {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
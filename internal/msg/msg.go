@@ -8,33 +8,54 @@ import (
 	"github.com/fatih/color"
 )
 
+// out is where messages are written, see SetOutput
+var out io.Writer = os.Stdout
+
+// SetOutput makes messages and other status output go to w instead of stdout, e.g. to stderr when
+// stdout is machine readable
+func SetOutput(w io.Writer) {
+	out = w
+}
+
+// Output returns where messages and other status output go, see SetOutput
+func Output() io.Writer {
+	return out
+}
+
 func Error(format string, a ...any) {
-	fmt.Print(color.HiRedString("error"))
-	fmt.Print(": ")
-	fmt.Printf(format, a...)
-	fmt.Print("\n")
+	fmt.Fprint(out, color.HiRedString("error"))
+	fmt.Fprint(out, ": ")
+	fmt.Fprintf(out, format, a...)
+	fmt.Fprint(out, "\n")
 }
 
 func Warn(format string, a ...any) {
-	fmt.Print(color.YellowString("warn"))
-	fmt.Print(": ")
-	fmt.Printf(format, a...)
-	fmt.Print("\n")
+	fmt.Fprint(out, color.YellowString("warn"))
+	fmt.Fprint(out, ": ")
+	fmt.Fprintf(out, format, a...)
+	fmt.Fprint(out, "\n")
 }
 
 func Fatal(format string, a ...any) {
-	fmt.Print(color.RedString("fatal"))
-	fmt.Print(": ")
-	fmt.Printf(format, a...)
-	fmt.Print("\n")
+	fmt.Fprint(out, color.RedString("fatal"))
+	fmt.Fprint(out, ": ")
+	fmt.Fprintf(out, format, a...)
+	fmt.Fprint(out, "\n")
 	os.Exit(1)
 }
 
+func Done(format string, a ...any) {
+	fmt.Fprint(out, color.HiGreenString("done"))
+	fmt.Fprint(out, ": ")
+	fmt.Fprintf(out, format, a...)
+	fmt.Fprint(out, "\n")
+}
+
 func Info(format string, a ...any) {
-	fmt.Print(color.HiGreenString("info"))
-	fmt.Print(": ")
-	fmt.Printf(format, a...)
-	fmt.Print("\n")
+	fmt.Fprint(out, color.HiGreenString("info"))
+	fmt.Fprint(out, ": ")
+	fmt.Fprintf(out, format, a...)
+	fmt.Fprint(out, "\n")
 }
 
 type IndentWriter struct {
@@ -0,0 +1,24 @@
+package msg
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+func TestSetOutput(t *testing.T) {
+	color.NoColor = true
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stdout)
+
+	Warn("a %d", 1)
+	Info("b")
+	Error("c")
+	Done("d")
+	if want := "warn: a 1\ninfo: b\nerror: c\ndone: d\n"; buf.String() != want {
+		t.Errorf("output = %q, want %q", buf.String(), want)
+	}
+}
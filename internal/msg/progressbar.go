@@ -76,3 +76,8 @@ func (pb *ProgressBar) Finish() {
 	pb.print(true)
 	fmt.Fprintln(pb.W)
 }
+
+// Clear erases the progress bar, e.g. before a failed download is retried
+func (pb *ProgressBar) Clear() {
+	fmt.Fprintf(pb.W, "\r%s\r", strings.Repeat(" ", pb.Indent+48))
+}
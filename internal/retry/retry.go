@@ -0,0 +1,78 @@
+// Package retry retries network operations that fail with transient errors
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/qobs-build/qobs/internal/msg"
+)
+
+var (
+	// Attempts is how many times an operation is tried before giving up, at least once
+	Attempts = 3
+	// BaseDelay is the delay before the first retry, it doubles with every further retry
+	BaseDelay = time.Second
+)
+
+// StatusError is returned for an HTTP response that isn't 200 OK
+type StatusError struct {
+	URL  string
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("failed to download from url %s: status code %d", e.URL, e.Code)
+}
+
+func (e *StatusError) StatusCode() int {
+	return e.Code
+}
+
+// Do runs fn until it succeeds or fails with an error that isn't transient, at most Attempts times,
+// waiting with exponential backoff in between. what describes the operation in warnings. Do stops
+// early when ctx is done or its deadline would pass while waiting
+func Do(ctx context.Context, what string, fn func() error) error {
+	delay := BaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= Attempts || !IsTransient(err) {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+
+		msg.Warn("%s failed (attempt %d of %d), retrying in %s: %v", what, attempt, Attempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// IsTransient reports whether err is worth retrying: timeouts, reset or refused connections,
+// connections closed early and HTTP 5xx (or 429) responses. Missing resources and checksum
+// mismatches aren't
+func IsTransient(err error) bool {
+	var status interface{ StatusCode() int }
+	if errors.As(err, &status) {
+		code := status.StatusCode()
+		return code >= 500 || code == http.StatusTooManyRequests
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF)
+}